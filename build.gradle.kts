@@ -13,13 +13,47 @@ dependencies {
     implementation("io.ktor:ktor-server-netty:$ktorVersion")
     implementation("io.ktor:ktor-server-core:$ktorVersion")
     implementation("io.ktor:ktor-server-content-negotiation:$ktorVersion")
+    implementation("io.ktor:ktor-server-status-pages:$ktorVersion")
+    implementation("io.ktor:ktor-server-auth:$ktorVersion")
+    implementation("io.ktor:ktor-server-auth-jwt:$ktorVersion")
     implementation("io.ktor:ktor-serialization-kotlinx-json:$ktorVersion")
     implementation("org.jetbrains.kotlinx:kotlinx-coroutines-core:1.10.2")
     implementation("com.clickhouse:clickhouse-jdbc:0.8.6")
+    implementation("org.postgresql:postgresql:42.7.5")
+    implementation("org.xerial:sqlite-jdbc:3.49.1.0")
+    implementation("org.duckdb:duckdb_jdbc:1.2.2.0")
+    implementation("org.apache.kafka:kafka-clients:3.9.0")
+    implementation("org.eclipse.paho:org.eclipse.paho.client.mqttv3:1.2.5")
+    implementation("io.minio:minio:8.5.17")
     implementation("org.flywaydb:flyway-core:11.9.0")
     implementation("org.flywaydb:flyway-database-clickhouse:10.18.0")
+    implementation("org.flywaydb:flyway-database-postgresql:11.9.0")
     implementation("org.slf4j:slf4j-simple:2.0.17")
+    implementation("io.micrometer:micrometer-registry-prometheus:1.14.5")
+    implementation("redis.clients:jedis:5.2.0")
+    implementation("org.eclipse.angus:angus-mail:2.0.3")
+    implementation("com.github.luben:zstd-jni:1.5.6-10")
+    implementation("org.yaml:snakeyaml:2.4")
     testImplementation(kotlin("test"))
+    testImplementation("org.testcontainers:clickhouse:1.21.3")
+}
+
+tasks.test {
+    useJUnitPlatform()
+}
+
+// Benchmarks are kept out of the main source set, so they do not ship in the server image.
+val bench by sourceSets.creating {
+    compileClasspath += sourceSets.main.get().output
+    runtimeClasspath += sourceSets.main.get().output
+}
+configurations[bench.implementationConfigurationName].extendsFrom(configurations.implementation.get())
+configurations[bench.runtimeOnlyConfigurationName].extendsFrom(configurations.runtimeOnly.get())
+
+tasks.register<JavaExec>("bench") {
+    description = "Times parsing of a large Auto Export payload"
+    classpath = bench.runtimeClasspath
+    mainClass = "me.centralhardware.healthImportServer.tools.BenchCommandKt"
 }
 
 jib {
@@ -0,0 +1,86 @@
+package me.centralhardware.healthImportServer.tools
+
+import kotlinx.serialization.json.Json
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.ExportWrapper
+import me.centralhardware.healthImportServer.request.GPSLog
+import me.centralhardware.healthImportServer.request.HeartRateLog
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.QtyUnit
+import me.centralhardware.healthImportServer.request.RequestParser
+import me.centralhardware.healthImportServer.request.Sample
+import me.centralhardware.healthImportServer.request.Timestamps
+import me.centralhardware.healthImportServer.request.Workout
+import java.lang.management.ManagementFactory
+import java.nio.file.Files
+import java.nio.file.Paths
+import java.time.Instant
+
+/**
+ * `gradle bench --args="[--input <file>] [--samples N] [--workouts N] [--rounds N]"` times
+ * parsing of an Auto Export payload and the timestamp parsing done while
+ * storing it, and reports the bytes allocated per round. Without `--input`
+ * a payload of heart rate and step samples and workouts with routes is
+ * generated. Nothing is written to ClickHouse.
+ */
+fun main(args: Array<String>) = BenchCommand.run(parseOptions(args.toList()))
+
+object BenchCommand {
+    private val threads = ManagementFactory.getThreadMXBean() as com.sun.management.ThreadMXBean
+
+    fun run(options: Map<String, String>) {
+        val body = options["input"]?.let { Files.readAllBytes(Paths.get(it)) }
+            ?: generate(options["samples"]?.toInt() ?: 500_000, options["workouts"]?.toInt() ?: 200).toByteArray()
+        val rounds = options["rounds"]?.toInt() ?: 5
+        println("Payload of ${body.size / 1024} KiB")
+
+        repeat(rounds) { round ->
+            var export = Export()
+            val parse = measure { export = RequestParser.parse(body.inputStream()).export }
+            val timestamps = export.metrics.flatMap { it.data }.mapNotNull { it.date } +
+                    export.workouts.flatMap { w -> w.route.mapNotNull { it.timestamp } + w.heartRateData.mapNotNull { it.date } }
+            val parseTimestamps = measure { timestamps.forEach { Timestamps.parse(it) } }
+            println("Round ${round + 1}: parse $parse, ${timestamps.size} timestamps $parseTimestamps")
+        }
+    }
+
+    private fun measure(block: () -> Unit): String {
+        val thread = Thread.currentThread().threadId()
+        val allocatedBefore = threads.getThreadAllocatedBytes(thread)
+        val start = System.nanoTime()
+        block()
+        val millis = (System.nanoTime() - start) / 1_000_000
+        val allocated = (threads.getThreadAllocatedBytes(thread) - allocatedBefore) / (1024 * 1024)
+        return "${millis} ms, $allocated MiB allocated"
+    }
+
+    private fun generate(samples: Int, workouts: Int): String {
+        val start = Instant.parse("2024-01-01T00:00:00Z")
+        fun ts(seconds: Long) = Timestamps.format(start.plusSeconds(seconds))
+        val heartRate = List(samples / 2) { i ->
+            Sample(date = ts(i * 60L), min = 55.0 + i % 20, avg = 60.0 + i % 20, max = 65.0 + i % 20)
+        }
+        val steps = List(samples - samples / 2) { i -> Sample(date = ts(i * 60L), qty = (i % 120).toDouble()) }
+        val export = Export(
+            metrics = listOf(Metric("heart_rate", "count/min", heartRate), Metric("step_count", "count", steps)),
+            workouts = List(workouts) { w ->
+                val offset = w * 86_400L
+                Workout(
+                    id = "bench-$w",
+                    name = "Running",
+                    start = ts(offset),
+                    end = ts(offset + 1800),
+                    activeEnergyBurned = QtyUnit(350.0, "kcal"),
+                    distance = QtyUnit(5.0, "km"),
+                    route = List(1800) { i ->
+                        GPSLog(latitude = 52.5 + i * 1e-5, longitude = 13.4 + i * 1e-5, altitude = 34.0, timestamp = ts(offset + i))
+                    },
+                    heartRateData = List(30) { i ->
+                        HeartRateLog(min = 120.0, max = 150.0, avg = 135.0, units = "count/min", date = ts(offset + i * 60L))
+                    },
+                )
+            },
+        )
+        return Json.encodeToString(ExportWrapper.serializer(), ExportWrapper(export))
+    }
+}
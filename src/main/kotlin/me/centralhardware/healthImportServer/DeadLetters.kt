@@ -0,0 +1,84 @@
+package me.centralhardware.healthImportServer
+
+import kotlinx.serialization.json.Json
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.ExportWrapper
+import org.slf4j.LoggerFactory
+import java.nio.file.Files
+import java.nio.file.Path
+import java.nio.file.Paths
+import java.time.Instant
+import java.time.ZoneOffset
+import java.time.format.DateTimeFormatter
+import kotlin.io.path.listDirectoryEntries
+
+/**
+ * Chunks [RetrySpool] gave up on, kept in [dir] as `<time>-<upload>.json`
+ * in the Auto Export schema, so they can be uploaded again or imported with
+ * `reprocess` once whatever rejected them is fixed. Each comes with a
+ * `<time>-<upload>.error.txt` telling why it failed.
+ */
+class DeadLetters(val dir: Path) {
+    val log = LoggerFactory.getLogger(DeadLetters::class.java)
+    private val json = Json { explicitNulls = false }
+
+    /** Writes [chunk] of [upload], which failed [attempts] times with [error], and returns its file. */
+    fun write(upload: String, chunk: Export, attempts: Int, error: Throwable?): Path {
+        val file = next(upload)
+        Files.writeString(file, json.encodeToString(ExportWrapper.serializer(), ExportWrapper(chunk)))
+        report(file, upload, "Failed $attempts times to be written", error)
+        log.error("Moved a chunk of upload $upload to $file after $attempts failed attempts")
+        return file
+    }
+
+    /** Moves [file], a spooled chunk of [upload] that could not be read, here and returns its new place. */
+    fun move(upload: String, file: Path, error: Throwable): Path {
+        val target = next(upload)
+        Files.move(file, target)
+        report(target, upload, "Could not be read from $file", error)
+        log.error("Moved unreadable spooled chunk $file to $target")
+        return target
+    }
+
+    /** The payloads waiting to be reprocessed, oldest first. */
+    fun pending(): List<Path> =
+        if (!Files.isDirectory(dir)) emptyList()
+        else dir.listDirectoryEntries("*.json").sortedBy { it.fileName.toString() }
+
+    /** Removes [file] and its error report after it was reprocessed. */
+    fun delete(file: Path) {
+        Files.deleteIfExists(file)
+        Files.deleteIfExists(reportOf(file))
+    }
+
+    fun reportOf(file: Path): Path = file.resolveSibling(file.fileName.toString().removeSuffix(".json") + ".error.txt")
+
+    private fun next(upload: String): Path {
+        Files.createDirectories(dir)
+        val time = FILE_TIME.format(Instant.now())
+        return generateSequence(0) { it + 1 }
+            .map { n -> dir.resolve(if (n == 0) "$time-$upload.json" else "$time-$upload-$n.json") }
+            .first { !Files.exists(it) }
+    }
+
+    private fun report(file: Path, upload: String, reason: String, error: Throwable?) {
+        val report = buildString {
+            appendLine("Upload: $upload")
+            appendLine("Dead-lettered at: ${Instant.now()}")
+            appendLine("Reason: $reason")
+            if (error != null) {
+                appendLine()
+                appendLine(error.stackTraceToString())
+            }
+        }
+        Files.writeString(reportOf(file), report)
+    }
+
+    companion object {
+        private val FILE_TIME = DateTimeFormatter.ofPattern("yyyyMMdd'T'HHmmss'Z'").withZone(ZoneOffset.UTC)
+
+        /** Reads `DEAD_LETTER_DIR`, by default `dead-letter` in `UPLOAD_SPOOL_DIR`. */
+        fun fromEnv(): DeadLetters =
+            DeadLetters(Env.get("DEAD_LETTER_DIR")?.let { Paths.get(it) } ?: ResumableUploads.spoolDir().resolve("dead-letter"))
+    }
+}
@@ -0,0 +1,151 @@
+package me.centralhardware.healthImportServer
+
+import kotlinx.serialization.Serializable
+import kotlinx.serialization.json.Json
+import org.slf4j.LoggerFactory
+import java.io.DataInputStream
+import java.io.DataOutputStream
+import java.io.InputStream
+import java.nio.file.Files
+import java.nio.file.Path
+import java.nio.file.Paths
+import java.security.KeyFactory
+import java.security.PrivateKey
+import java.security.PublicKey
+import java.security.SecureRandom
+import java.security.spec.MGF1ParameterSpec
+import java.security.spec.PKCS8EncodedKeySpec
+import java.security.spec.X509EncodedKeySpec
+import java.time.Instant
+import java.time.ZoneOffset
+import java.time.format.DateTimeFormatter
+import java.util.Base64
+import java.util.UUID
+import javax.crypto.Cipher
+import javax.crypto.CipherInputStream
+import javax.crypto.CipherOutputStream
+import javax.crypto.KeyGenerator
+import javax.crypto.spec.GCMParameterSpec
+import javax.crypto.spec.OAEPParameterSpec
+import javax.crypto.spec.PSource
+import javax.crypto.spec.SecretKeySpec
+
+/**
+ * Keeps uploads only as files in [dir] that nobody without the private key
+ * of [publicKey] can read, the server included. Each payload is encrypted
+ * with a fresh AES-256-GCM key, which is encrypted with RSA-OAEP (SHA-256)
+ * and stored in front of it:
+ *
+ * `HIEA` `1` | key length (u16) | encrypted key | nonce (12 bytes) | ciphertext
+ *
+ * The ciphertext holds the length (u32) of a JSON [Envelope], the envelope
+ * and the payload exactly as it was received.
+ */
+class EncryptedArchive(private val dir: Path, private val publicKey: PublicKey) {
+    val log = LoggerFactory.getLogger(EncryptedArchive::class.java)
+    private val random = SecureRandom()
+
+    init {
+        Files.createDirectories(dir)
+    }
+
+    /** What is known about a payload besides its bytes; encrypted together with it. */
+    @Serializable
+    data class Envelope(val receivedAt: String, val contentType: String, val contentEncoding: String? = null)
+
+    /** Encrypts [body] into a new file and returns its path. */
+    fun store(body: ByteArray, envelope: Envelope): Path {
+        val key = KeyGenerator.getInstance("AES").apply { init(256, random) }.generateKey()
+        val wrap = Cipher.getInstance(RSA)
+        wrap.init(Cipher.ENCRYPT_MODE, publicKey, OAEP)
+        val wrappedKey = wrap.doFinal(key.encoded)
+        val nonce = ByteArray(NONCE_BYTES).also { random.nextBytes(it) }
+        val cipher = Cipher.getInstance(AES)
+        cipher.init(Cipher.ENCRYPT_MODE, key, GCMParameterSpec(TAG_BITS, nonce))
+
+        val name = "${FILE_TIME.format(Instant.now())}-${UUID.randomUUID().toString().take(8)}.$EXTENSION"
+        val file = dir.resolve(name)
+        val partial = dir.resolve("$name.part")
+        DataOutputStream(Files.newOutputStream(partial)).use { out ->
+            out.write(MAGIC)
+            out.writeShort(wrappedKey.size)
+            out.write(wrappedKey)
+            out.write(nonce)
+            DataOutputStream(CipherOutputStream(out, cipher)).use { plain ->
+                val header = Json.encodeToString(Envelope.serializer(), envelope).toByteArray()
+                plain.writeInt(header.size)
+                plain.write(header)
+                plain.write(body)
+            }
+        }
+        // Only complete files get the final name, so a crash never leaves a truncated archive.
+        Files.move(partial, file)
+        log.info("Archived ${body.size} bytes of ${envelope.contentType} as $name")
+        return file
+    }
+
+    companion object {
+        const val EXTENSION = "hiea"
+        private val MAGIC = "HIEA".toByteArray() + 1.toByte()
+        private const val RSA = "RSA/ECB/OAEPWithSHA-256AndMGF1Padding"
+        private const val AES = "AES/GCM/NoPadding"
+        private const val NONCE_BYTES = 12
+        private const val TAG_BITS = 128
+        private val OAEP = OAEPParameterSpec("SHA-256", "MGF1", MGF1ParameterSpec.SHA256, PSource.PSpecified.DEFAULT)
+        private val FILE_TIME = DateTimeFormatter.ofPattern("yyyyMMdd'T'HHmmss'Z'").withZone(ZoneOffset.UTC)
+
+        /**
+         * Reads `ARCHIVE_PUBLIC_KEY`, the path of a PEM encoded RSA public key,
+         * and `ARCHIVE_DIR` (default `archive`). Returns null unless the key is set.
+         */
+        fun fromEnv(): EncryptedArchive? {
+            val keyFile = Env.get("ARCHIVE_PUBLIC_KEY") ?: return null
+            val dir = Paths.get(Env.get("ARCHIVE_DIR") ?: "archive")
+            return EncryptedArchive(dir, publicKey(Files.readString(Paths.get(keyFile))))
+        }
+
+        /** Reads a `BEGIN PUBLIC KEY` PEM block, as written by `openssl pkey -pubout`. */
+        fun publicKey(pem: String): PublicKey =
+            KeyFactory.getInstance("RSA").generatePublic(X509EncodedKeySpec(pemBytes(pem)))
+
+        /** Reads an unencrypted `BEGIN PRIVATE KEY` PEM block, as written by `openssl genpkey`. */
+        fun privateKey(pem: String): PrivateKey =
+            KeyFactory.getInstance("RSA").generatePrivate(PKCS8EncodedKeySpec(pemBytes(pem)))
+
+        private fun pemBytes(pem: String): ByteArray =
+            Base64.getMimeDecoder().decode(pem.lines().filterNot { it.startsWith("-----") }.joinToString(""))
+
+        /** Decrypts an archived file with [privateKey] and returns its envelope and payload. */
+        fun open(input: InputStream, privateKey: PrivateKey): Pair<Envelope, ByteArray> {
+            val data = DataInputStream(input)
+            val magic = ByteArray(MAGIC.size).also { data.readFully(it) }
+            require(magic.contentEquals(MAGIC)) { "Not an encrypted archive of this server" }
+            val wrappedKey = ByteArray(data.readUnsignedShort()).also { data.readFully(it) }
+            val nonce = ByteArray(NONCE_BYTES).also { data.readFully(it) }
+            val unwrap = Cipher.getInstance(RSA)
+            unwrap.init(Cipher.DECRYPT_MODE, privateKey, OAEP)
+            val key = SecretKeySpec(unwrap.doFinal(wrappedKey), "AES")
+            val cipher = Cipher.getInstance(AES)
+            cipher.init(Cipher.DECRYPT_MODE, key, GCMParameterSpec(TAG_BITS, nonce))
+            DataInputStream(CipherInputStream(data, cipher)).use { plain ->
+                val header = ByteArray(plain.readInt()).also { plain.readFully(it) }
+                val envelope = Json.decodeFromString(Envelope.serializer(), header.decodeToString())
+                return envelope to plain.readBytes()
+            }
+        }
+    }
+}
+
+/**
+ * Runs the server as a pure archiver: uploads are encrypted into [archive]
+ * and never parsed or written to ClickHouse, which is not needed at all.
+ */
+fun runArchiveServer(archive: EncryptedArchive) = runUploadServer({ body, contentType, encoding ->
+    val envelope = EncryptedArchive.Envelope(
+        receivedAt = Instant.now().toString(),
+        contentType = contentType.withoutParameters().toString(),
+        contentEncoding = encoding,
+    )
+    val file = archive.store(body, envelope)
+    "Archived ${body.size} bytes as ${file.fileName}"
+})
@@ -0,0 +1,36 @@
+package me.centralhardware.healthImportServer
+
+/**
+ * Paths of the HTTP endpoints. An unguessable upload path is a weak second
+ * line of defense, and custom paths help to fit an existing reverse proxy
+ * layout.
+ */
+data class EndpointPaths(
+    val upload: String = "/upload",
+    val status: String = "/status",
+    val health: String = "/health",
+    val metrics: String = "/metrics",
+    val api: String = "/api",
+    val admin: String = "/admin",
+) {
+    init {
+        listOf(upload, status, health, metrics, api, admin).forEach { path ->
+            require(path.startsWith("/") && !path.contains(' ')) { "Endpoint path '$path' must start with /" }
+        }
+    }
+
+    companion object {
+        /** Reads `UPLOAD_PATH`, `STATUS_PATH`, `HEALTH_PATH`, `METRICS_PATH`, `API_PATH` and `ADMIN_PATH`. */
+        fun fromEnv(): EndpointPaths {
+            val defaults = EndpointPaths()
+            return EndpointPaths(
+                upload = Env.get("UPLOAD_PATH") ?: defaults.upload,
+                status = Env.get("STATUS_PATH") ?: defaults.status,
+                health = Env.get("HEALTH_PATH") ?: defaults.health,
+                metrics = Env.get("METRICS_PATH") ?: defaults.metrics,
+                api = Env.get("API_PATH") ?: defaults.api,
+                admin = Env.get("ADMIN_PATH") ?: defaults.admin,
+            )
+        }
+    }
+}
@@ -0,0 +1,113 @@
+package me.centralhardware.healthImportServer
+
+import org.slf4j.LoggerFactory
+import org.yaml.snakeyaml.Yaml
+import java.nio.file.Files
+import java.nio.file.Path
+import java.nio.file.Paths
+
+/**
+ * Settings, read from environment variables and optionally from a YAML or
+ * JSON file given with `--config <file>`. The file holds the same settings
+ * as the variables, nested maps joined with `_`, so
+ * `clickhouse: {dsn: ..., database: health}` sets `CLICKHOUSE_DSN` and
+ * `CLICKHOUSE_DATABASE`, and lists are joined with `,`. A `stores` map
+ * declares further stores, see [stores]. An environment variable overrides
+ * the file, so a secret can stay out of it; one set to an empty value
+ * counts as unset.
+ */
+object Env {
+    val log = LoggerFactory.getLogger(Env::class.java)
+    @Volatile
+    private var file: Map<String, String> = emptyMap()
+    @Volatile
+    private var path: Path? = null
+    private val prefix = ThreadLocal<String?>()
+
+    fun get(name: String): String? = prefix.get()?.let { lookup(it + name) } ?: lookup(name)
+
+    private fun lookup(name: String): String? = System.getenv(name)?.takeIf { it.isNotEmpty() } ?: file[name]
+
+    /**
+     * The values of [name] in the file and in the environment, in this
+     * order, for lists such as `STORES` that are merged rather than
+     * overridden.
+     */
+    fun layers(name: String): List<String> =
+        listOfNotNull(file[name], System.getenv(name)?.takeIf { it.isNotEmpty() })
+
+    /**
+     * Runs [block] with every setting `X` read as `<prefix>X` where that is
+     * set, e.g. `STORE_REPLICA_CLICKHOUSE_DSN` for `CLICKHOUSE_DSN`, so one
+     * `fromEnv` can configure several instances.
+     */
+    fun <T> scoped(prefix: String, block: () -> T): T {
+        val previous = this.prefix.get()
+        this.prefix.set(prefix)
+        try {
+            return block()
+        } finally {
+            this.prefix.set(previous)
+        }
+    }
+
+    /** Loads the file of `--config <file>` in [args] and returns the other arguments. */
+    fun load(args: List<String>): List<String> {
+        val index = args.indexOf("--config")
+        if (index < 0) return args
+        val path = Paths.get(args.getOrNull(index + 1) ?: error("--config needs a file"))
+        file = read(path)
+        this.path = path
+        log.info("Read ${file.size} settings from $path")
+        return args.subList(0, index) + args.drop(index + 2)
+    }
+
+    /**
+     * Reads the file of `--config` again and returns the names of the
+     * settings that changed. Only settings read when they are used pick up
+     * the new values; those read at startup still need a restart.
+     */
+    fun reload(): Set<String> {
+        val path = path ?: return emptySet()
+        val previous = file
+        file = read(path)
+        val changed = (previous.keys + file.keys).filterTo(sortedSetOf()) { previous[it] != file[it] }
+        log.info("Read ${file.size} settings from $path again, changed: ${changed.joinToString().ifEmpty { "none" }}")
+        return changed
+    }
+
+    private fun read(path: Path): Map<String, String> {
+        val root = Files.newBufferedReader(path).use { Yaml().load<Any?>(it) } ?: emptyMap<String, Any?>()
+        require(root is Map<*, *>) { "$path must hold a map of settings" }
+        return flatten(root)
+    }
+
+    private fun flatten(map: Map<*, *>, prefix: String = ""): Map<String, String> = buildMap {
+        for ((key, value) in map) {
+            val name = prefix + key.toString().uppercase().replace('-', '_').replace('.', '_')
+            when {
+                value == null -> {}
+                name == "STORES" && value is Map<*, *> -> putAll(stores(value))
+                value is Map<*, *> -> putAll(flatten(value, name + "_"))
+                value is List<*> -> put(name, value.filterNotNull().joinToString(","))
+                else -> put(name, value.toString())
+            }
+        }
+    }
+
+    /**
+     * Turns `stores: {replica: {type: clickhouse, clickhouse: {dsn: ...}}}`
+     * into `STORES=replica=clickhouse` and the `STORE_REPLICA_` settings of
+     * each store, such as `STORE_REPLICA_CLICKHOUSE_DSN`.
+     */
+    private fun stores(stores: Map<*, *>): Map<String, String> = buildMap {
+        val declared = mutableListOf<String>()
+        for ((store, options) in stores) {
+            require(options is Map<*, *>) { "Store $store in the config file must be a map of settings" }
+            val type = requireNotNull(options["type"]) { "Store $store in the config file needs a type" }
+            declared += "$store=$type"
+            putAll(flatten(options.filterKeys { it != "type" }, "STORE_${store.toString().uppercase()}_"))
+        }
+        put("STORES", declared.joinToString(","))
+    }
+}
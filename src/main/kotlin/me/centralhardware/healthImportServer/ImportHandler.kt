@@ -1,54 +1,508 @@
 package me.centralhardware.healthImportServer
 
+import io.ktor.http.ContentType
+import io.ktor.http.HttpHeaders
+import io.ktor.http.HttpStatusCode
 import io.ktor.server.application.*
-import io.ktor.server.request.receiveText
+import io.ktor.http.content.PartData
+import io.ktor.http.content.forEachPart
+import io.ktor.server.plugins.BadRequestException
+import io.ktor.server.request.contentType
+import io.ktor.server.request.receive
+import io.ktor.server.request.receiveMultipart
+import io.ktor.utils.io.toByteArray
+import io.ktor.server.response.header
+import io.ktor.server.response.respond
 import io.ktor.server.response.respondText
-import me.centralhardware.healthImportServer.request.RequestParser
+import kotlinx.serialization.Serializable
+import me.centralhardware.healthImportServer.analytics.GapDetector
+import me.centralhardware.healthImportServer.analytics.MissingRange
+import me.centralhardware.healthImportServer.analytics.PersonalRecordTracker
+import me.centralhardware.healthImportServer.api.ResponseCache
+import me.centralhardware.healthImportServer.api.UploadSignature
+import me.centralhardware.healthImportServer.analytics.TrendSmoother
+import me.centralhardware.healthImportServer.dedup.SampleDeduplicator
+import me.centralhardware.healthImportServer.monitoring.FreshnessTracker
+import me.centralhardware.healthImportServer.monitoring.LatencySlo
+import me.centralhardware.healthImportServer.monitoring.LiveFeed
+import me.centralhardware.healthImportServer.monitoring.PipelineMetrics
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.PayloadSplitter
 import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import me.centralhardware.healthImportServer.storage.JsonlStore
+import me.centralhardware.healthImportServer.storage.MqttPublisher
+import me.centralhardware.healthImportServer.storage.StoreRouter
+import me.centralhardware.healthImportServer.transform.PayloadTransform
+import me.centralhardware.healthImportServer.transform.applyCounting
+import kotlinx.coroutines.CoroutineScope
+import kotlinx.coroutines.Dispatchers
+import kotlinx.coroutines.channels.Channel
 import kotlinx.coroutines.launch
 import org.slf4j.LoggerFactory
+import java.io.InputStream
+import java.nio.file.Files
+import java.nio.file.Path
+import java.time.Duration
+import java.util.concurrent.atomic.AtomicInteger
 
-class ImportHandler(private val metricStore: ClickHouseMetricStore) {
+class ImportHandler(
+    private val metricStore: ClickHouseMetricStore,
+    private val maxChunkRows: Int,
+    private val tracker: ImportTracker,
+    private val deduplicator: SampleDeduplicator?,
+    private val recordTracker: PersonalRecordTracker?,
+    private val trendSmoother: TrendSmoother?,
+    private val transforms: List<PayloadTransform>,
+    private val signature: UploadSignature? = null,
+    private val freshness: FreshnessTracker? = null,
+    private val pipelineMetrics: PipelineMetrics? = null,
+    /** Uploads written to the store at the same time; further uploads wait in a queue. */
+    private val workers: Int = 2,
+    private val spill: QueueSpill? = null,
+    /** Emptied whenever data was written, so read APIs never serve a response older than the upload. */
+    private val responseCache: ResponseCache? = null,
+    /** Finds the ranges listed in JSON upload responses for a client to export again. */
+    private val gaps: GapDetector? = null,
+    /** Uploads waiting for a worker at most before further ones are answered 503; 0 is unbounded. */
+    private val maxQueued: Int = 0,
+    /** Gets every written chunk, to publish the newest values of some metrics. */
+    private val mqtt: MqttPublisher? = null,
+    /** Gets a copy of every written chunk as JSON lines. */
+    private val jsonl: JsonlStore? = null,
+    /** Gets every written chunk for the clients of `/api/stream`. */
+    private val live: LiveFeed? = null,
+    /** Decides which sections the main store gets and writes them to the other stores. */
+    private val router: StoreRouter? = null,
+    private val latency: LatencySlo? = null,
+    /** Keeps chunks that failed to be written and writes them again once ClickHouse is back. */
+    private val retrySpool: RetrySpool? = null,
+) {
     val log = LoggerFactory.getLogger(ImportHandler::class.java)
+    private val queue = Channel<Queued>(Channel.UNLIMITED)
+    private val queued = AtomicInteger()
 
-    suspend fun handle(call: ApplicationCall) {
-        val export = RequestParser.parse(call.receiveText())
-        val metrics = export.populatedMetrics()
-        val responseMsg = "Processing request. Received ${export.metrics.size} metrics " +
-                "(${metrics.size} populated), ${export.totalSamples()} samples, " +
-                "${export.workouts.size} workouts, ${export.stateOfMind.size} state of mind entries " +
-                "and ${export.ecg.size} ECG recordings."
+    /** An accepted upload waiting for a worker, with its chunks in memory or spilled to [file]. */
+    private class Queued(val progress: ImportProgress, val chunks: ArrayDeque<Export>?, val file: Path?, val rows: Long)
+
+    /** Starts the workers that write accepted uploads, and the retries of spooled chunks; they stop with [scope]. */
+    fun launchWorkers(scope: CoroutineScope) {
+        retrySpool?.launch(scope, metricStore::ping) { replay(it) }
+        spill?.pending()?.forEach(::requeue)
+        repeat(workers) {
+            scope.launch(Dispatchers.IO) {
+                for (queued in queue) {
+                    this@ImportHandler.queued.decrementAndGet()
+                    try {
+                        val chunks = try {
+                            queued.chunks ?: spill!!.read(queued.file!!)
+                        } catch (e: Exception) {
+                            log.error("Failed to read spilled upload ${queued.progress.id}", e)
+                            continue
+                        }
+                        // Workers live as long as the server, so no upload may end one, e.g. while ClickHouse is down.
+                        try {
+                            process(queued.progress, chunks)
+                        } catch (e: Exception) {
+                            log.error("Failed to process upload ${queued.progress.id}", e)
+                        }
+                    } finally {
+                        // Only now are the rows out of memory, and a spilled file is kept until here in case of a restart.
+                        spill?.release(queued.rows)
+                        queued.file?.let { spill?.delete(it) }
+                    }
+                }
+            }
+        }
+    }
 
-        call.respondText(responseMsg)
+    /** Queues a spilled upload left by a previous run again as an upload of its own. */
+    private fun requeue(file: Path) {
+        val spill = spill ?: return
+        val chunks = try {
+            spill.read(file)
+        } catch (e: Exception) {
+            log.error("Could not read $file left by a previous run", e)
+            spill.delete(file)
+            return
+        }
+        val progress = tracker.start(chunks, metadata = mapOf("spilled" to file.fileName.toString()))
+        log.info("Queued $file left by a previous run again as upload ${progress.id}")
+        queued.incrementAndGet()
+        queue.trySend(Queued(progress, null, file, 0))
+    }
 
-        val workouts = export.workouts
-        val stateOfMind = export.stateOfMind
-        val ecg = export.ecg
+    private suspend fun enqueue(progress: ImportProgress, chunks: ArrayDeque<Export>) {
+        val rows = progress.snapshot().rowsExpected.values.sumOf { it.toLong() }
+        queued.incrementAndGet()
+        var sent = false
+        try {
+            if (spill == null || spill.reserve(rows)) {
+                queue.send(Queued(progress, chunks, null, if (spill == null) 0 else rows))
+            } else {
+                queue.send(Queued(progress, null, spill.write(progress.id, chunks), 0))
+            }
+            sent = true
+        } finally {
+            // An upload that could not be spilled never reaches a worker, which would count it off.
+            if (!sent) queued.decrementAndGet()
+        }
+    }
 
-        call.application.launch {
-            log.info("Starting upload to ClickHouse")
+    suspend fun handle(call: ApplicationCall) {
+        call.response.header(HttpHeaders.AcceptEncoding, RequestEncoding.ACCEPTED)
+        if (call.request.contentType().match(ContentType.MultiPart.FormData)) return handleMultipart(call)
+        if (!admit(call)) return
+        val stages = linkedMapOf<String, Long>()
+        val body = measure(stages, PipelineMetrics.READ) { call.receive<ByteArray>() }
+        if (!verify(call, body)) return
+        accept(call, body, call.request.contentType(), encoding = call.request.headers[HttpHeaders.ContentEncoding], stages = stages)
+    }
 
-            metrics.takeIf { it.isNotEmpty() }?.let { localMetrics ->
-                metricStore.store(localMetrics)
-                val samples = localMetrics.sumOf { it.data.size }
-                log.info("Saved ${localMetrics.size} metrics with $samples samples")
+    /**
+     * Reads the first file part as the payload, and the other form fields
+     * as metadata of the import. A file part without a specific
+     * `Content-Type` is recognized by its file name extension.
+     */
+    private suspend fun handleMultipart(call: ApplicationCall) {
+        if (!admit(call)) return
+        var file: ByteArray? = null
+        var contentType = ContentType.Any
+        val metadata = mutableMapOf<String, String>()
+        val stages = linkedMapOf<String, Long>()
+        val started = System.nanoTime()
+        call.receiveMultipart(formFieldLimit = MULTIPART_LIMIT).forEachPart { part ->
+            when (part) {
+                is PartData.FileItem -> if (file == null) {
+                    file = part.provider().toByteArray()
+                    contentType = part.contentType?.takeUnless { it.match(ContentType.Application.OctetStream) }
+                        ?: part.originalFileName?.let { UploadFormat.ofFileName(it) }?.contentTypes?.first()
+                        ?: ContentType.Any
+                }
+                is PartData.FormItem -> part.name?.let { metadata[it] = part.value }
+                else -> {}
             }
-            ecg.takeIf { it.isNotEmpty() }?.let { localEcg ->
-                metricStore.storeEcg(localEcg)
-                val voltages = localEcg.sumOf { it.voltageMeasurements.size }
-                log.info("Saved ${localEcg.size} ECG entries with $voltages voltage measurements")
+            part.dispose()
+        }
+        stages[PipelineMetrics.READ] = (System.nanoTime() - started) / 1_000_000
+        val body = file ?: throw BadRequestException("Multipart upload without a file part")
+        if (!verify(call, body)) return
+        accept(call, body, contentType, metadata, stages = stages)
+    }
+
+    /** Answers 503 and returns false if [maxQueued] uploads are already waiting for a worker. */
+    suspend fun admit(call: ApplicationCall): Boolean {
+        if (maxQueued <= 0 || queued.get() < maxQueued) return true
+        log.warn("Rejected upload: $maxQueued uploads already waiting to be stored")
+        call.response.header(HttpHeaders.RetryAfter, RETRY_AFTER_SECONDS)
+        call.respondText("Too many uploads waiting to be stored, retry later", status = HttpStatusCode.ServiceUnavailable)
+        return false
+    }
+
+    /** Answers 401 and returns false if signatures are required and [body] is not signed correctly. */
+    suspend fun verify(call: ApplicationCall, body: ByteArray): Boolean {
+        if (signature == null) return true
+        val headers = call.request.headers
+        val error = signature.verify(headers[UploadSignature.TIMESTAMP_HEADER], headers[UploadSignature.SIGNATURE_HEADER], body)
+        if (error == null) {
+            call.attributes.put(UploadSignature.VERIFIED, Unit)
+            return true
+        }
+        log.warn("Rejected upload: $error")
+        call.respondText(error, status = HttpStatusCode.Unauthorized)
+        return false
+    }
+
+    /**
+     * Parses a complete payload of [contentType], sent with the
+     * `Content-Encoding` [encoding], and stores it in the background.
+     */
+    suspend fun accept(
+        call: ApplicationCall,
+        body: ByteArray,
+        contentType: ContentType,
+        metadata: Map<String, String> = emptyMap(),
+        encoding: String? = null,
+        stages: MutableMap<String, Long> = linkedMapOf(),
+    ) = accept(call, body.size.toLong(), body, { body.inputStream() }, contentType, metadata, encoding, stages)
+
+    /** Like the other [accept], but streams the payload from [file], e.g. an assembled resumable upload. */
+    suspend fun accept(call: ApplicationCall, file: Path, contentType: ContentType, encoding: String? = null) {
+        val head = Files.newInputStream(file).use { it.readNBytes(RequestEncoding.SNIFF_BYTES) }
+        accept(call, Files.size(file), head, { Files.newInputStream(file) }, contentType, emptyMap(), encoding, linkedMapOf())
+    }
+
+    /** Parses the payload of [size] bytes [open] reads, whose first bytes are [head]. */
+    private suspend fun accept(
+        call: ApplicationCall,
+        size: Long,
+        head: ByteArray,
+        open: () -> InputStream,
+        contentType: ContentType,
+        metadata: Map<String, String>,
+        encoding: String?,
+        stages: MutableMap<String, Long>,
+    ) {
+        val format = UploadFormat.of(contentType) ?: return call.respondText(
+            "Unsupported Content-Type $contentType, expected one of ${UploadFormat.supported()}",
+            status = HttpStatusCode.UnsupportedMediaType,
+        )
+        // JSON never starts with these bytes, so a match is a body compressed without saying so.
+        val decoding = encoding ?: RequestEncoding.sniff(head).takeIf { format == UploadFormat.JSON }
+        val unsupported = RequestEncoding.unsupported(decoding)
+        if (unsupported.isNotEmpty()) {
+            return call.respondText(
+                "Unsupported Content-Encoding ${unsupported.joinToString()}, expected one of ${RequestEncoding.ACCEPTED}",
+                status = HttpStatusCode.UnsupportedMediaType,
+            )
+        }
+        val (export, unknownFields) = try {
+            measure(stages, PipelineMetrics.PARSE) { format.parse(RequestEncoding.decode(open(), decoding)) }
+        } catch (e: Exception) {
+            RequestEncoding.tooLarge(e)?.let { throw it }
+            throw BadRequestException("Invalid ${format.name.lowercase()} upload: ${e.message}", e)
+        }
+        val (progress, chunks, reduced) = start(export, size, metadata, stages, UploadDevice.of(call.request.headers, metadata))
+        val diagnostics = UploadDiagnostics.of(export, chunks, unknownFields, reduced)
+        val responseMsg = "Processing request ${progress.id}. Received ${export.metrics.size} metrics " +
+                "(${export.populatedMetrics().size} populated), ${export.totalSamples()} samples, " +
+                "${export.workouts.size} workouts, ${export.stateOfMind.size} state of mind entries " +
+                "and ${export.ecg.size} ECG recordings. ${diagnostics.describe()}"
+
+        if (call.request.headers[HttpHeaders.Accept]?.contains("application/json") == true) {
+            val missing = gaps?.let { detector ->
+                runCatching { detector.missing(export) }.onFailure { log.warn("Could not detect gaps", it) }.getOrNull()
             }
-            workouts.takeIf { it.isNotEmpty() }?.let { localWorkouts ->
-                metricStore.storeWorkouts(localWorkouts)
-                log.info("Saved ${localWorkouts.size} workouts")
+            call.respond(
+                UploadResponse(
+                    progress.id, export.metrics.size, export.populatedMetrics().size, export.totalSamples(),
+                    export.workouts.size, export.stateOfMind.size, export.ecg.size, missing ?: emptyList(), diagnostics,
+                )
+            )
+        } else {
+            call.respondText(responseMsg)
+        }
+        enqueue(progress, chunks)
+    }
+
+    /**
+     * Stores [export] on the calling thread, as the import command does.
+     * Without [optimize] the tables are left to merge in the background,
+     * for single values entered by hand.
+     */
+    fun import(export: Export, optimize: Boolean = true): ImportProgress {
+        val (progress, chunks) = start(export)
+        process(progress, chunks, optimize = optimize)
+        return progress
+    }
+
+    private fun start(
+        export: Export,
+        bytesReceived: Long = 0,
+        metadata: Map<String, String> = emptyMap(),
+        stages: MutableMap<String, Long> = linkedMapOf(),
+        device: UploadDevice? = null,
+    ): Prepared {
+        val (chunks, reduced) = measure(stages, PipelineMetrics.PREPARE) {
+            val (transformed, reduced) = transforms.applyCounting(export.copy(metrics = export.populatedMetrics()))
+            PayloadSplitter.split(transformed, maxChunkRows) to reduced
+        }
+        val progress = tracker.start(chunks, bytesReceived, metadata, device)
+        stages.forEach { (stage, millis) -> progress.stage(stage, millis) }
+        return Prepared(progress, ArrayDeque(chunks), reduced)
+    }
+
+    /** An upload ready to be stored, with the number of samples the payload transforms dropped on purpose. */
+    private data class Prepared(val progress: ImportProgress, val chunks: ArrayDeque<Export>, val reduced: Int)
+
+    /** The chunk is in ClickHouse already, so a failing backup is logged but does not fail it. */
+    private fun backup(chunk: Export, progress: ImportProgress) {
+        try {
+            jsonl?.store(chunk)
+        } catch (e: Exception) {
+            log.error("Failed to append a chunk of upload ${progress.id} to JSON lines", e)
+        }
+    }
+
+    /**
+     * Stores a chunk of [retrySpool] or a dead letter again as an import of
+     * its own and returns why it failed again, or null. The chunk went
+     * through the payload transforms already, so they are not applied again.
+     */
+    fun replay(chunk: Export, metadata: Map<String, String> = mapOf("retry" to "true")): Exception? {
+        val progress = tracker.start(listOf(chunk), metadata = metadata)
+        return try {
+            process(progress, ArrayDeque(listOf(chunk)), spool = false)
+        } catch (e: Exception) {
+            log.error("Failed to replay a chunk as upload ${progress.id}", e)
+            e
+        }
+    }
+
+    /**
+     * Stores and drops [chunks] one by one, so only the part of an upload not
+     * yet written is kept. With [spool], chunks ClickHouse did not take are
+     * kept in [retrySpool]. Returns the error of the last chunk ClickHouse
+     * did not take; a sink failing after it does not count, as the chunk is
+     * stored.
+     */
+    private fun process(progress: ImportProgress, chunks: ArrayDeque<Export>, spool: Boolean = true, optimize: Boolean = true): Exception? {
+        val total = chunks.size
+        progress.begin()
+        log.info("Starting upload ${progress.id} to ClickHouse in $total chunk(s)")
+
+        var failed = 0
+        var lastError: Exception? = null
+        var index = 0
+        // Milliseconds spent writing per store, and the stores that failed a chunk, for the latency SLO.
+        val routed = linkedMapOf<String, Long>()
+        val failedStores = mutableSetOf<String>()
+        try {
+            while (chunks.isNotEmpty()) {
+                val chunk = chunks.removeFirst()
+                var written: Export? = null
+                try {
+                    val (stored, main) = storeChunk(chunk, progress, routed)
+                    written = stored
+                    progress.chunkStored(main)
+                    freshness?.record(main)
+                    gaps?.stored(main)
+                    mqtt?.publish(main)
+                    backup(main, progress)
+                    router?.store(stored)?.let { result ->
+                        result.millis.forEach { (store, millis) -> routed.merge(store, millis, Long::plus) }
+                        failedStores += result.failed
+                    }
+                    live?.publish(main)
+                    responseCache?.invalidate()
+                } catch (e: Exception) {
+                    failed++
+                    progress.chunkFailed()
+                    log.error("Failed to store chunk ${index + 1}/$total of upload ${progress.id}", e)
+                    // Only chunks that did not reach ClickHouse are kept, those of a failing sink after it are not.
+                    if (written == null) {
+                        lastError = e
+                        failedStores += StoreRouter.MAIN
+                        if (spool) {
+                            try {
+                                retrySpool?.write(progress.id, index, chunk)
+                            } catch (spoolError: Exception) {
+                                log.error("Failed to spool chunk ${index + 1}/$total of upload ${progress.id}", spoolError)
+                            }
+                        }
+                    }
+                }
+                index++
+                log.info(progress.describe())
             }
-            stateOfMind.takeIf { it.isNotEmpty() }?.let { localStateOfMind ->
-                metricStore.storeStateOfMind(localStateOfMind)
-                log.info("Saved ${localStateOfMind.size} state of mind entries")
+        } finally {
+            finish(progress, failed, total, routed, failedStores, optimize)
+        }
+        return lastError
+    }
+
+    /** Ends [progress] whatever happened to its chunks, so no import stays running. */
+    private fun finish(
+        progress: ImportProgress,
+        failed: Int,
+        total: Int,
+        routed: Map<String, Long>,
+        failedStores: Set<String>,
+        optimize: Boolean,
+    ) {
+        if (optimize) {
+            try {
+                measure(progress, PipelineMetrics.OPTIMIZE) { metricStore.optimizeTables() }
+            } catch (e: Exception) {
+                log.error("Failed to optimize tables after upload ${progress.id}", e)
             }
+        }
+        progress.finish()
+        pipelineMetrics?.record(progress.snapshot().stageMillis)
+        // A store that failed tells nothing about how fast it writes, so it is only counted.
+        routed.filterKeys { it !in failedStores }.forEach { (store, millis) -> latency?.record(store, progress.id, Duration.ofMillis(millis)) }
+        failedStores.forEach { latency?.failed(it) }
+        try {
+            metricStore.storeImport(progress.snapshot())
+        } catch (e: Exception) {
+            log.error("Failed to record upload ${progress.id} in the imports table", e)
+        }
+        responseCache?.invalidate()
+        if (failed > 0) {
+            log.warn("Finished upload ${progress.id} to clickhouse with $failed of $total chunk(s) failed.")
+        } else {
+            log.info("Finished upload ${progress.id} to clickhouse" + if (optimize) " and optimized tables." else ".")
+        }
+    }
 
-            metricStore.optimizeTables()
-            log.info("Finished upload to clickhouse and optimized tables.")
+    /**
+     * Stores [chunk] and returns the part of it that was actually written,
+     * which the other stores get, and the part of that the main store took.
+     * The time the main store took is added to [millis].
+     */
+    private fun storeChunk(chunk: Export, progress: ImportProgress, millis: MutableMap<String, Long>): Pair<Export, Export> {
+        val dedup = measure(progress, PipelineMetrics.VALIDATE) { deduplicator?.filter(chunk.metrics) }
+        val fresh = dedup?.metrics ?: chunk.metrics
+        if (dedup != null && dedup.skipped > 0) {
+            log.info("Skipped ${dedup.skipped} samples already written by a previous upload")
+        }
+        val metrics = fresh + (measure(progress, PipelineMetrics.VALIDATE) { trendSmoother?.derive(fresh) } ?: emptyList())
+        val written = chunk.copy(metrics = metrics)
+        val main = router?.select(StoreRouter.MAIN, written) ?: written
+        measure(millis, StoreRouter.MAIN) { metricStore.storeAll(main) }.forEach { (table, tableMillis) ->
+            progress.stage(PipelineMetrics.WRITE_PREFIX + table, tableMillis)
+        }
+        if (dedup != null) {
+            // Samples the main store does not take are not skipped next time.
+            val keys = router?.let { deduplicator?.keys(it.select(StoreRouter.MAIN, Export(metrics = fresh)).metrics) }
+            deduplicator?.remember(keys ?: dedup.keys)
+        }
+        log.info(
+            "Saved ${main.metrics.size} metrics with ${main.totalSamples()} samples, ${main.workouts.size} workouts, " +
+                    "${main.stateOfMind.size} state of mind entries and ${main.ecg.size} ECG entries " +
+                    "with ${main.ecg.sumOf { it.voltageMeasurements.size }} voltage measurements"
+        )
+        if (main.workouts.isNotEmpty()) {
+            try {
+                recordTracker?.process(main.workouts)
+            } catch (e: Exception) {
+                log.error("Failed to update personal records", e)
+            }
         }
+        return written to main
+    }
+
+    private inline fun <T> measure(stages: MutableMap<String, Long>, stage: String, block: () -> T): T {
+        val started = System.nanoTime()
+        return block().also { stages.merge(stage, (System.nanoTime() - started) / 1_000_000, Long::plus) }
+    }
+
+    private inline fun <T> measure(progress: ImportProgress, stage: String, block: () -> T): T {
+        val started = System.nanoTime()
+        return block().also { progress.stage(stage, (System.nanoTime() - started) / 1_000_000) }
+    }
+
+    companion object {
+        /** Largest file part accepted in a multipart upload. */
+        private const val MULTIPART_LIMIT = 512L * 1024 * 1024
+        private const val RETRY_AFTER_SECONDS = 30
     }
 }
+
+/**
+ * Answer to an upload sent with `Accept: application/json`. [missing] lists
+ * the recent date ranges still without data, this upload counted, so the
+ * client can ask for them to be exported again; [diagnostics] tells what
+ * of the payload could not be used.
+ */
+@Serializable
+data class UploadResponse(
+    val id: String,
+    val metrics: Int,
+    val populatedMetrics: Int,
+    val samples: Int,
+    val workouts: Int,
+    val stateOfMind: Int,
+    val ecg: Int,
+    val missing: List<MissingRange>,
+    val diagnostics: UploadDiagnostics,
+)
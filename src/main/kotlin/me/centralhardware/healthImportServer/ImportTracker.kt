@@ -0,0 +1,141 @@
+package me.centralhardware.healthImportServer
+
+import kotlinx.serialization.Serializable
+import me.centralhardware.healthImportServer.monitoring.PipelineMetrics
+import me.centralhardware.healthImportServer.request.Export
+import java.time.Instant
+import java.util.UUID
+import java.util.concurrent.ConcurrentHashMap
+
+/**
+ * Keeps track of running and recently finished imports so their progress can
+ * be reported through the status endpoint.
+ */
+class ImportTracker(private val history: Int = 20) {
+    private val imports = ArrayDeque<ImportProgress>()
+
+    fun start(
+        chunks: List<Export>,
+        bytesReceived: Long = 0,
+        metadata: Map<String, String> = emptyMap(),
+        device: UploadDevice? = null,
+    ): ImportProgress {
+        val expected = mutableMapOf<String, Int>()
+        chunks.forEach { chunk -> chunk.rowsPerTable().forEach { (table, rows) -> expected.merge(table, rows, Int::plus) } }
+        val progress = ImportProgress(UUID.randomUUID().toString(), Instant.now(), chunks.size, expected, bytesReceived, metadata, device)
+        synchronized(imports) {
+            imports.addLast(progress)
+            while (imports.size > history) imports.removeFirst()
+        }
+        return progress
+    }
+
+    fun snapshot(): List<ImportSnapshot> = synchronized(imports) { imports.map { it.snapshot() } }.reversed()
+
+    /** When the most recent import started, if there was one since startup. */
+    fun lastStarted(): Instant? = synchronized(imports) { imports.lastOrNull()?.startedAt }
+}
+
+class ImportProgress(
+    val id: String,
+    val startedAt: Instant,
+    private val totalChunks: Int,
+    private val expectedRows: Map<String, Int>,
+    private val bytesReceived: Long = 0,
+    /** Form fields sent along with a multipart upload, such as the device name. */
+    private val metadata: Map<String, String> = emptyMap(),
+    private val device: UploadDevice? = null,
+) {
+    private val rowsWritten = ConcurrentHashMap<String, Int>()
+    private val stageMillis = ConcurrentHashMap<String, Long>()
+    @Volatile private var chunksDone = 0
+    @Volatile private var chunksFailed = 0
+    @Volatile private var finishedAt: Instant? = null
+    @Volatile private var begun = false
+
+    /** Called when a worker picks the import from the queue. */
+    fun begin() {
+        begun = true
+    }
+
+    fun chunkStored(chunk: Export) {
+        chunk.rowsPerTable().forEach { (table, rows) -> rowsWritten.merge(table, rows, Int::plus) }
+        chunksDone++
+    }
+
+    fun chunkFailed() {
+        chunksDone++
+        chunksFailed++
+    }
+
+    /** Adds [millis] to the time spent in [stage], see [PipelineMetrics]. */
+    fun stage(stage: String, millis: Long) {
+        stageMillis.merge(stage, millis, Long::plus)
+    }
+
+    fun finish() {
+        finishedAt = Instant.now()
+    }
+
+    fun describe(): String {
+        val tables = expectedRows.keys.joinToString(", ") { "$it ${rowsWritten[it] ?: 0}/${expectedRows[it]}" }
+        return "Import $id: chunk $chunksDone/$totalChunks ($chunksFailed failed); rows $tables"
+    }
+
+    fun snapshot() = ImportSnapshot(
+        id = id,
+        state = when {
+            !begun -> "queued"
+            finishedAt == null -> "running"
+            chunksFailed > 0 -> "failed"
+            else -> "finished"
+        },
+        startedAt = startedAt.toString(),
+        finishedAt = finishedAt?.toString(),
+        bytesReceived = bytesReceived,
+        totalChunks = totalChunks,
+        chunksDone = chunksDone,
+        chunksFailed = chunksFailed,
+        rowsWritten = rowsWritten.toMap(),
+        rowsExpected = expectedRows,
+        metadata = metadata,
+        stageMillis = stageMillis.toMap(),
+        device = device,
+    )
+}
+
+@Serializable
+data class ImportSnapshot(
+    val id: String,
+    val state: String,
+    val startedAt: String,
+    val finishedAt: String?,
+    val bytesReceived: Long,
+    val totalChunks: Int,
+    val chunksDone: Int,
+    val chunksFailed: Int,
+    val rowsWritten: Map<String, Int>,
+    val rowsExpected: Map<String, Int>,
+    val metadata: Map<String, String> = emptyMap(),
+    /** Milliseconds spent per pipeline stage, e.g. `parse` or `write.metrics`. */
+    val stageMillis: Map<String, Long> = emptyMap(),
+    val device: UploadDevice? = null,
+)
+
+private fun Export.rowsPerTable(): Map<String, Int> = buildMap {
+    fun put(table: String, rows: Int) {
+        if (rows > 0) merge(table, rows, Int::plus)
+    }
+    put("metrics", metrics.sumOf { m -> m.data.count { (it.date ?: it.startDate) != null } })
+    put("workouts", workouts.size)
+    put("workout_routes", workouts.sumOf { it.route.size })
+    put("workout_heart_rate_data", workouts.sumOf { it.heartRateData.size })
+    put("workout_heart_rate_recovery", workouts.sumOf { it.heartRateRecovery.size })
+    put("workout_step_count_log", workouts.sumOf { it.stepCount.size })
+    put("workout_walking_running_distance", workouts.sumOf { it.walkingAndRunningDistance.size })
+    put("workout_active_energy", workouts.sumOf { it.activeEnergy.size })
+    put("workout_flights_climbed", workouts.sumOf { it.flightsClimbed.size })
+    put("state_of_mind", stateOfMind.size)
+    put("ecg", ecg.size)
+    put("ecg_voltage", ecg.sumOf { it.voltageMeasurements.size })
+}
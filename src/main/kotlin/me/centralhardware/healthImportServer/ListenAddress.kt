@@ -0,0 +1,19 @@
+package me.centralhardware.healthImportServer
+
+/** The host and port the server listens on, e.g. `0.0.0.0:8080` or, for IPv6, `[::]:8080`. */
+data class ListenAddress(val host: String, val port: Int) {
+    companion object {
+        /** Parses `host:port`, an IPv6 host given in brackets. */
+        fun parse(addr: String): ListenAddress {
+            val port = addr.substringAfterLast(':', "").toIntOrNull()
+            val host = addr.substringBeforeLast(':', "")
+            require(port != null && port in 0..65535 && host.isNotEmpty()) {
+                "ADDR '$addr' must be host:port, e.g. 0.0.0.0:8080 or [::]:8080"
+            }
+            return ListenAddress(host.removeSurrounding("[", "]"), port)
+        }
+
+        /** Reads `ADDR`, by default `0.0.0.0:8080`. */
+        fun fromEnv(): ListenAddress = parse(Env.get("ADDR") ?: "0.0.0.0:8080")
+    }
+}
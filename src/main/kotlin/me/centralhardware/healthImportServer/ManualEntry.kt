@@ -0,0 +1,124 @@
+package me.centralhardware.healthImportServer
+
+import io.ktor.http.HttpStatusCode
+import io.ktor.server.plugins.BadRequestException
+import io.ktor.server.request.receive
+import io.ktor.server.response.respond
+import io.ktor.server.routing.*
+import kotlinx.coroutines.Dispatchers
+import kotlinx.coroutines.withContext
+import io.ktor.serialization.kotlinx.json.DefaultJson
+import kotlinx.serialization.Serializable
+import kotlinx.serialization.SerializationException
+import me.centralhardware.healthImportServer.api.AnnotationResponse
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.Sample
+import me.centralhardware.healthImportServer.request.Timestamps
+import me.centralhardware.healthImportServer.storage.Annotation
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import java.time.Instant
+
+/** A sample of any metric, e.g. a weight from a scale that does not sync to Apple Health. */
+@Serializable
+data class ManualSample(
+    val metric: String,
+    val units: String,
+    val qty: Double,
+    val date: String? = null,
+    val source: String? = null,
+)
+
+@Serializable
+data class ManualBloodPressure(
+    val systolic: Double,
+    val diastolic: Double,
+    val date: String? = null,
+    val source: String? = null,
+)
+
+/** Context such as "caught a cold", stored in the `annotations` table. */
+@Serializable
+data class ManualAnnotation(
+    val text: String,
+    val tags: List<String> = emptyList(),
+    val date: String? = null,
+    val source: String? = null,
+)
+
+/**
+ * Endpoints for entering single values by hand, mounted next to the upload
+ * endpoint and authenticated like it:
+ *
+ * - `POST /upload/samples` stores a [ManualSample].
+ * - `POST /upload/blood-pressure` stores a [ManualBloodPressure] as the metrics
+ *   `blood_pressure_systolic` and `blood_pressure_diastolic` in mmHg.
+ * - `POST /upload/annotations` stores a [ManualAnnotation] and responds with it.
+ *   `POST /upload/notes`, where notes were stored as samples before there were
+ *   annotations, does the same.
+ *
+ * `date` defaults to now and `source` to `manual`. With `UPLOAD_SIGNING_KEY`
+ * the body has to be signed like an upload. Samples go through the same
+ * transforms and deduplication as an upload, and are written before the
+ * response, which is the status of the import. The tables are not optimized
+ * after each of them, as they are after an upload.
+ */
+fun Route.manualEntryRoutes(handler: ImportHandler, store: ClickHouseMetricStore) {
+    post("/samples") {
+        val entry = receiveSigned<ManualSample>(handler) ?: return@post
+        if (entry.metric.isBlank()) throw BadRequestException("metric must not be empty")
+        val sample = Sample(date = date(entry.date), qty = entry.qty, source = entry.source ?: SOURCE)
+        call.respond(store(handler, Metric(entry.metric, entry.units, listOf(sample))))
+    }
+    post("/blood-pressure") {
+        val entry = receiveSigned<ManualBloodPressure>(handler) ?: return@post
+        val date = date(entry.date)
+        val source = entry.source ?: SOURCE
+        call.respond(
+            store(
+                handler,
+                Metric("blood_pressure_systolic", "mmHg", listOf(Sample(date = date, qty = entry.systolic, source = source))),
+                Metric("blood_pressure_diastolic", "mmHg", listOf(Sample(date = date, qty = entry.diastolic, source = source))),
+            )
+        )
+    }
+    // The notes endpoint came first; its entries are annotations now.
+    for (path in listOf("/annotations", "/notes")) post(path) {
+        val entry = receiveSigned<ManualAnnotation>(handler) ?: return@post
+        if (entry.text.isBlank()) throw BadRequestException("text must not be empty")
+        val annotation = Annotation(
+            timestamp = instant(entry.date),
+            text = entry.text.trim(),
+            tags = entry.tags.map { it.trim() }.filter { it.isNotEmpty() }.distinct(),
+            source = entry.source ?: SOURCE,
+        )
+        withContext(Dispatchers.IO) { store.storeAnnotation(annotation) }
+        call.respond(HttpStatusCode.Created, AnnotationResponse.of(annotation))
+    }
+}
+
+private const val SOURCE = "manual"
+
+/** Decodes the body as [T] once its signature is verified, or answers 401 and returns null. */
+private suspend inline fun <reified T> RoutingContext.receiveSigned(handler: ImportHandler): T? {
+    val body = call.receive<ByteArray>()
+    if (!handler.verify(call, body)) return null
+    return try {
+        DefaultJson.decodeFromString<T>(body.decodeToString())
+    } catch (e: SerializationException) {
+        throw BadRequestException("Invalid body: ${e.message}", e)
+    } catch (e: IllegalArgumentException) {
+        throw BadRequestException("Invalid body: ${e.message}", e)
+    }
+}
+
+private suspend fun store(handler: ImportHandler, vararg metrics: Metric): ImportSnapshot =
+    withContext(Dispatchers.IO) { handler.import(Export(metrics = metrics.toList()), optimize = false).snapshot() }
+
+private fun instant(value: String?): Instant {
+    if (value == null) return Instant.now()
+    return Timestamps.parseOrNull(value) ?: throw BadRequestException("date must be a time like 2024-01-31T07:30:00Z")
+}
+
+/** [value] in the format of Auto Export, so the entry is stored like uploaded samples. */
+private fun date(value: String?): String = Timestamps.format(instant(value))
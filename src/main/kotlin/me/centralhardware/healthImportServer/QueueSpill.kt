@@ -0,0 +1,74 @@
+package me.centralhardware.healthImportServer
+
+import kotlinx.serialization.json.Json
+import me.centralhardware.healthImportServer.request.Export
+import org.slf4j.LoggerFactory
+import java.nio.file.Files
+import java.nio.file.Path
+import java.util.concurrent.atomic.AtomicLong
+import kotlin.io.path.listDirectoryEntries
+
+/**
+ * Keeps at most [maxRows] rows of queued uploads in memory. Uploads that
+ * would exceed it are written to [dir] as one JSON line per chunk and read
+ * back when a worker picks them up, so mass backfills are accepted without
+ * holding them all in memory. A file is deleted once its upload was
+ * processed, so those left by a previous run are queued again at startup.
+ */
+class QueueSpill(private val dir: Path, private val maxRows: Long) {
+    val log = LoggerFactory.getLogger(QueueSpill::class.java)
+    private val json = Json { ignoreUnknownKeys = true }
+    private val rowsInMemory = AtomicLong()
+
+    init {
+        Files.createDirectories(dir)
+    }
+
+    /** Files of the spilled uploads not processed yet, such as those of a previous run, oldest first. */
+    fun pending(): List<Path> = dir.listDirectoryEntries("*.jsonl").sortedBy { Files.getLastModifiedTime(it) }
+
+    /** Reserves memory for [rows] queued rows, or returns false if the upload has to be spilled. */
+    fun reserve(rows: Long): Boolean {
+        while (true) {
+            val current = rowsInMemory.get()
+            if (current > 0 && current + rows > maxRows) return false
+            if (rowsInMemory.compareAndSet(current, current + rows)) return true
+        }
+    }
+
+    fun release(rows: Long) {
+        rowsInMemory.addAndGet(-rows)
+    }
+
+    fun write(id: String, chunks: Collection<Export>): Path {
+        val file = dir.resolve("$id.jsonl")
+        Files.newBufferedWriter(file).use { writer ->
+            for (chunk in chunks) {
+                writer.write(json.encodeToString(Export.serializer(), chunk))
+                writer.newLine()
+            }
+        }
+        log.info("Spilled upload $id with ${chunks.size} chunk(s) to $file")
+        return file
+    }
+
+    /** Reads the chunks of a spilled upload. */
+    fun read(file: Path): ArrayDeque<Export> =
+        Files.newBufferedReader(file).useLines { lines ->
+            lines.filter { it.isNotBlank() }.mapTo(ArrayDeque()) { json.decodeFromString(Export.serializer(), it) }
+        }
+
+    /** Deletes the file of a spilled upload once it was processed. */
+    fun delete(file: Path) {
+        Files.deleteIfExists(file)
+    }
+
+    companion object {
+        /** Reads `IMPORT_QUEUE_MAX_ROWS` (default 1000000); `0` keeps every queued upload in memory. */
+        fun fromEnv(): QueueSpill? {
+            val maxRows = Env.get("IMPORT_QUEUE_MAX_ROWS")?.toLong() ?: 1_000_000
+            if (maxRows <= 0) return null
+            return QueueSpill(ResumableUploads.spoolDir().resolve("queue"), maxRows)
+        }
+    }
+}
@@ -0,0 +1,92 @@
+package me.centralhardware.healthImportServer
+
+import com.github.luben.zstd.ZstdInputStream
+import io.ktor.server.plugins.PayloadTooLargeException
+import java.io.FilterInputStream
+import java.io.InputStream
+import java.util.zip.GZIPInputStream
+import java.util.zip.InflaterInputStream
+
+/**
+ * `Content-Encoding` of upload bodies. Encodings are listed in the order
+ * they were applied and are undone in reverse. `MAX_DECOMPRESSED_MB`
+ * (default `1024`) limits how large a compressed body may become, whether
+ * it is compressed by its encoding or by its format, such as a zip archive.
+ */
+object RequestEncoding {
+    val maxDecompressedBytes = (Env.get("MAX_DECOMPRESSED_MB")?.toLong() ?: 1024) * 1024 * 1024
+
+    private val decoders: Map<String, (InputStream) -> InputStream> = mapOf(
+        "gzip" to { GZIPInputStream(it) },
+        "x-gzip" to { GZIPInputStream(it) },
+        "deflate" to { InflaterInputStream(it) },
+        "zstd" to { ZstdInputStream(it) },
+    )
+
+    /** Value of the `Accept-Encoding` response header advertising the supported encodings. */
+    val ACCEPTED = listOf("gzip", "deflate", "zstd").joinToString(", ")
+
+    /**
+     * The encoding [body] was compressed with going by its magic bytes, for
+     * clients that compress JSON without sending `Content-Encoding`.
+     */
+    fun sniff(body: ByteArray): String? = when {
+        body.startsWith(GZIP_MAGIC) -> "gzip"
+        body.startsWith(ZSTD_MAGIC) -> "zstd"
+        else -> null
+    }
+
+    private fun ByteArray.startsWith(prefix: ByteArray) = size >= prefix.size && prefix.indices.all { this[it] == prefix[it] }
+
+    /** Bytes [sniff] needs at most. */
+    const val SNIFF_BYTES = 4
+
+    private val GZIP_MAGIC = byteArrayOf(0x1f, 0x8b.toByte())
+    private val ZSTD_MAGIC = byteArrayOf(0x28, 0xb5.toByte(), 0x2f, 0xfd.toByte())
+
+    /** The encodings of [header] that can not be decoded. */
+    fun unsupported(header: String?): List<String> = parse(header).filter { it !in decoders }
+
+    /**
+     * Streams the decoded [body], so the decompressed payload is never held
+     * as a whole. Reading it throws [PayloadTooLargeException] once it grows
+     * beyond `MAX_DECOMPRESSED_MB`.
+     */
+    fun decode(body: ByteArray, header: String?): InputStream = decode(body.inputStream(), header)
+
+    /** Like the other [decode], for a body read from a file. */
+    fun decode(body: InputStream, header: String?): InputStream {
+        val encodings = parse(header)
+        if (encodings.isEmpty()) return body
+        val decoded = encodings.asReversed().fold(body) { input, encoding ->
+            decoders.getValue(encoding)(input)
+        }
+        return limit(decoded)
+    }
+
+    /** Caps [decompressed] at `MAX_DECOMPRESSED_MB`, for formats that are compressed themselves. */
+    fun limit(decompressed: InputStream): InputStream = LimitedInputStream(decompressed, maxDecompressedBytes)
+
+    /** The [PayloadTooLargeException] [e] was caused by, for parsers that wrap what the stream threw. */
+    fun tooLarge(e: Throwable): PayloadTooLargeException? =
+        generateSequence(e) { it.cause }.filterIsInstance<PayloadTooLargeException>().firstOrNull()
+
+    private fun parse(header: String?): List<String> =
+        header?.split(",")?.map { it.trim().lowercase() }?.filter { it.isNotEmpty() && it != "identity" } ?: emptyList()
+}
+
+/** Counts the bytes read from [input] and fails after [limit], so a small body cannot expand without bound. */
+internal class LimitedInputStream(input: InputStream, private val limit: Long) : FilterInputStream(input) {
+    private var count = 0L
+
+    override fun read(): Int = super.read().also { if (it >= 0) count(1) }
+
+    override fun read(b: ByteArray, off: Int, len: Int): Int = super.read(b, off, len).also { if (it > 0) count(it.toLong()) }
+
+    override fun skip(n: Long): Long = super.skip(n).also { count(it) }
+
+    private fun count(bytes: Long) {
+        count += bytes
+        if (count > limit) throw PayloadTooLargeException(limit)
+    }
+}
@@ -0,0 +1,197 @@
+package me.centralhardware.healthImportServer
+
+import io.ktor.http.ContentType
+import io.ktor.http.HttpHeaders
+import io.ktor.http.HttpStatusCode
+import io.ktor.server.request.contentType
+import io.ktor.server.request.receive
+import io.ktor.server.request.path
+import io.ktor.server.response.header
+import io.ktor.server.response.respond
+import io.ktor.server.response.respondText
+import io.ktor.server.routing.*
+import kotlinx.coroutines.CoroutineScope
+import kotlinx.coroutines.Dispatchers
+import kotlinx.coroutines.delay
+import kotlinx.coroutines.isActive
+import kotlinx.coroutines.launch
+import org.slf4j.LoggerFactory
+import java.nio.file.Files
+import java.nio.file.Path
+import java.nio.file.Paths
+import java.nio.file.StandardOpenOption
+import java.time.Duration
+import java.time.Instant
+import java.util.UUID
+import java.util.concurrent.ConcurrentHashMap
+import kotlin.io.path.listDirectoryEntries
+
+/**
+ * Uploads sent in pieces, for backfills too large to get through in one
+ * request. Pieces are appended to a file in [dir] at the offset the client
+ * reports, so a client that lost its connection asks for the current offset
+ * and continues from there. Uploads not touched for [ttl] are dropped, and
+ * so are the pieces left in [dir] by a previous run. Uploads may have at
+ * most [maxLength] bytes.
+ */
+class ResumableUploads(private val dir: Path, private val ttl: Duration, val maxLength: Long) {
+    val log = LoggerFactory.getLogger(ResumableUploads::class.java)
+    private val uploads = ConcurrentHashMap<String, Upload>()
+
+    class Upload(val id: String, val contentType: ContentType, val encoding: String?, val length: Long, val file: Path) {
+        @Volatile var offset = 0L
+        @Volatile var touched: Instant = Instant.now()
+    }
+
+    init {
+        Files.createDirectories(dir)
+        // Uploads are only known in memory, so pieces of a previous run can never be completed.
+        dir.listDirectoryEntries("*.part").takeIf { it.isNotEmpty() }?.let { leftover ->
+            log.warn("Dropping ${leftover.size} resumable upload(s) left by a previous run")
+            leftover.forEach { Files.deleteIfExists(it) }
+        }
+    }
+
+    /** Drops expired uploads every [EXPIRE_INTERVAL], also while no new ones are started; stops with [scope]. */
+    fun launch(scope: CoroutineScope) = scope.launch(Dispatchers.IO) {
+        while (isActive) {
+            delay(EXPIRE_INTERVAL.toMillis())
+            expire()
+        }
+    }
+
+    fun create(contentType: ContentType, encoding: String?, length: Long): Upload {
+        expire()
+        val id = UUID.randomUUID().toString()
+        val upload = Upload(id, contentType, encoding, length, Files.createFile(dir.resolve("$id.part")))
+        uploads[id] = upload
+        log.info("Started resumable upload $id of $length bytes")
+        return upload
+    }
+
+    fun get(id: String): Upload? = uploads[id]
+
+    /**
+     * Appends [bytes] if they start at the current offset of [upload] and
+     * returns the new offset, or null if the client is out of step.
+     */
+    fun append(upload: Upload, offset: Long, bytes: ByteArray): Long? = synchronized(upload) {
+        if (offset != upload.offset || offset + bytes.size > upload.length) return null
+        Files.write(upload.file, bytes, StandardOpenOption.APPEND)
+        upload.offset += bytes.size
+        upload.touched = Instant.now()
+        upload.offset
+    }
+
+    /** Forgets a complete [upload] and hands the file of its assembled payload to [read], deleting it afterwards. */
+    inline fun <T> complete(upload: Upload, read: (Path) -> T): T {
+        forget(upload)
+        return try {
+            read(upload.file)
+        } finally {
+            Files.deleteIfExists(upload.file)
+        }
+    }
+
+    fun forget(upload: Upload) {
+        uploads.remove(upload.id)
+    }
+
+    private fun expire() {
+        val cutoff = Instant.now().minus(ttl)
+        uploads.values.filter { it.touched.isBefore(cutoff) }.forEach {
+            log.warn("Dropping resumable upload ${it.id} at ${it.offset} of ${it.length} bytes")
+            uploads.remove(it.id)
+            Files.deleteIfExists(it.file)
+        }
+    }
+
+    companion object {
+        const val LENGTH_HEADER = "Upload-Length"
+        const val OFFSET_HEADER = "Upload-Offset"
+        private val EXPIRE_INTERVAL = Duration.ofMinutes(10)
+
+        /** `UPLOAD_SPOOL_DIR`, by default a directory in the temp directory. */
+        fun spoolDir(): Path = Env.get("UPLOAD_SPOOL_DIR")?.let { Paths.get(it) }
+            ?: Paths.get(System.getProperty("java.io.tmpdir"), "health-import-uploads")
+
+        /**
+         * Reads `UPLOAD_SPOOL_DIR`, `RESUMABLE_UPLOAD_TTL_HOURS` (default 24)
+         * and `RESUMABLE_UPLOAD_MAX_MB` (default 4096).
+         */
+        fun fromEnv(): ResumableUploads {
+            val ttl = Env.get("RESUMABLE_UPLOAD_TTL_HOURS")?.toLong() ?: 24
+            val maxLength = (Env.get("RESUMABLE_UPLOAD_MAX_MB")?.toLong() ?: 4096) * 1024 * 1024
+            return ResumableUploads(spoolDir(), Duration.ofHours(ttl), maxLength)
+        }
+    }
+}
+
+/**
+ * `POST /resumable` with `Upload-Length` and the `Content-Type` and
+ * `Content-Encoding` of the whole payload starts an upload,
+ * `PATCH /resumable/{id}` with `Upload-Offset` sends the next piece and
+ * `HEAD /resumable/{id}` reports the offset to continue from. The payload
+ * is processed once the last piece arrived, read from its file rather than
+ * from memory. Uploads longer than [ResumableUploads.maxLength] are refused
+ * with `413`.
+ */
+fun Route.resumableUploadRoutes(handler: ImportHandler, uploads: ResumableUploads) {
+    post("/resumable") {
+        val length = call.request.headers[ResumableUploads.LENGTH_HEADER]?.toLongOrNull()?.takeIf { it > 0 }
+            ?: return@post call.respondText("${ResumableUploads.LENGTH_HEADER} is required", status = HttpStatusCode.BadRequest)
+        if (length > uploads.maxLength) {
+            return@post call.respondText(
+                "Resumable uploads may have at most ${uploads.maxLength} bytes",
+                status = HttpStatusCode.PayloadTooLarge,
+            )
+        }
+        val contentType = call.request.contentType()
+        if (UploadFormat.of(contentType) == null) {
+            return@post call.respondText(
+                "Unsupported Content-Type $contentType, expected one of ${UploadFormat.supported()}",
+                status = HttpStatusCode.UnsupportedMediaType,
+            )
+        }
+        val encoding = call.request.headers[HttpHeaders.ContentEncoding]
+        val unsupported = RequestEncoding.unsupported(encoding)
+        if (unsupported.isNotEmpty()) {
+            call.response.header(HttpHeaders.AcceptEncoding, RequestEncoding.ACCEPTED)
+            return@post call.respondText(
+                "Unsupported Content-Encoding ${unsupported.joinToString()}",
+                status = HttpStatusCode.UnsupportedMediaType,
+            )
+        }
+        val upload = uploads.create(contentType, encoding, length)
+        call.response.header(HttpHeaders.Location, "${call.request.path().trimEnd('/')}/${upload.id}")
+        call.response.header(ResumableUploads.OFFSET_HEADER, 0)
+        call.respondText(upload.id, status = HttpStatusCode.Created)
+    }
+    head("/resumable/{id}") {
+        val upload = uploads.get(call.parameters["id"]!!) ?: return@head call.respond(HttpStatusCode.NotFound)
+        call.response.header(ResumableUploads.OFFSET_HEADER, upload.offset)
+        call.response.header(ResumableUploads.LENGTH_HEADER, upload.length)
+        call.respond(HttpStatusCode.OK)
+    }
+    patch("/resumable/{id}") {
+        val upload = uploads.get(call.parameters["id"]!!)
+            ?: return@patch call.respondText("Unknown or expired upload", status = HttpStatusCode.NotFound)
+        val offset = call.request.headers[ResumableUploads.OFFSET_HEADER]?.toLongOrNull()
+            ?: return@patch call.respondText("${ResumableUploads.OFFSET_HEADER} is required", status = HttpStatusCode.BadRequest)
+        val piece = call.receive<ByteArray>()
+        if (!handler.verify(call, piece)) return@patch
+        // Refuse the last piece while the queue is full, so the client can send it again later.
+        if (offset + piece.size >= upload.length && !handler.admit(call)) return@patch
+        val next = uploads.append(upload, offset, piece)
+        if (next == null) {
+            call.response.header(ResumableUploads.OFFSET_HEADER, upload.offset)
+            return@patch call.respondText(
+                "Expected a piece at offset ${upload.offset} of at most ${upload.length - upload.offset} bytes",
+                status = HttpStatusCode.Conflict,
+            )
+        }
+        call.response.header(ResumableUploads.OFFSET_HEADER, next)
+        if (next < upload.length) return@patch call.respond(HttpStatusCode.NoContent)
+        uploads.complete(upload) { file -> handler.accept(call, file, upload.contentType, encoding = upload.encoding) }
+    }
+}
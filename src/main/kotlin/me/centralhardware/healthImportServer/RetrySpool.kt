@@ -0,0 +1,127 @@
+package me.centralhardware.healthImportServer
+
+import kotlinx.coroutines.CoroutineScope
+import kotlinx.coroutines.Dispatchers
+import kotlinx.coroutines.delay
+import kotlinx.coroutines.isActive
+import kotlinx.coroutines.launch
+import kotlinx.serialization.json.Json
+import me.centralhardware.healthImportServer.request.Export
+import org.slf4j.LoggerFactory
+import java.nio.file.Files
+import java.nio.file.Path
+import java.nio.file.StandardCopyOption
+import java.time.Duration
+import kotlin.io.path.listDirectoryEntries
+
+/**
+ * Keeps chunks that could not be written to ClickHouse in [dir], one JSON
+ * file per chunk, and writes them again every [interval] once the store
+ * answers a ping, oldest first. A chunk that still fails while the store is
+ * reachable is tried [maxAttempts] times, then moved to [deadLetters] for a
+ * look at what is wrong with it.
+ *
+ * Unlike [QueueSpill], the files are kept over restarts, so nothing is lost
+ * when ClickHouse is down while the server is restarted as well, provided
+ * `UPLOAD_SPOOL_DIR` is on a volume that outlives the process.
+ */
+class RetrySpool(
+    private val dir: Path,
+    private val interval: Duration,
+    private val maxAttempts: Int,
+    private val deadLetters: DeadLetters,
+) {
+    val log = LoggerFactory.getLogger(RetrySpool::class.java)
+    private val json = Json { ignoreUnknownKeys = true }
+    private val attempts = mutableMapOf<String, Int>()
+
+    init {
+        Files.createDirectories(dir)
+        pending().takeIf { it.isNotEmpty() }?.let { log.info("${it.size} chunk(s) left from a previous run are waiting to be written") }
+    }
+
+    /** Persists chunk [index] of upload [id], which failed to be written. */
+    fun write(id: String, index: Int, chunk: Export) {
+        val file = dir.resolve("%d-%s-%04d.json".format(System.currentTimeMillis(), id, index))
+        val temp = dir.resolve("${file.fileName}.tmp")
+        Files.writeString(temp, json.encodeToString(Export.serializer(), chunk))
+        Files.move(temp, file, StandardCopyOption.ATOMIC_MOVE)
+        log.warn("Spooled chunk ${index + 1} of upload $id to $file, it is written again once ClickHouse is reachable")
+    }
+
+    /** Files of the chunks waiting to be written, oldest first. */
+    fun pending(): List<Path> = dir.listDirectoryEntries("*.json").sortedBy { it.fileName.toString() }
+
+    /**
+     * Starts the loop that hands the waiting chunks to [replay], which
+     * returns why one failed again or null, while [ping] does not throw; it
+     * stops with [scope].
+     */
+    fun launch(scope: CoroutineScope, ping: () -> Unit, replay: (Export) -> Exception?) = scope.launch(Dispatchers.IO) {
+        while (isActive) {
+            delay(interval.toMillis())
+            val files = pending()
+            if (files.isEmpty()) continue
+            val down = runCatching(ping).exceptionOrNull()
+            if (down != null) {
+                log.info("ClickHouse is still not reachable (${down.message}), ${files.size} spooled chunk(s) waiting")
+                continue
+            }
+            log.info("Writing ${files.size} spooled chunk(s) again")
+            for (file in files) {
+                if (!retry(file, replay)) break
+            }
+        }
+    }
+
+    /** Replays [file] and returns false if the store failed, so the other chunks wait for the next round. */
+    private fun retry(file: Path, replay: (Export) -> Exception?): Boolean {
+        // Files are named <time>-<upload id>-<chunk>.json.
+        val upload = file.fileName.toString().removeSuffix(".json").substringAfter('-')
+        val chunk = try {
+            json.decodeFromString(Export.serializer(), Files.readString(file))
+        } catch (e: Exception) {
+            deadLetters.move(upload, file, e)
+            return true
+        }
+        val error = replay(chunk)
+        if (error == null) {
+            Files.deleteIfExists(file)
+            attempts.remove(file.fileName.toString())
+            log.info("Wrote spooled chunk $file")
+            return true
+        }
+        val attempt = attempts.merge(file.fileName.toString(), 1, Int::plus)!!
+        if (attempt >= maxAttempts) {
+            attempts.remove(file.fileName.toString())
+            deadLetters.write(upload, chunk, attempt, error)
+            Files.deleteIfExists(file)
+        }
+        return false
+    }
+
+    companion object {
+        /**
+         * Reads `RETRY_INTERVAL_SECONDS`, how often spooled chunks are tried
+         * again (default 60; `0` drops failed chunks as before), and
+         * `RETRY_MAX_ATTEMPTS` (default 20). The chunks are kept in `failed/`
+         * in `UPLOAD_SPOOL_DIR`.
+         */
+        fun fromEnv(): RetrySpool? {
+            val interval = Env.get("RETRY_INTERVAL_SECONDS")?.toLong() ?: 60
+            if (interval <= 0) return null
+            if (Env.get("UPLOAD_SPOOL_DIR") == null) {
+                LoggerFactory.getLogger(RetrySpool::class.java).warn(
+                    "UPLOAD_SPOOL_DIR is not set, chunks waiting to be written are kept in ${ResumableUploads.spoolDir()} " +
+                        "and lost if the temp directory is cleared or the container is recreated"
+                )
+            }
+            return RetrySpool(
+                ResumableUploads.spoolDir().resolve("failed"),
+                Duration.ofSeconds(interval),
+                Env.get("RETRY_MAX_ATTEMPTS")?.toInt() ?: 20,
+                DeadLetters.fromEnv(),
+            )
+        }
+    }
+}
@@ -1,29 +1,332 @@
 package me.centralhardware.healthImportServer
 
+import io.ktor.serialization.kotlinx.json.*
+import io.ktor.server.application.*
+import io.ktor.server.auth.*
 import io.ktor.server.engine.*
 import io.ktor.server.netty.*
+import io.ktor.http.*
+import io.ktor.server.plugins.BadRequestException
+import io.ktor.server.plugins.PayloadTooLargeException
+import io.ktor.server.plugins.contentnegotiation.*
+import io.ktor.server.plugins.statuspages.*
+import io.ktor.server.response.*
 import io.ktor.server.routing.*
+import io.micrometer.prometheusmetrics.PrometheusConfig
+import io.micrometer.prometheusmetrics.PrometheusMeterRegistry
+import kotlinx.coroutines.Dispatchers
+import kotlinx.coroutines.delay
+import kotlinx.coroutines.launch
+import me.centralhardware.healthImportServer.analytics.GapDetector
+import me.centralhardware.healthImportServer.analytics.HeartRateZones
+import me.centralhardware.healthImportServer.analytics.PersonalRecordTracker
+import me.centralhardware.healthImportServer.analytics.TrendSmoother
+import me.centralhardware.healthImportServer.api.ADMIN_AUTH
+import me.centralhardware.healthImportServer.api.ApiTokens
+import me.centralhardware.healthImportServer.api.AuthGuard
+import me.centralhardware.healthImportServer.api.AuthGuardPlugin
+import me.centralhardware.healthImportServer.api.ClientAddresses
+import me.centralhardware.healthImportServer.api.IpAllowlist
+import me.centralhardware.healthImportServer.api.IpAllowlistPlugin
+import me.centralhardware.healthImportServer.api.OIDC_ADMIN_AUTH
+import me.centralhardware.healthImportServer.api.OIDC_AUTH
+import me.centralhardware.healthImportServer.api.OidcConfig
+import me.centralhardware.healthImportServer.api.ReadOnlyQuery
+import me.centralhardware.healthImportServer.api.ResponseCache
+import me.centralhardware.healthImportServer.api.TokenRole
+import me.centralhardware.healthImportServer.api.UploadSignature
+import me.centralhardware.healthImportServer.api.adminBearer
+import me.centralhardware.healthImportServer.api.adminRoutes
+import me.centralhardware.healthImportServer.api.annotationRoutes
+import me.centralhardware.healthImportServer.api.attachmentRoutes
+import me.centralhardware.healthImportServer.api.attachmentUploadRoutes
+import me.centralhardware.healthImportServer.api.apiTokens
+import me.centralhardware.healthImportServer.api.authenticateWith
+import me.centralhardware.healthImportServer.api.correlationRoutes
+import me.centralhardware.healthImportServer.api.coverageRoutes
+import me.centralhardware.healthImportServer.api.oidc
+import me.centralhardware.healthImportServer.api.queryRoutes
+import me.centralhardware.healthImportServer.api.sampleRoutes
+import me.centralhardware.healthImportServer.api.schemaRoutes
+import me.centralhardware.healthImportServer.api.seriesRoutes
+import me.centralhardware.healthImportServer.api.sleepRoutes
+import me.centralhardware.healthImportServer.api.stateOfMindRoutes
+import me.centralhardware.healthImportServer.api.statsRoutes
+import me.centralhardware.healthImportServer.api.streamRoutes
+import me.centralhardware.healthImportServer.api.ecgRoutes
+import me.centralhardware.healthImportServer.api.todayRoutes
+import me.centralhardware.healthImportServer.dedup.InMemoryDedupCache
+import me.centralhardware.healthImportServer.dedup.RedisDedupCache
+import me.centralhardware.healthImportServer.dedup.SampleDeduplicator
+import me.centralhardware.healthImportServer.monitoring.FreshnessTracker
+import me.centralhardware.healthImportServer.monitoring.LatencySlo
+import me.centralhardware.healthImportServer.monitoring.LiveFeed
+import me.centralhardware.healthImportServer.monitoring.PipelineMetrics
+import me.centralhardware.healthImportServer.monitoring.UploadWatchdog
+import me.centralhardware.healthImportServer.notify.loadNotifier
+import me.centralhardware.healthImportServer.report.EmailReporter
+import me.centralhardware.healthImportServer.report.WeeklyReportBuilder
+import me.centralhardware.healthImportServer.request.RequestParser
+import me.centralhardware.healthImportServer.storage.AttachmentFiles
 import me.centralhardware.healthImportServer.storage.ClickHouseConfig
 import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import me.centralhardware.healthImportServer.storage.ColumnCipher
+import me.centralhardware.healthImportServer.storage.DayBoundary
+import me.centralhardware.healthImportServer.storage.EcgStorage
+import me.centralhardware.healthImportServer.storage.JsonlStore
+import me.centralhardware.healthImportServer.storage.KafkaPublisher
+import me.centralhardware.healthImportServer.storage.MqttPublisher
+import me.centralhardware.healthImportServer.storage.ParquetArchive
+import me.centralhardware.healthImportServer.storage.PostgresMetricStore
+import me.centralhardware.healthImportServer.storage.Retention
+import me.centralhardware.healthImportServer.storage.SqliteMetricStore
+import me.centralhardware.healthImportServer.storage.StoreRouter
+import me.centralhardware.healthImportServer.storage.UpstreamForwarder
+import me.centralhardware.healthImportServer.storage.VictoriaMetricsStore
+import me.centralhardware.healthImportServer.tools.DemoData
+import me.centralhardware.healthImportServer.tools.parseOptions
+import me.centralhardware.healthImportServer.tools.runCommand
+import me.centralhardware.healthImportServer.transform.CounterDeltas
+import me.centralhardware.healthImportServer.transform.HeartRateDownsampler
+import me.centralhardware.healthImportServer.transform.MetricDecimator
+import me.centralhardware.healthImportServer.transform.MetricRenamer
+import me.centralhardware.healthImportServer.transform.PayloadTransform
+import me.centralhardware.healthImportServer.transform.TimestampGuard
+import me.centralhardware.healthImportServer.transform.WorkoutEnergyOverlap
+
+fun main(arguments: Array<String>) {
+    // `--config <file>` may come with any of the others.
+    val args = Env.load(arguments.toList())
+    // `--demo [--days N]` serves synthetic data, everything else is a command.
+    val demo = args.firstOrNull() == "--demo"
+    if (args.isNotEmpty() && !demo) return runCommand(args)
+    EncryptedArchive.fromEnv()?.let { return runArchiveServer(it) }
+    PostgresMetricStore.fromEnv()?.let { return runPostgresServer(it) }
+    SqliteMetricStore.fromEnv()?.let { return runSqliteServer(it) }
+    ParquetArchive.fromEnv()?.let { return runParquetServer(it) }
+    KafkaPublisher.fromEnv()?.let { return runKafkaServer(it) }
+    VictoriaMetricsStore.fromEnv()?.let { return runVictoriaMetricsServer(it) }
+    JsonlStore.standaloneFromEnv()?.let { return runJsonlServer(it) }
+    UpstreamForwarder.fromEnv(listOfNotNull(TimestampGuard.fromEnv(), MetricRenamer.fromEnv(), HeartRateDownsampler.fromEnv()))
+        ?.let { return runProxyServer(it) }
 
-fun main() {
     val metricStore = loadMetricStore()
-    val handler = ImportHandler(metricStore)
+    val tracker = ImportTracker()
+    val registry = PrometheusMeterRegistry(PrometheusConfig.DEFAULT)
+    val freshness = FreshnessTracker(registry).also { it.seed(metricStore) }
+    val responseCache = ResponseCache.fromEnv()
+    val gaps = GapDetector.fromEnv(metricStore)
+    val live = LiveFeed()
+    val deduplicator = loadDeduplicator()
+    val handler = loadImportHandler(
+        metricStore, tracker, freshness, PipelineMetrics(registry), QueueSpill.fromEnv(), responseCache, gaps, live,
+        LatencySlo.fromEnv(registry, loadNotifier(metricStore.profiles)), deduplicator,
+    )
+    if (demo) DemoData.seed(metricStore, handler, parseOptions(args.drop(1))["days"]?.toInt() ?: 90)
+    val adminToken = Env.get("ADMIN_TOKEN")
+    val oidcConfig = OidcConfig.fromEnv()
+    val allowlist = IpAllowlist.fromEnv()
+    val authGuard = AuthGuard.fromEnv(loadNotifier(metricStore.profiles))
+    val tokens = ApiTokens.fromEnv(metricStore)
+    val uploadAuth = listOfNotNull(tokens?.let { TokenRole.UPLOAD.provider })
+    val apiAuth = listOfNotNull(oidcConfig?.let { OIDC_AUTH }, tokens?.let { TokenRole.READ.provider })
+    val adminAuth = listOfNotNull(
+        adminToken?.let { ADMIN_AUTH },
+        oidcConfig?.adminGroup?.let { OIDC_ADMIN_AUTH },
+        tokens?.let { TokenRole.ADMIN.provider },
+    )
+
+    val reporter = EmailReporter.fromEnv(WeeklyReportBuilder(metricStore))
+    val watchdog = UploadWatchdog.fromEnv(tracker, loadNotifier(metricStore.profiles))
+
+    val resumableUploads = ResumableUploads.fromEnv()
+    val attachments = AttachmentFiles.fromEnv()
+    val attachmentMaxBytes = (Env.get("ATTACHMENT_MAX_MB")?.toLong() ?: 50) * 1024 * 1024
 
-    embeddedServer(Netty, port = 8080) {
+    val addr = ListenAddress.fromEnv()
+    val paths = EndpointPaths.fromEnv()
+
+    embeddedServer(Netty, host = addr.host, port = addr.port) {
+        handler.launchWorkers(this)
+        resumableUploads.launch(this)
+        reporter?.let { launch { it.run() } }
+        if (demo) {
+            // Keeps today's and yesterday's demo data growing, so "today" views stay alive.
+            launch(Dispatchers.IO) {
+                while (true) {
+                    delay(3_600_000)
+                    DemoData.seed(metricStore, handler, 2)
+                }
+            }
+        }
+        watchdog?.let { launch { it.run() } }
+        launch(Dispatchers.IO) { Retention(metricStore).run() }
+        install(ContentNegotiation) {
+            json()
+        }
+        authGuard?.let { guard ->
+            install(AuthGuardPlugin) {
+                this.guard = guard
+                addresses = ClientAddresses.fromEnv()
+            }
+        }
+        if (adminToken != null || oidcConfig != null || tokens != null) {
+            install(Authentication) {
+                adminToken?.let { adminBearer(it) }
+                oidcConfig?.let { oidc(it) }
+                tokens?.let { apiTokens(it) }
+            }
+        }
+        install(StatusPages) {
+            exception<BadRequestException> { call, cause ->
+                call.respondText(cause.message ?: "Bad request", status = HttpStatusCode.BadRequest)
+            }
+            exception<PayloadTooLargeException> { call, cause ->
+                call.respondText(cause.message ?: "Payload too large", status = HttpStatusCode.PayloadTooLarge)
+            }
+        }
         routing {
-            post("/upload") {
-                handler.handle(call)
+            route(paths.upload) {
+                allowlist?.let { install(IpAllowlistPlugin) { this.allowlist = it } }
+                authenticateWith(uploadAuth) {
+                    post {
+                        handler.handle(call)
+                    }
+                    resumableUploadRoutes(handler, resumableUploads)
+                    manualEntryRoutes(handler, metricStore)
+                    attachments?.let { attachmentUploadRoutes(metricStore, it, attachmentMaxBytes, handler::verify) }
+                }
+            }
+            // Shows upload ids and devices, so it needs a read or admin token once either is configured.
+            authenticateWith(apiAuth + adminAuth) {
+                get(paths.status) {
+                    call.respond(tracker.snapshot())
+                }
+            }
+            // Lists what real payloads contain, so it is only shown to admins.
+            if (adminAuth.isNotEmpty()) {
+                authenticateWith(adminAuth) {
+                    get("${paths.status}/unknown-fields") {
+                        call.respond(RequestParser.unknownFields())
+                    }
+                }
+            }
+            get(paths.metrics) {
+                call.respondText(registry.scrape(), ContentType.parse("text/plain; version=0.0.4"))
+            }
+            get(paths.health) {
+                try {
+                    metricStore.ping()
+                    call.respondText("ok")
+                } catch (e: Exception) {
+                    call.application.log.warn("Health check failed", e)
+                    call.respondText("clickhouse unavailable", status = HttpStatusCode.ServiceUnavailable)
+                }
+            }
+            route(paths.api) {
+                authenticateWith(apiAuth) {
+                    correlationRoutes(metricStore, responseCache)
+                    todayRoutes(metricStore)
+                    ecgRoutes(metricStore)
+                    statsRoutes(metricStore, responseCache)
+                    schemaRoutes(metricStore)
+                    sampleRoutes(metricStore)
+                    seriesRoutes(metricStore, responseCache)
+                    sleepRoutes(metricStore, responseCache)
+                    stateOfMindRoutes(metricStore)
+                    annotationRoutes(metricStore)
+                    attachments?.let { attachmentRoutes(metricStore, it) }
+                    coverageRoutes(metricStore, gaps, responseCache)
+                    streamRoutes(live)
+                }
+                // Never without authentication, unlike the rest of the query API.
+                if (metricStore.queriesEnabled && (apiAuth.isNotEmpty() || adminAuth.isNotEmpty())) {
+                    authenticateWith(apiAuth + adminAuth) {
+                        queryRoutes(metricStore, ReadOnlyQuery.fromEnv())
+                    }
+                }
+            }
+            if (adminAuth.isNotEmpty()) {
+                route(paths.admin) {
+                    allowlist?.let { install(IpAllowlistPlugin) { this.allowlist = it } }
+                    adminRoutes(
+                        metricStore, PersonalRecordTracker(metricStore, loadNotifier(metricStore.profiles)), adminAuth, responseCache,
+                        attachments, deduplicator,
+                    )
+                }
             }
         }
     }.start(wait = true)
 }
 
 fun loadMetricStore(): ClickHouseMetricStore {
-    val dsn = System.getenv("CLICKHOUSE_DSN")
+    val dsn = Env.get("CLICKHOUSE_DSN")
         ?: error("CLICKHOUSE_DSN must be set")
-    val db = System.getenv("CLICKHOUSE_DATABASE")
+    val db = Env.get("CLICKHOUSE_DATABASE")
         ?: error("CLICKHOUSE_DATABASE must be set")
-    return ClickHouseMetricStore(ClickHouseConfig(dsn, db))
+    val ecgStorage = Env.get("ECG_STORAGE")?.let { EcgStorage.valueOf(it.uppercase()) } ?: EcgStorage.ARRAY
+    val insertSettings = Env.get("CLICKHOUSE_INSERT_SETTINGS")?.let { ClickHouseConfig.parseSettings(it) } ?: emptyMap()
+    val settings = Env.get("CLICKHOUSE_SETTINGS")?.let { ClickHouseConfig.parseSettings(it) } ?: emptyMap()
+    val config = ClickHouseConfig(
+        dsn = dsn,
+        database = db,
+        ecgStorage = ecgStorage,
+        insertSettings = insertSettings,
+        secure = Env.get("CLICKHOUSE_SECURE")?.toBoolean() ?: false,
+        settings = settings,
+        optimize = Env.get("CLICKHOUSE_OPTIMIZE")?.toBoolean() ?: true,
+        ddl = Env.get("CLICKHOUSE_DDL")?.toBoolean() ?: true,
+        metricTables = Env.get("CLICKHOUSE_METRIC_TABLES")?.let { ClickHouseConfig.parsePairs(it) } ?: emptyMap(),
+        insertParallelism = Env.get("CLICKHOUSE_INSERT_PARALLELISM")?.toInt() ?: 4,
+        deduplication = Env.get("CLICKHOUSE_DEDUP")?.let { ClickHouseConfig.parseDeduplication(it) } ?: emptyMap(),
+        dayBoundary = DayBoundary.fromEnv(),
+        queryUser = Env.get("CLICKHOUSE_QUERY_USER"),
+        queryPassword = Env.get("CLICKHOUSE_QUERY_PASSWORD"),
+    )
+    return ClickHouseMetricStore(config, HeartRateZones.fromEnv(), ColumnCipher.fromEnv())
+}
+
+fun loadImportHandler(
+    metricStore: ClickHouseMetricStore,
+    tracker: ImportTracker,
+    freshness: FreshnessTracker? = null,
+    pipelineMetrics: PipelineMetrics? = null,
+    spill: QueueSpill? = null,
+    responseCache: ResponseCache? = null,
+    gaps: GapDetector? = null,
+    live: LiveFeed? = null,
+    latency: LatencySlo? = null,
+    deduplicator: SampleDeduplicator? = loadDeduplicator(),
+): ImportHandler {
+    val maxChunkRows = Env.get("MAX_CHUNK_ROWS")?.toInt() ?: 10_000
+    val recordTracker = PersonalRecordTracker(metricStore, loadNotifier(metricStore.profiles))
+    val trendSmoother = TrendSmoother.fromEnv(metricStore)
+    val workers = Env.get("IMPORT_WORKERS")?.toInt() ?: 2
+    val maxQueued = Env.get("IMPORT_QUEUE_SIZE")?.toInt() ?: 0
+    return ImportHandler(
+        metricStore, maxChunkRows, tracker, deduplicator, recordTracker, trendSmoother, loadTransforms(metricStore),
+        UploadSignature.fromEnv(), freshness, pipelineMetrics, workers, spill, responseCache, gaps, maxQueued,
+        MqttPublisher.fromEnv(metricStore), JsonlStore.fromEnv(), live, StoreRouter.fromEnv(::loadMetricStore), latency,
+        RetrySpool.fromEnv(),
+    )
 }
 
+fun loadTransforms(metricStore: ClickHouseMetricStore): List<PayloadTransform> = listOfNotNull(
+    TimestampGuard.fromEnv(),
+    MetricRenamer.fromEnv(),
+    MetricDecimator.fromEnv(metricStore),
+    CounterDeltas.fromEnv(metricStore),
+    WorkoutEnergyOverlap.fromEnv(metricStore),
+    HeartRateDownsampler.fromEnv(),
+)
+
+fun loadDeduplicator(): SampleDeduplicator? {
+    val redisUrl = Env.get("DEDUP_REDIS_URL")
+    if (redisUrl != null) {
+        val ttlHours = Env.get("DEDUP_TTL_HOURS")?.toLong() ?: 48
+        return SampleDeduplicator(RedisDedupCache(redisUrl, ttlHours * 3600))
+    }
+    // Off unless asked for, as it changes which samples of a resent upload are written.
+    val size = Env.get("DEDUP_CACHE_SIZE")?.toInt() ?: 0
+    return if (size > 0) SampleDeduplicator(InMemoryDedupCache(size)) else null
+}
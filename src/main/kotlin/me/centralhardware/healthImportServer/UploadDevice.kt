@@ -0,0 +1,57 @@
+package me.centralhardware.healthImportServer
+
+import io.ktor.http.Headers
+import io.ktor.http.HttpHeaders
+import kotlinx.serialization.Serializable
+import java.net.URLDecoder
+
+/**
+ * The phone or watch an upload came from, kept with the import to tell why
+ * payloads of two devices differ. Auto Export sends none of this by itself;
+ * set its custom headers to e.g. `X-Device-Model: Apple Watch Series 9`,
+ * `X-OS-Version: watchOS 11.2` and `X-Battery-Level: 80`. Multipart uploads
+ * may send the same as the form fields `device_model`, `os_version`,
+ * `app_version` and `battery_level`. Without `X-App-Version` the app and
+ * version are taken from the `User-Agent`.
+ */
+@Serializable
+data class UploadDevice(
+    val model: String? = null,
+    val osVersion: String? = null,
+    val appVersion: String? = null,
+    /** Battery charge in percent. */
+    val batteryLevel: Double? = null,
+) {
+    companion object {
+        const val MODEL_HEADER = "X-Device-Model"
+        const val OS_VERSION_HEADER = "X-OS-Version"
+        const val APP_VERSION_HEADER = "X-App-Version"
+        const val BATTERY_HEADER = "X-Battery-Level"
+
+        /** What [headers] and the form fields [metadata] tell about the device, or null if nothing. */
+        fun of(headers: Headers, metadata: Map<String, String> = emptyMap()): UploadDevice? {
+            fun value(header: String, field: String) = (headers[header] ?: metadata[field])?.trim()?.takeIf { it.isNotEmpty() }
+            val device = UploadDevice(
+                model = value(MODEL_HEADER, "device_model"),
+                osVersion = value(OS_VERSION_HEADER, "os_version"),
+                appVersion = value(APP_VERSION_HEADER, "app_version") ?: headers[HttpHeaders.UserAgent]?.let(::app),
+                batteryLevel = value(BATTERY_HEADER, "battery_level")?.let(::battery),
+            )
+            return device.takeUnless { it == UploadDevice() }
+        }
+
+        /** The first product of a `User-Agent` such as `Health%20Auto%20Export/7.2 CFNetwork/1568 Darwin/24.1.0`. */
+        private fun app(userAgent: String): String? {
+            val product = userAgent.trim().substringBefore(' ').takeIf { it.contains('/') } ?: return null
+            val name = runCatching { URLDecoder.decode(product.substringBefore('/'), Charsets.UTF_8) }.getOrNull() ?: return null
+            return "$name ${product.substringAfter('/')}".trim()
+        }
+
+        /** Percent from `80`, `80%` or `0.8`; null if it is none of these. */
+        private fun battery(value: String): Double? {
+            val level = value.removeSuffix("%").trim().toDoubleOrNull() ?: return null
+            val percent = if ('.' in value && level <= 1 && !value.endsWith("%")) level * 100 else level
+            return percent.takeIf { it in 0.0..100.0 }
+        }
+    }
+}
@@ -0,0 +1,63 @@
+package me.centralhardware.healthImportServer
+
+import kotlinx.serialization.Serializable
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.Sample
+import me.centralhardware.healthImportServer.request.Timestamps
+
+/**
+ * What the server made of an upload, echoed in the response so a payload
+ * can be checked from the response viewer of Auto Export. A metric is
+ * recognized if at least one of its samples has a timestamp and a value the
+ * server stores; [unknownMetrics] sent samples, but none of them usable.
+ * [samplesSkipped] counts the samples without a timestamp or value, and
+ * those dropped by the payload transforms, e.g. for timestamps out of range.
+ * Samples a transform drops on purpose, such as `METRIC_SAMPLING_SECONDS`
+ * lowering the resolution, are not counted.
+ */
+@Serializable
+data class UploadDiagnostics(
+    val recognizedMetrics: Int,
+    val unknownMetrics: List<String>,
+    val samplesSkipped: Int,
+    val unknownFields: List<String>,
+    val warnings: Int,
+) {
+    fun describe(): String {
+        val parts = mutableListOf("$recognizedMetrics metrics recognized")
+        if (unknownMetrics.isNotEmpty()) parts += "${unknownMetrics.size} without usable samples (${unknownMetrics.joinToString()})"
+        if (samplesSkipped > 0) parts += "$samplesSkipped samples skipped"
+        if (unknownFields.isNotEmpty()) parts += "${unknownFields.size} unknown fields (${unknownFields.joinToString()})"
+        return "Diagnostics: ${parts.joinToString()}, $warnings warnings."
+    }
+
+    companion object {
+        /** Unknown fields listed at most, so the response stays readable on a phone. */
+        private const val MAX_LISTED = 10
+
+        /**
+         * Diagnoses [export] as parsed, given the [prepared] chunks left of it
+         * after the payload transforms, which dropped [reduced] samples on purpose.
+         */
+        fun of(export: Export, prepared: Collection<Export>, unknownFields: Set<String>, reduced: Int = 0): UploadDiagnostics {
+            val usable = export.populatedMetrics().associate { metric -> metric.name to metric.data.count(::isUsable) }
+            val unusable = export.totalSamples() - usable.values.sum()
+            val left = prepared.sumOf { chunk -> chunk.metrics.sumOf { metric -> metric.data.count(::isUsable) } }
+            val transformed = (usable.values.sum() - left - reduced).coerceAtLeast(0)
+            val unknownMetrics = usable.filterValues { it == 0 }.keys.toList()
+            return UploadDiagnostics(
+                recognizedMetrics = usable.count { it.value > 0 },
+                unknownMetrics = unknownMetrics,
+                samplesSkipped = unusable + transformed,
+                unknownFields = unknownFields.take(MAX_LISTED),
+                warnings = unknownMetrics.size + unknownFields.size + (if (unusable + transformed > 0) 1 else 0),
+            )
+        }
+
+        private fun isUsable(s: Sample): Boolean {
+            if (Timestamps.parseOrNull(s.date ?: s.startDate) == null) return false
+            return listOf(s.qty, s.avg, s.min, s.max, s.asleep, s.inBed, s.core, s.deep, s.rem, s.awake).any { it != null } ||
+                s.value != null
+        }
+    }
+}
@@ -0,0 +1,77 @@
+package me.centralhardware.healthImportServer
+
+import io.ktor.http.ContentType
+import me.centralhardware.healthImportServer.migrate.AppleHealthXml
+import me.centralhardware.healthImportServer.migrate.FitDecoder
+import me.centralhardware.healthImportServer.migrate.GpxDecoder
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.HealthAutoExportCsv
+import me.centralhardware.healthImportServer.request.ParseResult
+import me.centralhardware.healthImportServer.request.RequestParser
+import me.centralhardware.healthImportServer.request.Workout
+import java.io.InputStream
+import java.util.zip.GZIPInputStream
+
+/**
+ * Payload formats accepted on the upload endpoint, picked by `Content-Type`.
+ * Uploads without a `Content-Type` are read as JSON.
+ */
+enum class UploadFormat(
+    val contentTypes: List<ContentType>,
+    /** File name extensions, for multipart file parts sent as `application/octet-stream`. */
+    private val extensions: List<String>,
+    /**
+     * Reads the decoded body; streaming parsers never hold the whole text in
+     * memory, and formats that inflate it are capped like a `Content-Encoding`.
+     */
+    private val parser: (InputStream) -> ParseResult,
+) {
+    JSON(listOf(ContentType.Application.Json), listOf("json"), { RequestParser.parse(it) }),
+    GZIP_JSON(
+        listOf(ContentType.Application.GZip, ContentType("application", "x-gzip")),
+        listOf("gz"),
+        { RequestParser.parse(RequestEncoding.limit(GZIPInputStream(it))) },
+    ),
+    CSV(
+        listOf(ContentType.Text.CSV),
+        listOf("csv"),
+        { ParseResult(HealthAutoExportCsv.parse(it.readBytes().decodeToString()).normalized()) },
+    ),
+    APPLE_HEALTH_XML(listOf(ContentType.Application.Xml, ContentType.Text.Xml), listOf("xml"), { ParseResult(AppleHealthXml.parse(it).normalized()) }),
+    APPLE_HEALTH_ARCHIVE(
+        listOf(ContentType.Application.Zip),
+        listOf("zip"),
+        { ParseResult(AppleHealthXml.parseArchive(it, RequestEncoding.maxDecompressedBytes).normalized()) },
+    ),
+    GPX(
+        listOf(ContentType("application", "gpx+xml")),
+        listOf("gpx"),
+        { ParseResult(workout(GpxDecoder.decode(it.readBytes(), "upload"))) },
+    ),
+    FIT(
+        listOf(ContentType("application", "vnd.ant.fit"), ContentType("application", "fit")),
+        listOf("fit"),
+        { ParseResult(workout(FitDecoder.decode(it.readBytes(), "upload"))) },
+    );
+
+    fun parse(body: InputStream): ParseResult = body.use(parser)
+
+    /** Extension for a file holding a payload of this format. */
+    val fileExtension: String get() = extensions.first()
+
+    companion object {
+        /** The format of [contentType], or null if it is not supported. */
+        fun of(contentType: ContentType): UploadFormat? {
+            if (contentType == ContentType.Any) return JSON
+            return entries.firstOrNull { format -> format.contentTypes.any { contentType.match(it) } }
+        }
+
+        fun ofFileName(name: String): UploadFormat? =
+            entries.firstOrNull { name.substringAfterLast('.').lowercase() in it.extensions }
+
+        fun supported(): String = entries.flatMap { it.contentTypes }.joinToString()
+    }
+}
+
+private fun workout(workout: Workout?): Export =
+    Export(workouts = listOfNotNull(workout?.sortedChronologically()))
@@ -0,0 +1,189 @@
+package me.centralhardware.healthImportServer
+
+import io.ktor.http.ContentType
+import io.ktor.http.HttpHeaders
+import io.ktor.http.HttpStatusCode
+import io.ktor.server.application.install
+import io.ktor.server.auth.Authentication
+import io.ktor.server.engine.embeddedServer
+import io.ktor.server.netty.Netty
+import io.ktor.server.plugins.BadRequestException
+import io.ktor.server.plugins.UnsupportedMediaTypeException
+import io.ktor.server.request.contentType
+import io.ktor.server.request.receive
+import io.ktor.server.response.respondText
+import io.ktor.server.routing.get
+import io.ktor.server.routing.post
+import io.ktor.server.routing.route
+import io.ktor.server.routing.routing
+import kotlinx.coroutines.Dispatchers
+import kotlinx.coroutines.withContext
+import me.centralhardware.healthImportServer.api.ApiTokens
+import me.centralhardware.healthImportServer.api.AuthGuard
+import me.centralhardware.healthImportServer.api.AuthGuardPlugin
+import me.centralhardware.healthImportServer.api.ClientAddresses
+import me.centralhardware.healthImportServer.api.IpAllowlist
+import me.centralhardware.healthImportServer.api.IpAllowlistPlugin
+import me.centralhardware.healthImportServer.api.TokenRole
+import me.centralhardware.healthImportServer.api.UploadSignature
+import me.centralhardware.healthImportServer.api.apiTokens
+import me.centralhardware.healthImportServer.api.authenticateWith
+import me.centralhardware.healthImportServer.notify.loadNotifier
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.storage.JsonlStore
+import me.centralhardware.healthImportServer.storage.KafkaPublisher
+import me.centralhardware.healthImportServer.storage.ParquetArchive
+import me.centralhardware.healthImportServer.storage.PostgresMetricStore
+import me.centralhardware.healthImportServer.storage.SqliteMetricStore
+import me.centralhardware.healthImportServer.storage.UpstreamForwarder
+import me.centralhardware.healthImportServer.storage.VictoriaMetricsStore
+import org.slf4j.LoggerFactory
+
+/**
+ * Runs a server with only the upload and health endpoints, for the modes
+ * that do not write to ClickHouse. `ALLOWED_NETWORKS`, `API_TOKENS`,
+ * `UPLOAD_SIGNING_KEY` and the lockout of failed authentications apply as
+ * usual. [accept] gets every verified upload with its `Content-Type` and
+ * `Content-Encoding` and returns the response text; [health] throws if
+ * the backend cannot be reached, and only the log tells why.
+ */
+fun runUploadServer(
+    accept: suspend (body: ByteArray, contentType: ContentType, encoding: String?) -> String,
+    health: () -> Unit = {},
+) {
+    val log = LoggerFactory.getLogger("me.centralhardware.healthImportServer.UploadServer")
+    val addr = ListenAddress.fromEnv()
+    val paths = EndpointPaths.fromEnv()
+    val allowlist = IpAllowlist.fromEnv()
+    val tokens = ApiTokens.fromEnv(null)
+    val signature = UploadSignature.fromEnv()
+    val authGuard = AuthGuard.fromEnv(loadNotifier())
+
+    embeddedServer(Netty, host = addr.host, port = addr.port) {
+        authGuard?.let { guard ->
+            install(AuthGuardPlugin) {
+                this.guard = guard
+                addresses = ClientAddresses.fromEnv()
+            }
+        }
+        tokens?.let { install(Authentication) { apiTokens(it) } }
+        routing {
+            route(paths.upload) {
+                allowlist?.let { install(IpAllowlistPlugin) { this.allowlist = it } }
+                authenticateWith(listOfNotNull(tokens?.let { TokenRole.UPLOAD.provider })) {
+                    post {
+                        val body = call.receive<ByteArray>()
+                        if (signature != null) {
+                            val headers = call.request.headers
+                            val error = signature.verify(
+                                headers[UploadSignature.TIMESTAMP_HEADER], headers[UploadSignature.SIGNATURE_HEADER], body,
+                            )
+                            if (error != null) {
+                                log.warn("Rejected upload: $error")
+                                return@post call.respondText(error, status = HttpStatusCode.Unauthorized)
+                            }
+                            call.attributes.put(UploadSignature.VERIFIED, Unit)
+                        }
+                        val contentType = call.request.contentType().takeUnless { it == ContentType.Any } ?: ContentType.Application.Json
+                        call.respondText(accept(body, contentType, call.request.headers[HttpHeaders.ContentEncoding]))
+                    }
+                }
+            }
+            get(paths.health) {
+                try {
+                    health()
+                    call.respondText("ok")
+                } catch (e: Exception) {
+                    log.warn("Health check failed", e)
+                    call.respondText("unavailable", status = HttpStatusCode.ServiceUnavailable)
+                }
+            }
+        }
+    }.start(wait = true)
+}
+
+/**
+ * Runs the server for a PostgreSQL installation: uploads are parsed and
+ * written to [store] before the response, payload transforms and the query
+ * API are not available.
+ */
+fun runPostgresServer(store: PostgresMetricStore) = runUploadServer(
+    accept = { body, contentType, encoding ->
+        val export = parseUpload(body, contentType, encoding)
+        stored(withContext(Dispatchers.IO) { store.store(export) })
+    },
+    health = store::ping,
+)
+
+/** Like [runPostgresServer], for an SQLite file. */
+fun runSqliteServer(store: SqliteMetricStore) = runUploadServer(
+    accept = { body, contentType, encoding ->
+        val export = parseUpload(body, contentType, encoding)
+        stored(withContext(Dispatchers.IO) { store.store(export) })
+    },
+    health = store::ping,
+)
+
+/** Like [runPostgresServer], appending to Parquet files. */
+fun runParquetServer(archive: ParquetArchive) = runUploadServer(
+    accept = { body, contentType, encoding ->
+        val export = parseUpload(body, contentType, encoding)
+        stored(withContext(Dispatchers.IO) { archive.store(export) })
+    },
+    health = archive::ping,
+)
+
+/** Like [runPostgresServer], publishing to Kafka. */
+fun runKafkaServer(publisher: KafkaPublisher) = runUploadServer(
+    accept = { body, contentType, encoding ->
+        val export = parseUpload(body, contentType, encoding)
+        "Published " + withContext(Dispatchers.IO) { publisher.store(export) }.entries
+            .joinToString { (topic, count) -> "$count messages to $topic" } + "."
+    },
+    health = publisher::ping,
+)
+
+/** Like [runPostgresServer], appending to JSON lines files. */
+fun runJsonlServer(store: JsonlStore) = runUploadServer(
+    accept = { body, contentType, encoding ->
+        val export = parseUpload(body, contentType, encoding)
+        stored(withContext(Dispatchers.IO) { store.store(export) })
+    },
+    health = store::ping,
+)
+
+/** Like [runPostgresServer], forwarding the selected part of every upload to another server. */
+fun runProxyServer(forwarder: UpstreamForwarder) = runUploadServer(
+    accept = { body, contentType, encoding ->
+        val export = parseUpload(body, contentType, encoding)
+        val forwarded = withContext(Dispatchers.IO) { forwarder.forward(export) }
+        "Forwarded ${forwarded.totalSamples()} of ${export.totalSamples()} samples, ${forwarded.workouts.size} workouts, " +
+            "${forwarded.stateOfMind.size} state of mind entries and ${forwarded.ecg.size} ECG recordings."
+    },
+    health = forwarder::ping,
+)
+
+/** Like [runPostgresServer], pushing to VictoriaMetrics. */
+fun runVictoriaMetricsServer(store: VictoriaMetricsStore) = runUploadServer(
+    accept = { body, contentType, encoding ->
+        val export = parseUpload(body, contentType, encoding)
+        "Imported " + withContext(Dispatchers.IO) { store.store(export) }.entries
+            .joinToString { (metric, count) -> "$count $metric points" } + "."
+    },
+    health = store::ping,
+)
+
+private fun parseUpload(body: ByteArray, contentType: ContentType, encoding: String?): Export {
+    val format = UploadFormat.of(contentType) ?: throw UnsupportedMediaTypeException(contentType)
+    val unsupported = RequestEncoding.unsupported(encoding)
+    if (unsupported.isNotEmpty()) throw BadRequestException("Unsupported Content-Encoding ${unsupported.joinToString()}")
+    return try {
+        format.parse(RequestEncoding.decode(body, encoding ?: RequestEncoding.sniff(body).takeIf { format == UploadFormat.JSON })).export
+    } catch (e: Exception) {
+        RequestEncoding.tooLarge(e)?.let { throw it }
+        throw BadRequestException("Invalid ${format.name.lowercase()} upload: ${e.message}", e)
+    }
+}
+
+private fun stored(rows: Map<String, Int>): String =
+    "Stored " + rows.entries.joinToString { (table, count) -> "$count rows in $table" } + "."
@@ -0,0 +1,106 @@
+package me.centralhardware.healthImportServer.analytics
+
+import kotlinx.serialization.Serializable
+import java.time.LocalDate
+import java.time.temporal.ChronoUnit
+
+/**
+ * Which days of a range have data for a metric, and where it is missing.
+ * Days before the first sample are not a gap, the metric may simply not
+ * have been recorded yet; missing days at the end of the range are, as
+ * that is what a sync that silently stopped looks like. A metric without
+ * any data in the range is one gap over all of it.
+ */
+object Coverage {
+
+    /**
+     * [days] are the sorted days with data. A gap is at least [minGapDays]
+     * days long, and longer than three times the usual spacing of the
+     * metric, so a weekly weigh-in does not report a gap every week.
+     */
+    fun of(metric: String, days: List<LocalDate>, from: LocalDate, to: LocalDate, minGapDays: Int): MetricCoverage {
+        val ranges = mutableListOf<DateRange>()
+        val gaps = mutableListOf<DateRange>()
+        var rangeStart: LocalDate? = null
+        var previous: LocalDate? = null
+        for (day in days) {
+            if (previous == null || day != previous.plusDays(1)) {
+                if (previous != null) ranges += range(rangeStart!!, previous)
+                rangeStart = day
+            }
+            previous = day
+        }
+        if (previous != null) ranges += range(rangeStart!!, previous)
+
+        val spacing = days.zipWithNext { a, b -> ChronoUnit.DAYS.between(a, b) }.sorted().let { it.getOrNull(it.size / 2) } ?: 1
+        val minimum = maxOf(minGapDays.toLong(), 3 * spacing - 1)
+        fun gap(start: LocalDate, end: LocalDate) {
+            if (!end.isBefore(start) && ChronoUnit.DAYS.between(start, end) + 1 >= minimum) gaps += range(start, end)
+        }
+        ranges.zipWithNext { a, b -> gap(LocalDate.parse(a.to).plusDays(1), LocalDate.parse(b.from).minusDays(1)) }
+        ranges.lastOrNull()?.let { gap(LocalDate.parse(it.to).plusDays(1), to) } ?: gap(from, to)
+
+        val total = ChronoUnit.DAYS.between(from, to) + 1
+        return MetricCoverage(
+            metric = metric,
+            first = days.firstOrNull()?.toString(),
+            last = days.lastOrNull()?.toString(),
+            daysWithData = days.size,
+            coverage = if (total > 0) days.size.toDouble() / total else 0.0,
+            ranges = ranges,
+            gaps = gaps,
+        )
+    }
+
+    /**
+     * The gaps of [coverages] as ranges to export again, overlapping and
+     * adjacent gaps of different metrics joined into one range.
+     */
+    fun missing(coverages: List<MetricCoverage>): List<MissingRange> {
+        val gaps = coverages
+            .flatMap { c -> c.gaps.map { Triple(LocalDate.parse(it.from), LocalDate.parse(it.to), c.metric) } }
+            .sortedBy { it.first }
+        val ranges = mutableListOf<MissingRange>()
+        var current: Pair<LocalDate, LocalDate>? = null
+        val metrics = sortedSetOf<String>()
+        fun flush() {
+            current?.let { ranges += MissingRange(it.first.toString(), it.second.toString(), metrics.toList()) }
+            metrics.clear()
+        }
+        for ((from, to, metric) in gaps) {
+            val open = current
+            if (open != null && !from.isAfter(open.second.plusDays(1))) {
+                current = open.first to maxOf(open.second, to)
+            } else {
+                flush()
+                current = from to to
+            }
+            metrics += metric
+        }
+        flush()
+        return ranges
+    }
+
+    private fun range(from: LocalDate, to: LocalDate) =
+        DateRange(from.toString(), to.toString(), (ChronoUnit.DAYS.between(from, to) + 1).toInt())
+}
+
+@Serializable
+data class DateRange(val from: String, val to: String, val days: Int)
+
+@Serializable
+data class MetricCoverage(
+    val metric: String,
+    val first: String?,
+    val last: String?,
+    val daysWithData: Int,
+    /** Share of the days of the requested range with data. */
+    val coverage: Double,
+    /** Runs of consecutive days with data. */
+    val ranges: List<DateRange>,
+    val gaps: List<DateRange>,
+)
+
+/** Days to export again because at least one of [metrics] has no data on them. */
+@Serializable
+data class MissingRange(val from: String, val to: String, val metrics: List<String>)
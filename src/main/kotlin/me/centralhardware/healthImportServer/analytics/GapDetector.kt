@@ -0,0 +1,79 @@
+package me.centralhardware.healthImportServer.analytics
+
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.Timestamps
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import java.time.Duration
+import java.time.Instant
+import java.time.LocalDate
+
+/**
+ * Finds the days of the last [lookbackDays] days that [metrics] (all stored
+ * metrics if empty) have no data for, as ranges a client can export again.
+ * The stored days are read from ClickHouse at most every [maxAge] and kept
+ * up to date with the chunks passed to [stored] in between, so answering an
+ * upload rarely waits for a query.
+ */
+class GapDetector(
+    private val store: ClickHouseMetricStore,
+    private val lookbackDays: Int,
+    private val metrics: List<String> = emptyList(),
+    private val minGapDays: Int = 2,
+    private val maxAge: Duration = Duration.ofMinutes(5),
+) {
+    /** Days with data per metric from [from] to [today], as read at [loadedAt]. */
+    private class StoredDays(val from: LocalDate, val today: LocalDate, val days: MutableMap<String, MutableSet<LocalDate>>, val loadedAt: Instant)
+
+    private var cached: StoredDays? = null
+
+    /** Missing ranges, not counting days that [pending], an upload not stored yet, has data for. */
+    fun missing(pending: Export = Export(), today: LocalDate = store.days.today()): List<MissingRange> {
+        val from = today.minusDays(lookbackDays - 1L)
+        val days = storedDays(from, today).mapValuesTo(mutableMapOf()) { it.value.toMutableSet() }
+        metrics.forEach { days.getOrPut(it) { mutableSetOf() } }
+        add(days, pending, from, today)
+        return Coverage.missing(days.map { (metric, d) -> Coverage.of(metric, d.sorted(), from, today, minGapDays) })
+    }
+
+    /** Counts the days of [export], which was just written, as stored until the days are read again. */
+    @Synchronized
+    fun stored(export: Export) {
+        val cached = cached ?: return
+        add(cached.days, export, cached.from, cached.today)
+    }
+
+    /** A copy of the cached days, read again once they are older than [maxAge] or of another day. */
+    @Synchronized
+    private fun storedDays(from: LocalDate, today: LocalDate): Map<String, Set<LocalDate>> {
+        val current = cached?.takeIf { it.today == today && Duration.between(it.loadedAt, Instant.now()) < maxAge }
+            ?: StoredDays(from, today, store.metricDays(metrics, from, today).mapValuesTo(mutableMapOf()) { it.value.toMutableSet() }, Instant.now())
+                .also { cached = it }
+        return current.days.mapValues { it.value.toSet() }
+    }
+
+    private fun add(days: MutableMap<String, MutableSet<LocalDate>>, export: Export, from: LocalDate, today: LocalDate) {
+        for (metric in export.metrics) {
+            if (metrics.isNotEmpty() && metric.name !in metrics) continue
+            for (sample in metric.data) {
+                val day = Timestamps.parseOrNull(sample.date ?: sample.startDate)?.let { store.days.of(it) }
+                if (day != null && day in from..today) days.getOrPut(metric.name) { mutableSetOf() } += day
+            }
+        }
+    }
+
+    companion object {
+        /**
+         * Reads `GAP_LOOKBACK_DAYS` (default 30), `GAP_METRICS` (comma
+         * separated), `GAP_MIN_DAYS` (default 2) and `GAP_CACHE_SECONDS`
+         * (default 300).
+         */
+        fun fromEnv(store: ClickHouseMetricStore): GapDetector = GapDetector(
+            store,
+            lookbackDays = Env.get("GAP_LOOKBACK_DAYS")?.toInt() ?: 30,
+            metrics = Env.get("GAP_METRICS")?.split(",")?.map { it.trim() }?.filter { it.isNotEmpty() } ?: emptyList(),
+            minGapDays = Env.get("GAP_MIN_DAYS")?.toInt() ?: 2,
+            maxAge = Duration.ofSeconds(Env.get("GAP_CACHE_SECONDS")?.toLong() ?: 300),
+        )
+    }
+}
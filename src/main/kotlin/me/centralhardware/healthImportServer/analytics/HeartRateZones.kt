@@ -0,0 +1,65 @@
+package me.centralhardware.healthImportServer.analytics
+
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.request.Timestamps
+import me.centralhardware.healthImportServer.request.Workout
+import java.time.Duration
+
+/**
+ * Five heart rate zones given by the lower bounds (bpm) of zones 2 to 5.
+ * Everything below the first bound counts as zone 1.
+ */
+class HeartRateZones(private val lowerBounds: List<Double>) {
+
+    init {
+        require(lowerBounds.size == ZONES - 1) { "Expected ${ZONES - 1} zone bounds, got ${lowerBounds.size}" }
+        require(lowerBounds.zipWithNext().all { (a, b) -> a < b }) { "Zone bounds must be increasing: $lowerBounds" }
+    }
+
+    fun zoneOf(bpm: Double): Int = lowerBounds.count { bpm >= it }
+
+    /**
+     * Seconds spent in each zone during [workout]. Every heart rate sample
+     * lasts until the next one, but never longer than [maxSampleGap].
+     */
+    fun timeInZones(workout: Workout): IntArray {
+        val seconds = IntArray(ZONES)
+        val end = Timestamps.parseOrNull(workout.end)
+        val samples = workout.heartRateData
+            .mapNotNull { h ->
+                val ts = Timestamps.parseOrNull(h.date) ?: return@mapNotNull null
+                val bpm = h.avg ?: h.max ?: return@mapNotNull null
+                ts to bpm
+            }
+            .sortedBy { it.first }
+        samples.forEachIndexed { i, (ts, bpm) ->
+            val until = samples.getOrNull(i + 1)?.first ?: end ?: ts
+            val duration = Duration.between(ts, until).coerceIn(Duration.ZERO, maxSampleGap)
+            seconds[zoneOf(bpm)] += duration.seconds.toInt()
+        }
+        return seconds
+    }
+
+    companion object {
+        const val ZONES = 5
+        private val maxSampleGap: Duration = Duration.ofMinutes(2)
+        private val defaultPercentages = listOf(0.6, 0.7, 0.8, 0.9)
+
+        fun fromMaxHeartRate(maxHeartRate: Double) = HeartRateZones(defaultPercentages.map { it * maxHeartRate })
+
+        fun fromAge(age: Int) = fromMaxHeartRate(220.0 - age)
+
+        /**
+         * Zones from `HR_ZONES` (comma separated bounds), `HR_MAX` or `USER_AGE`,
+         * in that order. Returns null when none of them is set.
+         */
+        fun fromEnv(): HeartRateZones? {
+            Env.get("HR_ZONES")?.let { value ->
+                return HeartRateZones(value.split(",").map { it.trim().toDouble() })
+            }
+            Env.get("HR_MAX")?.let { return fromMaxHeartRate(it.toDouble()) }
+            Env.get("USER_AGE")?.let { return fromAge(it.toInt()) }
+            return null
+        }
+    }
+}
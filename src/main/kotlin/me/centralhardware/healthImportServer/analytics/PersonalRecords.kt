@@ -0,0 +1,129 @@
+package me.centralhardware.healthImportServer.analytics
+
+import me.centralhardware.healthImportServer.notify.Notifier
+import me.centralhardware.healthImportServer.request.QtyUnit
+import me.centralhardware.healthImportServer.request.Timestamps
+import me.centralhardware.healthImportServer.request.Workout
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import org.slf4j.LoggerFactory
+import java.time.Duration
+import java.time.Instant
+
+enum class RecordKind(val id: String, val units: String, val higherIsBetter: Boolean) {
+    FASTEST_5K("fastest_5k", "s", false),
+    LONGEST_RUN("longest_run", "km", true),
+    LONGEST_RIDE("longest_ride", "km", true),
+    MOST_ELEVATION("most_elevation", "m", true);
+
+    companion object {
+        fun byId(id: String) = entries.firstOrNull { it.id == id }
+    }
+}
+
+data class PersonalRecord(
+    val kind: RecordKind,
+    val value: Double,
+    val workoutId: String,
+    val workoutName: String,
+    val achievedAt: Instant,
+) {
+    fun beats(other: PersonalRecord) = if (kind.higherIsBetter) value > other.value else value < other.value
+}
+
+/**
+ * Detects personal records in incoming workouts, compares them with the
+ * records already stored and persists the ones that were broken.
+ */
+class PersonalRecordTracker(
+    private val store: ClickHouseMetricStore,
+    private val notifier: Notifier,
+) {
+    val log = LoggerFactory.getLogger(PersonalRecordTracker::class.java)
+
+    fun process(workouts: List<Workout>) {
+        // The table keeps every record ever broken, so the best of each kind is the current one.
+        val best = store.personalRecords().groupBy { it.kind }
+            .mapValues { (_, records) -> records.reduce { best, record -> if (record.beats(best)) record else best } }
+            .toMutableMap()
+        val broken = mutableListOf<PersonalRecord>()
+        for (candidate in workouts.flatMap { detect(it) }.sortedBy { it.achievedAt }) {
+            val current = best[candidate.kind]
+            if (current == null || candidate.beats(current)) {
+                best[candidate.kind] = candidate
+                broken += candidate
+            }
+        }
+        if (broken.isEmpty()) return
+
+        store.storePersonalRecords(broken)
+        log.info("Stored ${broken.size} new personal records")
+        // Backfills of old workouts establish records silently.
+        val recent = Instant.now().minus(notifyWindow)
+        broken.filter { it.achievedAt.isAfter(recent) }.forEach { record ->
+            notifier.notify("New personal record", describe(record))
+        }
+    }
+
+    private fun describe(record: PersonalRecord): String {
+        val value = when (record.kind) {
+            RecordKind.FASTEST_5K -> Duration.ofSeconds(record.value.toLong()).let {
+                "%d:%02d".format(it.toMinutes(), it.toSecondsPart())
+            }
+            else -> "%.2f %s".format(record.value, record.kind.units)
+        }
+        return "${record.kind.id.replace('_', ' ')}: $value (${record.workoutName})"
+    }
+
+    companion object {
+        private val notifyWindow: Duration = Duration.ofDays(7)
+
+        fun detect(workout: Workout): List<PersonalRecord> {
+            val id = workout.id ?: return emptyList()
+            val start = Timestamps.parseOrNull(workout.start) ?: return emptyList()
+            val end = Timestamps.parseOrNull(workout.end) ?: return emptyList()
+            val name = workout.name ?: ""
+            val seconds = Duration.between(start, end).seconds.toDouble()
+            val distanceKm = workout.distance?.let { kilometers(it) }
+            val elevation = workout.elevationUp?.let { meters(it) }
+
+            fun record(kind: RecordKind, value: Double) = PersonalRecord(kind, value, id, name, start)
+
+            return buildList {
+                if (distanceKm != null && distanceKm > 0) {
+                    if (isRun(name)) {
+                        add(record(RecordKind.LONGEST_RUN, distanceKm))
+                        if (distanceKm >= 5.0 && seconds > 0) add(record(RecordKind.FASTEST_5K, seconds * 5.0 / distanceKm))
+                    }
+                    if (isRide(name)) add(record(RecordKind.LONGEST_RIDE, distanceKm))
+                }
+                if (elevation != null && elevation > 0) add(record(RecordKind.MOST_ELEVATION, elevation))
+            }
+        }
+
+        private fun isRun(name: String) = name.contains("run", ignoreCase = true)
+
+        private fun isRide(name: String) =
+            listOf("cycl", "ride", "bike").any { name.contains(it, ignoreCase = true) }
+
+        private fun kilometers(q: QtyUnit): Double? {
+            val value = q.total() ?: return null
+            return when (q.units?.lowercase()) {
+                "km", null -> value
+                "mi" -> value * 1.609344
+                "m" -> value / 1000
+                "yd" -> value * 0.0009144
+                else -> null
+            }
+        }
+
+        private fun meters(q: QtyUnit): Double? {
+            val value = q.total() ?: return null
+            return when (q.units?.lowercase()) {
+                "m", null -> value
+                "ft" -> value * 0.3048
+                "km" -> value * 1000
+                else -> null
+            }
+        }
+    }
+}
@@ -0,0 +1,108 @@
+package me.centralhardware.healthImportServer.analytics
+
+import kotlinx.serialization.Serializable
+import me.centralhardware.healthImportServer.request.Sample
+import me.centralhardware.healthImportServer.request.Timestamps
+import java.time.Duration
+import java.time.Instant
+import java.time.LocalDate
+import java.time.ZoneId
+
+/**
+ * Assembles nights from stored `sleep_analysis` samples. Aggregated samples
+ * already describe a night each. Unaggregated samples are single phases
+ * (`Core`, `Deep`, `REM`, `Awake`, `In Bed`, ...) that are joined per source
+ * into one session until a gap of more than [MAX_GAP]. A night belongs to
+ * the day it ended on, like in the Health app.
+ */
+object SleepSessions {
+    private val MAX_GAP = Duration.ofHours(3)
+    private val ASLEEP = setOf("asleep", "core", "deep", "rem", "unspecified")
+
+    fun assemble(samples: List<Sample>, zone: ZoneId = ZoneId.systemDefault()): List<SleepSession> {
+        val (phases, nights) = samples.partition { it.value != null }
+        val sessions = nights.mapNotNull { aggregated(it, zone) } +
+            phases.groupBy { it.source }.flatMap { (source, segments) -> segmented(source, segments, zone) }
+        return sessions.sortedWith(compareBy({ it.night }, { it.bedTime }))
+    }
+
+    private fun aggregated(s: Sample, zone: ZoneId): SleepSession? {
+        val bed = Timestamps.parseOrNull(s.inBedStart ?: s.sleepStart)
+        val wake = Timestamps.parseOrNull(s.inBedEnd ?: s.sleepEnd)
+        val night = (wake ?: Timestamps.parseOrNull(s.date) ?: return null).atZone(zone).toLocalDate()
+        val phases = listOfNotNull(
+            s.core?.let { "core" to it },
+            s.deep?.let { "deep" to it },
+            s.rem?.let { "rem" to it },
+            s.awake?.let { "awake" to it },
+        ).toMap()
+        val inBed = s.inBed ?: if (bed != null && wake != null) hours(bed, wake) else null
+        return session(night, bed, wake, s.asleep, inBed, phases, s.sleepSource ?: s.inBedSource)
+    }
+
+    private fun segmented(source: String?, segments: List<Sample>, zone: ZoneId): List<SleepSession> {
+        val timed = segments.mapNotNull { s ->
+            val start = Timestamps.parseOrNull(s.startDate ?: s.date) ?: return@mapNotNull null
+            val end = Timestamps.parseOrNull(s.endDate) ?: return@mapNotNull null
+            Triple(start, end, s)
+        }.sortedBy { it.first }
+
+        val groups = mutableListOf<MutableList<Triple<Instant, Instant, Sample>>>()
+        for (segment in timed) {
+            val current = groups.lastOrNull()
+            if (current == null || Duration.between(current.maxOf { it.second }, segment.first) > MAX_GAP) {
+                groups += mutableListOf(segment)
+            } else {
+                current += segment
+            }
+        }
+        return groups.map { group ->
+            val bed = group.minOf { it.first }
+            val wake = group.maxOf { it.second }
+            val phases = group.groupBy { phase(it.third.value!!) }
+                .filterKeys { it != "in_bed" }
+                .mapValues { (_, parts) -> parts.sumOf { (start, end, s) -> s.qty ?: hours(start, end) } }
+            val asleep = phases.filterKeys { it in ASLEEP }.values.sum()
+            session(wake.atZone(zone).toLocalDate(), bed, wake, asleep, hours(bed, wake), phases, source)
+        }
+    }
+
+    private fun session(
+        night: LocalDate,
+        bed: Instant?,
+        wake: Instant?,
+        asleep: Double?,
+        inBed: Double?,
+        phases: Map<String, Double>,
+        source: String?,
+    ) = SleepSession(
+        night = night.toString(),
+        bedTime = bed?.toString(),
+        wakeTime = wake?.toString(),
+        asleepHours = asleep,
+        inBedHours = inBed,
+        phases = phases,
+        efficiency = if (asleep != null && inBed != null && inBed > 0) minOf(1.0, asleep / inBed) else null,
+        source = source,
+    )
+
+    /** `In Bed` becomes `in_bed`, `REM` becomes `rem`. */
+    private fun phase(value: String) = value.trim().lowercase().replace(' ', '_')
+
+    private fun hours(from: Instant, to: Instant) = Duration.between(from, to).toSeconds() / 3600.0
+}
+
+@Serializable
+data class SleepSession(
+    /** The day the night ended on. */
+    val night: String,
+    val bedTime: String?,
+    val wakeTime: String?,
+    val asleepHours: Double?,
+    val inBedHours: Double?,
+    /** Hours per sleep phase, e.g. `core`, `deep`, `rem` and `awake`. */
+    val phases: Map<String, Double>,
+    /** Share of the time in bed spent asleep. */
+    val efficiency: Double?,
+    val source: String?,
+)
@@ -0,0 +1,32 @@
+package me.centralhardware.healthImportServer.analytics
+
+import kotlin.math.sqrt
+
+object Statistics {
+
+    fun standardDeviation(values: List<Double>): Double? {
+        if (values.size < 2) return null
+        val mean = values.average()
+        return sqrt(values.sumOf { (it - mean) * (it - mean) } / (values.size - 1))
+    }
+
+    /** Pearson correlation coefficient, or null when it is undefined. */
+    fun pearson(xs: List<Double>, ys: List<Double>): Double? {
+        require(xs.size == ys.size) { "Series must have the same length" }
+        if (xs.size < 2) return null
+        val mx = xs.average()
+        val my = ys.average()
+        var cov = 0.0
+        var vx = 0.0
+        var vy = 0.0
+        for (i in xs.indices) {
+            val dx = xs[i] - mx
+            val dy = ys[i] - my
+            cov += dx * dy
+            vx += dx * dx
+            vy += dy * dy
+        }
+        if (vx == 0.0 || vy == 0.0) return null
+        return cov / sqrt(vx * vy)
+    }
+}
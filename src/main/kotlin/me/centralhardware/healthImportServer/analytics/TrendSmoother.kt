@@ -0,0 +1,51 @@
+package me.centralhardware.healthImportServer.analytics
+
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.Sample
+import me.centralhardware.healthImportServer.request.Timestamps
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+
+/**
+ * Derives exponentially smoothed trend metrics (as in The Hacker's Diet) from
+ * noisy body composition readings. For every source metric a synthetic
+ * `<name>_trend` metric is produced that continues from the last stored trend
+ * value.
+ */
+class TrendSmoother(
+    private val store: ClickHouseMetricStore,
+    private val alpha: Double = 0.1,
+    private val sources: Set<String> = setOf("weight_body_mass", "body_fat_percentage", "lean_body_mass"),
+) {
+
+    fun derive(metrics: List<Metric>): List<Metric> = metrics.filter { it.name in sources }.mapNotNull { smooth(it) }
+
+    private fun smooth(metric: Metric): Metric? {
+        val samples = metric.data
+            .mapNotNull { s ->
+                val ts = Timestamps.parseOrNull(s.date) ?: return@mapNotNull null
+                val qty = s.qty ?: return@mapNotNull null
+                Triple(ts, s.date, qty)
+            }
+            .sortedBy { it.first }
+        if (samples.isEmpty()) return null
+
+        val name = metric.name + TREND_SUFFIX
+        var trend = store.latestValue(name, before = samples.first().first) ?: samples.first().third
+        val data = samples.map { (_, date, qty) ->
+            trend += alpha * (qty - trend)
+            Sample(date = date, qty = trend)
+        }
+        return Metric(name, metric.units, data)
+    }
+
+    companion object {
+        const val TREND_SUFFIX = "_trend"
+
+        fun fromEnv(store: ClickHouseMetricStore): TrendSmoother {
+            val alpha = Env.get("TREND_SMOOTHING")?.toDouble() ?: 0.1
+            val sources = Env.get("TREND_METRICS")?.split(",")?.map { it.trim() }?.toSet()
+            return if (sources != null) TrendSmoother(store, alpha, sources) else TrendSmoother(store, alpha)
+        }
+    }
+}
@@ -0,0 +1,235 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.http.*
+import io.ktor.server.application.*
+import io.ktor.server.auth.*
+import io.ktor.server.auth.jwt.*
+import io.ktor.server.plugins.BadRequestException
+import io.ktor.server.request.*
+import io.ktor.server.response.*
+import io.ktor.server.routing.*
+import kotlinx.serialization.builtins.MapSerializer
+import kotlinx.serialization.builtins.serializer
+import kotlinx.serialization.json.Json
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.analytics.PersonalRecordTracker
+import me.centralhardware.healthImportServer.dedup.SampleDeduplicator
+import me.centralhardware.healthImportServer.storage.AttachmentFiles
+import me.centralhardware.healthImportServer.storage.AuditEntry
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import me.centralhardware.healthImportServer.storage.UserProfile
+import org.slf4j.LoggerFactory
+import java.security.MessageDigest
+import java.time.Instant
+import java.time.LocalDate
+
+private val log = LoggerFactory.getLogger("me.centralhardware.healthImportServer.api.AdminRoutes")
+
+const val ADMIN_AUTH = "admin"
+
+/** Accepts `Authorization: Bearer <token>` for the admin API. */
+fun AuthenticationConfig.adminBearer(token: String) {
+    bearer(ADMIN_AUTH) {
+        authenticate { credential ->
+            if (MessageDigest.isEqual(credential.token.toByteArray(), token.toByteArray())) {
+                UserIdPrincipal(actor(credential.token))
+            } else {
+                null
+            }
+        }
+    }
+}
+
+/**
+ * Administrative endpoints, mounted below `/admin`. Every invocation is
+ * written to the `audit_log` table together with the outcome. Callers
+ * authenticate with the admin token or an OIDC token of the admin group.
+ *
+ * - `POST /admin/purge?metric=<name>&from=<date>&to=<date>` deletes samples of a metric.
+ * - `POST /admin/purge?metric=<name>&start=<time>&end=<time>` deletes the samples taken in a time range.
+ * - `POST /admin/purge?workout=<id>` deletes a workout with its logs, route and attachments.
+ * - `POST /admin/correct?metric=<name>&start=<time>&end=<time>&column=<column>&value=<value>` overwrites a
+ *   value of samples, or multiplies it with `factor=<factor>` instead.
+ * - `POST /admin/correct?workout=<id>&column=<column>&value=<value>` overwrites a field of a workout.
+ * - `POST /admin/reprocess?from=<date>&to=<date>` re-runs personal record detection on stored workouts.
+ * - `POST /admin/reload` reads the `--config` file and the user profiles again.
+ * - `GET /admin/profiles` lists the user profiles, `GET /admin/profiles/{user}` returns one.
+ * - `PUT /admin/profiles/{user}` saves a [UserProfile], `DELETE /admin/profiles/{user}` removes it.
+ */
+fun Route.adminRoutes(
+    store: ClickHouseMetricStore,
+    recordTracker: PersonalRecordTracker,
+    providers: List<String>,
+    responseCache: ResponseCache? = null,
+    attachments: AttachmentFiles? = null,
+    /** Forgets the samples of purged or corrected metrics, so they are written again when sent again. */
+    deduplicator: SampleDeduplicator? = null,
+) {
+    require(providers.isNotEmpty()) { "The admin API needs at least one authentication provider" }
+    authenticate(*providers.toTypedArray()) {
+        post("/purge") {
+            call.audited(store, "purge") {
+                val workout = call.workoutParam()
+                if (workout != null) {
+                    val files = if (attachments != null) store.attachments(workout) else emptyList()
+                    store.purgeWorkout(workout)
+                    files.forEach { attachments?.delete(it.location) }
+                    responseCache?.invalidate()
+                    call.respondText("Deleted workout $workout")
+                } else if (call.request.queryParameters["start"] != null) {
+                    val metric = call.requiredParam("metric")
+                    val (start, end) = call.timeRange()
+                    val count = store.purgeSamples(metric, start, end)
+                    deduplicator?.forget(metric)
+                    responseCache?.invalidate()
+                    call.respondText("Deleted $count $metric samples from $start to $end")
+                } else {
+                    val metric = call.requiredParam("metric")
+                    val from = call.dateParam("from", LocalDate.EPOCH)
+                    val to = call.dateParam("to", store.days.today())
+                    store.purgeMetric(metric, from, to)
+                    deduplicator?.forget(metric)
+                    responseCache?.invalidate()
+                    call.respondText("Deleted $metric samples from $from to $to")
+                }
+            }
+        }
+        post("/correct") {
+            call.audited(store, "correct") {
+                val workout = call.workoutParam()
+                if (workout != null) {
+                    val column = call.requiredParam("column")
+                    val type = ClickHouseMetricStore.WORKOUT_COLUMNS[column] ?: throw BadRequestException(
+                        "Query parameter 'column' must be one of ${ClickHouseMetricStore.WORKOUT_COLUMNS.keys.joinToString()}"
+                    )
+                    val value = call.requiredParam("value")
+                    // Answers values that do not parse as the column type with 400.
+                    when (type) {
+                        "Float64" -> call.doubleParam("value")
+                        "DateTime" -> call.instantParam("value")
+                    }
+                    if (!store.correctWorkout(workout, column, value)) {
+                        return@audited call.respondText("Workout $workout not found", status = HttpStatusCode.NotFound)
+                    }
+                    responseCache?.invalidate()
+                    call.respondText("Set $column of workout $workout to $value")
+                } else {
+                    val metric = call.requiredParam("metric")
+                    val (start, end) = call.timeRange()
+                    val column = call.choiceParam("column", ClickHouseMetricStore.VALUE_COLUMNS, "qty")
+                    val value = call.doubleParam("value")
+                    val factor = call.doubleParam("factor")
+                    if ((value == null) == (factor == null)) throw BadRequestException("Expected either 'value' or 'factor'")
+                    val count = store.correctSamples(metric, start, end, column, value, factor)
+                    if (count == 0L) {
+                        return@audited call.respondText("No $metric samples found from $start to $end", status = HttpStatusCode.NotFound)
+                    }
+                    deduplicator?.forget(metric)
+                    responseCache?.invalidate()
+                    call.respondText("Corrected $column of $count $metric samples from $start to $end")
+                }
+            }
+        }
+        post("/reprocess") {
+            call.audited(store, "reprocess") {
+                val to = call.dateParam("to", store.days.today())
+                val from = call.dateParam("from", to.minusDays(30))
+                val workouts = store.exportBetween(from, to).workouts
+                recordTracker.process(workouts)
+                call.respondText("Checked ${workouts.size} workouts from $from to $to for personal records")
+            }
+        }
+        post("/reload") {
+            call.audited(store, "reload") {
+                val changed = try {
+                    Env.reload()
+                } catch (e: Exception) {
+                    throw BadRequestException("Could not read the config file: ${e.message}", e)
+                }
+                store.profiles.invalidate()
+                responseCache?.invalidate()
+                call.respondText(
+                    "Reloaded the user profiles and the config file, changed settings: ${changed.joinToString().ifEmpty { "none" }}. " +
+                        "Settings read at startup take effect after a restart."
+                )
+            }
+        }
+        get("/profiles") {
+            call.respond(store.userProfiles())
+        }
+        get("/profiles/{user}") {
+            val user = call.parameters["user"]!!
+            val profile = store.userProfiles().find { it.user == user }
+                ?: return@get call.respondText("No profile of $user", status = HttpStatusCode.NotFound)
+            call.respond(profile)
+        }
+        put("/profiles/{user}") {
+            call.audited(store, "profile") {
+                val user = call.parameters["user"]!!
+                val profile = try {
+                    call.receive<UserProfile>().copy(user = user)
+                } catch (e: Exception) {
+                    throw BadRequestException("Invalid profile: ${e.message}", e)
+                }
+                store.storeUserProfile(profile)
+                responseCache?.invalidate()
+                call.respond(profile)
+            }
+        }
+        delete("/profiles/{user}") {
+            call.audited(store, "delete-profile") {
+                val user = call.parameters["user"]!!
+                if (!store.deleteUserProfile(user)) {
+                    return@audited call.respondText("No profile of $user", status = HttpStatusCode.NotFound)
+                }
+                responseCache?.invalidate()
+                call.respondText("Deleted the profile of $user")
+            }
+        }
+    }
+}
+
+/** The `workout` parameter, answered with 400 if it is not a workout id. */
+private fun ApplicationCall.workoutParam(): String? = request.queryParameters["workout"]?.also {
+    if (!isUuid(it)) throw BadRequestException("Query parameter 'workout' must be a workout id, got '$it'")
+}
+
+/** `start` and `end`, or `timestamp` alone for a single sample. */
+private fun ApplicationCall.timeRange(): Pair<Instant, Instant> {
+    instantParam("timestamp")?.let { return it to it }
+    val start = instantParam("start") ?: throw BadRequestException("Missing query parameter 'start'")
+    val end = instantParam("end") ?: throw BadRequestException("Missing query parameter 'end'")
+    if (end < start) throw BadRequestException("'end' must not be before 'start'")
+    return start to end
+}
+
+private suspend fun ApplicationCall.audited(store: ClickHouseMetricStore, action: String, block: suspend () -> Unit) {
+    val parameters = request.queryParameters.entries().associate { (name, values) -> name to values.joinToString(",") }
+    var status = HttpStatusCode.InternalServerError
+    try {
+        block()
+        status = response.status() ?: HttpStatusCode.OK
+    } catch (e: BadRequestException) {
+        status = HttpStatusCode.BadRequest
+        throw e
+    } finally {
+        val entry = AuditEntry(
+            timestamp = Instant.now(),
+            actor = principal<UserIdPrincipal>()?.name ?: principal<JWTPrincipal>()?.subject?.let { "oidc:$it" } ?: "",
+            action = action,
+            parameters = Json.encodeToString(MapSerializer(String.serializer(), String.serializer()), parameters),
+            status = status.value,
+        )
+        try {
+            store.storeAuditEntry(entry)
+        } catch (e: Exception) {
+            log.error("Failed to write audit log entry $entry", e)
+        }
+    }
+}
+
+/** Identifies a token in the audit log without storing the token itself. */
+fun actor(token: String): String {
+    val digest = MessageDigest.getInstance("SHA-256").digest(token.toByteArray())
+    return "token:" + digest.take(6).joinToString("") { "%02x".format(it) }
+}
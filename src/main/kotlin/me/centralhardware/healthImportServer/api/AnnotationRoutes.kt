@@ -0,0 +1,32 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.server.response.*
+import io.ktor.server.routing.*
+import kotlinx.serialization.Serializable
+import me.centralhardware.healthImportServer.storage.Annotation
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+
+/**
+ * `GET /api/annotations?from=<date>&to=<date>&tags=<tags>`: the annotations
+ * of a range, oldest first, to overlay on metric charts.
+ */
+fun Route.annotationRoutes(store: ClickHouseMetricStore) {
+    get("/annotations") {
+        val to = call.dateParam("to", store.days.today())
+        val from = call.dateParam("from", to.minusDays(90))
+        call.respond(store.annotations(from, to, call.listParam("tags")).map { AnnotationResponse.of(it) })
+    }
+}
+
+@Serializable
+data class AnnotationResponse(
+    val timestamp: String,
+    val text: String,
+    val tags: List<String>,
+    val source: String,
+) {
+    companion object {
+        fun of(annotation: Annotation) =
+            AnnotationResponse(annotation.timestamp.toString(), annotation.text, annotation.tags, annotation.source)
+    }
+}
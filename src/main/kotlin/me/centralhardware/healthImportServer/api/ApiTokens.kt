@@ -0,0 +1,95 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.http.auth.HttpAuthHeader
+import io.ktor.server.auth.*
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import java.security.MessageDigest
+import java.time.Duration
+
+/** Query parameter carrying the token of an upload sent without `Authorization` header. */
+const val TOKEN_PARAMETER = "token"
+
+/** What an API token may be used for. */
+enum class TokenRole {
+    /** `/upload` only, for the key embedded in Auto Export on the phone. */
+    UPLOAD,
+    /** The query API below `/api`. */
+    READ,
+    /** Everything, including deleting data through the admin API. */
+    ADMIN;
+
+    /** Name of the authentication provider accepting tokens that may call endpoints of this role. */
+    val provider: String get() = "token-${name.lowercase()}"
+
+    fun grants(required: TokenRole): Boolean = this == ADMIN || this == required
+
+    companion object {
+        fun of(name: String): TokenRole? = entries.firstOrNull { it.name.equals(name, ignoreCase = true) }
+
+        fun names(): String = entries.joinToString { it.name.lowercase() }
+    }
+}
+
+/**
+ * Bearer tokens with the role each of them has: the ones configured in
+ * [roles] and those created with the `token` command in [stored].
+ */
+class ApiTokens(private val roles: Map<String, TokenRole>, private val stored: StoredTokens? = null) {
+    fun role(token: String): TokenRole? = roles.entries
+        .firstOrNull { MessageDigest.isEqual(it.key.toByteArray(), token.toByteArray()) }
+        ?.value
+        ?: stored?.role(token)
+
+    companion object {
+        /**
+         * Reads `API_TOKENS`, comma separated `token=role` pairs such as
+         * `3f9c1a...=upload,77b0e2...=read`, `UPLOAD_TOKEN`, a single token
+         * with the upload role, and `API_TOKEN_REFRESH_SECONDS` (default 60).
+         * Returns null if no token is configured and none was ever created in
+         * [metricStore]; without a store only the environment is read.
+         */
+        fun fromEnv(metricStore: ClickHouseMetricStore?): ApiTokens? {
+            val roles = (Env.get("API_TOKENS")?.let { parse(it) } ?: emptyMap()) +
+                    listOfNotNull(Env.get("UPLOAD_TOKEN")?.trim()?.takeIf { it.isNotEmpty() }?.let { it to TokenRole.UPLOAD })
+            val refresh = Duration.ofSeconds(Env.get("API_TOKEN_REFRESH_SECONDS")?.toLong() ?: 60)
+            val stored = metricStore?.let { StoredTokens(it, refresh) }?.takeIf { it.exist() }
+            if (roles.isEmpty() && stored == null) return null
+            return ApiTokens(roles, stored)
+        }
+
+        fun parse(value: String): Map<String, TokenRole> =
+            value.split(',').map { it.trim() }.filter { it.isNotEmpty() }.associate { pair ->
+                // Split at the last '=', base64 tokens may end with padding.
+                val separator = pair.lastIndexOf('=')
+                require(separator > 0) { "Expected token=role in API_TOKENS" }
+                val role = pair.substring(separator + 1).trim()
+                val parsed = TokenRole.of(role)
+                    ?: throw IllegalArgumentException("Unknown role '$role' in API_TOKENS, expected one of ${TokenRole.names()}")
+                pair.substring(0, separator).trim() to parsed
+            }
+    }
+}
+
+/**
+ * Registers one bearer provider per [TokenRole]; each accepts the tokens
+ * whose role grants it. The audit log records callers by [actor]. Uploads
+ * may pass the token as `?token=` instead, for clients that cannot set
+ * headers.
+ */
+fun AuthenticationConfig.apiTokens(tokens: ApiTokens) {
+    for (required in TokenRole.entries) {
+        bearer(required.provider) {
+            if (required == TokenRole.UPLOAD) {
+                authHeader { call ->
+                    call.request.parseAuthorizationHeader()
+                        ?: call.request.queryParameters[TOKEN_PARAMETER]?.let { HttpAuthHeader.Single("Bearer", it) }
+                }
+            }
+            authenticate { credential ->
+                val role = tokens.role(credential.token)
+                if (role != null && role.grants(required)) UserIdPrincipal(actor(credential.token)) else null
+            }
+        }
+    }
+}
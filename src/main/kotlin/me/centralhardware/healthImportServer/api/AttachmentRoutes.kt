@@ -0,0 +1,153 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.http.*
+import io.ktor.server.application.*
+import io.ktor.server.request.*
+import io.ktor.server.response.*
+import io.ktor.server.routing.*
+import io.ktor.utils.io.readRemaining
+import kotlinx.io.readByteArray
+import kotlinx.serialization.Serializable
+import me.centralhardware.healthImportServer.storage.AttachmentFiles
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import me.centralhardware.healthImportServer.storage.WorkoutAttachment
+import java.security.MessageDigest
+import java.time.Instant
+import java.util.UUID
+
+/**
+ * `POST /upload/workouts/{id}/attachments?name=<file name>` attaches the
+ * body, e.g. a photo or the original FIT file, to a stored workout, and
+ * `DELETE /upload/workouts/{id}/attachments/{attachment}` removes one. They
+ * are mounted next to the upload endpoint and authenticated like it, with
+ * the body, empty for a delete, checked by [verify] against the upload
+ * signature. Bodies larger than [maxBytes] are rejected with `413`, content
+ * types other than [ATTACHMENT_TYPES] with `415`.
+ */
+fun Route.attachmentUploadRoutes(
+    store: ClickHouseMetricStore,
+    files: AttachmentFiles,
+    maxBytes: Long,
+    verify: suspend (ApplicationCall, ByteArray) -> Boolean,
+) {
+    post("/workouts/{id}/attachments") {
+        val workout = call.parameters["id"]!!
+        if (!workoutExists(store, workout)) {
+            return@post call.respondText("Workout $workout not found", status = HttpStatusCode.NotFound)
+        }
+        if ((call.request.contentLength() ?: 0) > maxBytes) {
+            return@post call.respondText("Attachments may have at most $maxBytes bytes", status = HttpStatusCode.PayloadTooLarge)
+        }
+        val contentType = call.request.contentType().takeUnless { it == ContentType.Any }?.withoutParameters()
+            ?: ContentType.Application.OctetStream
+        if (ATTACHMENT_TYPES.none { contentType.match(it) }) {
+            return@post call.respondText(
+                "Attachments must have one of the types ${ATTACHMENT_TYPES.joinToString()}",
+                status = HttpStatusCode.UnsupportedMediaType,
+            )
+        }
+        // Reads one byte more than allowed, so a chunked body is not read whole to find it is too large.
+        val body = call.receiveChannel().readRemaining(maxBytes + 1).readByteArray()
+        if (body.size > maxBytes) {
+            return@post call.respondText("Attachments may have at most $maxBytes bytes", status = HttpStatusCode.PayloadTooLarge)
+        }
+        if (!verify(call, body)) return@post
+        val name = call.request.queryParameters["name"]
+            ?: call.request.header(HttpHeaders.ContentDisposition)
+                ?.let { ContentDisposition.parse(it).parameter(ContentDisposition.Parameters.FileName) }
+            ?: "attachment"
+        val id = UUID.randomUUID().toString()
+        val attachment = WorkoutAttachment(
+            id = id,
+            workoutId = workout,
+            name = name,
+            contentType = contentType.toString(),
+            size = body.size.toLong(),
+            sha256 = MessageDigest.getInstance("SHA-256").digest(body).joinToString("") { "%02x".format(it) },
+            location = "$workout/$id",
+            createdAt = Instant.now(),
+        )
+        files.put(attachment.location, body, attachment.contentType)
+        store.storeAttachment(attachment)
+        call.respond(HttpStatusCode.Created, AttachmentResponse.of(attachment))
+    }
+    delete("/workouts/{id}/attachments/{attachment}") {
+        if (!verify(call, ByteArray(0))) return@delete
+        val workout = call.parameters["id"]!!
+        val id = call.parameters["attachment"]!!
+        val attachment = (if (isUuid(workout) && isUuid(id)) store.attachments(workout, id).firstOrNull() else null)
+            ?: return@delete call.respondText("Attachment $id not found", status = HttpStatusCode.NotFound)
+        store.deleteAttachment(workout, id)
+        files.delete(attachment.location)
+        call.respond(HttpStatusCode.NoContent)
+    }
+}
+
+/**
+ * `GET /api/workouts/{id}/attachments` lists the files attached to a
+ * workout and `GET /api/workouts/{id}/attachments/{attachment}` downloads
+ * one of them.
+ */
+fun Route.attachmentRoutes(store: ClickHouseMetricStore, files: AttachmentFiles) {
+    get("/workouts/{id}/attachments") {
+        val workout = call.parameters["id"]!!
+        if (!workoutExists(store, workout)) {
+            return@get call.respondText("Workout $workout not found", status = HttpStatusCode.NotFound)
+        }
+        call.respond(store.attachments(workout).map { AttachmentResponse.of(it) })
+    }
+    get("/workouts/{id}/attachments/{attachment}") {
+        val workout = call.parameters["id"]!!
+        val id = call.parameters["attachment"]!!
+        val attachment = (if (isUuid(workout) && isUuid(id)) store.attachments(workout, id).firstOrNull() else null)
+            ?: return@get call.respondText("Attachment $id not found", status = HttpStatusCode.NotFound)
+        val bytes = files.get(attachment.location)
+            ?: return@get call.respondText("File of attachment $id is missing", status = HttpStatusCode.NotFound)
+        call.response.header(
+            HttpHeaders.ContentDisposition,
+            ContentDisposition.Attachment.withParameter(ContentDisposition.Parameters.FileName, attachment.name).toString(),
+        )
+        call.response.header("X-Content-Type-Options", "nosniff")
+        // Types stored before they were checked are served as plain bytes, so a browser never renders them.
+        val contentType = ContentType.parse(attachment.contentType).takeIf { type -> ATTACHMENT_TYPES.any { type.match(it) } }
+            ?: ContentType.Application.OctetStream
+        call.respondBytes(bytes, contentType)
+    }
+}
+
+/**
+ * The types attachments may have: photos and screenshots, PDFs, and GPX or
+ * FIT files. None of them runs scripts when a browser opens it.
+ */
+private val ATTACHMENT_TYPES = listOf(
+    ContentType.Image.JPEG,
+    ContentType.Image.PNG,
+    ContentType.Image.GIF,
+    ContentType("image", "webp"),
+    ContentType("image", "heic"),
+    ContentType("image", "heif"),
+    ContentType.Application.Pdf,
+    ContentType("application", "gpx+xml"),
+    ContentType.Application.OctetStream,
+)
+
+/** ClickHouse fails on ids that are no UUID, which cannot belong to a workout anyway. */
+internal fun isUuid(value: String) = runCatching { UUID.fromString(value) }.isSuccess
+
+private fun workoutExists(store: ClickHouseMetricStore, id: String) = isUuid(id) && store.workoutExists(id)
+
+@Serializable
+data class AttachmentResponse(
+    val id: String,
+    val workoutId: String,
+    val name: String,
+    val contentType: String,
+    val size: Long,
+    val sha256: String,
+    val createdAt: String,
+) {
+    companion object {
+        fun of(a: WorkoutAttachment) =
+            AttachmentResponse(a.id, a.workoutId, a.name, a.contentType, a.size, a.sha256, a.createdAt.toString())
+    }
+}
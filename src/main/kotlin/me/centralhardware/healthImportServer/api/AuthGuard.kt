@@ -0,0 +1,141 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.http.*
+import io.ktor.server.application.*
+import io.ktor.server.application.hooks.ResponseSent
+import io.ktor.server.auth.*
+import io.ktor.server.response.*
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.notify.Notifier
+import org.slf4j.LoggerFactory
+import java.time.Duration
+import java.time.Instant
+import java.util.concurrent.ConcurrentHashMap
+
+/**
+ * Locks out client addresses after [maxFailures] failed authentications in
+ * a row. The first lockout lasts [lockout] and every further one twice as
+ * long as the one before, up to a day. After [alertLockouts] lockouts in a
+ * row the address is reported to [notifier], at most once an hour, together
+ * with fingerprints of the tokens it tried. An address without failures for
+ * a day starts over.
+ */
+class AuthGuard(
+    private val maxFailures: Int,
+    private val lockout: Duration,
+    private val alertLockouts: Int,
+    private val notifier: Notifier,
+) {
+    val log = LoggerFactory.getLogger(AuthGuard::class.java)
+    private val offenders = ConcurrentHashMap<String, Offender>()
+
+    private class Offender {
+        var failures = 0
+        var lockouts = 0
+        var lockedUntil: Instant = Instant.EPOCH
+        var lastFailure: Instant = Instant.EPOCH
+        var alerted: Instant = Instant.EPOCH
+        val tokens = LinkedHashSet<String>()
+    }
+
+    /** How long [address] is still locked out, or null if it may try. */
+    fun lockedFor(address: String, now: Instant = Instant.now()): Duration? {
+        val offender = offenders[address] ?: return null
+        return synchronized(offender) {
+            if (offender.lockedUntil.isAfter(now)) Duration.between(now, offender.lockedUntil) else null
+        }
+    }
+
+    /** Records a rejected request from [address], presenting [token] if it sent one. */
+    fun failed(address: String, token: String?, now: Instant = Instant.now()) {
+        forgetQuiet(now)
+        val offender = offenders.computeIfAbsent(address) { Offender() }
+        val alert = synchronized(offender) {
+            offender.lastFailure = now
+            token?.let { if (offender.tokens.size < MAX_TOKENS) offender.tokens += actor(it) }
+            if (++offender.failures < maxFailures) return
+            offender.failures = 0
+            offender.lockouts++
+            val duration = lockout.multipliedBy(1L shl minOf(offender.lockouts - 1, 20)).coerceAtMost(MAX_LOCKOUT)
+            offender.lockedUntil = now.plus(duration)
+            log.warn("Locked out $address for $duration after ${offender.lockouts} lockout(s) for failed authentication")
+            if (offender.lockouts < alertLockouts || offender.alerted.plus(ALERT_INTERVAL).isAfter(now)) return
+            offender.alerted = now
+            "$address failed to authenticate ${offender.lockouts * maxFailures} times in a row and is locked out " +
+                    "for $duration. Tokens tried: ${offender.tokens.joinToString().ifEmpty { "none" }}."
+        }
+        notifier.notify("Repeated authentication failures", alert)
+    }
+
+    fun succeeded(address: String) {
+        offenders.remove(address)
+    }
+
+    /**
+     * Counts a response to [address]: a 401 as a failure, and a success as
+     * clearing its failures only if the call was [authenticated], so a
+     * random token sent to an open route such as `/health` does not.
+     */
+    fun responded(address: String, status: HttpStatusCode, token: String?, authenticated: Boolean) {
+        when {
+            status == HttpStatusCode.Unauthorized -> failed(address, token)
+            status.isSuccess() && authenticated -> succeeded(address)
+        }
+    }
+
+    private fun forgetQuiet(now: Instant) {
+        val cutoff = now.minus(QUIET)
+        offenders.entries.removeIf { (_, offender) -> synchronized(offender) { offender.lastFailure.isBefore(cutoff) } }
+    }
+
+    companion object {
+        private val MAX_LOCKOUT = Duration.ofDays(1)
+        private val QUIET = Duration.ofDays(1)
+        private val ALERT_INTERVAL = Duration.ofHours(1)
+        private const val MAX_TOKENS = 5
+
+        /**
+         * Reads `AUTH_MAX_FAILURES` (default 5, 0 disables the lockout),
+         * `AUTH_LOCKOUT_SECONDS` (default 60) and `AUTH_ALERT_LOCKOUTS` (default 3).
+         */
+        fun fromEnv(notifier: Notifier): AuthGuard? {
+            val maxFailures = Env.get("AUTH_MAX_FAILURES")?.toInt() ?: 5
+            if (maxFailures <= 0) return null
+            val lockout = Duration.ofSeconds(Env.get("AUTH_LOCKOUT_SECONDS")?.toLong() ?: 60)
+            val alertLockouts = Env.get("AUTH_ALERT_LOCKOUTS")?.toInt() ?: 3
+            return AuthGuard(maxFailures, lockout, alertLockouts, notifier)
+        }
+    }
+}
+
+class AuthGuardConfig {
+    lateinit var guard: AuthGuard
+    var addresses = ClientAddresses()
+}
+
+/**
+ * Answers 429 to locked out clients before anything else runs, and counts
+ * every 401, whether from a bearer token, OIDC or an upload signature, as a
+ * failed attempt. A successful request that authenticated, with a principal
+ * or an upload signature that was verified, clears the failures of its
+ * address.
+ */
+val AuthGuardPlugin = createApplicationPlugin("AuthGuard", ::AuthGuardConfig) {
+    val guard = pluginConfig.guard
+    val addresses = pluginConfig.addresses
+    onCall { call ->
+        val address = addresses.of(call)?.hostAddress ?: return@onCall
+        val locked = guard.lockedFor(address) ?: return@onCall
+        call.response.header(HttpHeaders.RetryAfter, locked.seconds + 1)
+        call.respondText("Too many failed authentication attempts", status = HttpStatusCode.TooManyRequests)
+    }
+    on(ResponseSent) { call ->
+        val address = addresses.of(call)?.hostAddress ?: return@on
+        val status = call.response.status() ?: return@on
+        val authorization = call.request.headers[HttpHeaders.Authorization]
+        val token = authorization?.takeIf { it.startsWith("Bearer ") }?.removePrefix("Bearer ")?.trim()
+            ?: call.request.queryParameters[TOKEN_PARAMETER]
+        val authenticated = call.principal<Any>() != null || call.attributes.contains(UploadSignature.VERIFIED)
+        guard.responded(address, status, token, authenticated)
+    }
+}
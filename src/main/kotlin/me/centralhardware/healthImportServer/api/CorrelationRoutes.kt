@@ -0,0 +1,61 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.server.response.*
+import io.ktor.server.routing.*
+import kotlinx.serialization.Serializable
+import me.centralhardware.healthImportServer.analytics.Statistics
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+
+/**
+ * `GET /api/correlation?x=sleep_analysis&xField=asleep&y=resting_heart_rate&lag=1`
+ *
+ * Correlates the daily values of two metrics over a date range. With `lag`
+ * the value of `x` on a day is paired with `y` that many days later.
+ */
+fun Route.correlationRoutes(store: ClickHouseMetricStore, cache: ResponseCache? = null) {
+    get("/correlation") {
+        val x = call.requiredParam("x")
+        val y = call.requiredParam("y")
+        val to = call.dateParam("to", store.days.today())
+        val from = call.dateParam("from", to.minusDays(90))
+        val lag = call.intParam("lag", 0)
+        val xField = call.choiceParam("xField", ClickHouseMetricStore.VALUE_COLUMNS, "qty")
+        val yField = call.choiceParam("yField", ClickHouseMetricStore.VALUE_COLUMNS, "qty")
+        val xAgg = call.choiceParam("xAgg", ClickHouseMetricStore.AGGREGATES, "avg")
+        val yAgg = call.choiceParam("yAgg", ClickHouseMetricStore.AGGREGATES, "avg")
+
+        call.respondCached(cache) {
+            val xs = store.dailyValues(x, xField, xAgg, from, to)
+            val ys = store.dailyValues(y, yField, yAgg, from.plusDays(lag.toLong()), to.plusDays(lag.toLong()))
+            val points = xs.mapNotNull { (day, xv) ->
+                val yv = ys[day.plusDays(lag.toLong())] ?: return@mapNotNull null
+                CorrelationPoint(day.toString(), xv, yv)
+            }
+            CorrelationReport(
+                x = x,
+                y = y,
+                from = from.toString(),
+                to = to.toString(),
+                lagDays = lag,
+                n = points.size,
+                pearson = Statistics.pearson(points.map { it.x }, points.map { it.y }),
+                points = points,
+            )
+        }
+    }
+}
+
+@Serializable
+data class CorrelationReport(
+    val x: String,
+    val y: String,
+    val from: String,
+    val to: String,
+    val lagDays: Int,
+    val n: Int,
+    val pearson: Double?,
+    val points: List<CorrelationPoint>,
+)
+
+@Serializable
+data class CorrelationPoint(val date: String, val x: Double, val y: Double)
@@ -0,0 +1,32 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.server.routing.*
+import me.centralhardware.healthImportServer.analytics.Coverage
+import me.centralhardware.healthImportServer.analytics.GapDetector
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+
+/**
+ * `GET /api/coverage?from=<date>&to=<date>&metric=<metrics>&minGapDays=2`:
+ * per metric the runs of days with data and the gaps in between, to spot
+ * sync failures such as a week without sleep data. Metrics asked for by
+ * name are reported even if they have no data at all.
+ *
+ * `GET /api/coverage/missing` lists the gaps of the last `GAP_LOOKBACK_DAYS`
+ * as date ranges to export again, for a Shortcut that asks Auto Export for
+ * them.
+ */
+fun Route.coverageRoutes(store: ClickHouseMetricStore, gaps: GapDetector, cache: ResponseCache? = null) {
+    get("/coverage") {
+        val to = call.dateParam("to", store.days.today())
+        val from = call.dateParam("from", to.minusDays(90))
+        val metrics = call.listParam("metric")
+        val minGapDays = call.intParam("minGapDays", 2)
+        call.respondCached(cache) {
+            val days = store.metricDays(metrics, from, to)
+            (days.keys + metrics).distinct().map { metric -> Coverage.of(metric, days[metric] ?: emptyList(), from, to, minGapDays) }
+        }
+    }
+    get("/coverage/missing") {
+        call.respondCached(cache) { gaps.missing() }
+    }
+}
@@ -0,0 +1,84 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.http.*
+import io.ktor.server.response.*
+import io.ktor.server.routing.*
+import kotlinx.serialization.Serializable
+import me.centralhardware.healthImportServer.request.Timestamps
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+
+/**
+ * `GET /api/ecg?from=<date>&to=<date>` lists the recordings of a range and
+ * `GET /api/ecg/{id}/waveform?format=json|csv` reconstructs the voltage
+ * series of a single ECG recording.
+ */
+fun Route.ecgRoutes(store: ClickHouseMetricStore) {
+    get("/ecg") {
+        val to = call.dateParam("to", store.days.today())
+        val from = call.dateParam("from", to.minusDays(90))
+        call.respond(
+            store.ecgRecordings(from, to).map { (id, e) ->
+                EcgRecordingResponse(
+                    id = id,
+                    start = e.start?.let { Timestamps.parse(it).toString() },
+                    end = e.end?.let { Timestamps.parse(it).toString() },
+                    classification = e.classification,
+                    averageHeartRate = e.averageHeartRate,
+                    samplingFrequency = e.samplingFrequency,
+                    numberOfVoltageMeasurements = e.numberOfVoltageMeasurements,
+                    source = e.source,
+                )
+            }
+        )
+    }
+    get("/ecg/{id}/waveform") {
+        val id = call.parameters["id"]!!
+        val format = call.choiceParam("format", setOf("json", "csv"), "json")
+        val waveform = store.ecgWaveform(id)
+            ?: return@get call.respondText("ECG recording $id not found", status = HttpStatusCode.NotFound)
+
+        if (format == "csv") {
+            val csv = buildString {
+                append("timestamp,voltage\n")
+                waveform.offsets.zip(waveform.voltages).forEach { (offset, voltage) ->
+                    val ts = waveform.start.plusNanos((offset * 1_000_000_000).toLong())
+                    append(ts).append(',').append(voltage).append('\n')
+                }
+            }
+            call.respondText(csv, ContentType.Text.CSV)
+        } else {
+            call.respond(
+                EcgWaveformResponse(
+                    id = waveform.id,
+                    start = waveform.start.toString(),
+                    samplingFrequency = waveform.samplingFrequency,
+                    units = waveform.units,
+                    offsets = waveform.offsets,
+                    voltages = waveform.voltages,
+                )
+            )
+        }
+    }
+}
+
+@Serializable
+data class EcgRecordingResponse(
+    val id: String,
+    val start: String?,
+    val end: String?,
+    val classification: String?,
+    val averageHeartRate: Double?,
+    val samplingFrequency: Int?,
+    val numberOfVoltageMeasurements: Int?,
+    val source: String?,
+)
+
+@Serializable
+data class EcgWaveformResponse(
+    val id: String,
+    val start: String,
+    val samplingFrequency: Int,
+    val units: String,
+    val offsets: List<Double>,
+    val voltages: List<Double>,
+)
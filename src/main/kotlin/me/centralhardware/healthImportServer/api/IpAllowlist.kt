@@ -0,0 +1,101 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.http.*
+import io.ktor.server.application.*
+import io.ktor.server.request.*
+import io.ktor.server.response.*
+import me.centralhardware.healthImportServer.Env
+import org.slf4j.LoggerFactory
+import java.math.BigInteger
+import java.net.InetAddress
+
+/** An IPv4 or IPv6 network such as `192.168.1.0/24`; a plain address is a single host. */
+class Cidr(value: String) {
+    private val network: BigInteger
+    private val prefix: Int
+    private val bits: Int
+
+    init {
+        val address = InetAddress.getByName(value.substringBefore('/').trim())
+        bits = address.address.size * 8
+        prefix = value.substringAfter('/', "$bits").trim().toInt()
+        require(prefix in 0..bits) { "Invalid prefix length in $value" }
+        network = mask(BigInteger(1, address.address))
+    }
+
+    fun contains(address: InetAddress): Boolean =
+        address.address.size * 8 == bits && mask(BigInteger(1, address.address)) == network
+
+    private fun mask(value: BigInteger): BigInteger = value.shiftRight(bits - prefix)
+
+    companion object {
+        fun parseList(value: String): List<Cidr> = value.split(",").filter { it.isNotBlank() }.map { Cidr(it) }
+    }
+}
+
+/**
+ * Finds the client address of a request: the peer address, unless the peer
+ * is one of [trustedProxies]: then `X-Forwarded-For` is read from the right
+ * and the first address that is not a trusted proxy is used.
+ */
+class ClientAddresses(private val trustedProxies: List<Cidr> = emptyList()) {
+
+    fun of(call: ApplicationCall): InetAddress? =
+        clientAddress(call.request.local.remoteAddress, call.request.headers.getAll(HttpHeaders.XForwardedFor) ?: emptyList())
+
+    fun clientAddress(peer: String, forwardedFor: List<String>): InetAddress? {
+        var address = parse(peer) ?: return null
+        val hops = forwardedFor.flatMap { it.split(",") }.map { it.trim() }.filter { it.isNotEmpty() }.asReversed()
+        for (hop in hops) {
+            if (trustedProxies.none { it.contains(address) }) break
+            address = parse(hop) ?: return null
+        }
+        return address
+    }
+
+    private fun parse(value: String): InetAddress? =
+        // Only literals, never resolve a host name taken from a header.
+        if (value.isNotEmpty() && value.all { it.isDigit() || it in "abcdefABCDEF.:" }) {
+            runCatching { InetAddress.getByName(value) }.getOrNull()
+        } else {
+            null
+        }
+
+    companion object {
+        /** Reads `TRUSTED_PROXIES`, comma separated networks. */
+        fun fromEnv(): ClientAddresses =
+            ClientAddresses(Env.get("TRUSTED_PROXIES")?.let { Cidr.parseList(it) } ?: emptyList())
+    }
+}
+
+/** Networks allowed to reach a route, from the client address found by [addresses]. */
+class IpAllowlist(private val allowed: List<Cidr>, val addresses: ClientAddresses = ClientAddresses()) {
+
+    fun allows(address: InetAddress): Boolean = allowed.any { it.contains(address) }
+
+    companion object {
+        /** Reads `ALLOWED_NETWORKS` and `TRUSTED_PROXIES`, both comma separated networks. */
+        fun fromEnv(): IpAllowlist? {
+            val allowed = Env.get("ALLOWED_NETWORKS")?.let { Cidr.parseList(it) } ?: return null
+            return IpAllowlist(allowed, ClientAddresses.fromEnv())
+        }
+    }
+}
+
+class IpAllowlistConfig {
+    lateinit var allowlist: IpAllowlist
+}
+
+/** Answers 403 to clients outside of the configured networks. */
+val IpAllowlistPlugin = createRouteScopedPlugin("IpAllowlist", ::IpAllowlistConfig) {
+    val log = LoggerFactory.getLogger("me.centralhardware.healthImportServer.api.IpAllowlist")
+    val allowlist = pluginConfig.allowlist
+    onCall { call ->
+        val address = allowlist.addresses.of(call)
+        if (address == null || !allowlist.allows(address)) {
+            // Without the query string, which may carry a token.
+            log.warn("Rejected ${call.request.path()} from ${address?.hostAddress ?: call.request.local.remoteAddress}")
+            call.respondText("Forbidden", status = HttpStatusCode.Forbidden)
+        }
+    }
+}
@@ -0,0 +1,90 @@
+package me.centralhardware.healthImportServer.api
+
+import com.auth0.jwk.JwkProviderBuilder
+import io.ktor.server.auth.*
+import io.ktor.server.auth.jwt.*
+import io.ktor.server.routing.*
+import kotlinx.serialization.json.Json
+import kotlinx.serialization.json.jsonObject
+import kotlinx.serialization.json.jsonPrimitive
+import me.centralhardware.healthImportServer.Env
+import java.net.URI
+import java.net.URL
+import java.net.http.HttpClient
+import java.net.http.HttpRequest
+import java.net.http.HttpResponse
+import java.util.concurrent.TimeUnit
+
+const val OIDC_AUTH = "oidc"
+const val OIDC_ADMIN_AUTH = "oidc-admin"
+
+/**
+ * Validation of bearer tokens issued by an OpenID Connect provider such as
+ * Authelia or Keycloak. Signing keys are fetched from [jwksUrl] and cached.
+ */
+data class OidcConfig(
+    val issuer: String,
+    val audience: String,
+    val jwksUrl: URL,
+    /** Members of this group may use the admin API. Without it OIDC tokens are not accepted there. */
+    val adminGroup: String? = null,
+    val groupsClaim: String = "groups",
+) {
+    companion object {
+        /**
+         * Reads `OIDC_ISSUER`, `OIDC_AUDIENCE`, `OIDC_JWKS_URL`, `OIDC_ADMIN_GROUP`
+         * and `OIDC_GROUPS_CLAIM`. Without `OIDC_JWKS_URL` the key set is looked
+         * up in the issuer's discovery document.
+         */
+        fun fromEnv(): OidcConfig? {
+            val issuer = Env.get("OIDC_ISSUER") ?: return null
+            val audience = Env.get("OIDC_AUDIENCE") ?: error("OIDC_AUDIENCE must be set together with OIDC_ISSUER")
+            val jwksUrl = Env.get("OIDC_JWKS_URL") ?: discoverJwksUrl(issuer)
+            return OidcConfig(
+                issuer = issuer,
+                audience = audience,
+                jwksUrl = URI(jwksUrl).toURL(),
+                adminGroup = Env.get("OIDC_ADMIN_GROUP"),
+                groupsClaim = Env.get("OIDC_GROUPS_CLAIM") ?: "groups",
+            )
+        }
+
+        private fun discoverJwksUrl(issuer: String): String {
+            val request = HttpRequest.newBuilder(URI("${issuer.trimEnd('/')}/.well-known/openid-configuration")).GET().build()
+            val response = HttpClient.newHttpClient().send(request, HttpResponse.BodyHandlers.ofString())
+            check(response.statusCode() == 200) { "OIDC discovery for $issuer failed with status ${response.statusCode()}" }
+            return Json.parseToJsonElement(response.body()).jsonObject["jwks_uri"]?.jsonPrimitive?.content
+                ?: error("OIDC discovery document of $issuer has no jwks_uri")
+        }
+    }
+}
+
+fun AuthenticationConfig.oidc(config: OidcConfig) {
+    val jwks = JwkProviderBuilder(config.jwksUrl)
+        .cached(10, 24, TimeUnit.HOURS)
+        .rateLimited(10, 1, TimeUnit.MINUTES)
+        .build()
+    jwt(OIDC_AUTH) {
+        verifier(jwks, config.issuer) {
+            withAudience(config.audience)
+            acceptLeeway(30)
+        }
+        validate { JWTPrincipal(it.payload) }
+    }
+    val adminGroup = config.adminGroup ?: return
+    jwt(OIDC_ADMIN_AUTH) {
+        verifier(jwks, config.issuer) {
+            withAudience(config.audience)
+            acceptLeeway(30)
+        }
+        validate { credential ->
+            val groups = credential.payload.getClaim(config.groupsClaim).asList(String::class.java) ?: emptyList()
+            if (adminGroup in groups) JWTPrincipal(credential.payload) else null
+        }
+    }
+}
+
+/** Requires one of [providers] for the routes built by [build], or nothing if the list is empty. */
+fun Route.authenticateWith(providers: List<String>, build: Route.() -> Unit) {
+    if (providers.isEmpty()) build() else authenticate(*providers.toTypedArray(), build = build)
+}
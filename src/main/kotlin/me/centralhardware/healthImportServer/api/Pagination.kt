@@ -0,0 +1,48 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.http.HttpHeaders
+import io.ktor.server.application.*
+import io.ktor.server.plugins.BadRequestException
+import io.ktor.server.response.header
+import io.ktor.server.util.url
+import me.centralhardware.healthImportServer.Env
+import java.util.Base64
+
+/**
+ * Cursor based paging for the query API. A page response carries the cursor
+ * of the next page in its body and in a `Link: <...>; rel="next"` header;
+ * the cursor is opaque to clients and only valid for the same request.
+ */
+object Pagination {
+    const val CURSOR = "cursor"
+    const val LIMIT = "limit"
+
+    /** Largest page any endpoint returns, from `API_MAX_PAGE_SIZE` (default 10000). */
+    val maxPageSize = Env.get("API_MAX_PAGE_SIZE")?.toInt() ?: 10_000
+
+    fun encode(position: String): String =
+        Base64.getUrlEncoder().withoutPadding().encodeToString(position.toByteArray())
+
+    fun decode(cursor: String): String = try {
+        Base64.getUrlDecoder().decode(cursor).decodeToString()
+    } catch (_: IllegalArgumentException) {
+        throw BadRequestException("Invalid cursor")
+    }
+}
+
+/** The position encoded in the `cursor` parameter, or null on the first page. */
+fun ApplicationCall.cursorParam(): String? = request.queryParameters[Pagination.CURSOR]?.let { Pagination.decode(it) }
+
+/** The `limit` parameter, capped at [Pagination.maxPageSize]. */
+fun ApplicationCall.pageSizeParam(default: Int): Int {
+    val limit = intParam(Pagination.LIMIT, default)
+    if (limit < 1) throw BadRequestException("Query parameter '${Pagination.LIMIT}' must be positive")
+    return minOf(limit, Pagination.maxPageSize)
+}
+
+/** Sets the `Link` header to this request with [next] as cursor and returns the cursor. */
+fun ApplicationCall.linkNext(next: String?): String? {
+    val cursor = next?.let { Pagination.encode(it) } ?: return null
+    response.header(HttpHeaders.Link, "<${url { parameters[Pagination.CURSOR] = cursor }}>; rel=\"next\"")
+    return cursor
+}
@@ -0,0 +1,48 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.server.application.*
+import io.ktor.server.plugins.BadRequestException
+import java.time.Instant
+import java.time.LocalDate
+import java.time.format.DateTimeParseException
+
+fun ApplicationCall.requiredParam(name: String): String =
+    request.queryParameters[name] ?: throw BadRequestException("Missing query parameter '$name'")
+
+fun ApplicationCall.dateParam(name: String, default: LocalDate): LocalDate {
+    val value = request.queryParameters[name] ?: return default
+    return try {
+        LocalDate.parse(value)
+    } catch (_: DateTimeParseException) {
+        throw BadRequestException("Query parameter '$name' must be a date like 2024-01-31")
+    }
+}
+
+fun ApplicationCall.instantParam(name: String): Instant? {
+    val value = request.queryParameters[name] ?: return null
+    return try {
+        Instant.parse(value)
+    } catch (_: DateTimeParseException) {
+        throw BadRequestException("Query parameter '$name' must be a time like 2024-01-31T07:30:00Z")
+    }
+}
+
+fun ApplicationCall.intParam(name: String, default: Int): Int {
+    val value = request.queryParameters[name] ?: return default
+    return value.toIntOrNull() ?: throw BadRequestException("Query parameter '$name' must be an integer")
+}
+
+fun ApplicationCall.choiceParam(name: String, choices: Set<String>, default: String): String {
+    val value = request.queryParameters[name] ?: return default
+    if (value !in choices) throw BadRequestException("Query parameter '$name' must be one of ${choices.joinToString()}")
+    return value
+}
+
+fun ApplicationCall.doubleParam(name: String): Double? {
+    val value = request.queryParameters[name] ?: return null
+    return value.toDoubleOrNull() ?: throw BadRequestException("Query parameter '$name' must be a number")
+}
+
+/** A comma separated parameter, empty if it is missing. */
+fun ApplicationCall.listParam(name: String): List<String> =
+    request.queryParameters[name]?.split(",")?.map { it.trim() }?.filter { it.isNotEmpty() } ?: emptyList()
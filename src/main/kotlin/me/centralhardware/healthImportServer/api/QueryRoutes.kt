@@ -0,0 +1,64 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.http.HttpStatusCode
+import io.ktor.server.plugins.BadRequestException
+import io.ktor.server.request.receiveText
+import io.ktor.server.response.*
+import io.ktor.server.routing.*
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import java.sql.SQLException
+
+/**
+ * Limits of ad hoc queries. What they may do is up to ClickHouse: they run
+ * as `CLICKHOUSE_QUERY_USER`, whose settings profile makes it read-only and
+ * whose grants only cover the health database, see
+ * [ClickHouseMetricStore.readOnlyQuery]. The checks here only give clearer
+ * errors for the obvious mistakes.
+ */
+class ReadOnlyQuery(val maxRows: Int, val timeoutSeconds: Int) {
+
+    /** Returns the query without a trailing semicolon, or throws if it is not a SELECT. */
+    fun validate(sql: String): String {
+        val query = sql.trim().removeSuffix(";").trim()
+        require(query.isNotEmpty()) { "Query is empty" }
+        require(select.containsMatchIn(query)) { "Only SELECT queries are allowed" }
+        return query
+    }
+
+    companion object {
+        private val select = Regex("^(SELECT|WITH)\\b", RegexOption.IGNORE_CASE)
+
+        /** Reads `QUERY_MAX_ROWS` (default 10000) and `QUERY_TIMEOUT_SECONDS` (default 10). */
+        fun fromEnv() = ReadOnlyQuery(
+            maxRows = Env.get("QUERY_MAX_ROWS")?.toInt() ?: 10_000,
+            timeoutSeconds = Env.get("QUERY_TIMEOUT_SECONDS")?.toInt() ?: 10,
+        )
+    }
+}
+
+/**
+ * `POST /api/query` with a SELECT statement as the body returns its columns
+ * and rows as JSON. Results beyond the row limit are paged: the response is
+ * marked as truncated and sending the same query with the `next` cursor
+ * returns the following rows. Pages are only stable if the query has an
+ * ORDER BY.
+ */
+fun Route.queryRoutes(store: ClickHouseMetricStore, limits: ReadOnlyQuery) {
+    post("/query") {
+        val query = try {
+            limits.validate(call.receiveText())
+        } catch (e: IllegalArgumentException) {
+            return@post call.respondText(e.message ?: "Query not allowed", status = HttpStatusCode.BadRequest)
+        }
+        val offset = call.cursorParam()?.let { it.toLongOrNull() ?: throw BadRequestException("Invalid cursor") } ?: 0
+        try {
+            val pageSize = minOf(call.pageSizeParam(limits.maxRows), limits.maxRows)
+            val result = store.readOnlyQuery(query, pageSize, limits.timeoutSeconds, offset)
+            val next = if (result.truncated) (offset + result.rows.size).toString() else null
+            call.respond(result.copy(next = call.linkNext(next)))
+        } catch (e: SQLException) {
+            call.respondText(e.message ?: "Query failed", status = HttpStatusCode.BadRequest)
+        }
+    }
+}
@@ -0,0 +1,99 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.http.ContentType
+import io.ktor.server.application.ApplicationCall
+import io.ktor.server.request.uri
+import io.ktor.server.response.respond
+import io.ktor.server.response.respondText
+import kotlinx.serialization.json.Json
+import kotlinx.serialization.serializer
+import me.centralhardware.healthImportServer.Env
+import redis.clients.jedis.JedisPooled
+import java.time.Duration
+
+/**
+ * Responses of the heavier read endpoints, so dashboards refreshing every
+ * few seconds do not query ClickHouse each time. Entries expire after a TTL
+ * and are all dropped whenever data was written or deleted.
+ */
+interface ResponseCache : AutoCloseable {
+    fun get(key: String): String?
+    fun put(key: String, value: String)
+    fun invalidate()
+    override fun close() {}
+
+    companion object {
+        /**
+         * Reads `API_CACHE_TTL_SECONDS` (default 300, 0 disables caching),
+         * `API_CACHE_REDIS_URL` and `API_CACHE_SIZE` (default 1000 responses
+         * kept in memory without Redis).
+         */
+        fun fromEnv(): ResponseCache? {
+            val ttl = Duration.ofSeconds(Env.get("API_CACHE_TTL_SECONDS")?.toLong() ?: 300)
+            if (ttl.isZero) return null
+            Env.get("API_CACHE_REDIS_URL")?.let { return RedisResponseCache(it, ttl.seconds) }
+            val size = Env.get("API_CACHE_SIZE")?.toInt() ?: 1000
+            return if (size > 0) InMemoryResponseCache(size, ttl) else null
+        }
+    }
+}
+
+class InMemoryResponseCache(private val capacity: Int, private val ttl: Duration) : ResponseCache {
+    private class Entry(val value: String, val expires: Long)
+
+    private val entries = object : LinkedHashMap<String, Entry>(16, 0.75f, true) {
+        override fun removeEldestEntry(eldest: MutableMap.MutableEntry<String, Entry>?) = size > capacity
+    }
+
+    override fun get(key: String): String? = synchronized(entries) {
+        val entry = entries[key] ?: return null
+        if (entry.expires > System.nanoTime()) return entry.value
+        entries.remove(key)
+        null
+    }
+
+    override fun put(key: String, value: String) = synchronized(entries) {
+        entries[key] = Entry(value, System.nanoTime() + ttl.toNanos())
+    }
+
+    override fun invalidate() = synchronized(entries) { entries.clear() }
+}
+
+/**
+ * Keeps responses in Redis, shared between instances. Keys carry a
+ * generation number that [invalidate] increments, so an upload to any
+ * instance hides all older entries at once; they expire by themselves.
+ */
+class RedisResponseCache(
+    url: String,
+    private val ttlSeconds: Long,
+    private val prefix: String = "health-import:cache:",
+) : ResponseCache {
+    private val jedis = JedisPooled(url)
+    private val generationKey = prefix + "generation"
+
+    private fun key(key: String) = prefix + (jedis.get(generationKey) ?: "0") + ":" + key
+
+    override fun get(key: String): String? = jedis.get(key(key))
+
+    override fun put(key: String, value: String) {
+        jedis.setex(key(key), ttlSeconds, value)
+    }
+
+    override fun invalidate() {
+        jedis.incr(generationKey)
+    }
+
+    override fun close() = jedis.close()
+}
+
+/**
+ * Responds with the JSON of [compute], taken from [cache] if the same URL
+ * was requested before. Without a cache this is just `respond(compute())`.
+ */
+suspend inline fun <reified T : Any> ApplicationCall.respondCached(cache: ResponseCache?, compute: () -> T) {
+    if (cache == null) return respond(compute())
+    val key = request.uri
+    val json = cache.get(key) ?: Json.encodeToString(serializer<T>(), compute()).also { cache.put(key, it) }
+    respondText(json, ContentType.Application.Json)
+}
@@ -0,0 +1,46 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.server.plugins.BadRequestException
+import io.ktor.server.response.*
+import io.ktor.server.routing.*
+import kotlinx.serialization.Serializable
+import me.centralhardware.healthImportServer.request.Sample
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import me.centralhardware.healthImportServer.storage.SampleCursor
+import java.time.Instant
+import java.time.format.DateTimeParseException
+
+/**
+ * `GET /api/samples?metric=<metric>&from=<date>&to=<date>&limit=<n>`: the
+ * raw samples of one metric, oldest first, one page at a time. Follow
+ * `next` (or the `Link` header) to get the rest of the range.
+ */
+fun Route.sampleRoutes(store: ClickHouseMetricStore) {
+    get("/samples") {
+        val metric = call.requiredParam("metric")
+        val to = call.dateParam("to", store.days.today())
+        val from = call.dateParam("from", to.minusDays(1))
+        val limit = call.pageSizeParam(1000)
+        // Cursors are `<timestamp>|<source>`, those from before sources were paged are timestamps only.
+        val after = call.cursorParam()?.let {
+            try {
+                SampleCursor(Instant.parse(it.substringBefore('|')), it.substringAfter('|', ""))
+            } catch (_: DateTimeParseException) {
+                throw BadRequestException("Invalid cursor")
+            }
+        }
+        val (page, last) = store.samplesPage(metric, from, to, after, limit)
+        val next = last?.let { "${it.timestamp}|${it.source}" }
+        call.respond(
+            SamplePage(
+                metric = metric,
+                units = page.map { it.second }.distinct(),
+                data = page.map { it.first },
+                next = call.linkNext(next),
+            )
+        )
+    }
+}
+
+@Serializable
+data class SamplePage(val metric: String, val units: List<String>, val data: List<Sample>, val next: String?)
@@ -0,0 +1,22 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.server.response.*
+import io.ktor.server.routing.*
+import kotlinx.serialization.Serializable
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import me.centralhardware.healthImportServer.storage.MetricInfo
+import me.centralhardware.healthImportServer.storage.TableSchema
+
+/**
+ * `GET /api/schema`: the tables and columns of the database and the metrics
+ * stored so far, read from ClickHouse on every request so it always matches
+ * the migrations and `CLICKHOUSE_METRIC_TABLES`.
+ */
+fun Route.schemaRoutes(store: ClickHouseMetricStore) {
+    get("/schema") {
+        call.respond(Schema(store.tableSchemas(), store.metricCatalog()))
+    }
+}
+
+@Serializable
+data class Schema(val tables: List<TableSchema>, val metrics: List<MetricInfo>)
@@ -0,0 +1,50 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.server.plugins.BadRequestException
+import io.ktor.server.response.*
+import io.ktor.server.routing.*
+import kotlinx.serialization.Serializable
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import me.centralhardware.healthImportServer.storage.DownsampleMethod
+import me.centralhardware.healthImportServer.storage.SeriesPoint
+
+/**
+ * `GET /api/series?metric=heart_rate&field=avg&from=<date>&to=<date>&points=500&method=bucket|lttb`:
+ * a metric reduced to about `points` points by ClickHouse, so a chart does
+ * not have to fetch every sample of the range.
+ */
+fun Route.seriesRoutes(store: ClickHouseMetricStore, cache: ResponseCache? = null) {
+    get("/series") {
+        val metric = call.requiredParam("metric")
+        val field = call.choiceParam("field", ClickHouseMetricStore.VALUE_COLUMNS, "qty")
+        val to = call.dateParam("to", store.days.today())
+        val from = call.dateParam("from", to.minusDays(7))
+        val points = call.intParam("points", 500)
+        if (points !in 2..Pagination.maxPageSize) {
+            throw BadRequestException("Query parameter 'points' must be between 2 and ${Pagination.maxPageSize}")
+        }
+        val method = DownsampleMethod.valueOf(
+            call.choiceParam("method", DownsampleMethod.entries.map { it.name.lowercase() }.toSet(), "bucket").uppercase()
+        )
+        call.respondCached(cache) {
+            Series(
+                metric = metric,
+                field = field,
+                from = from.toString(),
+                to = to.toString(),
+                method = method.name.lowercase(),
+                points = store.series(metric, field, from, to, points, method),
+            )
+        }
+    }
+}
+
+@Serializable
+data class Series(
+    val metric: String,
+    val field: String,
+    val from: String,
+    val to: String,
+    val method: String,
+    val points: List<SeriesPoint>,
+)
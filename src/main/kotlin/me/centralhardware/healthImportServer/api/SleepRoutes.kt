@@ -0,0 +1,24 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.server.response.*
+import io.ktor.server.routing.*
+import me.centralhardware.healthImportServer.analytics.SleepSessions
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import java.time.LocalDate
+
+/**
+ * `GET /api/sleep?from=<date>&to=<date>`: one entry per night and source
+ * with bed and wake time, hours per phase and sleep efficiency. Nights are
+ * dated with the day they ended on.
+ */
+fun Route.sleepRoutes(store: ClickHouseMetricStore, cache: ResponseCache? = null) {
+    get("/sleep") {
+        val to = call.dateParam("to", store.days.today())
+        val from = call.dateParam("from", to.minusDays(7))
+        call.respondCached(cache) {
+            // A night ending on `from` started the day before.
+            val samples = store.samplesBetween("sleep_analysis", from.minusDays(1), to)
+            SleepSessions.assemble(samples, store.days.zone()).filter { LocalDate.parse(it.night) in from..to }
+        }
+    }
+}
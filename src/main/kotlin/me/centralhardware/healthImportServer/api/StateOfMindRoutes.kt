@@ -0,0 +1,26 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.server.response.*
+import io.ktor.server.routing.*
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import me.centralhardware.healthImportServer.storage.StateOfMindFilter
+
+/**
+ * `GET /api/state-of-mind?from=<date>&to=<date>&kind=dailyMood&minValence=-1&maxValence=1&labels=happy,calm&associations=work`:
+ * logged moods and emotions, oldest first, for journaling apps and mood
+ * dashboards.
+ */
+fun Route.stateOfMindRoutes(store: ClickHouseMetricStore) {
+    get("/state-of-mind") {
+        val to = call.dateParam("to", store.days.today())
+        val from = call.dateParam("from", to.minusDays(30))
+        val filter = StateOfMindFilter(
+            kinds = call.listParam("kind"),
+            minValence = call.doubleParam("minValence"),
+            maxValence = call.doubleParam("maxValence"),
+            labels = call.listParam("labels"),
+            associations = call.listParam("associations"),
+        )
+        call.respond(store.stateOfMind(from, to, filter))
+    }
+}
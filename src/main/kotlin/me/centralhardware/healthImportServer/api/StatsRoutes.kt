@@ -0,0 +1,19 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.server.response.*
+import io.ktor.server.routing.*
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+
+/**
+ * `GET /api/stats?granularity=hour|day|week|month&from=<date>&to=<date>`:
+ * uploads, rows written, bytes received and failures per period, for an
+ * ingestion health panel.
+ */
+fun Route.statsRoutes(store: ClickHouseMetricStore, cache: ResponseCache? = null) {
+    get("/stats") {
+        val granularity = call.choiceParam("granularity", ClickHouseMetricStore.GRANULARITIES.keys, "day")
+        val to = call.dateParam("to", store.days.today())
+        val from = call.dateParam("from", to.minusDays(30))
+        call.respondCached(cache) { store.importStats(granularity, from, to) }
+    }
+}
@@ -0,0 +1,72 @@
+package me.centralhardware.healthImportServer.api
+
+import me.centralhardware.healthImportServer.storage.ApiToken
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import org.slf4j.LoggerFactory
+import java.security.MessageDigest
+import java.security.SecureRandom
+import java.time.Duration
+import java.time.Instant
+import java.util.Base64
+import java.util.concurrent.ConcurrentHashMap
+
+/**
+ * Tokens created with the `token` command, read from the `api_tokens` table
+ * again every [refresh], so created and revoked tokens take effect without a
+ * restart. When a token was last used is written at most every five minutes.
+ */
+class StoredTokens(private val store: ClickHouseMetricStore, private val refresh: Duration) {
+    val log = LoggerFactory.getLogger(StoredTokens::class.java)
+
+    @Volatile private var byHash: Map<String, ApiToken> = emptyMap()
+    @Volatile private var loadedAt = 0L
+    private val usageWritten = ConcurrentHashMap<String, Instant>()
+
+    /** Whether a token was ever created, revoked ones included. */
+    fun exist(): Boolean {
+        reload()
+        return byHash.isNotEmpty()
+    }
+
+    fun role(token: String): TokenRole? {
+        if (System.nanoTime() - loadedAt > refresh.toNanos()) reload()
+        val stored = byHash[hash(token)]?.takeIf { it.revokedAt == null } ?: return null
+        recordUsage(stored.id)
+        return TokenRole.of(stored.role)
+    }
+
+    private fun reload() {
+        try {
+            byHash = store.apiTokens().associateBy { it.hash }
+        } catch (e: Exception) {
+            log.warn("Failed to read API tokens, keeping the ${byHash.size} read before", e)
+        }
+        loadedAt = System.nanoTime()
+    }
+
+    private fun recordUsage(id: String) {
+        val now = Instant.now()
+        val written = usageWritten[id]
+        if (written != null && written.plus(USAGE_INTERVAL).isAfter(now)) return
+        usageWritten[id] = now
+        try {
+            store.storeApiTokenUsage(id, now)
+        } catch (e: Exception) {
+            log.warn("Failed to record usage of API token $id", e)
+        }
+    }
+
+    companion object {
+        private val USAGE_INTERVAL = Duration.ofMinutes(5)
+        private val random = SecureRandom()
+
+        fun hash(token: String): String =
+            MessageDigest.getInstance("SHA-256").digest(token.toByteArray()).joinToString("") { "%02x".format(it) }
+
+        /** A new random token, 256 bits encoded as URL safe base64. */
+        fun generate(): String {
+            val bytes = ByteArray(32).also { random.nextBytes(it) }
+            return Base64.getUrlEncoder().withoutPadding().encodeToString(bytes)
+        }
+    }
+}
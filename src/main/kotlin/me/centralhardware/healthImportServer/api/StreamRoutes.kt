@@ -0,0 +1,51 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.http.*
+import io.ktor.server.response.*
+import io.ktor.server.routing.*
+import kotlinx.coroutines.coroutineScope
+import kotlinx.coroutines.delay
+import kotlinx.coroutines.launch
+import kotlinx.coroutines.sync.Mutex
+import kotlinx.coroutines.sync.withLock
+import kotlinx.serialization.json.Json
+import me.centralhardware.healthImportServer.monitoring.LiveEvent
+import me.centralhardware.healthImportServer.monitoring.LiveFeed
+
+/**
+ * `GET /api/stream?metrics=<names>&type=metric|workout|all` streams the
+ * samples and workouts being written as server-sent events, one `metric`
+ * or `workout` event per sample or workout with a [LiveEvent] as data. A
+ * comment line is sent every 15 seconds, so proxies keep quiet connections
+ * open.
+ */
+fun Route.streamRoutes(feed: LiveFeed) {
+    get("/stream") {
+        val metrics = call.listParam("metrics").toSet()
+        val type = call.choiceParam("type", setOf(LiveEvent.METRIC, LiveEvent.WORKOUT, "all"), "all")
+        call.response.cacheControl(CacheControl.NoCache(null))
+        call.respondTextWriter(ContentType.Text.EventStream) {
+            val lock = Mutex()
+            suspend fun send(text: String) = lock.withLock {
+                write(text)
+                flush()
+            }
+            coroutineScope {
+                launch {
+                    while (true) {
+                        delay(KEEPALIVE_MILLIS)
+                        send(": keepalive\n\n")
+                    }
+                }
+                send(": connected\n\n")
+                feed.events.collect { event ->
+                    if (type != "all" && event.type != type) return@collect
+                    if (event.type == LiveEvent.METRIC && metrics.isNotEmpty() && event.name !in metrics) return@collect
+                    send("event: ${event.type}\ndata: ${Json.encodeToString(LiveEvent.serializer(), event)}\n\n")
+                }
+            }
+        }
+    }
+}
+
+private const val KEEPALIVE_MILLIS = 15_000L
@@ -0,0 +1,57 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.server.response.*
+import io.ktor.server.routing.*
+import kotlinx.serialization.Serializable
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import java.time.Duration
+
+/**
+ * `GET /api/today`: a small summary meant for iOS Shortcuts widgets.
+ */
+fun Route.todayRoutes(store: ClickHouseMetricStore) {
+    get("/today") {
+        // The day the daily values below are grouped by, not necessarily the one of this server.
+        val today = store.today()
+        val steps = store.dailyValues("step_count", "qty", "sum", today, today)[today]
+        // Auto Export dates aggregated sleep with the day the night ended.
+        val sleep = store.dailyValues("sleep_analysis", "asleep", "sum", today, today)[today]
+        val workout = store.lastWorkout()?.let { w ->
+            val hasDistance = w.distance > 0
+            TodayWorkout(
+                name = w.name,
+                start = w.start.toString(),
+                minutes = Duration.between(w.start, w.end).toMinutes(),
+                distance = if (hasDistance) w.distance else null,
+                distanceUnits = if (hasDistance) w.distanceUnits else null,
+                activeEnergy = if (w.activeEnergy > 0) w.activeEnergy else null,
+            )
+        }
+        val weight = store.latestSample("weight_body_mass")?.let {
+            TodayWeight(value = it.qty, units = it.units, date = it.timestamp.toString())
+        }
+        call.respond(TodaySummary(today.toString(), steps, sleep, workout, weight))
+    }
+}
+
+@Serializable
+data class TodaySummary(
+    val date: String,
+    val steps: Double?,
+    val sleepHours: Double?,
+    val lastWorkout: TodayWorkout?,
+    val latestWeight: TodayWeight?,
+)
+
+@Serializable
+data class TodayWorkout(
+    val name: String,
+    val start: String,
+    val minutes: Long,
+    val distance: Double?,
+    val distanceUnits: String?,
+    val activeEnergy: Double?,
+)
+
+@Serializable
+data class TodayWeight(val value: Double, val units: String, val date: String)
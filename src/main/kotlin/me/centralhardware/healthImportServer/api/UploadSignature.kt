@@ -0,0 +1,58 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.util.AttributeKey
+import java.security.MessageDigest
+import java.time.Duration
+import java.time.Instant
+import javax.crypto.Mac
+import javax.crypto.spec.SecretKeySpec
+import me.centralhardware.healthImportServer.Env
+
+/**
+ * Checks `X-Timestamp` (unix seconds) and `X-Signature`, the hex HMAC-SHA256
+ * of `<timestamp>\n<body>`, on uploads. Requests outside of [window] are
+ * rejected, and so is a signature seen before within the window, so a
+ * captured request can not be sent again.
+ */
+class UploadSignature(key: String, private val window: Duration) {
+    private val secret = SecretKeySpec(key.toByteArray(), "HmacSHA256")
+    private val seen = LinkedHashMap<String, Instant>()
+
+    /** Returns why the request is rejected, or null if it is valid. */
+    fun verify(timestamp: String?, signature: String?, body: ByteArray, now: Instant = Instant.now()): String? {
+        if (timestamp == null || signature == null) return "Missing $TIMESTAMP_HEADER or $SIGNATURE_HEADER header"
+        val sentAt = timestamp.toLongOrNull()?.let { Instant.ofEpochSecond(it) } ?: return "Invalid $TIMESTAMP_HEADER"
+        if (Duration.between(sentAt, now).abs() > window) return "Request timestamp outside of the allowed window"
+        if (!MessageDigest.isEqual(sign(timestamp, body).toByteArray(), signature.lowercase().toByteArray())) {
+            return "Invalid signature"
+        }
+        synchronized(seen) {
+            val expired = now.minus(window)
+            seen.entries.removeIf { it.value.isBefore(expired) }
+            if (seen.putIfAbsent(signature.lowercase(), sentAt) != null) return "Request was already received"
+        }
+        return null
+    }
+
+    fun sign(timestamp: String, body: ByteArray): String {
+        val mac = Mac.getInstance("HmacSHA256")
+        mac.init(secret)
+        mac.update("$timestamp\n".toByteArray())
+        return mac.doFinal(body).joinToString("") { "%02x".format(it) }
+    }
+
+    companion object {
+        const val TIMESTAMP_HEADER = "X-Timestamp"
+        const val SIGNATURE_HEADER = "X-Signature"
+
+        /** Set on calls whose signature was verified, so [AuthGuard] counts them as authenticated. */
+        val VERIFIED = AttributeKey<Unit>("UploadSignatureVerified")
+
+        /** Reads `UPLOAD_SIGNING_KEY` and `UPLOAD_SIGNATURE_WINDOW_SECONDS` (default 300). */
+        fun fromEnv(): UploadSignature? {
+            val key = Env.get("UPLOAD_SIGNING_KEY") ?: return null
+            val window = Env.get("UPLOAD_SIGNATURE_WINDOW_SECONDS")?.toLong() ?: 300
+            return UploadSignature(key, Duration.ofSeconds(window))
+        }
+    }
+}
@@ -0,0 +1,74 @@
+package me.centralhardware.healthImportServer.dedup
+
+import redis.clients.jedis.JedisPooled
+import redis.clients.jedis.params.ScanParams
+
+/**
+ * Remembers keys of recently written samples.
+ */
+interface DedupCache : AutoCloseable {
+    /** Returns the subset of [keys] that has already been written. */
+    fun seen(keys: Collection<String>): Set<String>
+    fun remember(keys: Collection<String>)
+    /** Forgets the keys starting with [prefix], so their samples are written again when they are sent. */
+    fun forget(prefix: String)
+    override fun close() {}
+}
+
+class InMemoryDedupCache(private val capacity: Int) : DedupCache {
+    private val entries = object : LinkedHashMap<String, Boolean>(capacity, 0.75f, true) {
+        override fun removeEldestEntry(eldest: MutableMap.MutableEntry<String, Boolean>?) = size > capacity
+    }
+
+    override fun seen(keys: Collection<String>): Set<String> = synchronized(entries) {
+        keys.filterTo(mutableSetOf()) { entries[it] != null }
+    }
+
+    override fun remember(keys: Collection<String>) = synchronized(entries) {
+        keys.forEach { entries[it] = true }
+    }
+
+    override fun forget(prefix: String) {
+        synchronized(entries) { entries.keys.removeIf { it.startsWith(prefix) } }
+    }
+}
+
+class RedisDedupCache(
+    url: String,
+    private val ttlSeconds: Long,
+    private val prefix: String = "health-import:dedup:",
+) : DedupCache {
+    private val jedis = JedisPooled(url)
+
+    override fun seen(keys: Collection<String>): Set<String> {
+        val seen = mutableSetOf<String>()
+        for (batch in keys.chunked(1000)) {
+            val values = jedis.mget(*batch.map { prefix + it }.toTypedArray())
+            batch.forEachIndexed { i, key -> if (values[i] != null) seen += key }
+        }
+        return seen
+    }
+
+    override fun remember(keys: Collection<String>) {
+        for (batch in keys.chunked(1000)) {
+            jedis.pipelined().use { pipeline ->
+                batch.forEach { pipeline.setex(prefix + it, ttlSeconds, "1") }
+                pipeline.sync()
+            }
+        }
+    }
+
+    override fun forget(prefix: String) {
+        // Glob characters in metric names are matched literally.
+        val pattern = (this.prefix + prefix).replace(Regex("[*?\\[\\]\\\\]")) { "\\" + it.value } + "*"
+        val params = ScanParams().match(pattern).count(1000)
+        var cursor = ScanParams.SCAN_POINTER_START
+        do {
+            val page = jedis.scan(cursor, params)
+            if (page.result.isNotEmpty()) jedis.del(*page.result.toTypedArray())
+            cursor = page.cursor
+        } while (cursor != ScanParams.SCAN_POINTER_START)
+    }
+
+    override fun close() = jedis.close()
+}
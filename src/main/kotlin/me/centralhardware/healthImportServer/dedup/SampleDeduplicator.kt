@@ -0,0 +1,49 @@
+package me.centralhardware.healthImportServer.dedup
+
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.Sample
+
+/**
+ * Drops samples that were already written by a previous upload. Auto Export
+ * sends overlapping windows on every sync, so most samples of a regular upload
+ * have been seen before.
+ *
+ * The key includes the sample values, so a corrected aggregate for the same
+ * timestamp is still written.
+ */
+class SampleDeduplicator(private val cache: DedupCache) {
+
+    fun filter(metrics: List<Metric>): DedupResult {
+        val keyed = metrics.map { m -> m to m.data.map { key(m, it) } }
+        val seen = cache.seen(keyed.flatMap { it.second })
+        var skipped = 0
+        val fresh = keyed.mapNotNull { (m, keys) ->
+            val data = m.data.filterIndexed { i, _ -> keys[i] !in seen }
+            skipped += m.data.size - data.size
+            if (data.isEmpty()) null else m.copy(data = data)
+        }
+        val newKeys = keyed.flatMap { it.second }.filterNot { it in seen }
+        return DedupResult(fresh, newKeys, skipped)
+    }
+
+    /** The keys of the samples of [metrics], to [remember] only some of those [filter] let through. */
+    fun keys(metrics: List<Metric>): List<String> = metrics.flatMap { m -> m.data.map { key(m, it) } }
+
+    /** Marks samples as written; called only after the store succeeded. */
+    fun remember(keys: Collection<String>) = cache.remember(keys)
+
+    /** Forgets the samples of [metric], after they were purged or corrected, so sending them again writes them. */
+    fun forget(metric: String) = cache.forget("$metric|")
+
+    private fun key(m: Metric, s: Sample): String =
+        listOf(
+            m.name, s.date ?: s.startDate, s.sleepSource ?: s.inBedSource ?: s.source,
+            s.qty, s.min, s.max, s.avg, s.asleep, s.inBed, s.value
+        ).joinToString("|") { it?.toString() ?: "" }
+}
+
+data class DedupResult(
+    val metrics: List<Metric>,
+    val keys: List<String>,
+    val skipped: Int,
+)
@@ -0,0 +1,117 @@
+package me.centralhardware.healthImportServer.migrate
+
+import me.centralhardware.healthImportServer.LimitedInputStream
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.QtyUnit
+import me.centralhardware.healthImportServer.request.Sample
+import me.centralhardware.healthImportServer.request.Workout
+import java.io.InputStream
+import java.util.UUID
+import java.util.zip.ZipInputStream
+import javax.xml.stream.XMLInputFactory
+import javax.xml.stream.XMLStreamConstants
+import javax.xml.stream.XMLStreamReader
+
+/**
+ * Reads `export.xml` of the Apple Health app's "Export All Health Data", or
+ * the `export.zip` archive containing it. Quantity records become metric
+ * samples and workouts keep their totals; category records such as sleep
+ * analysis and everything else in the file are skipped.
+ */
+object AppleHealthXml {
+    private const val QUANTITY_PREFIX = "HKQuantityTypeIdentifier"
+    private const val WORKOUT_PREFIX = "HKWorkoutActivityType"
+
+    /** Identifiers whose Auto Export name is not just the snake cased identifier. */
+    private val names = mapOf(
+        "ActiveEnergyBurned" to "active_energy",
+        "DistanceWalkingRunning" to "walking_running_distance",
+        "HeartRateVariabilitySDNN" to "heart_rate_variability",
+        "OxygenSaturation" to "blood_oxygen_saturation",
+        "BodyMass" to "weight_body_mass",
+    )
+
+    private val factory = XMLInputFactory.newInstance().apply {
+        // export.xml carries an inline DTD; never resolve anything it points to.
+        setProperty(XMLInputFactory.SUPPORT_DTD, false)
+        setProperty(XMLInputFactory.IS_SUPPORTING_EXTERNAL_ENTITIES, false)
+    }
+
+    fun parse(input: InputStream): Export {
+        val reader = factory.createXMLStreamReader(input)
+        val samples = linkedMapOf<Pair<String, String>, MutableList<Sample>>()
+        val workouts = mutableListOf<Workout>()
+        try {
+            while (reader.hasNext()) {
+                if (reader.next() != XMLStreamConstants.START_ELEMENT) continue
+                when (reader.localName) {
+                    "Record" -> {
+                        val type = reader.attr("type")?.takeIf { it.startsWith(QUANTITY_PREFIX) } ?: continue
+                        val value = reader.attr("value")?.toDoubleOrNull() ?: continue
+                        val name = metricName(type.removePrefix(QUANTITY_PREFIX))
+                        samples.getOrPut(name to (reader.attr("unit") ?: "")) { mutableListOf() } +=
+                            Sample(date = reader.attr("startDate"), qty = value)
+                    }
+                    "Workout" -> workouts += readWorkout(reader)
+                }
+            }
+        } finally {
+            reader.close()
+        }
+        return Export(
+            metrics = samples.map { (key, data) -> Metric(key.first, key.second, data) },
+            workouts = workouts,
+        )
+    }
+
+    /** Reads the `export.xml` entry of an `export.zip` archive, failing once it inflates beyond [maxBytes]. */
+    fun parseArchive(input: InputStream, maxBytes: Long = Long.MAX_VALUE): Export {
+        ZipInputStream(input).use { zip ->
+            while (true) {
+                val entry = zip.nextEntry ?: break
+                if (entry.name.substringAfterLast('/') == "export.xml") return parse(LimitedInputStream(zip, maxBytes))
+            }
+        }
+        throw IllegalArgumentException("Archive does not contain export.xml")
+    }
+
+    private fun readWorkout(reader: XMLStreamReader): Workout {
+        val type = reader.attr("workoutActivityType")?.removePrefix(WORKOUT_PREFIX) ?: "Other"
+        val start = reader.attr("startDate")
+        var energy = quantity(reader.attr("totalEnergyBurned"), reader.attr("totalEnergyBurnedUnit"))
+        var distance = quantity(reader.attr("totalDistance"), reader.attr("totalDistanceUnit"))
+        val workout = Workout(
+            id = UUID.nameUUIDFromBytes("applehealth|$type|$start".toByteArray()).toString(),
+            name = type.replace(Regex("(?<=[a-z])(?=[A-Z])"), " "),
+            start = start,
+            end = reader.attr("endDate"),
+        )
+        // Newer exports keep the totals in WorkoutStatistics children.
+        var depth = 1
+        while (depth > 0 && reader.hasNext()) {
+            when (reader.next()) {
+                XMLStreamConstants.START_ELEMENT -> {
+                    depth++
+                    if (reader.localName != "WorkoutStatistics") continue
+                    val total = quantity(reader.attr("sum"), reader.attr("unit")) ?: continue
+                    when (reader.attr("type")?.removePrefix(QUANTITY_PREFIX)) {
+                        "ActiveEnergyBurned" -> energy = energy ?: total
+                        "DistanceWalkingRunning", "DistanceCycling", "DistanceSwimming" -> distance = distance ?: total
+                    }
+                }
+                XMLStreamConstants.END_ELEMENT -> depth--
+            }
+        }
+        return workout.copy(activeEnergyBurned = energy, distance = distance)
+    }
+
+    private fun quantity(value: String?, units: String?): QtyUnit? =
+        value?.toDoubleOrNull()?.let { QtyUnit(it, units) }
+
+    /** `StepCount` becomes `step_count`, matching the JSON export. */
+    private fun metricName(identifier: String): String =
+        names[identifier] ?: identifier.replace(Regex("(?<=[a-z0-9])(?=[A-Z])"), "_").lowercase()
+
+    private fun XMLStreamReader.attr(name: String): String? = getAttributeValue(null, name)
+}
@@ -0,0 +1,157 @@
+package me.centralhardware.healthImportServer.migrate
+
+import me.centralhardware.healthImportServer.request.GPSLog
+import me.centralhardware.healthImportServer.request.HeartRateLog
+import me.centralhardware.healthImportServer.request.QtyUnit
+import me.centralhardware.healthImportServer.request.Timestamps
+import me.centralhardware.healthImportServer.request.Workout
+import java.nio.ByteBuffer
+import java.nio.ByteOrder
+import java.time.Instant
+import java.util.UUID
+
+/**
+ * Decodes the parts of a FIT activity file (as written by HealthFit) that map
+ * onto a [Workout]: the session summary and the per-second records with
+ * position, altitude and heart rate. Everything else is skipped.
+ */
+object FitDecoder {
+    private const val FIT_EPOCH = 631_065_600L
+    private const val SESSION = 18
+    private const val RECORD = 20
+    private const val TIMESTAMP = 253
+
+    private val sports = mapOf(
+        1 to "Running", 2 to "Cycling", 4 to "Fitness Equipment", 5 to "Swimming", 10 to "Training",
+        11 to "Walking", 15 to "Rowing", 17 to "Hiking", 21 to "E-Biking",
+    )
+
+    private class Field(val number: Int, val size: Int, val baseType: Int)
+
+    private class Definition(val global: Int, val order: ByteOrder, val fields: List<Field>, val developerSize: Int)
+
+    fun decode(bytes: ByteArray, name: String): Workout? {
+        val buffer = ByteBuffer.wrap(bytes).order(ByteOrder.LITTLE_ENDIAN)
+        val headerSize = bytes[0].toInt() and 0xFF
+        require(bytes.size >= 12 && String(bytes, 8, 4) == ".FIT") { "$name is not a FIT file" }
+        val dataEnd = minOf(bytes.size, headerSize + buffer.getInt(4))
+        buffer.position(headerSize)
+
+        val definitions = mutableMapOf<Int, Definition>()
+        val sessions = mutableListOf<Map<Int, Long>>()
+        val records = mutableListOf<Map<Int, Long>>()
+        var lastTimestamp = 0L
+        while (buffer.position() < dataEnd) {
+            val header = buffer.get().toInt() and 0xFF
+            if (header and 0x80 != 0) {
+                // Compressed timestamp header: five bits of offset to the last timestamp.
+                val definition = definitions[(header shr 5) and 0x03] ?: error("Undefined local message in $name")
+                val offset = (header and 0x1F).toLong()
+                lastTimestamp = if (offset >= (lastTimestamp and 0x1F)) (lastTimestamp and 0x1F.inv().toLong()) + offset
+                else (lastTimestamp and 0x1F.inv().toLong()) + offset + 0x20
+                val values = readData(buffer, definition).toMutableMap()
+                values[TIMESTAMP] = lastTimestamp
+                collect(definition, values, sessions, records)
+            } else if (header and 0x40 != 0) {
+                definitions[header and 0x0F] = readDefinition(buffer, header and 0x20 != 0)
+            } else {
+                val definition = definitions[header and 0x0F] ?: error("Undefined local message in $name")
+                val values = readData(buffer, definition)
+                values[TIMESTAMP]?.let { lastTimestamp = it }
+                collect(definition, values, sessions, records)
+            }
+        }
+
+        val session = sessions.firstOrNull() ?: return null
+        val start = instant(session[2] ?: records.firstNotNullOfOrNull { it[TIMESTAMP] } ?: return null)
+        val end = start.plusMillis(session[7] ?: 0L)
+        return Workout(
+            id = UUID.nameUUIDFromBytes("fit|$name|$start".toByteArray()).toString(),
+            name = sports[session[5]?.toInt()] ?: "Other",
+            start = Timestamps.format(start),
+            end = Timestamps.format(end),
+            activeEnergyBurned = session[11]?.let { QtyUnit(it.toDouble(), "kcal") },
+            distance = session[9]?.let { QtyUnit(it / 100_000.0, "km") },
+            elevationUp = session[22]?.let { QtyUnit(it.toDouble(), "m") },
+            elevationDown = session[23]?.let { QtyUnit(it.toDouble(), "m") },
+            route = records.mapNotNull { record ->
+                val lat = record[0]?.toInt() ?: return@mapNotNull null
+                val lon = record[1]?.toInt() ?: return@mapNotNull null
+                GPSLog(
+                    latitude = semicircles(lat),
+                    longitude = semicircles(lon),
+                    altitude = (record[78] ?: record[2])?.let { it / 5.0 - 500 },
+                    timestamp = record[TIMESTAMP]?.let { Timestamps.format(instant(it)) },
+                    speed = record[73]?.let { it / 1000.0 } ?: record[6]?.let { it / 1000.0 },
+                )
+            },
+            heartRateData = records.mapNotNull { record ->
+                val bpm = record[3]?.toDouble() ?: return@mapNotNull null
+                val ts = record[TIMESTAMP] ?: return@mapNotNull null
+                HeartRateLog(min = bpm, max = bpm, avg = bpm, units = "count/min", source = "FIT", date = Timestamps.format(instant(ts)))
+            },
+        )
+    }
+
+    private fun collect(
+        definition: Definition,
+        values: Map<Int, Long>,
+        sessions: MutableList<Map<Int, Long>>,
+        records: MutableList<Map<Int, Long>>,
+    ) {
+        when (definition.global) {
+            SESSION -> sessions += values
+            RECORD -> records += values
+        }
+    }
+
+    private fun readDefinition(buffer: ByteBuffer, developer: Boolean): Definition {
+        buffer.get() // reserved
+        val order = if (buffer.get().toInt() == 0) ByteOrder.LITTLE_ENDIAN else ByteOrder.BIG_ENDIAN
+        val global = buffer.order(order).short.toInt() and 0xFFFF
+        buffer.order(ByteOrder.LITTLE_ENDIAN)
+        val fields = List(buffer.get().toInt() and 0xFF) {
+            Field(buffer.get().toInt() and 0xFF, buffer.get().toInt() and 0xFF, buffer.get().toInt() and 0xFF)
+        }
+        var developerSize = 0
+        if (developer) {
+            repeat(buffer.get().toInt() and 0xFF) {
+                buffer.get()
+                developerSize += buffer.get().toInt() and 0xFF
+                buffer.get()
+            }
+        }
+        return Definition(global, order, fields, developerSize)
+    }
+
+    /** Reads integer fields; invalid values, arrays and strings are left out. */
+    private fun readData(buffer: ByteBuffer, definition: Definition): MutableMap<Int, Long> {
+        val values = mutableMapOf<Int, Long>()
+        buffer.order(definition.order)
+        for (field in definition.fields) {
+            val start = buffer.position()
+            val type = field.baseType and 0x1F
+            val value = when (field.size to type) {
+                1 to 0, 1 to 2, 1 to 13 -> (buffer.get().toLong() and 0xFF).takeIf { it != 0xFFL }
+                1 to 10 -> (buffer.get().toLong() and 0xFF).takeIf { it != 0L }
+                1 to 1 -> buffer.get().toLong().takeIf { it != 0x7FL }
+                2 to 3 -> buffer.short.toLong().takeIf { it != 0x7FFFL }
+                2 to 4 -> (buffer.short.toLong() and 0xFFFF).takeIf { it != 0xFFFFL }
+                2 to 11 -> (buffer.short.toLong() and 0xFFFF).takeIf { it != 0L }
+                4 to 5 -> buffer.int.toLong().takeIf { it != 0x7FFFFFFFL }
+                4 to 6 -> (buffer.int.toLong() and 0xFFFFFFFFL).takeIf { it != 0xFFFFFFFFL }
+                4 to 12 -> (buffer.int.toLong() and 0xFFFFFFFFL).takeIf { it != 0L }
+                else -> null
+            }
+            buffer.position(start + field.size)
+            if (value != null) values[field.number] = value
+        }
+        buffer.position(buffer.position() + definition.developerSize)
+        buffer.order(ByteOrder.LITTLE_ENDIAN)
+        return values
+    }
+
+    private fun instant(fitSeconds: Long): Instant = Instant.ofEpochSecond(FIT_EPOCH + fitSeconds)
+
+    private fun semicircles(value: Int): Double = value * (180.0 / (1L shl 31))
+}
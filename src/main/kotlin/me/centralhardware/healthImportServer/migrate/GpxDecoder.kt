@@ -0,0 +1,75 @@
+package me.centralhardware.healthImportServer.migrate
+
+import me.centralhardware.healthImportServer.request.GPSLog
+import me.centralhardware.healthImportServer.request.HeartRateLog
+import me.centralhardware.healthImportServer.request.Timestamps
+import me.centralhardware.healthImportServer.request.Workout
+import java.io.ByteArrayInputStream
+import java.util.UUID
+import javax.xml.stream.XMLInputFactory
+import javax.xml.stream.XMLStreamConstants
+
+/**
+ * Decodes a GPX track into a [Workout] with its route. Heart rate is read
+ * from the Garmin `TrackPointExtension` (`<gpxtpx:hr>`) when present.
+ */
+object GpxDecoder {
+    private val factory = XMLInputFactory.newInstance().apply {
+        setProperty(XMLInputFactory.SUPPORT_DTD, false)
+        setProperty(XMLInputFactory.IS_SUPPORTING_EXTERNAL_ENTITIES, false)
+    }
+
+    private class Point(val lat: Double, val lon: Double, var ele: Double? = null, var time: String? = null, var hr: Double? = null)
+
+    fun decode(bytes: ByteArray, name: String): Workout? {
+        val reader = factory.createXMLStreamReader(ByteArrayInputStream(bytes))
+        val points = mutableListOf<Point>()
+        var type: String? = null
+        var point: Point? = null
+        try {
+            while (reader.hasNext()) {
+                when (reader.next()) {
+                    XMLStreamConstants.START_ELEMENT -> when (reader.localName) {
+                        "trkpt" -> {
+                            val lat = reader.getAttributeValue(null, "lat")?.toDoubleOrNull()
+                            val lon = reader.getAttributeValue(null, "lon")?.toDoubleOrNull()
+                            point = if (lat != null && lon != null) Point(lat, lon) else null
+                        }
+                        "ele" -> point?.ele = reader.elementText.trim().toDoubleOrNull()
+                        "time" -> point?.time = reader.elementText.trim()
+                        "hr" -> point?.hr = reader.elementText.trim().toDoubleOrNull()
+                        "type" -> if (point == null && type == null) type = reader.elementText.trim()
+                    }
+                    XMLStreamConstants.END_ELEMENT -> if (reader.localName == "trkpt") {
+                        point?.let { points += it }
+                        point = null
+                    }
+                }
+            }
+        } finally {
+            reader.close()
+        }
+
+        val times = points.mapNotNull { Timestamps.parseOrNull(it.time) }
+        val start = times.minOrNull() ?: return null
+        return Workout(
+            id = UUID.nameUUIDFromBytes("gpx|$name|$start".toByteArray()).toString(),
+            name = type?.replaceFirstChar { it.uppercase() } ?: "Other",
+            start = Timestamps.format(start),
+            end = Timestamps.format(times.max()),
+            route = points.map { p ->
+                GPSLog(
+                    latitude = p.lat,
+                    longitude = p.lon,
+                    altitude = p.ele,
+                    timestamp = Timestamps.parseOrNull(p.time)?.let { Timestamps.format(it) },
+                )
+            },
+            heartRateData = points.mapNotNull { p ->
+                val bpm = p.hr ?: return@mapNotNull null
+                val ts = Timestamps.parseOrNull(p.time) ?: return@mapNotNull null
+                HeartRateLog(min = bpm, max = bpm, avg = bpm, units = "count/min", source = "GPX", date = Timestamps.format(ts))
+            },
+        )
+    }
+}
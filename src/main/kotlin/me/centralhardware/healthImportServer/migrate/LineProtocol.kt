@@ -0,0 +1,78 @@
+package me.centralhardware.healthImportServer.migrate
+
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.Sample
+import me.centralhardware.healthImportServer.request.Timestamps
+import java.time.Instant
+
+/**
+ * Reads InfluxDB line protocol, as written by `influx export` or
+ * `influxd inspect export-lp`. Health pipelines built on InfluxDB store one
+ * measurement per metric with the value in a `qty` or `value` field and
+ * optional `min`/`max`/`avg` fields; the unit is taken from a `unit` or
+ * `units` tag.
+ */
+object LineProtocol {
+
+    fun parse(lines: Sequence<String>, precision: String = "ns"): Export {
+        val samples = linkedMapOf<Pair<String, String>, MutableList<Sample>>()
+        for (line in lines) {
+            if (line.isBlank() || line.startsWith("#")) continue
+            val (key, fields, time) = split(line)
+            val keyParts = splitUnescaped(key, ',')
+            val tags = keyParts.drop(1).associate { it.substringBefore('=').unescape() to it.substringAfter('=').unescape() }
+            val values = splitUnescaped(fields, ',').associate { field ->
+                field.substringBefore('=').unescape() to number(field.substringAfter('='))
+            }
+            val units = tags["unit"] ?: tags["units"] ?: ""
+            val ts = time?.let { instant(it.toLong(), precision) } ?: continue
+            samples.getOrPut(keyParts.first().unescape() to units) { mutableListOf() } += Sample(
+                date = Timestamps.format(ts),
+                qty = values["qty"] ?: values["value"],
+                max = values["max"],
+                min = values["min"],
+                avg = values["avg"],
+            )
+        }
+        return Export(metrics = samples.map { (key, data) -> Metric(key.first, key.second, data) })
+    }
+
+    /** Splits a line into key, fields and timestamp at unescaped spaces outside of string fields. */
+    private fun split(line: String): Triple<String, String, String?> {
+        val parts = splitUnescaped(line.trim(), ' ')
+        require(parts.size >= 2) { "Invalid line protocol: $line" }
+        return Triple(parts[0], parts[1], parts.getOrNull(2))
+    }
+
+    private fun splitUnescaped(value: String, separator: Char): List<String> {
+        val parts = mutableListOf<String>()
+        val current = StringBuilder()
+        var quoted = false
+        var i = 0
+        while (i < value.length) {
+            val c = value[i]
+            when {
+                c == '\\' && i + 1 < value.length -> { current.append(c).append(value[i + 1]); i++ }
+                c == '"' -> { quoted = !quoted; current.append(c) }
+                c == separator && !quoted -> { parts += current.toString(); current.clear() }
+                else -> current.append(c)
+            }
+            i++
+        }
+        parts += current.toString()
+        return parts
+    }
+
+    private fun String.unescape() = replace(Regex("""\\(.)"""), "$1")
+
+    /** Numeric field values; integers carry an `i` or `u` suffix. Strings and booleans are ignored. */
+    private fun number(value: String): Double? = value.removeSuffix("i").removeSuffix("u").toDoubleOrNull()
+
+    private fun instant(value: Long, precision: String): Instant = when (precision) {
+        "s" -> Instant.ofEpochSecond(value)
+        "ms" -> Instant.ofEpochMilli(value)
+        "us" -> Instant.ofEpochSecond(value / 1_000_000, value % 1_000_000 * 1000)
+        else -> Instant.ofEpochSecond(value / 1_000_000_000, value % 1_000_000_000)
+    }
+}
@@ -0,0 +1,76 @@
+package me.centralhardware.healthImportServer.monitoring
+
+import io.micrometer.core.instrument.Gauge
+import io.micrometer.core.instrument.MeterRegistry
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.Timestamps
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import org.slf4j.LoggerFactory
+import java.time.Duration
+import java.time.Instant
+import java.util.concurrent.ConcurrentHashMap
+
+/**
+ * Latest sample timestamp per metric and source device, exposed as
+ * `health_data_minutes_since_last_sample`. A Watch that silently stops
+ * syncing shows up as a growing gauge long before anyone looks at a
+ * dashboard.
+ */
+class FreshnessTracker(private val registry: MeterRegistry) {
+    val log = LoggerFactory.getLogger(FreshnessTracker::class.java)
+    private val latest = ConcurrentHashMap<DataSource, Instant>()
+
+    fun record(export: Export) {
+        for (m in export.metrics) {
+            for (s in m.data) {
+                val ts = Timestamps.parseOrNull(s.date ?: s.startDate) ?: continue
+                update(DataSource(m.name, s.sleepSource ?: s.inBedSource ?: s.source ?: ""), ts)
+            }
+        }
+        for (w in export.workouts) {
+            Timestamps.parseOrNull(w.end)?.let { update(DataSource(WORKOUTS, ""), it) }
+            for (h in w.heartRateData) {
+                Timestamps.parseOrNull(h.date)?.let { update(DataSource(WORKOUT_HEART_RATE, h.source ?: ""), it) }
+            }
+        }
+        for (s in export.stateOfMind) {
+            Timestamps.parseOrNull(s.start)?.let { update(DataSource(STATE_OF_MIND, ""), it) }
+        }
+        for (e in export.ecg) {
+            Timestamps.parseOrNull(e.start)?.let { update(DataSource(ECG, e.source ?: ""), it) }
+        }
+    }
+
+    /** Seeds the tracker with what is already stored, so gauges exist right after a restart. */
+    fun seed(store: ClickHouseMetricStore) {
+        try {
+            store.latestSampleTimes().forEach { (key, ts) -> update(DataSource(key.first, key.second), ts) }
+        } catch (e: Exception) {
+            log.warn("Could not read the latest stored sample times", e)
+        }
+    }
+
+    fun minutesSince(source: DataSource, now: Instant = Instant.now()): Double =
+        latest[source]?.let { Duration.between(it, now).toSeconds() / 60.0 } ?: Double.NaN
+
+    private fun update(source: DataSource, ts: Instant) {
+        val previous = latest.putIfAbsent(source, ts)
+        if (previous == null) {
+            Gauge.builder("health_data_minutes_since_last_sample", this) { it.minutesSince(source) }
+                .description("Minutes since the newest stored sample of a metric and source")
+                .tags("metric", source.metric, "source", source.source)
+                .register(registry)
+        } else if (ts.isAfter(previous)) {
+            latest.merge(source, ts) { a, b -> if (b.isAfter(a)) b else a }
+        }
+    }
+
+    companion object {
+        const val WORKOUTS = "workouts"
+        const val WORKOUT_HEART_RATE = "workout_heart_rate"
+        const val STATE_OF_MIND = "state_of_mind"
+        const val ECG = "ecg"
+    }
+}
+
+data class DataSource(val metric: String, val source: String)
@@ -0,0 +1,92 @@
+package me.centralhardware.healthImportServer.monitoring
+
+import io.micrometer.core.instrument.Counter
+import io.micrometer.core.instrument.MeterRegistry
+import io.micrometer.core.instrument.Timer
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.notify.Notifier
+import org.slf4j.LoggerFactory
+import java.time.Duration
+
+/**
+ * Time spent writing an upload to the main store and to each of the other
+ * `STORES`, exposed as `health_import_duration_seconds{store}` with its
+ * median, p95 and p99. Writes that failed are only counted, as
+ * `health_import_store_failures_total{store}`, and left out of the SLO.
+ * With an [slo], every upload over it is logged, and a notification is sent
+ * once the [percentile] of the last [window] uploads of a store exceeds it,
+ * e.g. because ClickHouse disks are filling up. The next notification for
+ * that store is sent after it was back within the SLO.
+ */
+class LatencySlo(
+    private val registry: MeterRegistry,
+    private val notifier: Notifier? = null,
+    private val slo: Duration? = null,
+    private val window: Int = 50,
+    private val percentile: Double = 0.95,
+) {
+    val log = LoggerFactory.getLogger(LatencySlo::class.java)
+    private val recent = mutableMapOf<String, ArrayDeque<Long>>()
+    private val degraded = mutableSetOf<String>()
+
+    init {
+        require(percentile > 0 && percentile < 1) { "SLO percentile must be between 0 and 1, got $percentile" }
+        slo?.let { log.info("Expecting ${(percentile * 100).toInt()}% of uploads to be stored within ${it.toMillis()} ms") }
+    }
+
+    fun record(store: String, upload: String, duration: Duration) {
+        Timer.builder("health_import_duration")
+            .description("Time spent writing an upload to a store")
+            .tag("store", store)
+            .publishPercentiles(0.5, 0.95, 0.99)
+            .register(registry)
+            .record(duration)
+        val slo = slo ?: return
+        if (duration > slo) log.warn("Upload $upload took ${duration.toMillis()} ms to store in $store, over the SLO of ${slo.toMillis()} ms")
+        val current = synchronized(recent) {
+            val durations = recent.getOrPut(store) { ArrayDeque() }
+            durations.addLast(duration.toMillis())
+            if (durations.size > window) durations.removeFirst()
+            if (durations.size < MIN_UPLOADS) return
+            durations.sorted()[((durations.size - 1) * percentile).toInt()]
+        }
+        val p = "p${(percentile * 100).toInt()}"
+        if (current <= slo.toMillis()) {
+            if (synchronized(degraded) { degraded.remove(store) }) log.info("$p of uploads to $store is back within the SLO at $current ms")
+            return
+        }
+        if (!synchronized(degraded) { degraded.add(store) }) return
+        val message = "$p of the last uploads to $store is $current ms, over the SLO of ${slo.toMillis()} ms. " +
+            "The store may be running out of disk space or be overloaded."
+        log.warn(message)
+        notifier?.notify("Health uploads slow", message)
+    }
+
+    /** Counts an upload [store] failed to write some of. */
+    fun failed(store: String) {
+        Counter.builder("health_import_store_failures")
+            .description("Uploads a store failed to write some of")
+            .tag("store", store)
+            .register(registry)
+            .increment()
+    }
+
+    companion object {
+        /** Uploads of a store needed before its percentile is compared with the SLO. */
+        private const val MIN_UPLOADS = 5
+
+        /**
+         * Reads `SLO_UPLOAD_SECONDS`, the time within which uploads should be
+         * stored, `SLO_PERCENTILE` (default 0.95) and `SLO_WINDOW`, the
+         * uploads the percentile is taken of (default 50). Without
+         * `SLO_UPLOAD_SECONDS` only the durations are recorded.
+         */
+        fun fromEnv(registry: MeterRegistry, notifier: Notifier): LatencySlo = LatencySlo(
+            registry = registry,
+            notifier = notifier,
+            slo = Env.get("SLO_UPLOAD_SECONDS")?.toDouble()?.let { Duration.ofMillis((it * 1000).toLong()) },
+            window = Env.get("SLO_WINDOW")?.toInt() ?: 50,
+            percentile = Env.get("SLO_PERCENTILE")?.toDouble() ?: 0.95,
+        )
+    }
+}
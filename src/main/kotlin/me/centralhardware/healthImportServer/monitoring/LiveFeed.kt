@@ -0,0 +1,81 @@
+package me.centralhardware.healthImportServer.monitoring
+
+import kotlinx.coroutines.channels.BufferOverflow
+import kotlinx.coroutines.flow.MutableSharedFlow
+import kotlinx.coroutines.flow.SharedFlow
+import kotlinx.coroutines.flow.asSharedFlow
+import kotlinx.serialization.Serializable
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.Timestamps
+
+/**
+ * The samples and workouts of every written chunk, for `/api/stream` and
+ * the `tail` command. Nothing is kept: a subscriber only sees what is
+ * written while it is connected. A slow subscriber misses the oldest events
+ * instead of holding up uploads.
+ */
+class LiveFeed {
+    private val flow = MutableSharedFlow<LiveEvent>(extraBufferCapacity = BUFFER, onBufferOverflow = BufferOverflow.DROP_OLDEST)
+
+    val events: SharedFlow<LiveEvent> = flow.asSharedFlow()
+
+    fun publish(export: Export) {
+        if (flow.subscriptionCount.value == 0) return
+        for (m in export.metrics) {
+            for (s in m.data) {
+                val ts = Timestamps.parseOrNull(s.date ?: s.startDate) ?: continue
+                val value = s.qty ?: s.avg ?: s.asleep
+                flow.tryEmit(
+                    LiveEvent(
+                        type = LiveEvent.METRIC,
+                        name = m.name,
+                        timestamp = ts.toString(),
+                        value = value,
+                        units = m.units,
+                        source = s.sleepSource ?: s.inBedSource ?: s.source,
+                        category = s.value,
+                    )
+                )
+            }
+        }
+        for (w in export.workouts) {
+            val start = Timestamps.parseOrNull(w.start) ?: continue
+            flow.tryEmit(
+                LiveEvent(
+                    type = LiveEvent.WORKOUT,
+                    name = w.name ?: "workout",
+                    timestamp = start.toString(),
+                    end = Timestamps.parseOrNull(w.end)?.toString(),
+                    value = w.activeEnergyBurned?.total(),
+                    units = w.activeEnergyBurned?.units,
+                )
+            )
+        }
+    }
+
+    companion object {
+        private const val BUFFER = 4096
+    }
+}
+
+/**
+ * One sample or workout. [value] is `qty`, or `Avg` for heart rate, or
+ * `asleep` for sleep, and for a workout its active energy; [category] is
+ * the value of a category sample such as a sleep phase.
+ */
+@Serializable
+data class LiveEvent(
+    val type: String,
+    val name: String,
+    val timestamp: String,
+    val end: String? = null,
+    val value: Double? = null,
+    val units: String? = null,
+    val source: String? = null,
+    val category: String? = null,
+) {
+    companion object {
+        const val METRIC = "metric"
+        const val WORKOUT = "workout"
+    }
+}
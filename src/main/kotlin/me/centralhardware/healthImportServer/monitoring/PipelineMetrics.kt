@@ -0,0 +1,37 @@
+package me.centralhardware.healthImportServer.monitoring
+
+import io.micrometer.core.instrument.MeterRegistry
+import io.micrometer.core.instrument.Timer
+import java.time.Duration
+
+/**
+ * Time spent per upload in each stage of the pipeline, exposed as
+ * `health_import_stage_seconds{stage}`. Writes are reported per table as
+ * `write.<table>`, so a slow upload can be attributed to the payload size
+ * (`read`), the parser (`parse`) or the database.
+ */
+class PipelineMetrics(private val registry: MeterRegistry) {
+
+    fun record(stages: Map<String, Long>) {
+        stages.forEach { (stage, millis) ->
+            Timer.builder("health_import_stage")
+                .description("Time spent per upload in a stage of the import pipeline")
+                .tag("stage", stage)
+                .register(registry)
+                .record(Duration.ofMillis(millis))
+        }
+    }
+
+    companion object {
+        /** Receiving the body. */
+        const val READ = "read"
+        /** Decompressing and parsing, which are streamed into each other. */
+        const val PARSE = "parse"
+        /** Transforms and splitting into chunks. */
+        const val PREPARE = "prepare"
+        /** Deduplication and derived metrics before the chunks are written. */
+        const val VALIDATE = "validate"
+        const val WRITE_PREFIX = "write."
+        const val OPTIMIZE = "optimize"
+    }
+}
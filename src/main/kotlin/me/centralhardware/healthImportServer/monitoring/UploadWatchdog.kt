@@ -0,0 +1,50 @@
+package me.centralhardware.healthImportServer.monitoring
+
+import kotlinx.coroutines.delay
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.ImportTracker
+import me.centralhardware.healthImportServer.notify.Notifier
+import org.slf4j.LoggerFactory
+import java.time.Duration
+import java.time.Instant
+
+/**
+ * Notifies when no upload arrived for [maxSilence]. Auto Export automations
+ * on the phone tend to break silently, e.g. after an iOS update. One
+ * notification is sent per silence; the next upload re-arms the watchdog.
+ */
+class UploadWatchdog(
+    private val tracker: ImportTracker,
+    private val notifier: Notifier,
+    private val maxSilence: Duration,
+    private val checkInterval: Duration = Duration.ofMinutes(5),
+) {
+    val log = LoggerFactory.getLogger(UploadWatchdog::class.java)
+    private val startedAt = Instant.now()
+
+    suspend fun run() {
+        log.info("Expecting an upload at least every ${maxSilence.toHours()} hours")
+        var alerted = false
+        while (true) {
+            delay(checkInterval.toMillis())
+            val last = tracker.lastStarted()
+            val silence = Duration.between(last ?: startedAt, Instant.now())
+            if (silence < maxSilence) {
+                alerted = false
+            } else if (!alerted) {
+                alerted = true
+                val since = last?.let { "since $it" } ?: "since the server started at $startedAt"
+                log.warn("No upload $since")
+                notifier.notify("Health upload missing", "No Auto Export upload was received for ${silence.toHours()} hours ($since).")
+            }
+        }
+    }
+
+    companion object {
+        /** Enabled by `UPLOAD_EXPECTED_HOURS`, the longest expected time between uploads. */
+        fun fromEnv(tracker: ImportTracker, notifier: Notifier): UploadWatchdog? {
+            val hours = Env.get("UPLOAD_EXPECTED_HOURS")?.toLong() ?: return null
+            return UploadWatchdog(tracker, notifier, Duration.ofHours(hours))
+        }
+    }
+}
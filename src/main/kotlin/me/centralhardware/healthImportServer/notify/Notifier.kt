@@ -0,0 +1,76 @@
+package me.centralhardware.healthImportServer.notify
+
+import kotlinx.serialization.Serializable
+import kotlinx.serialization.json.Json
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.storage.UserProfiles
+import org.slf4j.LoggerFactory
+import java.net.URI
+import java.net.http.HttpClient
+import java.net.http.HttpRequest
+import java.net.http.HttpResponse
+import java.time.Duration
+import java.util.concurrent.ConcurrentHashMap
+
+/**
+ * Delivers notifications about noteworthy events, e.g. a broken personal record.
+ */
+interface Notifier {
+    fun notify(title: String, message: String)
+}
+
+class LogNotifier : Notifier {
+    val log = LoggerFactory.getLogger(LogNotifier::class.java)
+
+    override fun notify(title: String, message: String) {
+        log.info("$title: $message")
+    }
+}
+
+/**
+ * Posts `{"title": ..., "message": ...}` to a webhook URL.
+ */
+class WebhookNotifier(private val url: String) : Notifier {
+    val log = LoggerFactory.getLogger(WebhookNotifier::class.java)
+    private val client = HttpClient.newBuilder().connectTimeout(Duration.ofSeconds(10)).build()
+
+    override fun notify(title: String, message: String) {
+        val body = Json.encodeToString(Notification.serializer(), Notification(title, message))
+        val request = HttpRequest.newBuilder(URI(url))
+            .timeout(Duration.ofSeconds(10))
+            .header("Content-Type", "application/json")
+            .POST(HttpRequest.BodyPublishers.ofString(body))
+            .build()
+        try {
+            val response = client.send(request, HttpResponse.BodyHandlers.discarding())
+            if (response.statusCode() !in 200..299) {
+                log.warn("Notification webhook returned HTTP ${response.statusCode()}")
+            }
+        } catch (e: Exception) {
+            log.warn("Failed to send notification \"$title\"", e)
+        }
+    }
+
+    @Serializable
+    private data class Notification(val title: String, val message: String)
+}
+
+/**
+ * Sends to the notification targets of the current user profile, or to
+ * [fallback] while it has none.
+ */
+class ProfileNotifier(private val profiles: UserProfiles, private val fallback: Notifier) : Notifier {
+    private val webhooks = ConcurrentHashMap<String, WebhookNotifier>()
+
+    override fun notify(title: String, message: String) {
+        val targets = profiles.current()?.notificationTargets.orEmpty()
+        if (targets.isEmpty()) return fallback.notify(title, message)
+        targets.forEach { url -> webhooks.getOrPut(url) { WebhookNotifier(url) }.notify(title, message) }
+    }
+}
+
+/** Reads `NOTIFY_WEBHOOK_URL`; with [profiles], the targets of the current profile take precedence. */
+fun loadNotifier(profiles: UserProfiles? = null): Notifier {
+    val notifier = Env.get("NOTIFY_WEBHOOK_URL")?.let { WebhookNotifier(it) } ?: LogNotifier()
+    return profiles?.let { ProfileNotifier(it, notifier) } ?: notifier
+}
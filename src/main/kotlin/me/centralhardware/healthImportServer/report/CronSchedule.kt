@@ -0,0 +1,75 @@
+package me.centralhardware.healthImportServer.report
+
+import java.time.ZonedDateTime
+import java.time.temporal.ChronoUnit
+
+/**
+ * A classic five field cron expression (`minute hour day-of-month month day-of-week`).
+ * Fields support `*`, lists, ranges and steps, e.g. `0 8 * * 1` or `0-59/15 6-22 * * 1-5`.
+ */
+class CronSchedule(expression: String) {
+    private val minutes: Set<Int>
+    private val hours: Set<Int>
+    private val daysOfMonth: Set<Int>
+    private val months: Set<Int>
+    private val daysOfWeek: Set<Int>
+    private val anyDayOfMonth: Boolean
+    private val anyDayOfWeek: Boolean
+
+    init {
+        val fields = expression.trim().split(Regex("\\s+"))
+        require(fields.size == 5) { "Cron expression must have 5 fields: $expression" }
+        minutes = parseField(fields[0], 0, 59)
+        hours = parseField(fields[1], 0, 23)
+        daysOfMonth = parseField(fields[2], 1, 31)
+        months = parseField(fields[3], 1, 12)
+        // 0 and 7 both mean Sunday, java.time uses 7.
+        daysOfWeek = parseField(fields[4], 0, 7).map { if (it == 0) 7 else it }.toSet()
+        anyDayOfMonth = fields[2] == "*"
+        anyDayOfWeek = fields[4] == "*"
+    }
+
+    /** The first matching time strictly after [after]. */
+    fun next(after: ZonedDateTime): ZonedDateTime {
+        var candidate = after.truncatedTo(ChronoUnit.MINUTES).plusMinutes(1)
+        val limit = after.plusYears(5)
+        while (candidate.isBefore(limit)) {
+            if (matches(candidate)) return candidate
+            candidate = when {
+                candidate.monthValue !in months -> candidate.plusMonths(1).withDayOfMonth(1).truncatedTo(ChronoUnit.DAYS)
+                !matchesDay(candidate) -> candidate.plusDays(1).truncatedTo(ChronoUnit.DAYS)
+                candidate.hour !in hours -> candidate.plusHours(1).truncatedTo(ChronoUnit.HOURS)
+                else -> candidate.plusMinutes(1)
+            }
+        }
+        error("Cron expression never matches")
+    }
+
+    private fun matches(t: ZonedDateTime) =
+        t.minute in minutes && t.hour in hours && t.monthValue in months && matchesDay(t)
+
+    private fun matchesDay(t: ZonedDateTime): Boolean {
+        val dom = t.dayOfMonth in daysOfMonth
+        val dow = t.dayOfWeek.value in daysOfWeek
+        return when {
+            anyDayOfMonth && anyDayOfWeek -> true
+            anyDayOfMonth -> dow
+            anyDayOfWeek -> dom
+            else -> dom || dow
+        }
+    }
+
+    private fun parseField(field: String, min: Int, max: Int): Set<Int> =
+        field.split(",").flatMap { part ->
+            val (range, step) = part.split("/", limit = 2).let { it[0] to (it.getOrNull(1)?.toInt() ?: 1) }
+            require(step > 0) { "Invalid step in cron field: $field" }
+            val (from, to) = when {
+                range == "*" -> min to max
+                range.contains("-") -> range.split("-", limit = 2).let { it[0].toInt() to it[1].toInt() }
+                part.contains("/") -> range.toInt() to max
+                else -> range.toInt() to range.toInt()
+            }
+            require(from in min..max && to in min..max && from <= to) { "Invalid cron field: $field" }
+            (from..to step step).toList()
+        }.toSet()
+}
@@ -0,0 +1,100 @@
+package me.centralhardware.healthImportServer.report
+
+import jakarta.mail.Authenticator
+import jakarta.mail.Message
+import jakarta.mail.PasswordAuthentication
+import jakarta.mail.Session
+import jakarta.mail.Transport
+import jakarta.mail.internet.InternetAddress
+import jakarta.mail.internet.MimeMessage
+import kotlinx.coroutines.delay
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.storage.DayBoundary
+import org.slf4j.LoggerFactory
+import java.time.Duration
+import java.time.ZoneId
+import java.time.ZonedDateTime
+import java.util.Properties
+
+data class SmtpConfig(
+    val host: String,
+    val port: Int,
+    val user: String?,
+    val password: String?,
+    val startTls: Boolean,
+    val from: String,
+    val to: List<String>,
+)
+
+/**
+ * Sends the weekly report by email on a cron schedule.
+ */
+class EmailReporter(
+    private val smtp: SmtpConfig,
+    private val builder: WeeklyReportBuilder,
+    private val schedule: CronSchedule,
+    private val zone: ZoneId,
+) {
+    val log = LoggerFactory.getLogger(EmailReporter::class.java)
+
+    suspend fun run() {
+        while (true) {
+            val now = ZonedDateTime.now(zone)
+            val next = schedule.next(now)
+            log.info("Next weekly report at $next")
+            delay(Duration.between(now, next).toMillis())
+            try {
+                send(next.toLocalDate().minusDays(1))
+            } catch (e: Exception) {
+                log.error("Failed to send weekly report", e)
+            }
+        }
+    }
+
+    /** Sends the report for the seven days ending with [to]. */
+    fun send(to: java.time.LocalDate) {
+        val summary = builder.build(to)
+        val message = MimeMessage(session()).apply {
+            setFrom(InternetAddress(smtp.from))
+            setRecipients(Message.RecipientType.TO, smtp.to.map { InternetAddress(it) }.toTypedArray())
+            subject = WeeklyReportRenderer.subject(summary)
+            setContent(WeeklyReportRenderer.html(summary), "text/html; charset=utf-8")
+        }
+        Transport.send(message)
+        log.info("Sent weekly report for ${summary.from} – ${summary.to} to ${smtp.to.joinToString()}")
+    }
+
+    private fun session(): Session {
+        val props = Properties().apply {
+            put("mail.smtp.host", smtp.host)
+            put("mail.smtp.port", smtp.port.toString())
+            put("mail.smtp.starttls.enable", smtp.startTls.toString())
+            put("mail.smtp.auth", (smtp.user != null).toString())
+        }
+        val auth = smtp.user?.let { user ->
+            object : Authenticator() {
+                override fun getPasswordAuthentication() = PasswordAuthentication(user, smtp.password ?: "")
+            }
+        }
+        return Session.getInstance(props, auth)
+    }
+
+    companion object {
+        /** Returns null unless both `REPORT_CRON` and `SMTP_HOST` are set. */
+        fun fromEnv(builder: WeeklyReportBuilder): EmailReporter? {
+            val cron = Env.get("REPORT_CRON") ?: return null
+            val host = Env.get("SMTP_HOST") ?: return null
+            val smtp = SmtpConfig(
+                host = host,
+                port = Env.get("SMTP_PORT")?.toInt() ?: 587,
+                user = Env.get("SMTP_USER"),
+                password = Env.get("SMTP_PASSWORD"),
+                startTls = Env.get("SMTP_STARTTLS")?.toBoolean() ?: true,
+                from = Env.get("SMTP_FROM") ?: error("SMTP_FROM must be set"),
+                to = (Env.get("REPORT_TO") ?: error("REPORT_TO must be set")).split(",").map { it.trim() },
+            )
+            val zone = Env.get("REPORT_TIMEZONE")?.let { ZoneId.of(it) } ?: DayBoundary.fromEnv().zone()
+            return EmailReporter(smtp, builder, CronSchedule(cron), zone)
+        }
+    }
+}
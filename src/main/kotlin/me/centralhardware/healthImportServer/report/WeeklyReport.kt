@@ -0,0 +1,130 @@
+package me.centralhardware.healthImportServer.report
+
+import me.centralhardware.healthImportServer.analytics.Statistics
+import me.centralhardware.healthImportServer.analytics.TrendSmoother
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import me.centralhardware.healthImportServer.storage.WorkoutSummary
+import java.time.Duration
+import java.time.LocalDate
+
+data class WeeklySummary(
+    val from: LocalDate,
+    val to: LocalDate,
+    val averageSleepHours: Double?,
+    val totalSteps: Double?,
+    val totalActiveEnergy: Double?,
+    val workouts: List<WorkoutSummary>,
+    val weightTrendStart: Double?,
+    val weightTrendEnd: Double?,
+    val anomalies: List<Anomaly>,
+    /** `metric` or `imperial`, from the user profile. */
+    val units: String = "metric",
+)
+
+data class Anomaly(val metric: String, val date: LocalDate, val value: Double, val baseline: Double)
+
+/**
+ * Collects the data for the weekly report from the store.
+ */
+class WeeklyReportBuilder(private val store: ClickHouseMetricStore) {
+
+    fun build(to: LocalDate): WeeklySummary {
+        val from = to.minusDays(6)
+        val sleep = store.dailyValues("sleep_analysis", "asleep", "sum", from, to)
+        val steps = store.dailyValues("step_count", "qty", "sum", from, to)
+        val energy = store.dailyValues("active_energy", "qty", "sum", from, to)
+        val weight = store.dailyValues("weight_body_mass" + TrendSmoother.TREND_SUFFIX, "qty", "avg", from, to)
+        return WeeklySummary(
+            from = from,
+            to = to,
+            averageSleepHours = sleep.values.takeIf { it.isNotEmpty() }?.average(),
+            totalSteps = steps.values.takeIf { it.isNotEmpty() }?.sum(),
+            totalActiveEnergy = energy.values.takeIf { it.isNotEmpty() }?.sum(),
+            workouts = store.workoutsBetween(from, to),
+            weightTrendStart = weight.values.firstOrNull(),
+            weightTrendEnd = weight.values.lastOrNull(),
+            anomalies = anomalyMetrics.flatMap { anomalies(it, from, to) },
+            units = store.profiles.current()?.units ?: "metric",
+        )
+    }
+
+    /** Days of the week whose value is more than two standard deviations off the preceding four weeks. */
+    private fun anomalies(metric: String, from: LocalDate, to: LocalDate): List<Anomaly> {
+        val baseline = store.dailyValues(metric, "qty", "avg", from.minusDays(28), from.minusDays(1)).values.toList()
+        val sd = Statistics.standardDeviation(baseline) ?: return emptyList()
+        val mean = baseline.average()
+        return store.dailyValues(metric, "qty", "avg", from, to)
+            .filter { (_, value) -> sd > 0 && kotlin.math.abs(value - mean) > 2 * sd }
+            .map { (day, value) -> Anomaly(metric, day, value, mean) }
+    }
+
+    companion object {
+        private val anomalyMetrics = listOf("resting_heart_rate", "heart_rate_variability", "respiratory_rate")
+    }
+}
+
+object WeeklyReportRenderer {
+
+    fun subject(summary: WeeklySummary) = "Health report ${summary.from} – ${summary.to}"
+
+    fun html(summary: WeeklySummary): String = buildString {
+        append("<html><body style=\"font-family: sans-serif\">")
+        append("<h2>").append(escape(subject(summary))).append("</h2>")
+
+        append("<table cellpadding=\"4\">")
+        row("Average sleep", summary.averageSleepHours?.let { "%.1f h".format(it) })
+        row("Steps", summary.totalSteps?.let { "%,.0f".format(it) })
+        row("Active energy", summary.totalActiveEnergy?.let { "%,.0f kcal".format(it) })
+        row("Workouts", summary.workouts.size.toString())
+        if (summary.weightTrendEnd != null) {
+            val change = summary.weightTrendStart?.let { summary.weightTrendEnd - it }
+            row("Weight trend", "%.1f".format(summary.weightTrendEnd) + (change?.let { " (%+.1f)".format(it) } ?: ""))
+        }
+        append("</table>")
+
+        if (summary.workouts.isNotEmpty()) {
+            append("<h3>Workouts</h3><ul>")
+            for (w in summary.workouts) {
+                val minutes = Duration.between(w.start, w.end).toMinutes()
+                append("<li>").append(escape(w.name)).append(" – $minutes min")
+                if (w.distance > 0) {
+                    val (distance, units) = distance(w.distance, w.distanceUnits, summary.units)
+                    append(", %.2f %s".format(distance, escape(units)))
+                }
+                if (w.activeEnergy > 0) append(", %.0f %s".format(w.activeEnergy, escape(w.activeEnergyUnits)))
+                append("</li>")
+            }
+            append("</ul>")
+        }
+
+        if (summary.anomalies.isNotEmpty()) {
+            append("<h3>Notable</h3><ul>")
+            for (a in summary.anomalies) {
+                append("<li>").append(escape(a.metric.replace('_', ' ')))
+                append(" on ${a.date}: %.1f (usually %.1f)".format(a.value, a.baseline)).append("</li>")
+            }
+            append("</ul>")
+        }
+        append("</body></html>")
+    }
+
+    /** [value] in [units] converted to kilometres or miles, whichever [system] prefers. */
+    private fun distance(value: Double, units: String, system: String): Pair<Double, String> = when {
+        system == "imperial" && units == "km" -> value / KM_PER_MILE to "mi"
+        system == "metric" && units == "mi" -> value * KM_PER_MILE to "km"
+        else -> value to units
+    }
+
+    private const val KM_PER_MILE = 1.609344
+
+    private fun StringBuilder.row(label: String, value: String?) {
+        append("<tr><td>").append(escape(label)).append("</td><td><b>")
+        append(escape(value ?: "–")).append("</b></td></tr>")
+    }
+
+    private fun escape(value: String) = value
+        .replace("&", "&amp;")
+        .replace("<", "&lt;")
+        .replace(">", "&gt;")
+        .replace("\"", "&quot;")
+}
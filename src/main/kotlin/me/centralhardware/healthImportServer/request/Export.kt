@@ -1,12 +1,41 @@
 package me.centralhardware.healthImportServer.request
 
+import kotlinx.serialization.ExperimentalSerializationApi
+import kotlinx.serialization.KSerializer
 import kotlinx.serialization.SerialName
 import kotlinx.serialization.Serializable
+import kotlinx.serialization.SerializationException
+import kotlinx.serialization.builtins.ListSerializer
+import kotlinx.serialization.descriptors.SerialDescriptor
+import kotlinx.serialization.descriptors.StructureKind
+import kotlinx.serialization.encoding.CompositeDecoder
+import kotlinx.serialization.encoding.Decoder
+import kotlinx.serialization.encoding.Encoder
 import kotlinx.serialization.json.Json
+import kotlinx.serialization.json.JsonArray
+import kotlinx.serialization.json.JsonDecoder
+import kotlinx.serialization.json.JsonElement
+import kotlinx.serialization.json.JsonNull
+import kotlinx.serialization.json.JsonObject
+import kotlinx.serialization.json.JsonPrimitive
+import kotlinx.serialization.json.decodeFromJsonElement
+import kotlinx.serialization.json.decodeFromStream
+import kotlinx.serialization.json.doubleOrNull
+import me.centralhardware.healthImportServer.Env
+import org.slf4j.LoggerFactory
+import java.io.InputStream
+import java.time.Instant
+import java.util.concurrent.ConcurrentHashMap
 
 @Serializable
 data class ExportWrapper(val data: Export)
 
+/**
+ * A payload. Parsed uploads are [normalized]: samples, workouts, their logs
+ * and routes, state of mind entries and ECG recordings are in time order,
+ * so stores insert in the order of their keys and derived metrics can take
+ * differences of neighbouring samples.
+ */
 @Serializable
 data class Export(
     val metrics: List<Metric> = emptyList(),
@@ -16,6 +45,38 @@ data class Export(
 ) {
     fun populatedMetrics(): List<Metric> = metrics.filter { it.data.isNotEmpty() }
     fun totalSamples(): Int = metrics.sumOf { it.data.size }
+
+    /**
+     * Auto Export sometimes lists a metric twice with overlapping samples.
+     * Joins the entries of equal name and units, in the order they first
+     * appeared, and keeps one of identical samples.
+     */
+    fun mergeDuplicateMetrics(): Export {
+        val groups = metrics.groupBy { it.name to it.units }
+        if (groups.size == metrics.size && metrics.all { m -> m.data.size == m.data.toSet().size }) return this
+        return copy(metrics = groups.map { (key, entries) -> Metric(key.first, key.second, entries.flatMap { it.data }.distinct()) })
+    }
+
+    /** Everything in time order; entries without a readable timestamp go last, in the order they came. */
+    fun sortedChronologically(): Export = Export(
+        metrics = metrics.map { m -> chronological(m.data) { it.date ?: it.startDate }.let { if (it === m.data) m else m.copy(data = it) } },
+        workouts = chronological(workouts) { it.start }.map { it.sortedChronologically() },
+        stateOfMind = chronological(stateOfMind) { it.start },
+        ecg = chronological(ecg) { it.start }.map { e ->
+            if (e.voltageMeasurements.zipWithNext().all { (a, b) -> (a.date ?: 0.0) <= (b.date ?: 0.0) }) e
+            else e.copy(voltageMeasurements = e.voltageMeasurements.sortedBy { it.date ?: Double.MAX_VALUE })
+        },
+    )
+
+    fun normalized(): Export = mergeDuplicateMetrics().sortedChronologically()
+}
+
+/** [items] in the order of [timestamp], those without a readable one last; [items] itself if already in order. */
+private fun <T> chronological(items: List<T>, timestamp: (T) -> String?): List<T> {
+    if (items.size < 2) return items
+    val keyed = items.map { (Timestamps.parseOrNull(timestamp(it)) ?: Instant.MAX) to it }
+    if (keyed.zipWithNext().all { (a, b) -> a.first <= b.first }) return items
+    return keyed.sortedBy { it.first }.map { it.second }
 }
 
 @Serializable
@@ -38,14 +99,82 @@ data class Sample(
     val asleep: Double? = null,
     val inBed: Double? = null,
     val sleepSource: String? = null,
-    val inBedSource: String? = null
+    val inBedSource: String? = null,
+    /** Aggregated sleep: when the night started and ended, and hours per phase. */
+    val sleepStart: String? = null,
+    val sleepEnd: String? = null,
+    val inBedStart: String? = null,
+    val inBedEnd: String? = null,
+    val core: Double? = null,
+    val deep: Double? = null,
+    val rem: Double? = null,
+    val awake: Double? = null,
+    /** Unaggregated category samples such as one sleep phase, `value` being e.g. `Deep` or `Awake`. */
+    val startDate: String? = null,
+    val endDate: String? = null,
+    val value: String? = null,
+    val source: String? = null
 )
 
-@Serializable
+/**
+ * A quantity with units. Some Auto Export versions send an array of quantities
+ * instead of a single object; in that case every element is kept in [values]
+ * and [qty] is left empty, use [total] or [mean] to get a summary.
+ */
+@Serializable(with = QtyUnitSerializer::class)
 data class QtyUnit(
     val qty: Double? = null,
-    val units: String? = null
-)
+    val units: String? = null,
+    val values: List<QtyUnit> = emptyList()
+) {
+    fun total(): Double? = if (values.isEmpty()) qty else values.mapNotNull { it.qty }.takeIf { it.isNotEmpty() }?.sum()
+    fun mean(): Double? = if (values.isEmpty()) qty else values.mapNotNull { it.qty }.takeIf { it.isNotEmpty() }?.average()
+}
+
+object QtyUnitSerializer : KSerializer<QtyUnit> {
+    private val log = LoggerFactory.getLogger(QtyUnitSerializer::class.java)
+
+    @Serializable
+    @SerialName("QtyUnit")
+    private class Surrogate(val qty: Double? = null, val units: String? = null)
+
+    override val descriptor: SerialDescriptor = Surrogate.serializer().descriptor
+
+    override fun deserialize(decoder: Decoder): QtyUnit {
+        val input = decoder as? JsonDecoder
+            ?: return decoder.decodeSerializableValue(Surrogate.serializer()).let { QtyUnit(it.qty, it.units) }
+        // Read the fields of the already decoded element instead of decoding it a second time.
+        return when (val element = input.decodeJsonElement()) {
+            is JsonArray -> {
+                val values = element.map { quantity(it as? JsonObject ?: throw SerializationException("Expected a quantity, got $it")) }
+                log.warn("Received quantity as an array of ${values.size} values, keeping all of them")
+                QtyUnit(units = values.firstNotNullOfOrNull { it.units }, values = values)
+            }
+            is JsonObject -> quantity(element)
+            else -> throw SerializationException("Expected a quantity or an array of them, got $element")
+        }
+    }
+
+    /** Rejects a quantity whose `qty` is not a number, as decoding it as [Surrogate] would. */
+    private fun quantity(element: JsonObject): QtyUnit {
+        val qty = element["qty"]?.takeUnless { it is JsonNull }
+        return QtyUnit(
+            qty = qty?.let { (it as? JsonPrimitive)?.doubleOrNull ?: throw SerializationException("Expected a number as qty, got $it") },
+            units = (element["units"] as? JsonPrimitive)?.takeIf { it.isString }?.content,
+        )
+    }
+
+    override fun serialize(encoder: Encoder, value: QtyUnit) {
+        if (value.values.isEmpty()) {
+            encoder.encodeSerializableValue(Surrogate.serializer(), Surrogate(value.qty, value.units))
+        } else {
+            encoder.encodeSerializableValue(
+                ListSerializer(Surrogate.serializer()),
+                value.values.map { Surrogate(it.qty, it.units) }
+            )
+        }
+    }
+}
 
 @Serializable
 data class StepCountLog(
@@ -93,13 +222,26 @@ data class Workout(
     val intensity: QtyUnit? = null,
     val humidity: QtyUnit? = null,
     val temperature: QtyUnit? = null,
+    val elevationUp: QtyUnit? = null,
+    val elevationDown: QtyUnit? = null,
     val route: List<GPSLog> = emptyList(),
     val heartRateData: List<HeartRateLog> = emptyList(),
     val heartRateRecovery: List<HeartRateLog> = emptyList(),
     val stepCount: List<StepCountLog> = emptyList(),
     val walkingAndRunningDistance: List<StepCountLog> = emptyList(),
-    val activeEnergy: List<StepCountLog> = emptyList()
-)
+    val activeEnergy: List<StepCountLog> = emptyList(),
+    val flightsClimbed: List<StepCountLog> = emptyList()
+) {
+    fun sortedChronologically(): Workout = copy(
+        route = chronological(route) { it.timestamp },
+        heartRateData = chronological(heartRateData) { it.date },
+        heartRateRecovery = chronological(heartRateRecovery) { it.date },
+        stepCount = chronological(stepCount) { it.date },
+        walkingAndRunningDistance = chronological(walkingAndRunningDistance) { it.date },
+        activeEnergy = chronological(activeEnergy) { it.date },
+        flightsClimbed = chronological(flightsClimbed) { it.date },
+    )
+}
 
 @Serializable
 data class StateOfMind(
@@ -132,11 +274,113 @@ data class ECGVoltage(
     val units: String? = null
 )
 
+/** A parsed payload and the fields in it the model does not know, for the diagnostics of its upload. */
+data class ParseResult(val export: Export, val unknownFields: Set<String> = emptySet())
+
+/**
+ * Reads Auto Export payloads. Fields the model does not know are ignored.
+ * With `UNKNOWN_FIELDS`, they are counted with the number of uploads they
+ * came in and logged when seen the first time, so real payloads show which
+ * data is not supported yet; it is off by default, as it builds a tree of
+ * every payload before decoding it. With `STRICT_SCHEMA` a payload with unknown fields is
+ * rejected with the list of all of them instead.
+ */
 object RequestParser {
+    private val log = LoggerFactory.getLogger(RequestParser::class.java)
     private val json = Json { ignoreUnknownKeys = true }
+    private val strict = Env.get("STRICT_SCHEMA")?.toBoolean() ?: false
+    private val collect = strict || (Env.get("UNKNOWN_FIELDS")?.toBoolean() ?: false)
+    private val seen = ConcurrentHashMap<String, UnknownField>()
 
-    fun parse(body: String): Export {
+    fun parse(body: String): ParseResult {
+        if (collect) return parseChecked(json.parseToJsonElement(body))
         val wrapper = json.decodeFromString<ExportWrapper>(body)
-        return wrapper.data
+        return ParseResult(normalized(wrapper.data))
+    }
+
+    /** Decodes straight from [body] without building the payload as a string first. */
+    @OptIn(ExperimentalSerializationApi::class)
+    fun parse(body: InputStream): ParseResult {
+        if (collect) return parseChecked(json.decodeFromStream<JsonElement>(body))
+        return ParseResult(normalized(json.decodeFromStream<ExportWrapper>(body).data))
+    }
+
+    private fun normalized(export: Export): Export {
+        val merged = export.mergeDuplicateMetrics()
+        if (merged !== export) {
+            log.info(
+                "Merged ${export.metrics.size - merged.metrics.size} duplicate metric entries and dropped " +
+                    "${export.totalSamples() - merged.totalSamples()} identical samples"
+            )
+        }
+        return merged.sortedChronologically()
+    }
+
+    /** Fields seen in uploads since startup that the parser ignored, most frequent first. */
+    fun unknownFields(): List<UnknownField> = seen.values.sortedByDescending { it.uploads }
+
+    private fun parseChecked(element: JsonElement): ParseResult {
+        val unknown = unknownFields(element, ExportWrapper.serializer().descriptor)
+        record(unknown)
+        return ParseResult(normalized(json.decodeFromJsonElement<ExportWrapper>(element).data), unknown)
+    }
+
+    /**
+     * Decodes one element of a payload found at [path] and adds its unknown
+     * fields to [unknown], to [record] them once the payload was read.
+     */
+    fun <T> decode(text: String, serializer: KSerializer<T>, path: String, unknown: MutableSet<String>): T {
+        if (!collect) return json.decodeFromString(serializer, text)
+        val element = json.parseToJsonElement(text)
+        unknown += unknownFields(element, serializer.descriptor, path)
+        require(!strict || unknown.isEmpty()) { "Unknown fields ${unknown.joinToString()}" }
+        return json.decodeFromJsonElement(serializer, element)
+    }
+
+    /** Throws if a payload with the [unknown] fields is rejected in strict mode, without counting them. */
+    fun validate(unknown: Set<String>) {
+        require(!strict || unknown.isEmpty()) { "Unknown fields ${unknown.joinToString()}" }
+    }
+
+    /** Counts the [unknown] fields of a payload, or rejects it in strict mode. */
+    fun record(unknown: Set<String>) {
+        if (!collect) return
+        validate(unknown)
+        val now = Instant.now().toString()
+        for (path in unknown) {
+            seen.compute(path) { _, field ->
+                if (field == null) log.info("Ignoring unknown field $path")
+                UnknownField(path, (field?.uploads ?: 0) + 1, field?.firstSeen ?: now, now)
+            }
+        }
+    }
+
+    /**
+     * Paths of the fields in [element] that [descriptor] has no property
+     * for, such as `data.metrics[].data[].heartRate`, each listed once.
+     */
+    fun unknownFields(element: JsonElement, descriptor: SerialDescriptor, path: String = ""): Set<String> {
+        val unknown = linkedSetOf<String>()
+        when {
+            // Quantities arrive as a single object or as an array of them.
+            element is JsonArray && descriptor.kind == StructureKind.CLASS ->
+                element.forEach { unknown += unknownFields(it, descriptor, path) }
+            element is JsonArray && descriptor.kind == StructureKind.LIST ->
+                element.forEach { unknown += unknownFields(it, descriptor.getElementDescriptor(0), "$path[]") }
+            element is JsonObject && descriptor.kind == StructureKind.MAP ->
+                element.values.forEach { unknown += unknownFields(it, descriptor.getElementDescriptor(1), "$path{}") }
+            element is JsonObject && descriptor.kind == StructureKind.CLASS ->
+                for ((key, value) in element) {
+                    val field = if (path.isEmpty()) key else "$path.$key"
+                    val index = descriptor.getElementIndex(key)
+                    if (index == CompositeDecoder.UNKNOWN_NAME) unknown += field
+                    else unknown += unknownFields(value, descriptor.getElementDescriptor(index), field)
+                }
+        }
+        return unknown
     }
 }
+
+/** A field of uploads the parser has no property for, with the number of uploads containing it. */
+@Serializable
+data class UnknownField(val path: String, val uploads: Int, val firstSeen: String, val lastSeen: String)
@@ -0,0 +1,233 @@
+package me.centralhardware.healthImportServer.request
+
+import kotlinx.serialization.KSerializer
+import kotlinx.serialization.builtins.serializer
+import kotlinx.serialization.json.Json
+import java.io.Reader
+
+/**
+ * Reads an Auto Export payload element by element: every metric sample,
+ * workout, state of mind entry and ECG recording is decoded on its own and
+ * handed on in exports of about [maxRows] rows, splitting a metric between
+ * them if needed. Memory is bounded by the largest workout or ECG recording
+ * instead of the whole payload, so historical exports of hundreds of
+ * megabytes can be imported on a small machine. A stream is read once, by
+ * either [forEach] or [validate].
+ */
+class ExportStream(private val input: Reader, private val maxRows: Int) {
+    private var peeked = NONE
+    private var offset = 0L
+
+    private val metrics = mutableListOf<Metric>()
+    private val workouts = mutableListOf<Workout>()
+    private val stateOfMind = mutableListOf<StateOfMind>()
+    private val ecg = mutableListOf<ECG>()
+    private var rows = 0
+    private val unknown = linkedSetOf<String>()
+
+    /** Calls [consumer] with the parts of the payload in the order they appear in it. */
+    fun forEach(consumer: (Export) -> Unit) {
+        read(consumer)
+        RequestParser.record(unknown)
+    }
+
+    /**
+     * Reads the whole payload without keeping it and throws if [forEach]
+     * would fail somewhere, so nothing is stored of a payload that is
+     * malformed or, in strict mode, has unknown fields towards its end.
+     */
+    fun validate() {
+        read {}
+        RequestParser.validate(unknown)
+    }
+
+    private fun read(consumer: (Export) -> Unit) {
+        expect('{')
+        members { key ->
+            if (key != "data") {
+                unknown += key
+                return@members readValue(null)
+            }
+            expect('{')
+            members { field ->
+                when (field) {
+                    "metrics" -> array { metric(consumer) }
+                    "workouts" -> elements(Workout.serializer(), "data.workouts[]", consumer) { workouts += it; it.rows() }
+                    "stateOfMind" -> elements(StateOfMind.serializer(), "data.stateOfMind[]", consumer) { stateOfMind += it; 1 }
+                    "ecg" -> elements(ECG.serializer(), "data.ecg[]", consumer) { ecg += it; 1 + it.voltageMeasurements.size }
+                    else -> {
+                        unknown += "data.$field"
+                        readValue(null)
+                    }
+                }
+            }
+        }
+        flush(consumer)
+    }
+
+    private fun <T> elements(serializer: KSerializer<T>, path: String, consumer: (Export) -> Unit, add: (T) -> Int) = array {
+        rows += add(decode(serializer, path))
+        if (rows >= maxRows) flush(consumer)
+    }
+
+    /**
+     * Reads one metric sample by sample. Samples after its name and units,
+     * where Auto Export writes them, are handed on in parts like other
+     * elements; those before them are kept until the end of the metric.
+     */
+    private fun metric(consumer: (Export) -> Unit) {
+        var name: String? = null
+        var units: String? = null
+        val samples = mutableListOf<Sample>()
+        expect('{')
+        members { field ->
+            when (field) {
+                "name" -> name = decode(String.serializer(), "data.metrics[].name")
+                "units" -> units = decode(String.serializer(), "data.metrics[].units")
+                "data" -> array {
+                    samples += decode(Sample.serializer(), "data.metrics[].data[]")
+                    rows++
+                    val metricName = name
+                    val metricUnits = units
+                    if (rows >= maxRows && metricName != null && metricUnits != null) {
+                        metrics += Metric(metricName, metricUnits, samples.toList())
+                        samples.clear()
+                        flush(consumer)
+                    }
+                }
+                else -> {
+                    unknown += "data.metrics[].$field"
+                    readValue(null)
+                }
+            }
+        }
+        metrics += Metric(name ?: fail("a metric name"), units ?: fail("the units of metric $name"), samples)
+    }
+
+    private fun <T> decode(serializer: KSerializer<T>, path: String): T {
+        val text = StringBuilder()
+        readValue(text)
+        return RequestParser.decode(text.toString(), serializer, path, unknown)
+    }
+
+    /** Calls [element] positioned at each element of the array that comes next. */
+    private fun array(element: () -> Unit) {
+        expect('[')
+        skipWhitespace()
+        if (peek() == ']'.code) {
+            next()
+            return
+        }
+        while (true) {
+            element()
+            skipWhitespace()
+            when (next()) {
+                ','.code -> continue
+                ']'.code -> return
+                else -> fail("',' or ']'")
+            }
+        }
+    }
+
+    private fun flush(consumer: (Export) -> Unit) {
+        if (metrics.isEmpty() && workouts.isEmpty() && stateOfMind.isEmpty() && ecg.isEmpty()) return
+        // Duplicates are merged and entries sorted within a part only; the store resolves the rest.
+        consumer(Export(metrics.toList(), workouts.toList(), stateOfMind.toList(), ecg.toList()).normalized())
+        metrics.clear()
+        workouts.clear()
+        stateOfMind.clear()
+        ecg.clear()
+        rows = 0
+    }
+
+    private fun Workout.rows(): Int = 1 + route.size + heartRateData.size + heartRateRecovery.size + stepCount.size +
+            walkingAndRunningDistance.size + activeEnergy.size
+
+    /** Reads the members of an object whose `{` was consumed, calling [member] positioned at each value. */
+    private fun members(member: (String) -> Unit) {
+        skipWhitespace()
+        if (peek() == '}'.code) {
+            next()
+            return
+        }
+        while (true) {
+            skipWhitespace()
+            val key = StringBuilder()
+            readValue(key)
+            expect(':')
+            member(Json.decodeFromString<String>(key.toString()))
+            skipWhitespace()
+            when (next()) {
+                ','.code -> continue
+                '}'.code -> return
+                else -> fail("',' or '}'")
+            }
+        }
+    }
+
+    /** Copies the next complete value to [out], or skips it if [out] is null. */
+    private fun readValue(out: StringBuilder?) {
+        skipWhitespace()
+        when (peek()) {
+            '{'.code, '['.code -> {
+                var depth = 0
+                var inString = false
+                var escaped = false
+                do {
+                    val c = next()
+                    if (c < 0) fail("end of the value")
+                    out?.append(c.toChar())
+                    when {
+                        escaped -> escaped = false
+                        inString && c == '\\'.code -> escaped = true
+                        c == '"'.code -> inString = !inString
+                        inString -> {}
+                        c == '{'.code || c == '['.code -> depth++
+                        c == '}'.code || c == ']'.code -> depth--
+                    }
+                } while (depth > 0)
+            }
+            '"'.code -> {
+                out?.append(next().toChar())
+                var escaped = false
+                while (true) {
+                    val c = next()
+                    if (c < 0) fail("end of the string")
+                    out?.append(c.toChar())
+                    if (escaped) escaped = false
+                    else if (c == '\\'.code) escaped = true
+                    else if (c == '"'.code) return
+                }
+            }
+            else -> while (peek() >= 0 && peek().toChar().let { !it.isWhitespace() && it !in ",}]" }) {
+                out?.append(next().toChar())
+            }
+        }
+    }
+
+    private fun expect(c: Char) {
+        skipWhitespace()
+        if (next() != c.code) fail("'$c'")
+    }
+
+    private fun skipWhitespace() {
+        while (peek() >= 0 && peek().toChar().isWhitespace()) next()
+    }
+
+    private fun peek(): Int {
+        if (peeked == NONE) peeked = input.read()
+        return peeked
+    }
+
+    private fun next(): Int = peek().also {
+        peeked = NONE
+        offset++
+    }
+
+    private fun fail(expected: String): Nothing =
+        throw IllegalArgumentException("Expected $expected at character $offset of the payload")
+
+    companion object {
+        private const val NONE = -2
+    }
+}
@@ -0,0 +1,73 @@
+package me.centralhardware.healthImportServer.request
+
+import org.slf4j.LoggerFactory
+
+/**
+ * Reads the "Health Metrics" CSV export of Health Auto Export. The first
+ * column is the timestamp, every other column is `Name (unit)` or
+ * `Name [Aggregate] (unit)`, e.g. `Heart Rate [Min] (count/min)`.
+ */
+object HealthAutoExportCsv {
+    val log = LoggerFactory.getLogger(HealthAutoExportCsv::class.java)
+    private val header = Regex("""^(.+?)\s*(?:\[(.+)])?\s*(?:\((.*)\))?$""")
+
+    fun parse(csv: String): Export {
+        val lines = csv.lineSequence().filter { it.isNotBlank() }.map { splitLine(it) }.iterator()
+        if (!lines.hasNext()) return Export()
+        val columns = lines.next().drop(1).map { column(it) }
+        columns.filter { it.field == null }.forEach { log.warn("Skipping unsupported CSV column ${it.header}") }
+
+        val samples = linkedMapOf<Pair<String, String>, MutableMap<String, Sample>>()
+        for (row in lines) {
+            val date = row.firstOrNull()?.takeIf { it.isNotEmpty() } ?: continue
+            columns.forEachIndexed { i, column ->
+                val field = column.field ?: return@forEachIndexed
+                val value = row.getOrNull(i + 1)?.takeIf { it.isNotEmpty() }?.toDoubleOrNull() ?: return@forEachIndexed
+                val byDate = samples.getOrPut(column.name to column.units) { linkedMapOf() }
+                byDate[date] = field(byDate[date] ?: Sample(date = date), value)
+            }
+        }
+        return Export(metrics = samples.map { (key, byDate) -> Metric(key.first, key.second, byDate.values.toList()) })
+    }
+
+    private class Column(val header: String, val name: String, val units: String, val field: ((Sample, Double) -> Sample)?)
+
+    private fun column(value: String): Column {
+        val match = header.matchEntire(value.trim())
+        val name = metricName(match?.groupValues?.get(1) ?: value)
+        val units = match?.groupValues?.get(3) ?: ""
+        val field: ((Sample, Double) -> Sample)? = when (match?.groupValues?.get(2)?.lowercase() ?: "") {
+            "" -> { s, v -> s.copy(qty = v) }
+            "min" -> { s, v -> s.copy(min = v) }
+            "max" -> { s, v -> s.copy(max = v) }
+            "avg" -> { s, v -> s.copy(avg = v) }
+            "asleep" -> { s, v -> s.copy(asleep = v) }
+            "in bed" -> { s, v -> s.copy(inBed = v) }
+            else -> null
+        }
+        return Column(value, name, units, field)
+    }
+
+    /** `Weight & Body Mass` becomes `weight_body_mass`, matching the JSON export. */
+    private fun metricName(value: String): String =
+        value.trim().lowercase().replace(Regex("[^a-z0-9]+"), "_").trim('_')
+
+    private fun splitLine(line: String): List<String> {
+        val fields = mutableListOf<String>()
+        val current = StringBuilder()
+        var quoted = false
+        var i = 0
+        while (i < line.length) {
+            val c = line[i]
+            when {
+                c == '"' && quoted && line.getOrNull(i + 1) == '"' -> { current.append('"'); i++ }
+                c == '"' -> quoted = !quoted
+                c == ',' && !quoted -> { fields += current.toString().trim(); current.clear() }
+                else -> current.append(c)
+            }
+            i++
+        }
+        fields += current.toString().trim()
+        return fields
+    }
+}
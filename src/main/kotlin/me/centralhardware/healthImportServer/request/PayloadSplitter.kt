@@ -0,0 +1,91 @@
+package me.centralhardware.healthImportServer.request
+
+/**
+ * Splits a parsed export into bounded chunks. Data is grouped by day and
+ * consecutive days are packed together until a chunk reaches [maxRows] rows,
+ * so a failure while storing one chunk only affects that slice of the payload.
+ */
+object PayloadSplitter {
+
+    fun split(export: Export, maxRows: Int): List<Export> {
+        if (maxRows <= 0) return listOf(export)
+
+        val byDay = sortedMapOf<String, MutableList<Item>>()
+        fun add(day: String, item: Item) = byDay.getOrPut(day) { mutableListOf() }.add(item)
+
+        for (m in export.metrics) {
+            for ((day, samples) in m.data.groupBy { dayOf(it.date) }) {
+                samples.chunked(maxRows).forEach { add(day, Item.MetricPart(m.copy(data = it))) }
+            }
+        }
+        export.workouts.forEach { add(dayOf(it.start), Item.WorkoutPart(it)) }
+        export.stateOfMind.forEach { add(dayOf(it.start), Item.StateOfMindPart(it)) }
+        export.ecg.forEach { add(dayOf(it.start), Item.EcgPart(it)) }
+
+        val chunks = mutableListOf<Export>()
+        var current = ChunkBuilder()
+        for (item in byDay.values.flatten()) {
+            if (!current.isEmpty() && current.rows + item.rows > maxRows) {
+                chunks += current.build()
+                current = ChunkBuilder()
+            }
+            current.add(item)
+        }
+        if (!current.isEmpty()) chunks += current.build()
+        return chunks
+    }
+
+    private fun dayOf(date: String?): String = date?.take(10) ?: ""
+
+    private sealed interface Item {
+        val rows: Int
+
+        class MetricPart(val metric: Metric) : Item {
+            override val rows get() = metric.data.size
+        }
+
+        class WorkoutPart(val workout: Workout) : Item {
+            override val rows
+                get() = 1 + workout.route.size + workout.heartRateData.size + workout.heartRateRecovery.size +
+                        workout.stepCount.size + workout.walkingAndRunningDistance.size + workout.activeEnergy.size +
+                        workout.flightsClimbed.size
+        }
+
+        class StateOfMindPart(val stateOfMind: StateOfMind) : Item {
+            override val rows get() = 1
+        }
+
+        class EcgPart(val ecg: ECG) : Item {
+            override val rows get() = 1 + ecg.voltageMeasurements.size
+        }
+    }
+
+    private class ChunkBuilder {
+        private val metrics = linkedMapOf<Pair<String, String>, MutableList<Sample>>()
+        private val workouts = mutableListOf<Workout>()
+        private val stateOfMind = mutableListOf<StateOfMind>()
+        private val ecg = mutableListOf<ECG>()
+        var rows = 0
+            private set
+
+        fun isEmpty() = rows == 0
+
+        fun add(item: Item) {
+            when (item) {
+                is Item.MetricPart -> metrics.getOrPut(item.metric.name to item.metric.units) { mutableListOf() }
+                    .addAll(item.metric.data)
+                is Item.WorkoutPart -> workouts += item.workout
+                is Item.StateOfMindPart -> stateOfMind += item.stateOfMind
+                is Item.EcgPart -> ecg += item.ecg
+            }
+            rows += item.rows
+        }
+
+        fun build() = Export(
+            metrics = metrics.map { (key, samples) -> Metric(key.first, key.second, samples) },
+            workouts = workouts.toList(),
+            stateOfMind = stateOfMind.toList(),
+            ecg = ecg.toList()
+        )
+    }
+}
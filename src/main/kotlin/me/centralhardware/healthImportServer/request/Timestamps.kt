@@ -0,0 +1,33 @@
+package me.centralhardware.healthImportServer.request
+
+import java.time.Instant
+import java.time.LocalDate
+import java.time.LocalDateTime
+import java.time.OffsetDateTime
+import java.time.ZoneId
+import java.time.format.DateTimeFormatter
+
+/**
+ * Parses and formats the timestamp formats found in Auto Export payloads.
+ */
+object Timestamps {
+    private val zonedTsFmt = DateTimeFormatter.ofPattern("yyyy-MM-dd HH:mm:ss Z")
+    private val localTsFmt = DateTimeFormatter.ofPattern("yyyy-MM-dd HH:mm:ss")
+    private val dateFmt = DateTimeFormatter.ofPattern("yyyy-MM-dd")
+
+    /**
+     * Picks the format by the shape of [value] rather than trying each one,
+     * since this runs for every sample and failed attempts are expensive.
+     */
+    fun parse(value: String): Instant = when {
+        value.length == 10 -> LocalDate.parse(value, dateFmt).atStartOfDay(ZoneId.systemDefault()).toInstant()
+        value.length > 10 && value[10] == 'T' -> Instant.parse(value)
+        value.length > 19 && value[value.length - 5] in "+-" -> OffsetDateTime.parse(value, zonedTsFmt).toInstant()
+        else -> LocalDateTime.parse(value, localTsFmt).atZone(ZoneId.systemDefault()).toInstant()
+    }
+
+    fun parseOrNull(value: String?): Instant? = value?.let { runCatching { parse(it) }.getOrNull() }
+
+    /** Formats [value] the way Auto Export does, in the system time zone. */
+    fun format(value: Instant): String = zonedTsFmt.format(value.atZone(ZoneId.systemDefault()))
+}
@@ -0,0 +1,107 @@
+package me.centralhardware.healthImportServer.storage
+
+import io.minio.GetObjectArgs
+import io.minio.MinioClient
+import io.minio.PutObjectArgs
+import io.minio.RemoveObjectArgs
+import io.minio.credentials.AwsEnvironmentProvider
+import io.minio.errors.ErrorResponseException
+import me.centralhardware.healthImportServer.Env
+import org.slf4j.LoggerFactory
+import java.io.ByteArrayInputStream
+import java.nio.file.Files
+import java.nio.file.Path
+import java.nio.file.Paths
+
+/**
+ * Where the files attached to workouts are kept; ClickHouse only holds
+ * references to them in `workout_attachments`. Keys are made of the
+ * workout and attachment UUIDs, so they are safe as paths.
+ */
+interface AttachmentFiles {
+    fun put(key: String, bytes: ByteArray, contentType: String)
+
+    /** The file stored under [key], or null if there is none. */
+    fun get(key: String): ByteArray?
+
+    /** Deletes the file stored under [key], if there is one. */
+    fun delete(key: String)
+
+    companion object {
+        /**
+         * Reads `ATTACHMENT_TARGET`, a directory such as `/data/attachments`
+         * or an `s3://bucket/prefix` URL using [S3Settings]. Returns null,
+         * disabling attachments, if it is not set.
+         */
+        fun fromEnv(): AttachmentFiles? {
+            val target = Env.get("ATTACHMENT_TARGET") ?: return null
+            if (!target.startsWith("s3://")) return DirectoryAttachments(Paths.get(target))
+            val location = target.removePrefix("s3://")
+            return S3Attachments(location.substringBefore('/'), location.substringAfter('/', "").trim('/'), S3Settings.fromEnv())
+        }
+    }
+}
+
+class DirectoryAttachments(private val dir: Path) : AttachmentFiles {
+    val log = LoggerFactory.getLogger(DirectoryAttachments::class.java)
+
+    init {
+        Files.createDirectories(dir)
+        log.info("Storing workout attachments in $dir")
+    }
+
+    override fun put(key: String, bytes: ByteArray, contentType: String) {
+        val file = dir.resolve(key)
+        Files.createDirectories(file.parent)
+        Files.write(file, bytes)
+    }
+
+    override fun get(key: String): ByteArray? = dir.resolve(key).takeIf { Files.exists(it) }?.let { Files.readAllBytes(it) }
+
+    override fun delete(key: String) {
+        Files.deleteIfExists(dir.resolve(key))
+    }
+}
+
+class S3Attachments(private val bucket: String, private val prefix: String, s3: S3Settings) : AttachmentFiles {
+    val log = LoggerFactory.getLogger(S3Attachments::class.java)
+    private val client = MinioClient.builder()
+        .endpoint(s3.endpoint ?: DEFAULT_ENDPOINT)
+        .apply {
+            if (s3.accessKeyId != null) credentials(s3.accessKeyId, s3.secretAccessKey ?: "")
+            else credentialsProvider(AwsEnvironmentProvider())
+        }
+        .apply { s3.region?.let { region(it) } }
+        .build()
+
+    init {
+        log.info("Storing workout attachments in s3://$bucket/$prefix")
+    }
+
+    private fun objectName(key: String) = if (prefix.isEmpty()) key else "$prefix/$key"
+
+    override fun put(key: String, bytes: ByteArray, contentType: String) {
+        client.putObject(
+            PutObjectArgs.builder()
+                .bucket(bucket)
+                .`object`(objectName(key))
+                .stream(ByteArrayInputStream(bytes), bytes.size.toLong(), -1)
+                .contentType(contentType)
+                .build()
+        )
+    }
+
+    override fun get(key: String): ByteArray? = try {
+        client.getObject(GetObjectArgs.builder().bucket(bucket).`object`(objectName(key)).build()).use { it.readAllBytes() }
+    } catch (e: ErrorResponseException) {
+        if (e.errorResponse().code() == "NoSuchKey") null else throw e
+    }
+
+    override fun delete(key: String) {
+        client.removeObject(RemoveObjectArgs.builder().bucket(bucket).`object`(objectName(key)).build())
+    }
+
+    companion object {
+        private const val DEFAULT_ENDPOINT = "https://s3.amazonaws.com"
+    }
+}
@@ -1,75 +1,297 @@
 package me.centralhardware.healthImportServer.storage
 
+import me.centralhardware.healthImportServer.ImportSnapshot
+import me.centralhardware.healthImportServer.analytics.HeartRateZones
+import me.centralhardware.healthImportServer.analytics.PersonalRecord
+import me.centralhardware.healthImportServer.analytics.RecordKind
 import me.centralhardware.healthImportServer.request.*
+import kotlinx.serialization.json.JsonArray
+import kotlinx.serialization.json.JsonElement
+import kotlinx.serialization.json.JsonNull
+import kotlinx.serialization.json.JsonPrimitive
 import org.flywaydb.core.Flyway
 import org.slf4j.LoggerFactory
 import java.net.URI
 import java.sql.Connection
 import java.sql.DriverManager
+import java.sql.Statement
 import java.sql.Timestamp
+import java.time.Instant
 import java.time.LocalDate
-import java.time.LocalDateTime
-import java.time.OffsetDateTime
-import java.time.format.DateTimeFormatter
+import java.util.concurrent.ArrayBlockingQueue
+import java.util.concurrent.ConcurrentHashMap
+import java.util.concurrent.ExecutionException
+import java.util.concurrent.Executors
+import java.util.concurrent.atomic.AtomicLong
 
-class ClickHouseMetricStore(private val config: ClickHouseConfig) : AutoCloseable {
+/**
+ * Stores exports in ClickHouse. Sending the same data again must not end up
+ * as duplicates: every table except `audit_log` is a ReplacingMergeTree keyed
+ * by what identifies a sample, and how duplicates of a key are resolved is
+ * picked per table by [ClickHouseConfig.deduplication]. The API token tables
+ * always keep the most recent row, their engine is not configurable.
+ */
+class ClickHouseMetricStore(
+    private val config: ClickHouseConfig,
+    private val heartRateZones: HeartRateZones? = null,
+    private val cipher: ColumnCipher? = null,
+) : AutoCloseable {
     val log = LoggerFactory.getLogger(ClickHouseMetricStore::class.java)
-    private val zonedTsFmt = DateTimeFormatter.ofPattern("yyyy-MM-dd HH:mm:ss Z")
-    private val localTsFmt = DateTimeFormatter.ofPattern("yyyy-MM-dd HH:mm:ss")
-    private val dateFmt = DateTimeFormatter.ofPattern("yyyy-MM-dd")
-
-    private fun parseTs(value: String): Timestamp {
-        return try {
-            Timestamp.from(java.time.Instant.parse(value))
-        } catch (_: Exception) {
-            try {
-                val odt = OffsetDateTime.parse(value, zonedTsFmt)
-                Timestamp.from(odt.toInstant())
-            } catch (_: Exception) {
-                try {
-                    val ldt = LocalDateTime.parse(value, localTsFmt)
-                    Timestamp.valueOf(ldt)
-                } catch (_: Exception) {
-                    val d = LocalDate.parse(value, dateFmt)
-                    Timestamp.valueOf(d.atStartOfDay())
-                }
-            }
-        }
-    }
+    private fun parseTs(value: String): Timestamp = Timestamp.from(Timestamps.parse(value))
+
     private val connection: Connection
+    /** Connection of [ClickHouseConfig.queryUser] for ad hoc queries; null without one. */
+    private val queryConnection: Connection?
+    private val insertConnections = ArrayBlockingQueue<Connection>(config.insertParallelism)
+    private val insertExecutor = Executors.newFixedThreadPool(config.insertParallelism) { task ->
+        Thread(task, "clickhouse-insert").apply { isDaemon = true }
+    }
+    /** Connection of the insert task running on this thread, see [runInserts]. */
+    private val taskConnection = ThreadLocal<Connection?>()
+    private val writer: Connection get() = taskConnection.get() ?: connection
+    private val logVersions = AtomicLong()
+    private val insertSettings = config.insertSettings.takeIf { it.isNotEmpty() }
+        ?.entries?.joinToString(", ", prefix = "SETTINGS ", postfix = " ") { (k, v) -> "$k = $v" }
+        ?: ""
 
     init {
-        val jdbcUrl = if (config.dsn.startsWith("clickhouse://")) {
-            "jdbc:" + config.dsn
-        } else config.dsn
-        val uri = URI(config.dsn)
+        val jdbcUrl = jdbcUrl()
+        // A read-only user may not change settings, so it connects without CLICKHOUSE_SETTINGS.
+        val queryUrl = jdbcUrl(withSettings = false)
+        val uri = URI(config.dsn.removePrefix("jdbc:").removePrefix("clickhouse:"))
         val creds = uri.userInfo?.split(":", limit = 2) ?: emptyList()
         val user = creds.getOrNull(0)
         val password = creds.getOrNull(1)
 
-        Flyway.configure()
-            .dataSource(jdbcUrl, user, password)
-            .locations("classpath:migration")
-            .placeholders(mapOf("database" to config.database))
-            .load()
-            .migrate()
+        if (config.ddl) {
+            Flyway.configure()
+                .dataSource(jdbcUrl, user, password)
+                .locations("classpath:migration")
+                .placeholders(mapOf("database" to config.database))
+                .load()
+                .migrate()
+        }
+
+        connection = DriverManager.getConnection(jdbcUrl, user, password)
+        repeat(config.insertParallelism) { insertConnections.add(DriverManager.getConnection(jdbcUrl, user, password)) }
+        queryConnection = config.queryUser?.let { queryUser ->
+            DriverManager.getConnection(queryUrl, queryUser, config.queryPassword)
+                .also { requireReadOnly(it, queryUser) }
+        }
+
+        if (config.ddl) {
+            createMetricTables()
+            addSourceToSortingKey()
+            applyDeduplication()
+            createHeartRateView()
+        } else {
+            requireTables()
+        }
+
+        if (config.insertSettings["async_insert"] == "1" && config.insertSettings["wait_for_async_insert"] == "0") {
+            log.warn("async_insert without wait_for_async_insert: failed inserts will not be reported")
+        }
+    }
+
+    /**
+     * Builds the JDBC URL from the DSN. Besides `clickhouse://` DSNs, `http://`
+     * and `https://` DSNs (as used by ClickHouse Cloud) are accepted. Credentials
+     * are passed separately and the secure flag and server settings are added
+     * as URL parameters so Flyway uses them as well.
+     */
+    private fun jdbcUrl(withSettings: Boolean = true): String {
+        val dsn = config.dsn.removePrefix("jdbc:")
+        val uri = URI(dsn.removePrefix("clickhouse:").takeIf { it.startsWith("http") } ?: dsn)
+        val scheme = if (uri.scheme == "clickhouse") "clickhouse" else "clickhouse:${uri.scheme}"
+        val port = if (uri.port != -1) ":${uri.port}" else ""
+        val params = buildList {
+            uri.rawQuery?.let { add(it) }
+            if (config.secure && uri.scheme != "https") add("ssl=true")
+            if (withSettings) config.settings.forEach { (k, v) -> add("clickhouse_setting_$k=$v") }
+        }
+        val query = if (params.isEmpty()) "" else params.joinToString("&", prefix = "?")
+        return "jdbc:$scheme://${uri.host}$port${uri.rawPath ?: ""}$query"
+    }
+
+    /**
+     * Rebuilds tables deduplicated with [Deduplication.VERSION] that still
+     * use the plain ReplacingMergeTree engine. The engine of a table can not
+     * be altered, so the rows are copied into a new table with a `version`
+     * column, which is then swapped in. Existing rows get version 0, so any
+     * later write of the same key replaces them.
+     */
+    private fun applyDeduplication() {
+        val tables = (TABLES + config.metricTables.values).filter { config.deduplication(it) == Deduplication.VERSION }
+        val sortingKeys = mutableMapOf<String, String>()
+        connection.prepareStatement(
+            "SELECT name, sorting_key FROM system.tables WHERE database = ? AND engine = 'ReplacingMergeTree' AND engine_full NOT LIKE 'ReplacingMergeTree(version)%'"
+        ).use { stmt ->
+            stmt.setString(1, config.database)
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) sortingKeys[rs.getString("name")] = rs.getString("sorting_key")
+            }
+        }
+        connection.createStatement().use { stmt ->
+            for (table in tables) {
+                val sortingKey = sortingKeys[table] ?: continue
+                log.info("Rebuilding $table as ReplacingMergeTree(version)")
+                stmt.execute("ALTER TABLE ${config.database}.$table ADD COLUMN IF NOT EXISTS version UInt64 DEFAULT 0")
+                rebuild(stmt, table, "ReplacingMergeTree(version) ORDER BY ($sortingKey)") { rebuilt ->
+                    stmt.execute("ALTER TABLE $rebuilt MODIFY COLUMN version UInt64 DEFAULT toUnixTimestamp64Micro(now64(6))")
+                }
+            }
+        }
+    }
+
+    /**
+     * Adds `source` to the sorting key of the metric tables, which were
+     * created without it, so samples of two devices taken at the same time
+     * are both kept rather than one replacing the other. A sorting key can
+     * only be extended with a column added in the same ALTER, so the rows
+     * are copied into a rebuilt table, keeping the engine.
+     */
+    private fun addSourceToSortingKey() {
+        val tables = (listOf("metrics") + config.metricTables.values).toSet()
+        val existing = mutableMapOf<String, Pair<String, String>>()
+        connection.prepareStatement(
+            "SELECT name, engine_full, sorting_key FROM system.tables WHERE database = ? AND engine LIKE '%ReplacingMergeTree'"
+        ).use { stmt ->
+            stmt.setString(1, config.database)
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) existing[rs.getString("name")] = rs.getString("engine_full") to rs.getString("sorting_key")
+            }
+        }
+        connection.createStatement().use { stmt ->
+            for (table in tables) {
+                val (engineFull, sortingKey) = existing[table] ?: continue
+                if ("source" in sortingKey.split(",").map { it.trim() }) continue
+                val engine = engineFull.split(" PARTITION BY ", " PRIMARY KEY ", " ORDER BY ", " SETTINGS ").first()
+                log.info("Rebuilding $table with source in its sorting key")
+                rebuild(stmt, table, "$engine ORDER BY ($sortingKey, source)")
+            }
+        }
+    }
+
+    /**
+     * Copies the rows of [table] into a new table with the same columns and
+     * [engine], a full engine clause, and swaps it in. [prepare] gets the new
+     * table before the rows are copied. Only Atomic databases can exchange
+     * tables in one step; in others, e.g. Ordinary ones, the tables are
+     * renamed, so the table is missing for a moment.
+     */
+    private fun rebuild(stmt: Statement, table: String, engine: String, prepare: (String) -> Unit = {}) {
+        val name = "${config.database}.$table"
+        stmt.execute("DROP TABLE IF EXISTS ${name}_rebuild")
+        stmt.execute("CREATE TABLE ${name}_rebuild AS $name ENGINE = $engine")
+        prepare("${name}_rebuild")
+        stmt.execute("INSERT INTO ${name}_rebuild SELECT * FROM $name")
+        if (databaseEngine(stmt) == "Atomic") {
+            stmt.execute("EXCHANGE TABLES $name AND ${name}_rebuild")
+            stmt.execute("DROP TABLE ${name}_rebuild")
+        } else {
+            stmt.execute("DROP TABLE IF EXISTS ${name}_old")
+            stmt.execute("RENAME TABLE $name TO ${name}_old, ${name}_rebuild TO $name")
+            stmt.execute("DROP TABLE ${name}_old")
+        }
+    }
+
+    private fun databaseEngine(stmt: Statement): String? =
+        stmt.executeQuery("SELECT engine FROM system.databases WHERE name = '${config.database}'").use { rs ->
+            if (rs.next()) rs.getString(1) else null
+        }
 
-        connection = DriverManager.getConnection(jdbcUrl)
+    /** Without DDL rights nothing can be created, so fail early if the schema is incomplete. */
+    private fun requireTables() {
+        val existing = mutableSetOf<String>()
+        connection.prepareStatement("SELECT name FROM system.tables WHERE database = ?").use { stmt ->
+            stmt.setString(1, config.database)
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) existing += rs.getString(1)
+            }
+        }
+        val missing = (TABLES + config.metricTables.values).distinct().filterNot { it in existing }
+        check(missing.isEmpty()) {
+            "DDL is disabled but tables are missing in ${config.database}: ${missing.joinToString()}. " +
+                    "Run the server once with a user that may create them or apply the migrations manually."
+        }
     }
 
     fun store(metrics: List<Metric>) {
-        if (metrics.isEmpty()) return
+        runInserts(metricInserts(metrics))
+    }
+
+    /**
+     * Writes everything in [export], inserting into up to
+     * [ClickHouseConfig.insertParallelism] tables at the same time. Fails
+     * with the first error after all inserts finished, otherwise returns
+     * the milliseconds spent per table.
+     */
+    fun storeAll(export: Export): Map<String, Long> = runInserts(
+        metricInserts(export.metrics) + ecgInserts(export.ecg) + workoutInserts(export.workouts) +
+                stateOfMindInserts(export.stateOfMind)
+    )
+
+    /** Runs inserts keyed by table and returns the milliseconds each took. */
+    private fun runInserts(inserts: List<Pair<String, () -> Unit>>): Map<String, Long> {
+        val millis = ConcurrentHashMap<String, Long>()
+        fun timed(table: String, insert: () -> Unit) {
+            val started = System.nanoTime()
+            insert()
+            millis.merge(table, (System.nanoTime() - started) / 1_000_000, Long::plus)
+        }
+        if (config.insertParallelism == 1 || inserts.size <= 1) {
+            withInsertConnection { inserts.forEach { (table, insert) -> timed(table, insert) } }
+            return millis
+        }
+        val futures = inserts.map { (table, insert) ->
+            insertExecutor.submit { withInsertConnection { timed(table, insert) } }
+        }
+        val errors = futures.mapNotNull { future ->
+            try {
+                future.get()
+                null
+            } catch (e: ExecutionException) {
+                e.cause ?: e
+            }
+        }
+        if (errors.isNotEmpty()) throw errors.first().apply { errors.drop(1).forEach { addSuppressed(it) } }
+        return millis
+    }
+
+    /**
+     * Runs [block] with a connection of the insert pool, shared by all uploads
+     * written at the same time, so writes never use [connection] of the read
+     * API. A block already holding one keeps it.
+     */
+    private fun <T> withInsertConnection(block: () -> T): T {
+        if (taskConnection.get() != null) return block()
+        val conn = insertConnections.take()
+        taskConnection.set(conn)
+        try {
+            return block()
+        } finally {
+            taskConnection.remove()
+            insertConnections.put(conn)
+        }
+    }
+
+    private fun metricInserts(metrics: List<Metric>): List<Pair<String, () -> Unit>> =
+        metrics.groupBy { metricsTable(it.name) }.map { (table, tableMetrics) -> table to { storeMetrics(table, tableMetrics) } }
+
+    private fun storeMetrics(table: String, metrics: List<Metric>) {
         val sql = """
-            INSERT INTO ${config.database}.metrics (timestamp, metric_name, metric_unit, qty, min, max, avg, asleep, in_bed, sleep_source, in_bed_source)
-            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+            INSERT INTO ${config.database}.$table
+            (timestamp, metric_name, metric_unit, qty, min, max, avg, asleep, in_bed, sleep_source, in_bed_source,
+             sleep_start, sleep_end, in_bed_start, in_bed_end, core, deep, rem, awake, category, source)
+            ${insertSettings}VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
         """.trimIndent()
-        connection.prepareStatement(sql).use { stmt ->
+        val none = Timestamp(0)
+        writer.prepareStatement(sql).use { stmt ->
             var count = 0
             for (m in metrics) {
                 for (s in m.data) {
-                    val ts = s.date ?: continue
+                    val ts = s.date ?: s.startDate ?: continue
                     val qty = s.qty ?: 0.0
-                    log.info("Batching metric: ${m.name} (${m.units}) $ts -> $qty")
                     stmt.setTimestamp(1, parseTs(ts))
                     stmt.setString(2, m.name)
                     stmt.setString(3, m.units)
@@ -79,19 +301,186 @@ class ClickHouseMetricStore(private val config: ClickHouseConfig) : AutoCloseabl
                     stmt.setDouble(7, s.avg?:  0.0)
                     stmt.setDouble(8, s.asleep?: 0.0)
                     stmt.setDouble(9, s.inBed?:  0.0)
-                    stmt.setString(10, s.sleepSource?:  "")
+                    stmt.setString(10, s.sleepSource ?: "")
                     stmt.setString(11, s.inBedSource?:  "")
+                    stmt.setTimestamp(12, (s.sleepStart ?: s.startDate)?.let { parseTs(it) } ?: none)
+                    stmt.setTimestamp(13, (s.sleepEnd ?: s.endDate)?.let { parseTs(it) } ?: none)
+                    stmt.setTimestamp(14, s.inBedStart?.let { parseTs(it) } ?: none)
+                    stmt.setTimestamp(15, s.inBedEnd?.let { parseTs(it) } ?: none)
+                    stmt.setDouble(16, s.core ?: 0.0)
+                    stmt.setDouble(17, s.deep ?: 0.0)
+                    stmt.setDouble(18, s.rem ?: 0.0)
+                    stmt.setDouble(19, s.awake ?: 0.0)
+                    stmt.setString(20, s.value ?: "")
+                    stmt.setString(21, s.source ?: "")
                     stmt.addBatch()
                     count++
                 }
             }
-            println("Executing metric batch with $count rows")
+            log.info("Executing $table batch with $count rows")
             stmt.executeBatch()
         }
     }
 
+    /** The table holding samples of [metricName]; see [ClickHouseConfig.metricTables]. */
+    fun metricsTable(metricName: String): String =
+        config.metricTables.entries.firstOrNull { (pattern, _) -> MetricFilter.matches(pattern, metricName) }?.value ?: "metrics"
+
+    /**
+     * A table expression reading the samples of all metrics, wherever they
+     * are stored. Only the configured tables are read, never the copies
+     * [applyDeduplication] makes while it rebuilds one.
+     */
+    fun allMetricsSource(): String {
+        if (config.metricTables.isEmpty()) return "${config.database}.metrics"
+        // Table names are checked to be [a-z0-9_] only, so they need no escaping in the pattern.
+        val tables = (listOf("metrics") + config.metricTables.values).distinct()
+        return "merge('${config.database}', '^(${tables.joinToString("|")})$')"
+    }
+
+    /**
+     * Points `heart_rate_all` at [allMetricsSource]. The migrations create it
+     * over every table starting with `metrics`, as they do not know the
+     * configured ones.
+     */
+    private fun createHeartRateView() {
+        connection.createStatement().use { stmt ->
+            stmt.execute(
+                """
+                CREATE OR REPLACE VIEW ${config.database}.heart_rate_all AS
+                SELECT timestamp, min, avg, max, units, device AS source, workout_id
+                FROM (
+                    SELECT
+                        timestamp, min, avg, max,
+                        metric_unit AS units,
+                        if(source != '', source, sleep_source) AS device,
+                        CAST(NULL AS Nullable(UUID)) AS workout_id
+                    FROM ${allMetricsSource()}
+                    WHERE metric_name = 'heart_rate'
+                )
+                UNION ALL
+                SELECT timestamp, min, avg, max, units, source, toNullable(workout_id) AS workout_id
+                FROM ${config.database}.workout_heart_rate_data
+                """.trimIndent()
+            )
+        }
+    }
+
+    /**
+     * Creates the dedicated metric tables. They share the columns of `metrics`
+     * but are ordered by metric name first, so reading one metric touches
+     * only its own parts. Columns added to `metrics` by later migrations are
+     * added to them as well.
+     */
+    private fun createMetricTables() {
+        val tables = config.metricTables.values.toSet()
+        connection.createStatement().use { stmt ->
+            for (table in tables) {
+                stmt.execute(
+                    """
+                    CREATE TABLE IF NOT EXISTS ${config.database}.$table AS ${config.database}.metrics
+                    ENGINE = ReplacingMergeTree()
+                    ORDER BY (metric_name, timestamp, source)
+                    """.trimIndent()
+                )
+            }
+        }
+        val columns = tableColumns()
+        val base = columns["metrics"] ?: return
+        connection.createStatement().use { stmt ->
+            for (table in tables) {
+                val existing = columns[table]?.map { it.first }?.toSet() ?: emptySet()
+                for ((name, definition) in base.filter { it.first !in existing }) {
+                    log.info("Adding column $name to ${config.database}.$table")
+                    stmt.execute("ALTER TABLE ${config.database}.$table ADD COLUMN IF NOT EXISTS $name $definition")
+                }
+            }
+        }
+    }
+
+    /** Column names and definitions (type and default) per table. */
+    private fun tableColumns(): Map<String, List<Pair<String, String>>> {
+        val sql = """
+            SELECT table, name, type, default_kind, default_expression
+            FROM system.columns
+            WHERE database = ?
+            ORDER BY table, position
+        """.trimIndent()
+        val columns = linkedMapOf<String, MutableList<Pair<String, String>>>()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setString(1, config.database)
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) {
+                    val default = rs.getString("default_kind").takeIf { it.isNotEmpty() }
+                        ?.let { " $it ${rs.getString("default_expression")}" } ?: ""
+                    columns.getOrPut(rs.getString("table")) { mutableListOf() } +=
+                        rs.getString("name") to rs.getString("type") + default
+                }
+            }
+        }
+        return columns
+    }
+
     fun storeWorkouts(workouts: List<Workout>) {
-        if (workouts.isEmpty()) return
+        runInserts(workoutInserts(workouts))
+    }
+
+    private fun workoutInserts(workouts: List<Workout>): List<Pair<String, () -> Unit>> {
+        if (workouts.isEmpty()) return emptyList()
+        // Looked up before any insert runs, so the workouts of this upload are not taken for resent ones.
+        val resent = withInsertConnection { storedWorkoutIds(workouts.mapNotNull { it.id }) }
+        fun replacing(table: String, rows: (Workout) -> List<*>, insert: (Long) -> Unit): Pair<String, () -> Unit> =
+            table to {
+                val version = nextLogVersion()
+                insert(version)
+                replaceWorkoutRows(table, workouts.filter { it.id in resent && rows(it).isNotEmpty() }.mapNotNull { it.id }, version)
+            }
+        return listOf(
+            "workouts" to { storeWorkoutRows(workouts) },
+            replacing("workout_routes", { it.route }) { storeWorkoutRoutes(workouts, it) },
+            replacing("workout_heart_rate_data", { it.heartRateData }) { storeWorkoutHeartRateData(workouts, it) },
+            replacing("workout_heart_rate_recovery", { it.heartRateRecovery }) { storeWorkoutHeartRateRecovery(workouts, it) },
+            replacing("workout_step_count_log", { it.stepCount }) { storeWorkoutStepCountLog(workouts, it) },
+            replacing("workout_walking_running_distance", { it.walkingAndRunningDistance }) {
+                storeWorkoutWalkingRunningDistance(workouts, it)
+            },
+            replacing("workout_active_energy", { it.activeEnergy }) { storeWorkoutActiveEnergy(workouts, it) },
+            replacing("workout_flights_climbed", { it.flightsClimbed }) { storeWorkoutFlightsClimbed(workouts, it) },
+        )
+    }
+
+    private fun storedWorkoutIds(ids: List<String>): Set<String> {
+        if (ids.isEmpty()) return emptySet()
+        val sql = "SELECT DISTINCT toString(id) FROM ${config.database}.workouts WHERE id IN (${ids.joinToString { "?" }})"
+        return writer.prepareStatement(sql).use { stmt ->
+            ids.forEachIndexed { i, id -> stmt.setString(i + 1, id) }
+            stmt.executeQuery().use { rs -> buildSet { while (rs.next()) add(rs.getString(1)) } }
+        }
+    }
+
+    /**
+     * Deletes the rows of [table] older than [version] for workouts that are
+     * sent again with rows of their own, e.g. once the route finished
+     * syncing, so the new rows replace the old ones instead of mixing with
+     * them. Runs right after the new rows were inserted, so readers never
+     * see the workout without them; if it fails, the old rows are left next
+     * to the new ones until the workout is sent again.
+     */
+    private fun replaceWorkoutRows(table: String, ids: List<String>, version: Long) {
+        if (ids.isEmpty()) return
+        val sql = "DELETE FROM ${config.database}.$table WHERE workout_id IN (${ids.joinToString { "?" }}) AND version < ?"
+        writer.prepareStatement(sql).use { stmt ->
+            ids.forEachIndexed { i, id -> stmt.setString(i + 1, id) }
+            stmt.setLong(ids.size + 1, version)
+            stmt.execute()
+        }
+        log.info("Replaced $table rows of ${ids.size} workout(s) sent again")
+    }
+
+    /** Versions of the rows of workout logs, increasing with every write, so a delete never takes rows written after it. */
+    private fun nextLogVersion(): Long = logVersions.updateAndGet { maxOf(it + 1, System.currentTimeMillis()) }
+
+    private fun storeWorkoutRows(workouts: List<Workout>) {
         val sql = """
             INSERT INTO ${config.database}.workouts
             (id, name, start, end,
@@ -99,10 +488,12 @@ class ClickHouseMetricStore(private val config: ClickHouseConfig) : AutoCloseabl
              distance_qty, distance_units,
              intensity_qty, intensity_units,
              humidity_qty, humidity_units,
-             temperature_qty, temperature_units)
-            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+             temperature_qty, temperature_units,
+             hr_zone_1_seconds, hr_zone_2_seconds, hr_zone_3_seconds, hr_zone_4_seconds, hr_zone_5_seconds,
+             elevation_up_qty, elevation_up_units, elevation_down_qty, elevation_down_units)
+            ${insertSettings}VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
         """.trimIndent()
-        connection.prepareStatement(sql).use { stmt ->
+        writer.prepareStatement(sql).use { stmt ->
             var count = 0
             for (w in workouts) {
                 val id = w.id ?: continue
@@ -112,153 +503,304 @@ class ClickHouseMetricStore(private val config: ClickHouseConfig) : AutoCloseabl
                 stmt.setString(2, w.name ?: "")
                 stmt.setTimestamp(3, parseTs(start))
                 stmt.setTimestamp(4, parseTs(end))
-                stmt.setDouble(5, w.activeEnergyBurned?.qty ?: 0.0)
+                stmt.setDouble(5, w.activeEnergyBurned?.total() ?: 0.0)
                 stmt.setString(6, w.activeEnergyBurned?.units ?: "")
-                stmt.setDouble(7, w.distance?.qty ?: 0.0)
+                stmt.setDouble(7, w.distance?.total() ?: 0.0)
                 stmt.setString(8, w.distance?.units ?: "")
-                stmt.setDouble(9, w.intensity?.qty ?: 0.0)
+                stmt.setDouble(9, w.intensity?.mean() ?: 0.0)
                 stmt.setString(10, w.intensity?.units ?: "")
-                stmt.setDouble(11, w.humidity?.qty ?: 0.0)
+                stmt.setDouble(11, w.humidity?.mean() ?: 0.0)
                 stmt.setString(12, w.humidity?.units ?: "")
-                stmt.setDouble(13, w.temperature?.qty ?: 0.0)
+                stmt.setDouble(13, w.temperature?.mean() ?: 0.0)
                 stmt.setString(14, w.temperature?.units ?: "")
+                val zones = (profiles.current()?.zones() ?: heartRateZones)?.timeInZones(w) ?: IntArray(HeartRateZones.ZONES)
+                zones.forEachIndexed { i, seconds -> stmt.setInt(15 + i, seconds) }
+                stmt.setDouble(20, w.elevationUp?.total() ?: 0.0)
+                stmt.setString(21, w.elevationUp?.units ?: "")
+                stmt.setDouble(22, w.elevationDown?.total() ?: 0.0)
+                stmt.setString(23, w.elevationDown?.units ?: "")
                 stmt.addBatch()
                 count++
             }
             log.info("Executing workout batch with $count rows")
             stmt.executeBatch()
         }
-
-        storeWorkoutRoutes(workouts)
-        storeWorkoutHeartRateData(workouts)
-        storeWorkoutHeartRateRecovery(workouts)
-        storeWorkoutStepCountLog(workouts)
-        storeWorkoutWalkingRunningDistance(workouts)
-        storeWorkoutActiveEnergy(workouts)
     }
 
     fun storeStateOfMind(stateOfMind: List<StateOfMind>) {
-        if (stateOfMind.isEmpty()) return
+        runInserts(stateOfMindInserts(stateOfMind))
+    }
+
+    private fun stateOfMindInserts(stateOfMind: List<StateOfMind>): List<Pair<String, () -> Unit>> =
+        if (stateOfMind.isEmpty()) emptyList() else listOf("state_of_mind" to { storeStateOfMindRows(stateOfMind) })
+
+    private fun storeStateOfMindRows(stateOfMind: List<StateOfMind>) {
         val sql = """
             INSERT INTO ${config.database}.state_of_mind
             (id, start, end, valence, valence_classification, kind, labels, associations)
-            VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+            ${insertSettings}VALUES (?, ?, ?, ?, ?, ?, ?, ?)
         """.trimIndent()
-        connection.prepareStatement(sql).use { stmt ->
-            var count = 0
-            for (s in stateOfMind) {
-                val id = s.id ?: continue
-                val start = s.start ?: continue
-                val end = s.end ?: continue
-                log.info("Batching state of mind: $s")
-                stmt.setString(1, id)
-                stmt.setTimestamp(2, parseTs(start))
-                stmt.setTimestamp(3, parseTs(end))
-                stmt.setDouble(4, s.valence ?: 0.0)
-                stmt.setString(5, s.valenceClassification ?: "")
-                stmt.setString(6, s.kind ?: "")
-                val labels = s.labels.joinToString(prefix = "[", postfix = "]", separator = ",") { "'$it'" }
-                val assoc = s.associations.joinToString(prefix = "[", postfix = "]", separator = ",") { "'$it'" }
-                stmt.setString(7, labels)
-                stmt.setString(8, assoc)
+        val labelSql = """
+            INSERT INTO ${config.database}.state_of_mind_labels (id, kind, name, display_name)
+            ${insertSettings}VALUES (?, ?, ?, ?)
+        """.trimIndent()
+        val mapSql = """
+            INSERT INTO ${config.database}.state_of_mind_label_map (state_of_mind_id, kind, label_id, start)
+            ${insertSettings}VALUES (?, ?, ?, ?)
+        """.trimIndent()
+        val labels = linkedMapOf<String, Pair<String, String>>()
+        writer.prepareStatement(sql).use { stmt ->
+            writer.prepareStatement(mapSql).use { mapStmt ->
+                var count = 0
+                var mapped = 0
+                for (s in stateOfMind) {
+                    val id = s.id ?: continue
+                    val start = s.start ?: continue
+                    val end = s.end ?: continue
+                    stmt.setString(1, id)
+                    stmt.setTimestamp(2, parseTs(start))
+                    stmt.setTimestamp(3, parseTs(end))
+                    stmt.setDouble(4, s.valence ?: 0.0)
+                    stmt.setString(5, s.valenceClassification ?: "")
+                    stmt.setString(6, s.kind ?: "")
+                    stmt.setString(7, arrayLiteral(s.labels.map { encrypt(ColumnCipher.LABELS, it) }))
+                    stmt.setString(8, arrayLiteral(s.associations.map { encrypt(ColumnCipher.ASSOCIATIONS, it) }))
+                    stmt.addBatch()
+                    count++
+
+                    val entries = s.labels.map { LabelNormalizer.LABEL to it } +
+                            s.associations.map { LabelNormalizer.ASSOCIATION to it }
+                    for ((kind, value) in entries) {
+                        val labelId = labelId(kind, value)
+                        labels.putIfAbsent(labelId, kind to value)
+                        mapStmt.setString(1, id)
+                        mapStmt.setString(2, kind)
+                        mapStmt.setString(3, labelId)
+                        mapStmt.setTimestamp(4, parseTs(start))
+                        mapStmt.addBatch()
+                        mapped++
+                    }
+                }
+                log.info("Executing state of mind batch with $count rows and $mapped label mappings")
+                stmt.executeBatch()
+                if (mapped > 0) mapStmt.executeBatch()
+            }
+        }
+        if (labels.isEmpty()) return
+        writer.prepareStatement(labelSql).use { stmt ->
+            for ((labelId, entry) in labels) {
+                val (kind, value) = entry
+                stmt.setString(1, labelId)
+                stmt.setString(2, kind)
+                val column = if (kind == LabelNormalizer.LABEL) ColumnCipher.LABELS else ColumnCipher.ASSOCIATIONS
+                stmt.setString(3, encrypt(column, LabelNormalizer.normalize(value)))
+                stmt.setString(4, encrypt(column, value.trim()))
                 stmt.addBatch()
-                count++
             }
-            log.info("Executing state of mind batch with $count rows")
             stmt.executeBatch()
         }
     }
 
+    private fun labelId(kind: String, value: String): String {
+        val column = if (kind == LabelNormalizer.LABEL) ColumnCipher.LABELS else ColumnCipher.ASSOCIATIONS
+        return if (cipher != null && cipher.encrypts(column)) cipher.id(kind, value) else LabelNormalizer.id(kind, value)
+    }
+
+    private fun encrypt(column: String, value: String): String =
+        if (cipher != null && cipher.encrypts(column)) cipher.encrypt(value) else value
+
+    private fun decrypt(value: String): String = cipher?.decrypt(value) ?: value
+
+    private fun arrayLiteral(values: List<String>): String =
+        values.joinToString(prefix = "[", postfix = "]", separator = ",") {
+            "'" + it.replace("\\", "\\\\").replace("'", "\\'") + "'"
+        }
+
     fun storeEcg(ecg: List<ECG>) {
-        if (ecg.isEmpty()) return
+        runInserts(ecgInserts(ecg))
+    }
+
+    private fun ecgInserts(ecg: List<ECG>): List<Pair<String, () -> Unit>> {
+        if (ecg.isEmpty()) return emptyList()
+        return listOfNotNull(
+            "ecg" to { storeEcgRows(ecg) },
+            if (config.ecgStorage != EcgStorage.ROWS) "ecg_waveform" to { storeEcgWaveforms(ecg) } else null,
+            if (config.ecgStorage != EcgStorage.ARRAY) "ecg_voltage" to { storeEcgVoltageRows(ecg) } else null,
+        )
+    }
+
+    private fun storeEcgRows(ecg: List<ECG>) {
         val sql = """
             INSERT INTO ${config.database}.ecg
             (id, classification, source, average_heart_rate, start, end, number_of_voltage_measurements, sampling_frequency)
-            VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+            ${insertSettings}VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+        """.trimIndent()
+
+        writer.prepareStatement(sql).use { ecgStmt ->
+            var ecgCount = 0
+            for (e in ecg) {
+                val start = e.start ?: continue
+                val end = e.end ?: continue
+                ecgStmt.setString(1, ecgId(e))
+                ecgStmt.setString(2, e.classification ?: "")
+                ecgStmt.setString(3, e.source ?: "")
+                ecgStmt.setDouble(4, e.averageHeartRate ?: 0.0)
+                ecgStmt.setTimestamp(5, parseTs(start))
+                ecgStmt.setTimestamp(6, parseTs(end))
+                ecgStmt.setInt(7, e.numberOfVoltageMeasurements ?: e.voltageMeasurements.size)
+                ecgStmt.setInt(8, e.samplingFrequency ?: 0)
+                ecgStmt.addBatch()
+                ecgCount++
+            }
+            log.info("Executing ECG batch with $ecgCount entries")
+            ecgStmt.executeBatch()
+        }
+    }
+
+    /** Stores each recording's voltages as one row of compressed arrays. */
+    private fun storeEcgWaveforms(ecg: List<ECG>) {
+        val sql = """
+            INSERT INTO ${config.database}.ecg_waveform
+            (ecg_id, start, sampling_frequency, units, offsets, voltages)
+            ${insertSettings}VALUES (?, ?, ?, ?, ?, ?)
         """.trimIndent()
-        val voltageSql = """
+        writer.prepareStatement(sql).use { stmt ->
+            var count = 0
+            for (e in ecg) {
+                if (e.start == null || e.end == null) continue
+                val points = e.voltageMeasurements.filter { it.date != null && it.voltage != null }
+                if (points.isEmpty()) continue
+                val first = points.first().date!!
+                stmt.setString(1, ecgId(e))
+                stmt.setTimestamp(2, Timestamp.from(epochSeconds(first)))
+                stmt.setInt(3, e.samplingFrequency ?: 0)
+                stmt.setString(4, points.firstNotNullOfOrNull { it.units } ?: "")
+                stmt.setString(5, points.joinToString(",", "[", "]") { (it.date!! - first).toString() })
+                stmt.setString(6, points.joinToString(",", "[", "]") { it.voltage!!.toString() })
+                stmt.addBatch()
+                count++
+            }
+            if (count > 0) {
+                log.info("Executing ECG waveform batch with $count recordings")
+                stmt.executeBatch()
+            }
+        }
+    }
+
+    private fun storeEcgVoltageRows(ecg: List<ECG>) {
+        val sql = """
             INSERT INTO ${config.database}.ecg_voltage
             (ecg_id, sample_index, timestamp, voltage, units)
-            VALUES (?, ?, ?, ?, ?)
-        """.trimIndent()
-
-        connection.prepareStatement(sql).use { ecgStmt ->
-            connection.prepareStatement(voltageSql).use { voltStmt ->
-                var ecgCount = 0
-                var voltCount = 0
-                for (e in ecg) {
-                    val start = e.start ?: continue
-                    val end = e.end ?: continue
-                    val base = listOf(
-                        start,
-                        end,
-                        e.classification ?: "",
-                        e.source ?: "",
-                        (e.averageHeartRate ?: 0.0).toString(),
-                        (e.numberOfVoltageMeasurements ?: e.voltageMeasurements.size).toString(),
-                        (e.samplingFrequency ?: 0).toString()
-                    ).joinToString("|")
-                    val id = java.util.UUID.nameUUIDFromBytes(base.toByteArray()).toString()
-
-                    ecgStmt.setString(1, id)
-                    ecgStmt.setString(2, e.classification ?: "")
-                    ecgStmt.setString(3, e.source ?: "")
-                    ecgStmt.setDouble(4, e.averageHeartRate ?: 0.0)
-                    ecgStmt.setTimestamp(5, parseTs(start))
-                    ecgStmt.setTimestamp(6, parseTs(end))
-                    ecgStmt.setInt(7, e.numberOfVoltageMeasurements ?: e.voltageMeasurements.size)
-                    ecgStmt.setInt(8, e.samplingFrequency ?: 0)
-                    ecgStmt.addBatch()
-                    ecgCount++
-
-                    var idx = 0
-                    for (v in e.voltageMeasurements) {
-                        val ts = v.date ?: continue
-                        val volt = v.voltage ?: continue
-                        log.info("Batching ECG voltage for $id: $v")
-                        voltStmt.setString(1, id)
-                        voltStmt.setInt(2, idx++)
-                        val instant = java.time.Instant.ofEpochMilli((ts * 1000).toLong())
-                        voltStmt.setTimestamp(3, java.sql.Timestamp.from(instant))
-                        voltStmt.setDouble(4, volt)
-                        voltStmt.setString(5, v.units ?: "")
-                        voltStmt.addBatch()
-                        voltCount++
-                    }
+            ${insertSettings}VALUES (?, ?, ?, ?, ?)
+        """.trimIndent()
+        writer.prepareStatement(sql).use { voltStmt ->
+            var voltCount = 0
+            for (e in ecg) {
+                if (e.start == null || e.end == null) continue
+                val id = ecgId(e)
+                var idx = 0
+                for (v in e.voltageMeasurements) {
+                    val ts = v.date ?: continue
+                    val volt = v.voltage ?: continue
+                    voltStmt.setString(1, id)
+                    voltStmt.setInt(2, idx++)
+                    val instant = java.time.Instant.ofEpochMilli((ts * 1000).toLong())
+                    voltStmt.setTimestamp(3, java.sql.Timestamp.from(instant))
+                    voltStmt.setDouble(4, volt)
+                    voltStmt.setString(5, v.units ?: "")
+                    voltStmt.addBatch()
+                    voltCount++
                 }
-                log.info("Executing ECG batch with $ecgCount entries and $voltCount voltage rows")
-                ecgStmt.executeBatch()
+            }
+            if (voltCount > 0) {
+                log.info("Executing ECG voltage batch with $voltCount rows")
                 voltStmt.executeBatch()
             }
         }
     }
 
-    private fun storeWorkoutRoutes(workouts: List<Workout>) {
+    /**
+     * The voltage series of one recording, from `ecg_waveform` or, for
+     * recordings stored with [EcgStorage.ROWS], rebuilt from `ecg_voltage`.
+     */
+    fun ecgWaveform(id: String): EcgWaveform? = storedWaveform(id) ?: rowWaveform(id)
+
+    private fun rowWaveform(id: String): EcgWaveform? {
+        val recording = ecgRecordings("id = ?", listOf(id)).firstOrNull()?.second ?: return null
+        val voltages = ecgVoltages(id).filter { it.date != null }
+        val first = voltages.firstOrNull()?.date ?: return null
+        return EcgWaveform(
+            id = id,
+            start = epochSeconds(first),
+            samplingFrequency = recording.samplingFrequency ?: 0,
+            units = voltages.first().units ?: "",
+            offsets = voltages.map { it.date!! - first },
+            voltages = voltages.map { it.voltage ?: 0.0 },
+        )
+    }
+
+    private fun storedWaveform(id: String): EcgWaveform? {
+        val sql = """
+            SELECT start, sampling_frequency, units,
+                   arrayStringConcat(arrayMap(x -> toString(x), offsets), ',') AS offsets,
+                   arrayStringConcat(arrayMap(x -> toString(x), voltages), ',') AS voltages
+            FROM ${config.database}.ecg_waveform FINAL
+            WHERE ecg_id = ?
+        """.trimIndent()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setString(1, id)
+            stmt.executeQuery().use { rs ->
+                if (!rs.next()) return null
+                return EcgWaveform(
+                    id = id,
+                    start = rs.getTimestamp("start").toInstant(),
+                    samplingFrequency = rs.getInt("sampling_frequency"),
+                    units = rs.getString("units"),
+                    offsets = parseDoubles(rs.getString("offsets")),
+                    voltages = parseDoubles(rs.getString("voltages")),
+                )
+            }
+        }
+    }
+
+    private fun parseDoubles(csv: String): List<Double> =
+        if (csv.isEmpty()) emptyList() else csv.split(",").map { it.toDouble() }
+
+    private fun epochSeconds(value: Double): java.time.Instant {
+        val seconds = kotlin.math.floor(value)
+        return java.time.Instant.ofEpochSecond(seconds.toLong(), ((value - seconds) * 1_000_000_000).toLong())
+    }
+
+    private fun storeWorkoutRoutes(workouts: List<Workout>, version: Long) {
         val sql = """
             INSERT INTO ${config.database}.workout_routes
             (workout_id, timestamp, lat, lon, altitude, course, vertical_accuracy,
-             horizontal_accuracy, course_accuracy, speed, speed_accuracy)
-            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+             horizontal_accuracy, course_accuracy, speed, speed_accuracy, location_encrypted, version)
+            ${insertSettings}VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
         """.trimIndent()
-        connection.prepareStatement(sql).use { stmt ->
+        // Encrypted routes keep only the ciphertext of the position.
+        val locationCipher = cipher?.takeIf { it.encrypts(ColumnCipher.LOCATIONS) }
+        val encrypted = locationCipher != null
+        writer.prepareStatement(sql).use { stmt ->
             var count = 0
             for (w in workouts) {
                 val id = w.id ?: continue
                 val start = w.start ?: continue
                 for (r in w.route) {
                     val ts = r.timestamp ?: start
-                    log.info("Batching workout route for $id: $r")
                     stmt.setString(1, id)
                     stmt.setTimestamp(2, parseTs(ts))
-                    stmt.setDouble(3, r.latitude ?: 0.0)
-                    stmt.setDouble(4, r.longitude ?: 0.0)
-                    stmt.setDouble(5, r.altitude ?: 0.0)
+                    stmt.setDouble(3, if (encrypted) 0.0 else r.latitude ?: 0.0)
+                    stmt.setDouble(4, if (encrypted) 0.0 else r.longitude ?: 0.0)
+                    stmt.setDouble(5, if (encrypted) 0.0 else r.altitude ?: 0.0)
                     stmt.setDouble(6, r.course ?: 0.0)
                     stmt.setDouble(7, r.verticalAccuracy ?: 0.0)
                     stmt.setDouble(8, r.horizontalAccuracy ?: 0.0)
                     stmt.setDouble(9, r.courseAccuracy ?: 0.0)
                     stmt.setDouble(10, r.speed ?: 0.0)
                     stmt.setDouble(11, r.speedAccuracy ?: 0.0)
+                    stmt.setString(12, locationCipher?.encrypt("${r.latitude ?: 0.0},${r.longitude ?: 0.0},${r.altitude ?: 0.0}") ?: "")
+                    stmt.setLong(13, version)
                     stmt.addBatch()
                     count++
                 }
@@ -270,20 +812,19 @@ class ClickHouseMetricStore(private val config: ClickHouseConfig) : AutoCloseabl
         }
     }
 
-    private fun storeWorkoutHeartRateData(workouts: List<Workout>) {
+    private fun storeWorkoutHeartRateData(workouts: List<Workout>, version: Long) {
         val sql = """
             INSERT INTO ${config.database}.workout_heart_rate_data
-            (workout_id, timestamp, min, max, avg, units, source)
-            VALUES (?, ?, ?, ?, ?, ?, ?)
+            (workout_id, timestamp, min, max, avg, units, source, version)
+            ${insertSettings}VALUES (?, ?, ?, ?, ?, ?, ?, ?)
         """.trimIndent()
-        connection.prepareStatement(sql).use { stmt ->
+        writer.prepareStatement(sql).use { stmt ->
             var count = 0
             for (w in workouts) {
                 val id = w.id ?: continue
                 val start = w.start ?: continue
                 for (h in w.heartRateData) {
                     val ts = h.date ?: start
-                    log.info("Batching workout heart rate data for $id: $h")
                     stmt.setString(1, id)
                     stmt.setTimestamp(2, parseTs(ts))
                     stmt.setDouble(3, h.min ?: 0.0)
@@ -291,6 +832,7 @@ class ClickHouseMetricStore(private val config: ClickHouseConfig) : AutoCloseabl
                     stmt.setDouble(5, h.avg ?: 0.0)
                     stmt.setString(6, h.units ?: "")
                     stmt.setString(7, h.source ?: "")
+                    stmt.setLong(8, version)
                     stmt.addBatch()
                     count++
                 }
@@ -302,20 +844,19 @@ class ClickHouseMetricStore(private val config: ClickHouseConfig) : AutoCloseabl
         }
     }
 
-    private fun storeWorkoutHeartRateRecovery(workouts: List<Workout>) {
+    private fun storeWorkoutHeartRateRecovery(workouts: List<Workout>, version: Long) {
         val sql = """
             INSERT INTO ${config.database}.workout_heart_rate_recovery
-            (workout_id, timestamp, min, max, avg, units, source)
-            VALUES (?, ?, ?, ?, ?, ?, ?)
+            (workout_id, timestamp, min, max, avg, units, source, version)
+            ${insertSettings}VALUES (?, ?, ?, ?, ?, ?, ?, ?)
         """.trimIndent()
-        connection.prepareStatement(sql).use { stmt ->
+        writer.prepareStatement(sql).use { stmt ->
             var count = 0
             for (w in workouts) {
                 val id = w.id ?: continue
                 val start = w.start ?: continue
                 for (h in w.heartRateRecovery) {
                     val ts = h.date ?: start
-                    log.info("Batching workout heart rate recovery for $id: $h")
                     stmt.setString(1, id)
                     stmt.setTimestamp(2, parseTs(ts))
                     stmt.setDouble(3, h.min ?: 0.0)
@@ -323,6 +864,7 @@ class ClickHouseMetricStore(private val config: ClickHouseConfig) : AutoCloseabl
                     stmt.setDouble(5, h.avg ?: 0.0)
                     stmt.setString(6, h.units ?: "")
                     stmt.setString(7, h.source ?: "")
+                    stmt.setLong(8, version)
                     stmt.addBatch()
                     count++
                 }
@@ -334,25 +876,25 @@ class ClickHouseMetricStore(private val config: ClickHouseConfig) : AutoCloseabl
         }
     }
 
-    private fun storeWorkoutStepCountLog(workouts: List<Workout>) {
+    private fun storeWorkoutStepCountLog(workouts: List<Workout>, version: Long) {
         val sql = """
             INSERT INTO ${config.database}.workout_step_count_log
-            (workout_id, timestamp, qty, units, source)
-            VALUES (?, ?, ?, ?, ?)
+            (workout_id, timestamp, qty, units, source, version)
+            ${insertSettings}VALUES (?, ?, ?, ?, ?, ?)
         """.trimIndent()
-        connection.prepareStatement(sql).use { stmt ->
+        writer.prepareStatement(sql).use { stmt ->
             var count = 0
             for (w in workouts) {
                 val id = w.id ?: continue
                 val start = w.start ?: continue
                 for (s in w.stepCount) {
                     val ts = s.date ?: start
-                    log.info("Batching step count log for $id: $s")
                     stmt.setString(1, id)
                     stmt.setTimestamp(2, parseTs(ts))
                     stmt.setDouble(3, s.qty ?: 0.0)
                     stmt.setString(4, s.units ?: "")
                     stmt.setString(5, s.source ?: "")
+                    stmt.setLong(6, version)
                     stmt.addBatch()
                     count++
                 }
@@ -364,25 +906,25 @@ class ClickHouseMetricStore(private val config: ClickHouseConfig) : AutoCloseabl
         }
     }
 
-    private fun storeWorkoutWalkingRunningDistance(workouts: List<Workout>) {
+    private fun storeWorkoutWalkingRunningDistance(workouts: List<Workout>, version: Long) {
         val sql = """
             INSERT INTO ${config.database}.workout_walking_running_distance
-            (workout_id, timestamp, qty, units, source)
-            VALUES (?, ?, ?, ?, ?)
+            (workout_id, timestamp, qty, units, source, version)
+            ${insertSettings}VALUES (?, ?, ?, ?, ?, ?)
         """.trimIndent()
-        connection.prepareStatement(sql).use { stmt ->
+        writer.prepareStatement(sql).use { stmt ->
             var count = 0
             for (w in workouts) {
                 val id = w.id ?: continue
                 val start = w.start ?: continue
                 for (s in w.walkingAndRunningDistance) {
                     val ts = s.date ?: start
-                    log.info("Batching walking/running distance for $id: $s")
                     stmt.setString(1, id)
                     stmt.setTimestamp(2, parseTs(ts))
                     stmt.setDouble(3, s.qty ?: 0.0)
                     stmt.setString(4, s.units ?: "")
                     stmt.setString(5, s.source ?: "")
+                    stmt.setLong(6, version)
                     stmt.addBatch()
                     count++
                 }
@@ -394,25 +936,25 @@ class ClickHouseMetricStore(private val config: ClickHouseConfig) : AutoCloseabl
         }
     }
 
-    private fun storeWorkoutActiveEnergy(workouts: List<Workout>) {
+    private fun storeWorkoutActiveEnergy(workouts: List<Workout>, version: Long) {
         val sql = """
             INSERT INTO ${config.database}.workout_active_energy
-            (workout_id, timestamp, qty, units, source)
-            VALUES (?, ?, ?, ?, ?)
+            (workout_id, timestamp, qty, units, source, version)
+            ${insertSettings}VALUES (?, ?, ?, ?, ?, ?)
         """.trimIndent()
-        connection.prepareStatement(sql).use { stmt ->
+        writer.prepareStatement(sql).use { stmt ->
             var count = 0
             for (w in workouts) {
                 val id = w.id ?: continue
                 val start = w.start ?: continue
                 for (s in w.activeEnergy) {
                     val ts = s.date ?: start
-                    log.info("Batching workout active energy for $id: $s")
                     stmt.setString(1, id)
                     stmt.setTimestamp(2, parseTs(ts))
                     stmt.setDouble(3, s.qty ?: 0.0)
                     stmt.setString(4, s.units ?: "")
                     stmt.setString(5, s.source ?: "")
+                    stmt.setLong(6, version)
                     stmt.addBatch()
                     count++
                 }
@@ -424,32 +966,1562 @@ class ClickHouseMetricStore(private val config: ClickHouseConfig) : AutoCloseabl
         }
     }
 
-    fun optimizeTables() {
-        val tables = listOf(
-            "metrics",
-            "workouts",
-            "workout_routes",
-            "workout_heart_rate_data",
-            "workout_heart_rate_recovery",
-            "workout_step_count_log",
-            "workout_walking_running_distance",
-            "workout_active_energy",
-            "ecg",
-            "ecg_voltage",
-            "state_of_mind"
-        )
+    private fun storeWorkoutFlightsClimbed(workouts: List<Workout>, version: Long) {
+        val sql = """
+            INSERT INTO ${config.database}.workout_flights_climbed
+            (workout_id, timestamp, qty, units, source, version)
+            ${insertSettings}VALUES (?, ?, ?, ?, ?, ?)
+        """.trimIndent()
+        writer.prepareStatement(sql).use { stmt ->
+            var count = 0
+            for (w in workouts) {
+                val id = w.id ?: continue
+                val start = w.start ?: continue
+                for (s in w.flightsClimbed) {
+                    val ts = s.date ?: start
+                    stmt.setString(1, id)
+                    stmt.setTimestamp(2, parseTs(ts))
+                    stmt.setDouble(3, s.qty ?: 0.0)
+                    stmt.setString(4, s.units ?: "")
+                    stmt.setString(5, s.source ?: "")
+                    stmt.setLong(6, version)
+                    stmt.addBatch()
+                    count++
+                }
+            }
+            if (count > 0) {
+                log.info("Executing workout flights climbed batch with $count rows")
+                stmt.executeBatch()
+            }
+        }
+    }
+
+    /** Daily aggregate of one value column of a metric, keyed by day; replaced samples are not counted twice. */
+    fun dailyValues(
+        metricName: String,
+        column: String,
+        aggregate: String,
+        from: LocalDate,
+        to: LocalDate,
+    ): Map<LocalDate, Double> {
+        require(column in VALUE_COLUMNS) { "Unknown value column $column" }
+        require(aggregate in AGGREGATES) { "Unknown aggregate $aggregate" }
+        val sql = """
+            SELECT ${day("timestamp")} AS day, $aggregate($column) AS value
+            FROM ${config.database}.${metricsTable(metricName)} FINAL
+            WHERE metric_name = ? AND ${day("timestamp")} BETWEEN ? AND ?
+            GROUP BY day
+            ORDER BY day
+        """.trimIndent()
+        val values = linkedMapOf<LocalDate, Double>()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setString(1, metricName)
+            stmt.setDate(2, java.sql.Date.valueOf(from))
+            stmt.setDate(3, java.sql.Date.valueOf(to))
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) values[rs.getDate("day").toLocalDate()] = rs.getDouble("value")
+            }
+        }
+        return values
+    }
+
+    /** The days from [from] to [to] with at least one sample, per metric, of [metricNames] or all metrics if empty. */
+    fun metricDays(metricNames: List<String>, from: LocalDate, to: LocalDate): Map<String, List<LocalDate>> {
+        val filter = if (metricNames.isEmpty()) "" else "AND metric_name IN (${metricNames.joinToString { "?" }})"
+        val sql = """
+            SELECT metric_name, ${day("timestamp")} AS day
+            FROM ${allMetricsSource()}
+            WHERE ${day("timestamp")} BETWEEN ? AND ? $filter
+            GROUP BY metric_name, day
+            ORDER BY metric_name, day
+        """.trimIndent()
+        val days = linkedMapOf<String, MutableList<LocalDate>>()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setDate(1, java.sql.Date.valueOf(from))
+            stmt.setDate(2, java.sql.Date.valueOf(to))
+            metricNames.forEachIndexed { i, name -> stmt.setString(i + 3, name) }
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) {
+                    days.getOrPut(rs.getString("metric_name")) { mutableListOf() } += rs.getDate("day").toLocalDate()
+                }
+            }
+        }
+        return days
+    }
+
+    /**
+     * About [points] points of [column] of [metricName] from [from] to [to]
+     * for charting. [DownsampleMethod.BUCKET] averages equally long intervals
+     * and keeps their extremes, [DownsampleMethod.LTTB] picks the samples that
+     * keep the shape of the line with ClickHouse's
+     * `largestTriangleThreeBuckets`.
+     */
+    fun series(
+        metricName: String,
+        column: String,
+        from: LocalDate,
+        to: LocalDate,
+        points: Int,
+        method: DownsampleMethod,
+    ): List<SeriesPoint> {
+        require(column in VALUE_COLUMNS) { "Unknown value column $column" }
+        // FINAL, so a corrected sample not merged yet is not counted next to the one it replaced.
+        val source = "${config.database}.${metricsTable(metricName)} FINAL"
+        val sql = when (method) {
+            DownsampleMethod.BUCKET -> {
+                val seconds = java.time.Duration.between(from.atStartOfDay(), to.plusDays(1).atStartOfDay()).seconds
+                val bucket = maxOf(1, (seconds + points - 1) / points)
+                """
+                    SELECT toStartOfInterval(timestamp, INTERVAL $bucket SECOND) AS t,
+                           avg($column) AS value, min($column) AS low, max($column) AS high
+                    FROM $source
+                    WHERE metric_name = ? AND ${day("timestamp")} BETWEEN ? AND ?
+                    GROUP BY t
+                    ORDER BY t
+                """.trimIndent()
+            }
+            DownsampleMethod.LTTB -> """
+                SELECT tupleElement(p, 1) AS t, tupleElement(p, 2) AS value, NULL AS low, NULL AS high
+                FROM (
+                    SELECT arrayJoin(largestTriangleThreeBuckets($points)(timestamp, toFloat64($column))) AS p
+                    FROM $source
+                    WHERE metric_name = ? AND ${day("timestamp")} BETWEEN ? AND ?
+                )
+                ORDER BY t
+            """.trimIndent()
+        }
+        val series = mutableListOf<SeriesPoint>()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setString(1, metricName)
+            stmt.setDate(2, java.sql.Date.valueOf(from))
+            stmt.setDate(3, java.sql.Date.valueOf(to))
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) {
+                    series += SeriesPoint(
+                        timestamp = rs.getTimestamp("t").toInstant().toString(),
+                        value = rs.getDouble("value"),
+                        min = rs.getObject("low")?.let { rs.getDouble("low") },
+                        max = rs.getObject("high")?.let { rs.getDouble("high") },
+                    )
+                }
+            }
+        }
+        return series
+    }
+
+    fun workoutsBetween(from: LocalDate, to: LocalDate): List<WorkoutSummary> {
+        val sql = """
+            SELECT $WORKOUT_SUMMARY_COLUMNS
+            FROM ${config.database}.workouts FINAL
+            WHERE ${day("start")} BETWEEN ? AND ?
+            ORDER BY start
+        """.trimIndent()
+        val workouts = mutableListOf<WorkoutSummary>()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setDate(1, java.sql.Date.valueOf(from))
+            stmt.setDate(2, java.sql.Date.valueOf(to))
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) workouts += readWorkoutSummary(rs)
+            }
+        }
+        return workouts
+    }
+
+    fun lastWorkout(): WorkoutSummary? {
+        val sql = """
+            SELECT $WORKOUT_SUMMARY_COLUMNS
+            FROM ${config.database}.workouts FINAL
+            ORDER BY start DESC
+            LIMIT 1
+        """.trimIndent()
         connection.createStatement().use { stmt ->
-            for (table in tables) {
-                stmt.addBatch("OPTIMIZE TABLE ${config.database}." + table)
+            stmt.executeQuery(sql).use { rs ->
+                return if (rs.next()) readWorkoutSummary(rs) else null
             }
-            stmt.executeBatch()
         }
     }
 
-    override fun close() { connection.close() }
-}
+    private fun readWorkoutSummary(rs: java.sql.ResultSet) = WorkoutSummary(
+        id = rs.getString("id"),
+        name = rs.getString("name"),
+        start = rs.getTimestamp("start").toInstant(),
+        end = rs.getTimestamp("end").toInstant(),
+        activeEnergy = rs.getDouble("active_energy_qty"),
+        activeEnergyUnits = rs.getString("active_energy_units"),
+        distance = rs.getDouble("distance_qty"),
+        distanceUnits = rs.getString("distance_units"),
+    )
 
-data class ClickHouseConfig(
-    val dsn: String,
-    val database: String,
-)
+    fun latestSample(metricName: String): LatestSample? {
+        val sql = """
+            SELECT timestamp, qty, metric_unit FROM ${config.database}.${metricsTable(metricName)} FINAL
+            WHERE metric_name = ?
+            ORDER BY timestamp DESC
+            LIMIT 1
+        """.trimIndent()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setString(1, metricName)
+            stmt.executeQuery().use { rs ->
+                if (!rs.next()) return null
+                return LatestSample(rs.getTimestamp("timestamp").toInstant(), rs.getDouble("qty"), rs.getString("metric_unit"))
+            }
+        }
+    }
+
+    fun latestValue(metricName: String, before: java.time.Instant): Double? {
+        val sql = """
+            SELECT qty FROM ${config.database}.${metricsTable(metricName)} FINAL
+            WHERE metric_name = ? AND timestamp < ?
+            ORDER BY timestamp DESC
+            LIMIT 1
+        """.trimIndent()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setString(1, metricName)
+            stmt.setTimestamp(2, Timestamp.from(before))
+            stmt.executeQuery().use { rs ->
+                return if (rs.next()) rs.getDouble(1) else null
+            }
+        }
+    }
+
+    /** Reads everything stored between [from] and [to] back into the Auto Export model. */
+    fun exportBetween(from: LocalDate, to: LocalDate): Export = Export(
+        metrics = exportMetrics(from, to),
+        workouts = exportWorkouts(from, to),
+        stateOfMind = stateOfMind(from, to),
+        ecg = exportEcg(from, to),
+    )
+
+    private fun exportMetrics(from: LocalDate, to: LocalDate): List<Metric> {
+        val sql = """
+            SELECT timestamp, metric_name, metric_unit, $SAMPLE_COLUMNS
+            FROM ${allMetricsSource()} FINAL
+            WHERE ${day("timestamp")} BETWEEN ? AND ?
+            ORDER BY metric_name, timestamp
+        """.trimIndent()
+        val metrics = linkedMapOf<Pair<String, String>, MutableList<Sample>>()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setDate(1, java.sql.Date.valueOf(from))
+            stmt.setDate(2, java.sql.Date.valueOf(to))
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) {
+                    val key = rs.getString("metric_name") to rs.getString("metric_unit")
+                    metrics.getOrPut(key) { mutableListOf() } += readSample(rs)
+                }
+            }
+        }
+        return metrics.map { (key, samples) -> Metric(key.first, key.second, samples) }
+    }
+
+    /**
+     * Up to [limit] samples of [metricName] from [from] to [to], oldest
+     * first, starting after the sample at [after]. Samples are paged by
+     * timestamp and source, as a metric has at most one sample per
+     * timestamp of each source. Returns the samples with their units and,
+     * if the page is full, the cursor of the next one.
+     */
+    fun samplesPage(
+        metricName: String,
+        from: LocalDate,
+        to: LocalDate,
+        after: SampleCursor?,
+        limit: Int,
+    ): Pair<List<Pair<Sample, String>>, SampleCursor?> {
+        val sql = """
+            SELECT timestamp, metric_unit, $SAMPLE_COLUMNS
+            FROM ${config.database}.${metricsTable(metricName)} FINAL
+            WHERE metric_name = ? AND ${day("timestamp")} BETWEEN ? AND ? AND (timestamp, source) > (?, ?)
+            ORDER BY timestamp, source
+            LIMIT ?
+        """.trimIndent()
+        val samples = mutableListOf<Pair<Sample, String>>()
+        var last: SampleCursor? = null
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setString(1, metricName)
+            stmt.setDate(2, java.sql.Date.valueOf(from))
+            stmt.setDate(3, java.sql.Date.valueOf(to))
+            stmt.setTimestamp(4, Timestamp.from(after?.timestamp ?: java.time.Instant.EPOCH))
+            stmt.setString(5, after?.source ?: "")
+            stmt.setInt(6, limit)
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) {
+                    samples += readSample(rs) to rs.getString("metric_unit")
+                    // The stored source, not the one of the sample, which falls back to the sleep source.
+                    last = SampleCursor(rs.getTimestamp("timestamp").toInstant(), rs.getString("source"))
+                }
+            }
+        }
+        return samples to last.takeIf { samples.size == limit }
+    }
+
+    /** Samples of [metricName] taken from [from] to [to], oldest first. */
+    fun samplesBetween(metricName: String, from: LocalDate, to: LocalDate): List<Sample> {
+        val sql = """
+            SELECT timestamp, $SAMPLE_COLUMNS
+            FROM ${config.database}.${metricsTable(metricName)} FINAL
+            WHERE metric_name = ? AND ${day("timestamp")} BETWEEN ? AND ?
+            ORDER BY timestamp
+        """.trimIndent()
+        val samples = mutableListOf<Sample>()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setString(1, metricName)
+            stmt.setDate(2, java.sql.Date.valueOf(from))
+            stmt.setDate(3, java.sql.Date.valueOf(to))
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) samples += readSample(rs)
+            }
+        }
+        return samples
+    }
+
+    private fun readSample(rs: java.sql.ResultSet): Sample {
+        val min = rs.getDouble("min").nonZero()
+        val max = rs.getDouble("max").nonZero()
+        val avg = rs.getDouble("avg").nonZero()
+        val asleep = rs.getDouble("asleep").nonZero()
+        val inBed = rs.getDouble("in_bed").nonZero()
+        val category = rs.getString("category").ifEmpty { null }
+        fun time(column: String) = rs.getTimestamp(column).toInstant().takeIf { it.epochSecond != 0L }?.let { Timestamps.format(it) }
+        // qty is written as 0 for samples that only carry Min/Avg/Max or sleep values
+        val qty = rs.getDouble("qty").takeIf { it != 0.0 || listOfNotNull(min, max, avg, asleep, inBed).isEmpty() }
+        return Sample(
+            date = Timestamps.format(rs.getTimestamp("timestamp").toInstant()),
+            qty = qty,
+            max = max,
+            min = min,
+            avg = avg,
+            asleep = asleep,
+            inBed = inBed,
+            sleepSource = rs.getString("sleep_source").ifEmpty { null }?.takeIf { category == null },
+            inBedSource = rs.getString("in_bed_source").ifEmpty { null },
+            sleepStart = time("sleep_start")?.takeIf { category == null },
+            sleepEnd = time("sleep_end")?.takeIf { category == null },
+            inBedStart = time("in_bed_start"),
+            inBedEnd = time("in_bed_end"),
+            core = rs.getDouble("core").nonZero(),
+            deep = rs.getDouble("deep").nonZero(),
+            rem = rs.getDouble("rem").nonZero(),
+            awake = rs.getDouble("awake").nonZero(),
+            startDate = time("sleep_start")?.takeIf { category != null },
+            endDate = time("sleep_end")?.takeIf { category != null },
+            value = category,
+            // Before the source column, the source of category samples was kept in sleep_source.
+            source = rs.getString("source").ifEmpty { null } ?: rs.getString("sleep_source").ifEmpty { null }?.takeIf { category != null },
+        )
+    }
+
+    private fun exportWorkouts(from: LocalDate, to: LocalDate): List<Workout> {
+        val sql = """
+            SELECT toString(id) AS id, name, start, end,
+                   active_energy_qty, active_energy_units, distance_qty, distance_units,
+                   intensity_qty, intensity_units, humidity_qty, humidity_units,
+                   temperature_qty, temperature_units, elevation_up_qty, elevation_up_units,
+                   elevation_down_qty, elevation_down_units
+            FROM ${config.database}.workouts FINAL
+            WHERE ${day("start")} BETWEEN ? AND ?
+            ORDER BY start
+        """.trimIndent()
+        val workouts = mutableListOf<Workout>()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setDate(1, java.sql.Date.valueOf(from))
+            stmt.setDate(2, java.sql.Date.valueOf(to))
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) {
+                    fun qty(prefix: String): QtyUnit? {
+                        val qty = rs.getDouble("${prefix}_qty")
+                        val units = rs.getString("${prefix}_units")
+                        return if (qty == 0.0 && units.isEmpty()) null else QtyUnit(qty, units.ifEmpty { null })
+                    }
+                    workouts += Workout(
+                        id = rs.getString("id"),
+                        name = rs.getString("name"),
+                        start = Timestamps.format(rs.getTimestamp("start").toInstant()),
+                        end = Timestamps.format(rs.getTimestamp("end").toInstant()),
+                        activeEnergyBurned = qty("active_energy"),
+                        distance = qty("distance"),
+                        intensity = qty("intensity"),
+                        humidity = qty("humidity"),
+                        temperature = qty("temperature"),
+                        elevationUp = qty("elevation_up"),
+                        elevationDown = qty("elevation_down"),
+                    )
+                }
+            }
+        }
+        if (workouts.isEmpty()) return workouts
+
+        val routes = readWorkoutLogs("workout_routes", from, to) { rs ->
+            val location = rs.getString("location_encrypted").takeIf { it.isNotEmpty() }
+                ?.let { decrypt(it).split(",").map { v -> v.toDouble() } }
+            GPSLog(
+                latitude = location?.get(0) ?: rs.getDouble("lat"),
+                longitude = location?.get(1) ?: rs.getDouble("lon"),
+                altitude = location?.get(2) ?: rs.getDouble("altitude"),
+                timestamp = Timestamps.format(rs.getTimestamp("timestamp").toInstant()),
+                course = rs.getDouble("course"),
+                verticalAccuracy = rs.getDouble("vertical_accuracy"),
+                horizontalAccuracy = rs.getDouble("horizontal_accuracy"),
+                courseAccuracy = rs.getDouble("course_accuracy"),
+                speed = rs.getDouble("speed"),
+                speedAccuracy = rs.getDouble("speed_accuracy"),
+            )
+        }
+        val heartRate = readWorkoutLogs("workout_heart_rate_data", from, to, ::readHeartRateLog)
+        val recovery = readWorkoutLogs("workout_heart_rate_recovery", from, to, ::readHeartRateLog)
+        val steps = readWorkoutLogs("workout_step_count_log", from, to, ::readQuantityLog)
+        val distance = readWorkoutLogs("workout_walking_running_distance", from, to, ::readQuantityLog)
+        val energy = readWorkoutLogs("workout_active_energy", from, to, ::readQuantityLog)
+        val flights = readWorkoutLogs("workout_flights_climbed", from, to, ::readQuantityLog)
+        return workouts.map { w ->
+            w.copy(
+                route = routes[w.id].orEmpty(),
+                heartRateData = heartRate[w.id].orEmpty(),
+                heartRateRecovery = recovery[w.id].orEmpty(),
+                stepCount = steps[w.id].orEmpty(),
+                walkingAndRunningDistance = distance[w.id].orEmpty(),
+                activeEnergy = energy[w.id].orEmpty(),
+                flightsClimbed = flights[w.id].orEmpty(),
+            )
+        }
+    }
+
+    /** Rows of a workout sub-table for the workouts started in the range, keyed by workout id. */
+    private fun <T> readWorkoutLogs(
+        table: String,
+        from: LocalDate,
+        to: LocalDate,
+        read: (java.sql.ResultSet) -> T,
+    ): Map<String, List<T>> {
+        val sql = """
+            SELECT toString(workout_id) AS workout_key, *
+            FROM ${config.database}.$table FINAL
+            WHERE workout_id IN (SELECT id FROM ${config.database}.workouts WHERE ${day("start")} BETWEEN ? AND ?)
+            ORDER BY workout_id, timestamp
+        """.trimIndent()
+        val logs = linkedMapOf<String, MutableList<T>>()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setDate(1, java.sql.Date.valueOf(from))
+            stmt.setDate(2, java.sql.Date.valueOf(to))
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) logs.getOrPut(rs.getString("workout_key")) { mutableListOf() } += read(rs)
+            }
+        }
+        return logs
+    }
+
+    private fun readHeartRateLog(rs: java.sql.ResultSet) = HeartRateLog(
+        min = rs.getDouble("min"),
+        max = rs.getDouble("max"),
+        avg = rs.getDouble("avg"),
+        units = rs.getString("units"),
+        source = rs.getString("source"),
+        date = Timestamps.format(rs.getTimestamp("timestamp").toInstant()),
+    )
+
+    private fun readQuantityLog(rs: java.sql.ResultSet) = StepCountLog(
+        qty = rs.getDouble("qty"),
+        source = rs.getString("source"),
+        units = rs.getString("units"),
+        date = Timestamps.format(rs.getTimestamp("timestamp").toInstant()),
+    )
+
+    /**
+     * State of mind entries started from [from] to [to] matching [filter].
+     * Labels and associations are matched through `state_of_mind_label_map`,
+     * so the filter works on encrypted labels as well.
+     */
+    fun stateOfMind(from: LocalDate, to: LocalDate, filter: StateOfMindFilter = StateOfMindFilter()): List<StateOfMind> {
+        val conditions = mutableListOf("${day("start")} BETWEEN ? AND ?")
+        val params = mutableListOf<Any>(java.sql.Date.valueOf(from), java.sql.Date.valueOf(to))
+        if (filter.kinds.isNotEmpty()) {
+            conditions += "kind IN (${filter.kinds.joinToString { "?" }})"
+            params += filter.kinds
+        }
+        filter.minValence?.let { conditions += "valence >= ?"; params += it }
+        filter.maxValence?.let { conditions += "valence <= ?"; params += it }
+        for ((kind, values) in listOf(LabelNormalizer.LABEL to filter.labels, LabelNormalizer.ASSOCIATION to filter.associations)) {
+            if (values.isEmpty()) continue
+            conditions += "id IN (SELECT state_of_mind_id FROM ${config.database}.state_of_mind_label_map " +
+                "WHERE kind = ? AND label_id IN (${values.joinToString { "?" }}))"
+            params += kind
+            params += values.map { labelId(kind, it) }
+        }
+        val sql = """
+            SELECT toString(id) AS id, start, end, valence, valence_classification, kind, labels, associations
+            FROM ${config.database}.state_of_mind FINAL
+            WHERE ${conditions.joinToString(" AND ")}
+            ORDER BY start
+        """.trimIndent()
+        val entries = mutableListOf<StateOfMind>()
+        connection.prepareStatement(sql).use { stmt ->
+            params.forEachIndexed { i, param -> stmt.setObject(i + 1, param) }
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) {
+                    entries += StateOfMind(
+                        id = rs.getString("id"),
+                        valence = rs.getDouble("valence"),
+                        valenceClassification = rs.getString("valence_classification"),
+                        labels = stringArray(rs, "labels").map { decrypt(it) },
+                        associations = stringArray(rs, "associations").map { decrypt(it) },
+                        start = Timestamps.format(rs.getTimestamp("start").toInstant()),
+                        end = Timestamps.format(rs.getTimestamp("end").toInstant()),
+                        kind = rs.getString("kind"),
+                    )
+                }
+            }
+        }
+        return entries
+    }
+
+    private fun stringArray(rs: java.sql.ResultSet, column: String): List<String> =
+        (rs.getArray(column)?.array as? Array<*>)?.map { it.toString() } ?: emptyList()
+
+    private fun exportEcg(from: LocalDate, to: LocalDate): List<ECG> =
+        ecgRecordings(from, to).map { (id, e) -> e.copy(voltageMeasurements = ecgVoltages(id)) }
+
+    /** Recordings started from [from] to [to] by id, without their voltages. */
+    fun ecgRecordings(from: LocalDate, to: LocalDate): List<Pair<String, ECG>> =
+        ecgRecordings("${day("start")} BETWEEN ? AND ?", listOf(java.sql.Date.valueOf(from), java.sql.Date.valueOf(to)))
+
+    private fun ecgRecordings(condition: String, params: List<Any>): List<Pair<String, ECG>> {
+        val sql = """
+            SELECT toString(id) AS id, classification, source, average_heart_rate, start, end,
+                   number_of_voltage_measurements, sampling_frequency
+            FROM ${config.database}.ecg FINAL
+            WHERE $condition
+            ORDER BY start
+        """.trimIndent()
+        val recordings = mutableListOf<Pair<String, ECG>>()
+        connection.prepareStatement(sql).use { stmt ->
+            params.forEachIndexed { i, param -> stmt.setObject(i + 1, param) }
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) {
+                    recordings += rs.getString("id") to ECG(
+                        classification = rs.getString("classification"),
+                        source = rs.getString("source"),
+                        averageHeartRate = rs.getDouble("average_heart_rate"),
+                        start = Timestamps.format(rs.getTimestamp("start").toInstant()),
+                        numberOfVoltageMeasurements = rs.getInt("number_of_voltage_measurements"),
+                        samplingFrequency = rs.getInt("sampling_frequency"),
+                        end = Timestamps.format(rs.getTimestamp("end").toInstant()),
+                    )
+                }
+            }
+        }
+        return recordings
+    }
+
+    /** Voltages of one recording from whichever layout [EcgStorage] writes. */
+    private fun ecgVoltages(id: String): List<ECGVoltage> {
+        if (config.ecgStorage != EcgStorage.ROWS) {
+            val waveform = storedWaveform(id)
+            if (waveform != null) {
+                val start = waveform.start.epochSecond + waveform.start.nano / 1_000_000_000.0
+                return waveform.offsets.zip(waveform.voltages).map { (offset, voltage) ->
+                    ECGVoltage(start + offset, voltage, waveform.units)
+                }
+            }
+        }
+        val sql = """
+            SELECT toFloat64(timestamp) AS date, voltage, units
+            FROM ${config.database}.ecg_voltage FINAL
+            WHERE ecg_id = ?
+            ORDER BY sample_index
+        """.trimIndent()
+        val voltages = mutableListOf<ECGVoltage>()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setString(1, id)
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) voltages += ECGVoltage(rs.getDouble("date"), rs.getDouble("voltage"), rs.getString("units"))
+            }
+        }
+        return voltages
+    }
+
+    private fun Double.nonZero(): Double? = takeIf { it != 0.0 }
+
+    fun personalRecords(): List<PersonalRecord> {
+        val sql = """
+            SELECT record, value, toString(workout_id) AS workout_id, workout_name, achieved_at
+            FROM ${config.database}.personal_records FINAL
+        """.trimIndent()
+        val records = mutableListOf<PersonalRecord>()
+        connection.createStatement().use { stmt ->
+            stmt.executeQuery(sql).use { rs ->
+                while (rs.next()) {
+                    val kind = RecordKind.byId(rs.getString("record")) ?: continue
+                    records += PersonalRecord(
+                        kind = kind,
+                        value = rs.getDouble("value"),
+                        workoutId = rs.getString("workout_id"),
+                        workoutName = rs.getString("workout_name"),
+                        achievedAt = rs.getTimestamp("achieved_at").toInstant(),
+                    )
+                }
+            }
+        }
+        return records
+    }
+
+    fun storePersonalRecords(records: List<PersonalRecord>) {
+        if (records.isEmpty()) return
+        val sql = """
+            INSERT INTO ${config.database}.personal_records
+            (record, value, units, workout_id, workout_name, achieved_at)
+            ${insertSettings}VALUES (?, ?, ?, ?, ?, ?)
+        """.trimIndent()
+        connection.prepareStatement(sql).use { stmt ->
+            for (r in records) {
+                stmt.setString(1, r.kind.id)
+                stmt.setDouble(2, r.value)
+                stmt.setString(3, r.kind.units)
+                stmt.setString(4, r.workoutId)
+                stmt.setString(5, r.workoutName)
+                stmt.setTimestamp(6, Timestamp.from(r.achievedAt))
+                stmt.addBatch()
+            }
+            log.info("Executing personal records batch with ${records.size} rows")
+            stmt.executeBatch()
+        }
+    }
+
+    /** Deletes the samples of [metricName] between [from] and [to] with a lightweight delete. */
+    fun purgeMetric(metricName: String, from: LocalDate, to: LocalDate) {
+        val sql = """
+            DELETE FROM ${config.database}.${metricsTable(metricName)}
+            WHERE metric_name = ? AND ${day("timestamp")} BETWEEN ? AND ?
+        """.trimIndent()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setString(1, metricName)
+            stmt.setDate(2, java.sql.Date.valueOf(from))
+            stmt.setDate(3, java.sql.Date.valueOf(to))
+            stmt.execute()
+        }
+        log.info("Deleted $metricName samples from $from to $to")
+    }
+
+    /** Deletes the samples of [metricName] taken from [start] to [end], both included, and returns how many there were. */
+    fun purgeSamples(metricName: String, start: Instant, end: Instant): Long {
+        val count = countSamples(metricName, start, end)
+        val sql = """
+            DELETE FROM ${config.database}.${metricsTable(metricName)}
+            WHERE metric_name = ? AND timestamp BETWEEN ? AND ?
+        """.trimIndent()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setString(1, metricName)
+            stmt.setTimestamp(2, Timestamp.from(start))
+            stmt.setTimestamp(3, Timestamp.from(end))
+            stmt.execute()
+        }
+        log.info("Deleted $count $metricName samples from $start to $end")
+        return count
+    }
+
+    /**
+     * Sets [column], one of [VALUE_COLUMNS], of the [metricName] samples
+     * taken from [start] to [end] to [value], or multiplies it by [factor],
+     * and returns how many samples were changed. The mutation is waited for,
+     * so the read APIs return the corrected values once this returns.
+     */
+    fun correctSamples(metricName: String, start: Instant, end: Instant, column: String, value: Double?, factor: Double?): Long {
+        require(column in VALUE_COLUMNS) { "Unknown column $column" }
+        require((value == null) != (factor == null)) { "Expected either a value or a factor" }
+        val count = countSamples(metricName, start, end)
+        if (count == 0L) return 0
+        val sql = """
+            ALTER TABLE ${config.database}.${metricsTable(metricName)}
+            UPDATE $column = ${if (value != null) "?" else "$column * ?"}
+            WHERE metric_name = ? AND timestamp BETWEEN ? AND ?
+            SETTINGS mutations_sync = 1
+        """.trimIndent()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setDouble(1, value ?: factor!!)
+            stmt.setString(2, metricName)
+            stmt.setTimestamp(3, Timestamp.from(start))
+            stmt.setTimestamp(4, Timestamp.from(end))
+            stmt.execute()
+        }
+        log.info("Corrected $column of $count $metricName samples from $start to $end")
+        return count
+    }
+
+    private fun countSamples(metricName: String, start: Instant, end: Instant): Long {
+        val sql = """
+            SELECT count() FROM ${config.database}.${metricsTable(metricName)} FINAL
+            WHERE metric_name = ? AND timestamp BETWEEN ? AND ?
+        """.trimIndent()
+        return connection.prepareStatement(sql).use { stmt ->
+            stmt.setString(1, metricName)
+            stmt.setTimestamp(2, Timestamp.from(start))
+            stmt.setTimestamp(3, Timestamp.from(end))
+            stmt.executeQuery().use { rs -> if (rs.next()) rs.getLong(1) else 0 }
+        }
+    }
+
+    /**
+     * Sets [column], one of [WORKOUT_COLUMNS], of workout [id] to [value]
+     * and returns whether the workout exists. Like [correctSamples] it waits
+     * for the mutation.
+     */
+    fun correctWorkout(id: String, column: String, value: String): Boolean {
+        val type = WORKOUT_COLUMNS[column] ?: throw IllegalArgumentException("Unknown column $column")
+        if (!workoutExists(id)) return false
+        val sql = """
+            ALTER TABLE ${config.database}.workouts
+            UPDATE `$column` = ${if (type == "DateTime") "parseDateTimeBestEffort(?, 'UTC')" else "CAST(? AS $type)"}
+            WHERE id = ?
+            SETTINGS mutations_sync = 1
+        """.trimIndent()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setString(1, value)
+            stmt.setString(2, id)
+            stmt.execute()
+        }
+        log.info("Set $column of workout $id to $value")
+        return true
+    }
+
+    fun workoutExists(id: String): Boolean =
+        connection.prepareStatement("SELECT 1 FROM ${config.database}.workouts WHERE id = ? LIMIT 1").use { stmt ->
+            stmt.setString(1, id)
+            stmt.executeQuery().use { it.next() }
+        }
+
+    /** Deletes workout [id] with its logs, route and attachment references; the files are deleted by the caller. */
+    fun purgeWorkout(id: String) {
+        val tables = listOf(
+            "workouts" to "id",
+            "workout_routes" to "workout_id",
+            "workout_heart_rate_data" to "workout_id",
+            "workout_heart_rate_recovery" to "workout_id",
+            "workout_step_count_log" to "workout_id",
+            "workout_walking_running_distance" to "workout_id",
+            "workout_active_energy" to "workout_id",
+            "workout_flights_climbed" to "workout_id",
+            "workout_attachments" to "workout_id",
+        )
+        for ((table, column) in tables) {
+            connection.prepareStatement("DELETE FROM ${config.database}.$table WHERE $column = ?").use { stmt ->
+                stmt.setString(1, id)
+                stmt.execute()
+            }
+        }
+        log.info("Deleted workout $id")
+    }
+
+    fun storeAuditEntry(entry: AuditEntry) {
+        val sql = """
+            INSERT INTO ${config.database}.audit_log (timestamp, actor, action, parameters, status)
+            ${insertSettings}VALUES (?, ?, ?, ?, ?)
+        """.trimIndent()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setTimestamp(1, Timestamp.from(entry.timestamp))
+            stmt.setString(2, entry.actor)
+            stmt.setString(3, entry.action)
+            stmt.setString(4, entry.parameters)
+            stmt.setInt(5, entry.status)
+            stmt.executeUpdate()
+        }
+    }
+
+    fun storeAttachment(attachment: WorkoutAttachment) {
+        val sql = """
+            INSERT INTO ${config.database}.workout_attachments
+            (workout_id, id, name, content_type, size, sha256, location, created_at)
+            ${insertSettings}VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+        """.trimIndent()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setString(1, attachment.workoutId)
+            stmt.setString(2, attachment.id)
+            stmt.setString(3, attachment.name)
+            stmt.setString(4, attachment.contentType)
+            stmt.setLong(5, attachment.size)
+            stmt.setString(6, attachment.sha256)
+            stmt.setString(7, attachment.location)
+            stmt.setTimestamp(8, Timestamp.from(attachment.createdAt))
+            stmt.executeUpdate()
+        }
+        log.info("Attached ${attachment.name} (${attachment.size} bytes) to workout ${attachment.workoutId}")
+    }
+
+    /** The attachments of workout [workoutId], oldest first; with [id] only that one. */
+    fun attachments(workoutId: String, id: String? = null): List<WorkoutAttachment> {
+        val sql = """
+            SELECT toString(workout_id) AS workout_id, toString(id) AS id, name, content_type, size, sha256, location, created_at
+            FROM ${config.database}.workout_attachments FINAL
+            WHERE workout_id = ?${if (id != null) " AND id = ?" else ""}
+            ORDER BY created_at
+        """.trimIndent()
+        val attachments = mutableListOf<WorkoutAttachment>()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setString(1, workoutId)
+            id?.let { stmt.setString(2, it) }
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) {
+                    attachments += WorkoutAttachment(
+                        id = rs.getString("id"),
+                        workoutId = rs.getString("workout_id"),
+                        name = rs.getString("name"),
+                        contentType = rs.getString("content_type"),
+                        size = rs.getLong("size"),
+                        sha256 = rs.getString("sha256"),
+                        location = rs.getString("location"),
+                        createdAt = rs.getTimestamp("created_at").toInstant(),
+                    )
+                }
+            }
+        }
+        return attachments
+    }
+
+    /** Removes attachment [id] of workout [workoutId] from `workout_attachments`; the file is deleted by the caller. */
+    fun deleteAttachment(workoutId: String, id: String) {
+        connection.prepareStatement("DELETE FROM ${config.database}.workout_attachments WHERE workout_id = ? AND id = ?").use { stmt ->
+            stmt.setString(1, workoutId)
+            stmt.setString(2, id)
+            stmt.execute()
+        }
+        log.info("Deleted attachment $id of workout $workoutId")
+    }
+
+    fun storeAnnotation(annotation: Annotation) {
+        val sql = """
+            INSERT INTO ${config.database}.annotations (timestamp, text, tags, source)
+            ${insertSettings}VALUES (?, ?, ?, ?)
+        """.trimIndent()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setTimestamp(1, Timestamp.from(annotation.timestamp))
+            stmt.setString(2, annotation.text)
+            stmt.setString(3, arrayLiteral(annotation.tags))
+            stmt.setString(4, annotation.source)
+            stmt.executeUpdate()
+        }
+        log.info("Stored annotation at ${annotation.timestamp} with tags ${annotation.tags}")
+    }
+
+    /** Annotations of the days [from] to [to], oldest first; with [tags] only those with at least one of them. */
+    fun annotations(from: LocalDate, to: LocalDate, tags: List<String> = emptyList()): List<Annotation> {
+        val tagFilter = if (tags.isEmpty()) "" else "AND hasAny(tags, [${tags.joinToString { "?" }}])"
+        val sql = """
+            SELECT timestamp, text, tags, source
+            FROM ${config.database}.annotations FINAL
+            WHERE ${day("timestamp")} BETWEEN ? AND ? $tagFilter
+            ORDER BY timestamp
+        """.trimIndent()
+        val annotations = mutableListOf<Annotation>()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setDate(1, java.sql.Date.valueOf(from))
+            stmt.setDate(2, java.sql.Date.valueOf(to))
+            tags.forEachIndexed { i, tag -> stmt.setString(3 + i, tag) }
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) {
+                    annotations += Annotation(
+                        timestamp = rs.getTimestamp("timestamp").toInstant(),
+                        text = rs.getString("text"),
+                        tags = stringArray(rs, "tags"),
+                        source = rs.getString("source"),
+                    )
+                }
+            }
+        }
+        return annotations
+    }
+
+    /**
+     * Newest timestamp per metric and source, with workouts, state of mind
+     * and ECG as pseudo metrics; see [me.centralhardware.healthImportServer.monitoring.FreshnessTracker].
+     */
+    fun latestSampleTimes(): Map<Pair<String, String>, java.time.Instant> {
+        val sql = """
+            SELECT metric_name AS metric, multiIf(source != '', source, sleep_source != '', sleep_source, in_bed_source) AS device,
+                   max(timestamp) AS latest
+            FROM ${allMetricsSource()} GROUP BY metric, device
+            UNION ALL
+            SELECT 'workouts', '', max(end) FROM ${config.database}.workouts HAVING count() > 0
+            UNION ALL
+            SELECT 'workout_heart_rate', source, max(timestamp) FROM ${config.database}.workout_heart_rate_data GROUP BY source
+            UNION ALL
+            SELECT 'state_of_mind', '', max(start) FROM ${config.database}.state_of_mind HAVING count() > 0
+            UNION ALL
+            SELECT 'ecg', source, max(start) FROM ${config.database}.ecg GROUP BY source
+        """.trimIndent()
+        val latest = mutableMapOf<Pair<String, String>, java.time.Instant>()
+        connection.createStatement().use { stmt ->
+            stmt.executeQuery(sql).use { rs ->
+                while (rs.next()) latest[rs.getString(1) to rs.getString(2)] = rs.getTimestamp(3).toInstant()
+            }
+        }
+        return latest
+    }
+
+    fun storeImport(snapshot: ImportSnapshot) {
+        val sql = """
+            INSERT INTO ${config.database}.imports
+            (id, started_at, finished_at, state, bytes_received, chunks, chunks_failed, rows_expected, rows_written,
+             device_model, os_version, app_version, battery_level)
+            ${insertSettings}VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        """.trimIndent()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setString(1, snapshot.id)
+            stmt.setTimestamp(2, Timestamp.from(java.time.Instant.parse(snapshot.startedAt)))
+            stmt.setTimestamp(3, Timestamp.from(snapshot.finishedAt?.let { java.time.Instant.parse(it) } ?: java.time.Instant.now()))
+            stmt.setString(4, snapshot.state)
+            stmt.setLong(5, snapshot.bytesReceived)
+            stmt.setInt(6, snapshot.totalChunks)
+            stmt.setInt(7, snapshot.chunksFailed)
+            stmt.setLong(8, snapshot.rowsExpected.values.sumOf { it.toLong() })
+            stmt.setLong(9, snapshot.rowsWritten.values.sumOf { it.toLong() })
+            stmt.setString(10, snapshot.device?.model ?: "")
+            stmt.setString(11, snapshot.device?.osVersion ?: "")
+            stmt.setString(12, snapshot.device?.appVersion ?: "")
+            val battery = snapshot.device?.batteryLevel
+            if (battery != null) stmt.setFloat(13, battery.toFloat()) else stmt.setNull(13, java.sql.Types.FLOAT)
+            stmt.executeUpdate()
+        }
+    }
+
+    /** Writes the current state of [token]; the row with the latest `updated_at` wins. */
+    fun storeApiToken(token: ApiToken) {
+        val sql = """
+            INSERT INTO ${config.database}.api_tokens (id, name, role, hash, created_at, revoked_at)
+            ${insertSettings}VALUES (?, ?, ?, ?, ?, ?)
+        """.trimIndent()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setString(1, token.id)
+            stmt.setString(2, token.name)
+            stmt.setString(3, token.role)
+            stmt.setString(4, token.hash)
+            stmt.setTimestamp(5, Timestamp.from(token.createdAt))
+            stmt.setTimestamp(6, token.revokedAt?.let { Timestamp.from(it) })
+            stmt.executeUpdate()
+        }
+    }
+
+    fun storeApiTokenUsage(id: String, at: java.time.Instant) {
+        connection.prepareStatement(
+            "INSERT INTO ${config.database}.api_token_usage (id, last_used_at) ${insertSettings}VALUES (?, ?)"
+        ).use { stmt ->
+            stmt.setString(1, id)
+            stmt.setTimestamp(2, Timestamp.from(at))
+            stmt.executeUpdate()
+        }
+    }
+
+    /** All tokens ever created, revoked ones included, oldest first. */
+    fun apiTokens(): List<ApiToken> {
+        val lastUsed = mutableMapOf<String, java.time.Instant>()
+        connection.createStatement().use { stmt ->
+            stmt.executeQuery(
+                "SELECT id, max(last_used_at) AS last_used_at FROM ${config.database}.api_token_usage GROUP BY id"
+            ).use { rs ->
+                while (rs.next()) lastUsed[rs.getString("id")] = rs.getTimestamp("last_used_at").toInstant()
+            }
+        }
+        val tokens = mutableListOf<ApiToken>()
+        connection.createStatement().use { stmt ->
+            stmt.executeQuery(
+                "SELECT id, name, role, hash, created_at, revoked_at FROM ${config.database}.api_tokens FINAL ORDER BY created_at"
+            ).use { rs ->
+                while (rs.next()) {
+                    val id = rs.getString("id")
+                    tokens += ApiToken(
+                        id = id,
+                        name = rs.getString("name"),
+                        role = rs.getString("role"),
+                        hash = rs.getString("hash"),
+                        createdAt = rs.getTimestamp("created_at").toInstant(),
+                        revokedAt = rs.getTimestamp("revoked_at")?.toInstant(),
+                        lastUsedAt = lastUsed[id],
+                    )
+                }
+            }
+        }
+        return tokens
+    }
+
+    /** Uploads per period from the imports table, oldest first. */
+    fun importStats(granularity: String, from: LocalDate, to: LocalDate): List<ImportStats> {
+        val period = GRANULARITIES[granularity] ?: throw IllegalArgumentException("Unknown granularity $granularity")
+        val sql = """
+            SELECT toString(${if (granularity == "day") day("started_at") else "$period(started_at)"}) AS period,
+                   count() AS uploads,
+                   sum(rows_written) AS rows_written,
+                   sum(bytes_received) AS bytes_received,
+                   countIf(chunks_failed > 0) AS failed_uploads,
+                   sum(chunks_failed) AS failed_chunks
+            FROM ${config.database}.imports FINAL
+            WHERE ${day("started_at")} BETWEEN ? AND ?
+            GROUP BY period
+            ORDER BY period
+        """.trimIndent()
+        val stats = mutableListOf<ImportStats>()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setDate(1, java.sql.Date.valueOf(from))
+            stmt.setDate(2, java.sql.Date.valueOf(to))
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) {
+                    stats += ImportStats(
+                        period = rs.getString("period"),
+                        uploads = rs.getLong("uploads"),
+                        rowsWritten = rs.getLong("rows_written"),
+                        bytesReceived = rs.getLong("bytes_received"),
+                        failedUploads = rs.getLong("failed_uploads"),
+                        failedChunks = rs.getLong("failed_chunks"),
+                    )
+                }
+            }
+        }
+        return stats
+    }
+
+    /** Settings of the `user_profiles` table, which override those of the environment. */
+    val profiles = UserProfiles(::userProfiles)
+
+    /** How the queries of this store group timestamps into days, in the time zone of the profile if it has one. */
+    val days: DayBoundary get() = profiles.current()?.zone()?.let { config.dayBoundary.copy(zone = it) } ?: config.dayBoundary
+
+    private fun day(column: String) = days.sql(column)
+
+    /**
+     * Today as the daily aggregates of this store count it. Without a time
+     * zone for days, that is the day in the time zone of ClickHouse, which
+     * may not be the one of this server.
+     */
+    fun today(): LocalDate {
+        val days = days
+        if (days.zone != null) return days.today()
+        return connection.createStatement().use { stmt ->
+            stmt.executeQuery("SELECT ${days.sql("now()")}").use { rs -> if (rs.next()) rs.getDate(1).toLocalDate() else days.today() }
+        }
+    }
+
+    fun storeUserProfile(profile: UserProfile) {
+        val sql = """
+            INSERT INTO ${config.database}.user_profiles (user, heart_rate_zones, units, timezone, retention_days, notification_targets, updated_at)
+            ${insertSettings}VALUES (?, ?, ?, ?, ?, ?, ?)
+        """.trimIndent()
+        connection.prepareStatement(sql).use { stmt ->
+            stmt.setString(1, profile.user)
+            stmt.setString(2, profile.heartRateZones.joinToString(prefix = "[", postfix = "]"))
+            stmt.setString(3, profile.units)
+            stmt.setString(4, profile.timezone ?: "")
+            stmt.setInt(5, profile.retentionDays ?: 0)
+            stmt.setString(6, arrayLiteral(profile.notificationTargets))
+            stmt.setTimestamp(7, Timestamp.from(Instant.now()))
+            stmt.executeUpdate()
+        }
+        profiles.invalidate()
+        log.info("Stored the profile of ${profile.user}")
+    }
+
+    /** Deletes the profile of [user] and returns whether there was one. */
+    fun deleteUserProfile(user: String): Boolean {
+        if (userProfiles().none { it.user == user }) return false
+        connection.prepareStatement("DELETE FROM ${config.database}.user_profiles WHERE user = ?").use { stmt ->
+            stmt.setString(1, user)
+            stmt.execute()
+        }
+        profiles.invalidate()
+        log.info("Deleted the profile of $user")
+        return true
+    }
+
+    fun userProfiles(): List<UserProfile> {
+        val sql = """
+            SELECT user, heart_rate_zones, units, timezone, retention_days, notification_targets
+            FROM ${config.database}.user_profiles FINAL
+            ORDER BY user
+        """.trimIndent()
+        val loaded = mutableListOf<UserProfile>()
+        connection.createStatement().use { stmt ->
+            stmt.executeQuery(sql).use { rs ->
+                while (rs.next()) {
+                    loaded += UserProfile(
+                        user = rs.getString("user"),
+                        heartRateZones = (rs.getArray("heart_rate_zones")?.array as? Array<*>)
+                            ?.map { (it as Number).toDouble() } ?: emptyList(),
+                        units = rs.getString("units"),
+                        timezone = rs.getString("timezone").ifEmpty { null },
+                        retentionDays = rs.getInt("retention_days").takeIf { it > 0 },
+                        notificationTargets = stringArray(rs, "notification_targets"),
+                    )
+                }
+            }
+        }
+        return loaded
+    }
+
+    /** Deletes the samples of every metric taken before [cutoff], for the retention of a profile. */
+    fun purgeSamplesBefore(cutoff: Instant) {
+        for (table in (listOf("metrics") + config.metricTables.values).distinct()) {
+            connection.prepareStatement("DELETE FROM ${config.database}.$table WHERE timestamp < ?").use { stmt ->
+                stmt.setTimestamp(1, Timestamp.from(cutoff))
+                stmt.execute()
+            }
+        }
+        log.info("Deleted samples taken before $cutoff")
+    }
+
+    /** Rows in the tables of workouts, state of mind, ECGs and annotations, e.g. to tell whether the database holds data. */
+    fun sectionRowCounts(): Map<String, Long> = listOf("workouts", "state_of_mind", "ecg", "annotations").associateWith { table ->
+        connection.createStatement().use { stmt ->
+            stmt.executeQuery("SELECT count() FROM ${config.database}.$table").use { rs -> if (rs.next()) rs.getLong(1) else 0 }
+        }
+    }
+
+    /** Tables of the database with their engine and columns, in the order ClickHouse lists them. */
+    fun tableSchemas(): List<TableSchema> {
+        val tables = linkedMapOf<String, TableSchema>()
+        connection.prepareStatement(
+            "SELECT name, engine, sorting_key FROM system.tables WHERE database = ? AND NOT startsWith(name, '.') ORDER BY name"
+        ).use { stmt ->
+            stmt.setString(1, config.database)
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) {
+                    val name = rs.getString("name")
+                    tables[name] = TableSchema(
+                        name = name,
+                        engine = rs.getString("engine"),
+                        sortingKey = rs.getString("sorting_key"),
+                        deduplication = config.deduplication(name).name.lowercase(),
+                        columns = emptyList(),
+                    )
+                }
+            }
+        }
+        val columns = mutableMapOf<String, MutableList<ColumnSchema>>()
+        connection.prepareStatement(
+            "SELECT table, name, type, default_expression FROM system.columns WHERE database = ? ORDER BY table, position"
+        ).use { stmt ->
+            stmt.setString(1, config.database)
+            stmt.executeQuery().use { rs ->
+                while (rs.next()) {
+                    columns.getOrPut(rs.getString("table")) { mutableListOf() } +=
+                        ColumnSchema(rs.getString("name"), rs.getString("type"), rs.getString("default_expression").ifEmpty { null })
+                }
+            }
+        }
+        return tables.values.map { it.copy(columns = columns[it.name].orEmpty()) }
+    }
+
+    /** Every stored metric with its units, the table holding it and the time range covered. */
+    fun metricCatalog(): List<MetricInfo> {
+        val sql = """
+            SELECT metric_name, groupUniqArray(metric_unit) AS units, count() AS samples,
+                   min(timestamp) AS first, max(timestamp) AS last
+            FROM ${allMetricsSource()}
+            GROUP BY metric_name
+            ORDER BY metric_name
+        """.trimIndent()
+        val metrics = mutableListOf<MetricInfo>()
+        connection.createStatement().use { stmt ->
+            stmt.executeQuery(sql).use { rs ->
+                while (rs.next()) {
+                    val name = rs.getString("metric_name")
+                    @Suppress("UNCHECKED_CAST")
+                    metrics += MetricInfo(
+                        name = name,
+                        units = (rs.getArray("units").array as Array<String>).sorted(),
+                        table = metricsTable(name),
+                        samples = rs.getLong("samples"),
+                        first = rs.getTimestamp("first").toInstant().toString(),
+                        last = rs.getTimestamp("last").toInstant().toString(),
+                    )
+                }
+            }
+        }
+        return metrics
+    }
+
+    /** Whether [readOnlyQuery] can be used, i.e. [ClickHouseConfig.queryUser] is set. */
+    val queriesEnabled: Boolean get() = queryConnection != null
+
+    /**
+     * Fails unless the settings profile of [user] enforces `readonly = 1`, so
+     * its queries can neither write nor change settings, whatever they are.
+     */
+    private fun requireReadOnly(conn: Connection, user: String) {
+        val readonly = conn.createStatement().use { stmt ->
+            stmt.executeQuery("SELECT getSetting('readonly')").use { rs -> if (rs.next()) rs.getString(1) else null }
+        }
+        check(readonly == "1") { "ClickHouse user $user for ad hoc queries must have readonly = 1 in its settings profile, it has $readonly" }
+    }
+
+    /**
+     * Runs an ad hoc SELECT, see `api/QueryRoutes.kt`, as the read-only
+     * [ClickHouseConfig.queryUser]; its grants decide what it may read. The
+     * query is wrapped in an outer SELECT so [maxRows] and [offset] apply
+     * however it ends.
+     */
+    fun readOnlyQuery(query: String, maxRows: Int, timeoutSeconds: Int, offset: Long = 0): QueryResult {
+        val conn = queryConnection ?: error("Ad hoc queries need CLICKHOUSE_QUERY_USER")
+        // On lines of their own, so a line comment at the end of the query does not hide the limit.
+        val sql = "SELECT * FROM (\n$query\n) LIMIT ${maxRows + 1} OFFSET $offset"
+        conn.createStatement().use { stmt ->
+            stmt.queryTimeout = timeoutSeconds
+            stmt.executeQuery(sql).use { rs ->
+                val meta = rs.metaData
+                val columns = (1..meta.columnCount).map { QueryColumn(meta.getColumnLabel(it), meta.getColumnTypeName(it)) }
+                val rows = mutableListOf<List<JsonElement>>()
+                var truncated = false
+                while (rs.next()) {
+                    if (rows.size == maxRows) {
+                        truncated = true
+                        break
+                    }
+                    rows += columns.indices.map { i -> jsonValue(rs.getObject(i + 1)) }
+                }
+                return QueryResult(columns, rows, truncated)
+            }
+        }
+    }
+
+    private fun jsonValue(value: Any?): JsonElement = when (value) {
+        null -> JsonNull
+        is Boolean -> JsonPrimitive(value)
+        is Number -> JsonPrimitive(value)
+        is Timestamp -> JsonPrimitive(value.toInstant().toString())
+        is java.sql.Array -> JsonArray((value.array as Array<*>).map { jsonValue(it) })
+        else -> JsonPrimitive(value.toString())
+    }
+
+    /** Throws if ClickHouse can not be queried. */
+    fun ping() {
+        connection.createStatement().use { stmt ->
+            stmt.executeQuery("SELECT 1").use { rs -> check(rs.next()) { "ClickHouse returned no result" } }
+        }
+    }
+
+    /**
+     * Merges parts after an import. Tables deduplicated with
+     * [Deduplication.FINAL] are merged completely even if `optimize` is off,
+     * so no duplicates are left once the import finished.
+     */
+    fun optimizeTables() {
+        if (!config.ddl) return
+        connection.createStatement().use { stmt ->
+            for (table in (TABLES + config.metricTables.values).distinct()) {
+                when {
+                    config.deduplication(table) == Deduplication.FINAL ->
+                        stmt.addBatch("OPTIMIZE TABLE ${config.database}.$table FINAL")
+                    config.optimize -> stmt.addBatch("OPTIMIZE TABLE ${config.database}." + table)
+                }
+            }
+            stmt.executeBatch()
+        }
+    }
+
+    override fun close() {
+        insertExecutor.shutdown()
+        insertConnections.forEach { it.close() }
+        queryConnection?.close()
+        connection.close()
+    }
+
+    companion object {
+        val TABLES = listOf(
+            "metrics",
+            "workouts",
+            "workout_routes",
+            "workout_heart_rate_data",
+            "workout_heart_rate_recovery",
+            "workout_step_count_log",
+            "workout_walking_running_distance",
+            "workout_active_energy",
+            "workout_flights_climbed",
+            "ecg",
+            "ecg_voltage",
+            "ecg_waveform",
+            "state_of_mind",
+            "state_of_mind_labels",
+            "state_of_mind_label_map",
+            "personal_records",
+            "workout_attachments",
+            "annotations",
+            "audit_log",
+            "imports",
+            "api_tokens",
+            "api_token_usage",
+            "user_profiles",
+        )
+
+        /** Recordings carry no id, so one is derived from the record data. */
+        fun ecgId(e: ECG): String {
+            val base = listOf(
+                e.start ?: "",
+                e.end ?: "",
+                e.classification ?: "",
+                e.source ?: "",
+                (e.averageHeartRate ?: 0.0).toString(),
+                (e.numberOfVoltageMeasurements ?: e.voltageMeasurements.size).toString(),
+                (e.samplingFrequency ?: 0).toString()
+            ).joinToString("|")
+            return java.util.UUID.nameUUIDFromBytes(base.toByteArray()).toString()
+        }
+
+        /** Columns of `workouts` the admin API may correct, with their types. */
+        val WORKOUT_COLUMNS = mapOf(
+            "name" to "String",
+            "start" to "DateTime",
+            "end" to "DateTime",
+            "active_energy_qty" to "Float64",
+            "distance_qty" to "Float64",
+            "intensity_qty" to "Float64",
+            "humidity_qty" to "Float64",
+            "temperature_qty" to "Float64",
+            "elevation_up_qty" to "Float64",
+            "elevation_down_qty" to "Float64",
+        )
+
+        /** Tables whose engine is fixed by their migration, whatever [ClickHouseConfig.deduplication] says. */
+        val FIXED_ENGINE = setOf("audit_log", "api_tokens", "api_token_usage", "user_profiles")
+        val VALUE_COLUMNS = setOf("qty", "min", "max", "avg", "asleep", "in_bed", "core", "deep", "rem", "awake")
+        val AGGREGATES = setOf("avg", "sum", "min", "max", "count")
+        val GRANULARITIES = mapOf(
+            "hour" to "toStartOfHour",
+            "day" to "toDate",
+            "week" to "toMonday",
+            "month" to "toStartOfMonth",
+        )
+        private const val SAMPLE_COLUMNS =
+            "qty, min, max, avg, asleep, in_bed, sleep_source, in_bed_source, " +
+                "sleep_start, sleep_end, in_bed_start, in_bed_end, core, deep, rem, awake, category, source"
+        private const val WORKOUT_SUMMARY_COLUMNS =
+            "toString(id) AS id, name, start, end, active_energy_qty, active_energy_units, distance_qty, distance_units"
+    }
+}
+
+data class WorkoutSummary(
+    val id: String,
+    val name: String,
+    val start: java.time.Instant,
+    val end: java.time.Instant,
+    val activeEnergy: Double,
+    val activeEnergyUnits: String,
+    val distance: Double,
+    val distanceUnits: String,
+)
+
+/** The last sample of a page of [ClickHouseMetricStore.samplesPage]. */
+data class SampleCursor(val timestamp: java.time.Instant, val source: String)
+
+/** A file attached to a workout; [location] is its key in [AttachmentFiles]. */
+data class WorkoutAttachment(
+    val id: String,
+    val workoutId: String,
+    val name: String,
+    val contentType: String,
+    val size: Long,
+    val sha256: String,
+    val location: String,
+    val createdAt: java.time.Instant,
+)
+
+/** Context recorded by hand, such as "started new medication", to show next to the metrics. */
+data class Annotation(
+    val timestamp: java.time.Instant,
+    val text: String,
+    val tags: List<String> = emptyList(),
+    val source: String = "",
+)
+
+/** One invocation of an admin endpoint; see `api/AdminRoutes.kt`. */
+data class AuditEntry(
+    val timestamp: java.time.Instant,
+    /** Fingerprint of the token used, never the token itself. */
+    val actor: String,
+    val action: String,
+    /** Query parameters as a JSON object. */
+    val parameters: String,
+    val status: Int,
+)
+
+/** An API token managed with the `token` command; only the SHA-256 [hash] of the token is stored. */
+data class ApiToken(
+    val id: String,
+    val name: String,
+    /** A [me.centralhardware.healthImportServer.api.TokenRole], lower case. */
+    val role: String,
+    val hash: String,
+    val createdAt: java.time.Instant,
+    val revokedAt: java.time.Instant? = null,
+    val lastUsedAt: java.time.Instant? = null,
+)
+
+@kotlinx.serialization.Serializable
+data class ImportStats(
+    val period: String,
+    val uploads: Long,
+    val rowsWritten: Long,
+    val bytesReceived: Long,
+    val failedUploads: Long,
+    val failedChunks: Long,
+)
+
+@kotlinx.serialization.Serializable
+data class TableSchema(
+    val name: String,
+    val engine: String,
+    val sortingKey: String,
+    /** The [Deduplication] strategy configured for the table. */
+    val deduplication: String,
+    val columns: List<ColumnSchema>,
+)
+
+@kotlinx.serialization.Serializable
+data class ColumnSchema(val name: String, val type: String, val default: String?)
+
+@kotlinx.serialization.Serializable
+data class MetricInfo(
+    val name: String,
+    val units: List<String>,
+    val table: String,
+    /** Stored rows, counting duplicates not merged yet. */
+    val samples: Long,
+    val first: String,
+    val last: String,
+)
+
+@kotlinx.serialization.Serializable
+data class QueryColumn(val name: String, val type: String)
+
+@kotlinx.serialization.Serializable
+data class QueryResult(
+    val columns: List<QueryColumn>,
+    val rows: List<List<JsonElement>>,
+    val truncated: Boolean,
+    /** Cursor of the following rows, see `api/Pagination.kt`. */
+    val next: String? = null,
+)
+
+enum class DownsampleMethod { BUCKET, LTTB }
+
+@kotlinx.serialization.Serializable
+data class SeriesPoint(
+    val timestamp: String,
+    val value: Double,
+    /** Extremes of the bucket, only for [DownsampleMethod.BUCKET]. */
+    val min: Double? = null,
+    val max: Double? = null,
+)
+
+/** Empty fields match everything; labels and associations match if any of them is present. */
+data class StateOfMindFilter(
+    val kinds: List<String> = emptyList(),
+    val minValence: Double? = null,
+    val maxValence: Double? = null,
+    val labels: List<String> = emptyList(),
+    val associations: List<String> = emptyList(),
+)
+
+data class LatestSample(val timestamp: java.time.Instant, val qty: Double, val units: String)
+
+data class EcgWaveform(
+    val id: String,
+    val start: java.time.Instant,
+    val samplingFrequency: Int,
+    val units: String,
+    /** Seconds since [start] for each voltage. */
+    val offsets: List<Double>,
+    val voltages: List<Double>,
+)
+
+enum class EcgStorage { ROWS, ARRAY, BOTH }
+
+/** How a ReplacingMergeTree table resolves rows sharing a key. */
+enum class Deduplication {
+    /**
+     * Duplicates are collapsed by background merges and only hidden from
+     * queries using FINAL until then. Which of two rows survives depends on
+     * the order of the parts, so concurrent uploads of one key may keep
+     * either.
+     */
+    MERGE,
+
+    /**
+     * Every row carries the time it was written as `version` and the newest
+     * row of a key survives, regardless of merge order. Switching an
+     * existing table copies it once at startup.
+     */
+    VERSION,
+
+    /** Like [MERGE], but the table is merged with `OPTIMIZE ... FINAL` after every import. */
+    FINAL,
+}
+
+data class ClickHouseConfig(
+    val dsn: String,
+    val database: String,
+    val ecgStorage: EcgStorage = EcgStorage.ARRAY,
+    /** Settings added to every INSERT, e.g. `async_insert = 1`. Inserts are synchronous by default. */
+    val insertSettings: Map<String, String> = emptyMap(),
+    /** Use TLS for `clickhouse://` DSNs; `https://` DSNs are always secure. */
+    val secure: Boolean = false,
+    /** Server settings applied to every connection. */
+    val settings: Map<String, String> = emptyMap(),
+    /** Run OPTIMIZE after each import. ClickHouse Cloud discourages it. */
+    val optimize: Boolean = true,
+    /** Run migrations and OPTIMIZE. Disable for users without DDL rights. */
+    val ddl: Boolean = true,
+    /**
+     * Metric name patterns (`heart_rate`, `*audio_exposure`, `step_*`) mapped to
+     * dedicated tables. Table names must start with `metrics_`. Metrics not
+     * matching any pattern go to `metrics`.
+     */
+    val metricTables: Map<String, String> = emptyMap(),
+    /** Tables of one upload inserted at the same time, each over its own connection. */
+    val insertParallelism: Int = 4,
+    /** Strategy per table, `*` for all others. Tables not listed use [Deduplication.MERGE]. */
+    val deduplication: Map<String, Deduplication> = emptyMap(),
+    /** Time zone and hour at which days begin for daily aggregates and date ranges. */
+    val dayBoundary: DayBoundary = DayBoundary(),
+    /**
+     * ClickHouse user for `/api/query`, with `readonly = 1` in its settings
+     * profile and SELECT grants on [database] only. Without it ad hoc
+     * queries are not available.
+     */
+    val queryUser: String? = null,
+    val queryPassword: String? = null,
+) {
+    init {
+        require(insertParallelism >= 1) { "Insert parallelism must be at least 1" }
+        require(ddl || deduplication.values.all { it == Deduplication.MERGE }) {
+            "Deduplication strategies other than merge need DDL rights"
+        }
+        deduplication.keys.forEach { table ->
+            require(table == "*" || table in metricTables.values || table in ClickHouseMetricStore.TABLES && table !in ClickHouseMetricStore.FIXED_ENGINE) {
+                "Unknown table '$table' in deduplication strategies"
+            }
+        }
+        metricTables.values.forEach { table ->
+            require(Regex("metrics_[a-z0-9_]+").matches(table)) { "Metric table '$table' must be named metrics_<suffix>" }
+            require(!table.endsWith("_rebuild") && !table.endsWith("_old")) { "Metric table '$table' has the name of a rebuild copy" }
+        }
+    }
+
+    fun deduplication(table: String): Deduplication =
+        deduplication[table] ?: deduplication["*"]?.takeIf { table !in ClickHouseMetricStore.FIXED_ENGINE } ?: Deduplication.MERGE
+
+    companion object {
+        private val settingName = Regex("[a-z_]+")
+        private val settingValue = Regex("[A-Za-z0-9_.']+")
+
+        /** Parses `name=value` pairs separated by commas. */
+        fun parsePairs(value: String): Map<String, String> =
+            value.split(",").filter { it.isNotBlank() }.associate { pair ->
+                val parts = pair.split("=", limit = 2).map { it.trim() }
+                require(parts.size == 2) { "Expected name=value, got '$pair'" }
+                parts[0] to parts[1]
+            }
+
+        /** Parses `table=strategy` pairs such as `*=version,metrics=final`. */
+        fun parseDeduplication(value: String): Map<String, Deduplication> =
+            parsePairs(value).mapValues { (_, strategy) -> Deduplication.valueOf(strategy.uppercase()) }
+
+        fun parseSettings(value: String): Map<String, String> =
+            parsePairs(value).onEach { (name, setting) ->
+                require(settingName.matches(name)) { "Invalid ClickHouse setting name '$name'" }
+                require(settingValue.matches(setting)) { "Invalid value for ClickHouse setting '$name'" }
+            }
+    }
+}
@@ -0,0 +1,78 @@
+package me.centralhardware.healthImportServer.storage
+
+import java.nio.ByteBuffer
+import java.security.SecureRandom
+import java.util.Base64
+import java.util.UUID
+import javax.crypto.Cipher
+import javax.crypto.Mac
+import javax.crypto.spec.GCMParameterSpec
+import javax.crypto.spec.SecretKeySpec
+import me.centralhardware.healthImportServer.Env
+
+/**
+ * Encrypts values of sensitive columns with AES-GCM before they are written,
+ * so they are unreadable in ClickHouse itself and in backups. Encrypted values
+ * are prefixed with [PREFIX]; anything else is returned unchanged by
+ * [decrypt], so rows written before encryption was enabled stay readable.
+ */
+class ColumnCipher(key: ByteArray, private val columns: Set<String> = COLUMNS) {
+    private val secret = SecretKeySpec(key, "AES")
+    private val random = SecureRandom()
+
+    init {
+        require(key.size in setOf(16, 24, 32)) { "Encryption key must be 16, 24 or 32 bytes, got ${key.size}" }
+        val unknown = columns - COLUMNS
+        require(unknown.isEmpty()) { "Unknown encrypted columns ${unknown.joinToString()}, expected ${COLUMNS.joinToString()}" }
+    }
+
+    fun encrypts(column: String) = column in columns
+
+    fun encrypt(value: String): String {
+        val nonce = ByteArray(NONCE_BYTES).also { random.nextBytes(it) }
+        val cipher = Cipher.getInstance("AES/GCM/NoPadding")
+        cipher.init(Cipher.ENCRYPT_MODE, secret, GCMParameterSpec(TAG_BITS, nonce))
+        return PREFIX + Base64.getEncoder().encodeToString(nonce + cipher.doFinal(value.toByteArray()))
+    }
+
+    fun decrypt(value: String): String {
+        if (!value.startsWith(PREFIX)) return value
+        val bytes = Base64.getDecoder().decode(value.removePrefix(PREFIX))
+        val cipher = Cipher.getInstance("AES/GCM/NoPadding")
+        cipher.init(Cipher.DECRYPT_MODE, secret, GCMParameterSpec(TAG_BITS, bytes, 0, NONCE_BYTES))
+        return String(cipher.doFinal(bytes, NONCE_BYTES, bytes.size - NONCE_BYTES))
+    }
+
+    /**
+     * Keyed replacement for [LabelNormalizer.id]. Plain name based ids of a
+     * small label vocabulary are trivial to reverse.
+     */
+    fun id(kind: String, value: String): String {
+        val mac = Mac.getInstance("HmacSHA256")
+        mac.init(SecretKeySpec(secret.encoded, "HmacSHA256"))
+        val hash = ByteBuffer.wrap(mac.doFinal("$kind:${LabelNormalizer.normalize(value)}".toByteArray()))
+        return UUID(hash.long, hash.long).toString()
+    }
+
+    companion object {
+        const val PREFIX = "enc:v1:"
+        const val LABELS = "state_of_mind.labels"
+        const val ASSOCIATIONS = "state_of_mind.associations"
+        const val LOCATIONS = "workout_routes.location"
+        val COLUMNS = setOf(LABELS, ASSOCIATIONS, LOCATIONS)
+        private const val NONCE_BYTES = 12
+        private const val TAG_BITS = 128
+
+        /**
+         * Reads the base64 key from `ENCRYPTION_KEY` and the columns from
+         * `ENCRYPTED_COLUMNS` (all supported columns by default).
+         */
+        fun fromEnv(): ColumnCipher? {
+            val key = Env.get("ENCRYPTION_KEY") ?: return null
+            val columns = Env.get("ENCRYPTED_COLUMNS")
+                ?.split(",")?.map { it.trim() }?.filter { it.isNotEmpty() }?.toSet()
+                ?: COLUMNS
+            return ColumnCipher(Base64.getDecoder().decode(key), columns)
+        }
+    }
+}
@@ -0,0 +1,43 @@
+package me.centralhardware.healthImportServer.storage
+
+import me.centralhardware.healthImportServer.Env
+import java.time.Instant
+import java.time.LocalDate
+import java.time.ZoneId
+
+/**
+ * Where one day ends and the next begins for everything that groups data
+ * by day: daily aggregates, the API's date ranges, coverage and reports.
+ * Days start at [startHour] in [zone], so with 3 a late night out still
+ * counts to the evening before. Without a [zone], queries use the time
+ * zone of ClickHouse and everything else the one of this server, as before
+ * this was configurable.
+ */
+data class DayBoundary(val zone: ZoneId? = null, val startHour: Int = 0) {
+    init {
+        require(startHour in 0..23) { "Day start hour must be between 0 and 23, got $startHour" }
+    }
+
+    /** SQL expression of the day [column], a `DateTime`, belongs to. */
+    fun sql(column: String): String {
+        val shifted = if (startHour == 0) column else "$column - INTERVAL $startHour HOUR"
+        return if (zone == null) "toDate($shifted)" else "toDate($shifted, '${zone.id}')"
+    }
+
+    fun zone(): ZoneId = zone ?: ZoneId.systemDefault()
+
+    fun of(time: Instant): LocalDate = time.atZone(zone()).minusHours(startHour.toLong()).toLocalDate()
+
+    fun today(): LocalDate = of(Instant.now())
+
+    /** When [day] begins. */
+    fun start(day: LocalDate): Instant = day.atStartOfDay(zone()).plusHours(startHour.toLong()).toInstant()
+
+    companion object {
+        /** Reads `DAY_TIMEZONE`, e.g. `Europe/Berlin`, and `DAY_START_HOUR` (default 0). */
+        fun fromEnv(): DayBoundary = DayBoundary(
+            zone = Env.get("DAY_TIMEZONE")?.let { ZoneId.of(it) },
+            startHour = Env.get("DAY_START_HOUR")?.toInt() ?: 0,
+        )
+    }
+}
@@ -0,0 +1,56 @@
+package me.centralhardware.healthImportServer.storage
+
+import me.centralhardware.healthImportServer.request.ECG
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.StateOfMind
+import me.centralhardware.healthImportServer.request.Workout
+
+/**
+ * A backend that takes whole uploads, as a mode of its own or as one of the
+ * [StoreRouter] stores. Every backend stores metric samples; one that can
+ * store more implements [WorkoutStore], [StateOfMindStore] or [EcgStore],
+ * and [store] leaves out the sections it cannot store. Only
+ * [ClickHouseMetricStore] is read from; the query and admin APIs need it.
+ */
+interface ExportStore {
+    /** Writes [metrics] and returns the rows, points or messages written per table, metric or topic. */
+    fun writeMetrics(metrics: List<Metric>): Map<String, Int>
+
+    /** Fails if the backend cannot be reached. */
+    fun ping()
+
+    /** Writes the sections of [export] this backend can store and returns what was written, like [writeMetrics]. */
+    fun store(export: Export): Map<String, Int> {
+        val written = linkedMapOf<String, Int>()
+        fun add(counts: Map<String, Int>) = counts.forEach { (name, count) -> written.merge(name, count, Int::plus) }
+        add(writeMetrics(export.metrics))
+        if (this is WorkoutStore) add(writeWorkouts(export.workouts))
+        if (this is StateOfMindStore) add(writeStateOfMind(export.stateOfMind))
+        if (this is EcgStore) add(writeEcg(export.ecg))
+        return written
+    }
+}
+
+/** An [ExportStore] that stores workouts, with their routes and heart rate logs where it has tables for them. */
+interface WorkoutStore {
+    fun writeWorkouts(workouts: List<Workout>): Map<String, Int>
+}
+
+/** An [ExportStore] that stores state of mind entries. */
+interface StateOfMindStore {
+    fun writeStateOfMind(entries: List<StateOfMind>): Map<String, Int>
+}
+
+/** An [ExportStore] that stores ECG recordings. */
+interface EcgStore {
+    fun writeEcg(ecg: List<ECG>): Map<String, Int>
+}
+
+/** The sections of an upload [store] writes, named like the `STORE_ROUTES` sections. */
+fun ExportStore.sections(): Set<String> = setOfNotNull(
+    "metrics",
+    "workouts".takeIf { this is WorkoutStore },
+    "state_of_mind".takeIf { this is StateOfMindStore },
+    "ecg".takeIf { this is EcgStore },
+)
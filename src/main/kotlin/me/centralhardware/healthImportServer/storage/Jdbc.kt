@@ -0,0 +1,45 @@
+package me.centralhardware.healthImportServer.storage
+
+import org.slf4j.LoggerFactory
+import java.sql.Connection
+import java.sql.PreparedStatement
+import java.sql.Types
+import java.time.Instant
+import java.time.ZoneOffset
+
+/** Helpers of the stores writing through plain JDBC: PostgreSQL, SQLite and the Parquet archive. */
+private val log = LoggerFactory.getLogger("me.centralhardware.healthImportServer.storage.Jdbc")
+
+/**
+ * Adds every row [bind] accepts to one batch of [sql] and returns how many
+ * it added. Rows it rejects, such as those without an id or a timestamp
+ * that parses, are skipped with a warning instead of failing the upload.
+ */
+internal fun <T> Connection.batch(sql: String, rows: List<T>, bind: (PreparedStatement, T) -> Boolean): Int {
+    if (rows.isEmpty()) return 0
+    var count = 0
+    prepareStatement(sql).use { stmt ->
+        for (row in rows) {
+            if (!bind(stmt, row)) {
+                stmt.clearParameters()
+                continue
+            }
+            stmt.addBatch()
+            count++
+        }
+        if (count > 0) stmt.executeBatch()
+    }
+    if (count < rows.size) {
+        val table = sql.substringAfter("INTO ").substringBefore(' ')
+        log.warn("Skipped ${rows.size - count} of ${rows.size} rows for $table without an id or a valid timestamp")
+    }
+    return count
+}
+
+internal fun PreparedStatement.setNullableDouble(index: Int, value: Double?) {
+    if (value == null) setNull(index, Types.DOUBLE) else setDouble(index, value)
+}
+
+internal fun PreparedStatement.setInstant(index: Int, value: Instant?) {
+    if (value == null) setNull(index, Types.TIMESTAMP_WITH_TIMEZONE) else setObject(index, value.atOffset(ZoneOffset.UTC))
+}
@@ -0,0 +1,94 @@
+package me.centralhardware.healthImportServer.storage
+
+import kotlinx.serialization.json.Json
+import kotlinx.serialization.json.JsonObject
+import kotlinx.serialization.json.JsonPrimitive
+import kotlinx.serialization.json.encodeToJsonElement
+import kotlinx.serialization.json.jsonObject
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.request.ECG
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.Workout
+import me.centralhardware.healthImportServer.request.Timestamps
+import org.slf4j.LoggerFactory
+import java.io.Writer
+import java.nio.file.Files
+import java.nio.file.Path
+import java.nio.file.Paths
+import java.nio.file.StandardOpenOption
+import java.time.ZoneOffset
+
+/**
+ * Appends uploads as newline-delimited JSON to `<dir>/<kind>/<date>.jsonl`,
+ * `kind` being `metrics`, `workouts` or `ecg` and `date` the UTC day of the
+ * sample, workout start or recording start. A metric line is the sample as
+ * Auto Export sends it with `metric` and `units` added, like the Kafka
+ * messages; workouts and ECG recordings are written as uploaded. Records
+ * without a readable timestamp are skipped.
+ *
+ * Nothing is deduplicated: data sent twice is appended twice. The files
+ * are meant as a backup that can be uploaded again, or to see what a client
+ * sends.
+ */
+class JsonlStore(private val dir: Path) : ExportStore, WorkoutStore, EcgStore {
+    val log = LoggerFactory.getLogger(JsonlStore::class.java)
+
+    init {
+        Files.createDirectories(dir)
+        log.info("Appending uploads to JSON lines in $dir")
+    }
+
+    override fun ping() {
+        check(Files.isWritable(dir)) { "$dir is not writable" }
+    }
+
+    override fun writeMetrics(metrics: List<Metric>): Map<String, Int> = write("metrics") { add ->
+        for (metric in metrics) {
+            val names = mapOf("metric" to JsonPrimitive(metric.name), "units" to JsonPrimitive(metric.units))
+            for (sample in metric.data) {
+                add(sample.date ?: sample.startDate, JsonObject(names + json.encodeToJsonElement(sample).jsonObject))
+            }
+        }
+    }
+
+    override fun writeWorkouts(workouts: List<Workout>): Map<String, Int> = write("workouts") { add ->
+        workouts.forEach { add(it.start, json.encodeToJsonElement(it).jsonObject) }
+    }
+
+    override fun writeEcg(ecg: List<ECG>): Map<String, Int> = write("ecg") { add ->
+        ecg.forEach { add(it.start, json.encodeToJsonElement(it).jsonObject) }
+    }
+
+    /** Appends the lines [lines] produces to the files of [kind] and returns their number. */
+    @Synchronized
+    private fun write(kind: String, lines: (add: (String?, JsonObject) -> Unit) -> Unit): Map<String, Int> {
+        val files = linkedMapOf<Path, MutableList<String>>()
+        lines { timestamp, line ->
+            val day = Timestamps.parseOrNull(timestamp)?.atOffset(ZoneOffset.UTC)?.toLocalDate()
+            if (day != null) files.getOrPut(dir.resolve(kind).resolve("$day.jsonl")) { mutableListOf() } += line.toString()
+        }
+        for ((file, content) in files) {
+            Files.createDirectories(file.parent)
+            append(file).use { writer -> content.forEach { writer.write(it); writer.write("\n") } }
+        }
+        val count = files.values.sumOf { it.size }
+        return if (count == 0) emptyMap() else mapOf(kind to count)
+    }
+
+    private fun append(file: Path): Writer =
+        Files.newBufferedWriter(file, StandardOpenOption.CREATE, StandardOpenOption.APPEND)
+
+    companion object {
+        private val json = Json { explicitNulls = false }
+
+        /**
+         * Reads `JSONL_DIR`, e.g. `/data/jsonl`. Returns null, writing no
+         * JSON lines, if it is not set.
+         */
+        fun fromEnv(): JsonlStore? = Env.get("JSONL_DIR")?.let { JsonlStore(Paths.get(it)) }
+
+        /** Like [fromEnv], but only with `JSONL_ONLY=true`, which stores uploads in the files alone. */
+        fun standaloneFromEnv(): JsonlStore? =
+            if (Env.get("JSONL_ONLY").toBoolean()) fromEnv() else null
+    }
+}
@@ -0,0 +1,115 @@
+package me.centralhardware.healthImportServer.storage
+
+import kotlinx.serialization.json.Json
+import kotlinx.serialization.json.JsonObject
+import kotlinx.serialization.json.JsonPrimitive
+import kotlinx.serialization.json.encodeToJsonElement
+import kotlinx.serialization.json.jsonObject
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.StateOfMind
+import me.centralhardware.healthImportServer.request.Workout
+import org.apache.kafka.clients.producer.KafkaProducer
+import org.apache.kafka.clients.producer.ProducerConfig
+import org.apache.kafka.clients.producer.ProducerRecord
+import org.apache.kafka.clients.producer.RecordMetadata
+import org.apache.kafka.common.serialization.StringSerializer
+import org.slf4j.LoggerFactory
+import java.util.Properties
+import java.util.concurrent.Future
+import java.util.concurrent.TimeUnit
+
+/**
+ * Publishes every metric sample, workout and state of mind entry of an
+ * upload as a JSON message, so downstream pipelines can consume health
+ * data without ClickHouse. Samples are keyed by metric name, keeping the
+ * samples of one metric in order within a partition, workouts and state of
+ * mind entries by their id.
+ *
+ * A sample message is the sample as Auto Export sends it with `metric` and
+ * `units` added, e.g. `{"metric": "heart_rate", "units": "count/min",
+ * "date": "...", "Avg": 62.0, ...}`; a workout or state of mind message is
+ * the entry as uploaded.
+ */
+class KafkaPublisher(
+    properties: Properties,
+    private val topics: Topics = Topics(),
+) : ExportStore, WorkoutStore, StateOfMindStore, AutoCloseable {
+    val log = LoggerFactory.getLogger(KafkaPublisher::class.java)
+    private val producer = KafkaProducer(properties, StringSerializer(), StringSerializer())
+
+    data class Topics(
+        val metrics: String = "health.metrics",
+        val workouts: String = "health.workouts",
+        val stateOfMind: String = "health.state_of_mind",
+    )
+
+    /** Fails if the brokers cannot be reached. */
+    override fun ping() {
+        producer.partitionsFor(topics.metrics)
+    }
+
+    override fun writeMetrics(metrics: List<Metric>): Map<String, Int> = publish(topics.metrics) { send ->
+        for (metric in metrics) {
+            for (sample in metric.data) {
+                if ((sample.date ?: sample.startDate) == null) continue
+                val names = mapOf("metric" to JsonPrimitive(metric.name), "units" to JsonPrimitive(metric.units))
+                send(metric.name, JsonObject(names + json.encodeToJsonElement(sample).jsonObject))
+            }
+        }
+    }
+
+    override fun writeWorkouts(workouts: List<Workout>): Map<String, Int> = publish(topics.workouts) { send ->
+        workouts.forEach { send(it.id, json.encodeToJsonElement(it).jsonObject) }
+    }
+
+    override fun writeStateOfMind(entries: List<StateOfMind>): Map<String, Int> = publish(topics.stateOfMind) { send ->
+        entries.filter { it.start != null }.forEach { send(it.id, json.encodeToJsonElement(it).jsonObject) }
+    }
+
+    /** Sends the messages [messages] produces to [topic] and returns their number once the brokers acknowledged all of them. */
+    private fun publish(topic: String, messages: (send: (String?, JsonObject) -> Unit) -> Unit): Map<String, Int> {
+        val sent = mutableListOf<Future<RecordMetadata>>()
+        messages { key, value -> sent += producer.send(ProducerRecord(topic, key, value.toString())) }
+        if (sent.isEmpty()) return emptyMap()
+        producer.flush()
+        sent.forEach { it.get(SEND_TIMEOUT_SECONDS, TimeUnit.SECONDS) }
+        log.info("Published ${sent.size} messages to $topic")
+        return mapOf(topic to sent.size)
+    }
+
+    override fun close() = producer.close()
+
+    companion object {
+        private const val SEND_TIMEOUT_SECONDS = 60L
+        private val json = Json { explicitNulls = false }
+
+        /**
+         * Reads `KAFKA_BOOTSTRAP_SERVERS`, e.g. `kafka:9092`, the topics
+         * `KAFKA_TOPIC_METRICS`, `KAFKA_TOPIC_WORKOUTS` and
+         * `KAFKA_TOPIC_STATE_OF_MIND`, and `KAFKA_PROPERTIES`, further
+         * producer settings as `name=value` pairs separated by `;`, e.g.
+         * `security.protocol=SASL_SSL;sasl.mechanism=PLAIN`.
+         */
+        fun fromEnv(): KafkaPublisher? {
+            val servers = Env.get("KAFKA_BOOTSTRAP_SERVERS") ?: return null
+            val properties = Properties()
+            properties[ProducerConfig.BOOTSTRAP_SERVERS_CONFIG] = servers
+            properties[ProducerConfig.ACKS_CONFIG] = "all"
+            properties[ProducerConfig.ENABLE_IDEMPOTENCE_CONFIG] = "true"
+            properties[ProducerConfig.COMPRESSION_TYPE_CONFIG] = "zstd"
+            Env.get("KAFKA_PROPERTIES")?.split(';')?.map { it.trim() }?.filter { it.isNotEmpty() }?.forEach { pair ->
+                val separator = pair.indexOf('=')
+                require(separator > 0) { "Expected name=value in KAFKA_PROPERTIES" }
+                properties[pair.substring(0, separator).trim()] = pair.substring(separator + 1).trim()
+            }
+            val defaults = Topics()
+            val topics = Topics(
+                metrics = Env.get("KAFKA_TOPIC_METRICS") ?: defaults.metrics,
+                workouts = Env.get("KAFKA_TOPIC_WORKOUTS") ?: defaults.workouts,
+                stateOfMind = Env.get("KAFKA_TOPIC_STATE_OF_MIND") ?: defaults.stateOfMind,
+            )
+            return KafkaPublisher(properties, topics)
+        }
+    }
+}
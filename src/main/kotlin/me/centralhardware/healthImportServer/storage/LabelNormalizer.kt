@@ -0,0 +1,20 @@
+package me.centralhardware.healthImportServer.storage
+
+import java.util.UUID
+
+/**
+ * Normalizes state of mind labels and associations so that e.g. "Self Care"
+ * and "self care " end up as the same dictionary entry `self_care`.
+ */
+object LabelNormalizer {
+    const val LABEL = "label"
+    const val ASSOCIATION = "association"
+
+    private val whitespace = Regex("\\s+")
+
+    fun normalize(value: String): String = value.trim().lowercase().replace(whitespace, "_")
+
+    /** Stable id of a normalized label, the same on every instance. */
+    fun id(kind: String, value: String): String =
+        UUID.nameUUIDFromBytes("$kind:${normalize(value)}".toByteArray()).toString()
+}
@@ -0,0 +1,40 @@
+package me.centralhardware.healthImportServer.storage
+
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.request.Metric
+
+/**
+ * Selects metrics by name: those matching one of [include], or all if it is
+ * empty, and none matching one of [exclude]. Patterns may start or end with
+ * `*`, like in `CLICKHOUSE_METRIC_TABLES`.
+ */
+class MetricFilter(private val include: List<String> = emptyList(), private val exclude: List<String> = emptyList()) {
+
+    fun accepts(name: String) = (include.isEmpty() || include.any { matches(it, name) }) && exclude.none { matches(it, name) }
+
+    fun filter(metrics: List<Metric>): List<Metric> = metrics.filter { accepts(it.name) }
+
+    override fun toString(): String =
+        (if (include.isEmpty()) "all metrics" else include.joinToString()) +
+            (if (exclude.isEmpty()) "" else " except ${exclude.joinToString()}")
+
+    companion object {
+        /** Whether metric [name] matches [pattern], which may start or end with `*`. */
+        fun matches(pattern: String, name: String): Boolean = when {
+            pattern.startsWith("*") && pattern.endsWith("*") -> name.contains(pattern.trim('*'))
+            pattern.startsWith("*") -> name.endsWith(pattern.removePrefix("*"))
+            pattern.endsWith("*") -> name.startsWith(pattern.removeSuffix("*"))
+            else -> name == pattern
+        }
+
+        /** The comma separated patterns of setting [name]; empty if it is not set. */
+        fun patterns(name: String): List<String> =
+            Env.get(name)?.split(',')?.map { it.trim() }?.filter { it.isNotEmpty() } ?: emptyList()
+
+        /** Reads the comma separated patterns of [include] and [exclude]; null if neither is set. */
+        fun fromEnv(include: String, exclude: String): MetricFilter? {
+            val filter = MetricFilter(patterns(include), patterns(exclude))
+            return filter.takeIf { filter.include.isNotEmpty() || filter.exclude.isNotEmpty() }
+        }
+    }
+}
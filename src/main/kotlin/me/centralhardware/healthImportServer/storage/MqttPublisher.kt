@@ -0,0 +1,236 @@
+package me.centralhardware.healthImportServer.storage
+
+import kotlinx.serialization.json.Json
+import kotlinx.serialization.json.JsonObject
+import kotlinx.serialization.json.JsonPrimitive
+import kotlinx.serialization.json.encodeToJsonElement
+import kotlinx.serialization.json.jsonObject
+import kotlinx.serialization.json.jsonPrimitive
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.Sample
+import me.centralhardware.healthImportServer.request.Timestamps
+import org.eclipse.paho.client.mqttv3.MqttClient
+import org.eclipse.paho.client.mqttv3.MqttConnectOptions
+import org.eclipse.paho.client.mqttv3.MqttException
+import org.eclipse.paho.client.mqttv3.persist.MemoryPersistence
+import org.slf4j.LoggerFactory
+import java.time.Duration
+import java.time.Instant
+import java.time.LocalDate
+import java.util.UUID
+import java.util.concurrent.ConcurrentHashMap
+import java.util.concurrent.LinkedBlockingQueue
+
+/**
+ * Publishes the newest sample of the [metrics] to `<prefix>/<metric>`
+ * whenever an upload brought one, so Home Assistant or Node-RED can react
+ * to new health data. Messages are retained by default, so a subscriber
+ * gets the current value right away. A sample older than the one last
+ * published for its metric is not published, so a backfill of history does
+ * not turn old values into the current state; after a restart the last
+ * published times are read back from the retained messages.
+ *
+ * The payload is the sample as Auto Export sends it with `value`, `units`
+ * and `timestamp` added, e.g. `{"value": 72.4, "units": "kg", "timestamp":
+ * "2024-03-02T07:15:00Z", "qty": 72.4, ...}`; `value` is `qty`, or `Avg`
+ * for heart rate, or `asleep` for sleep, whichever the sample has. For the
+ * [totals] metrics, e.g. steps, `value` is instead the total of the day of
+ * the sample, as [days] divides them, which [total] reads from the store,
+ * and `day` is added.
+ *
+ * Messages are sent by a thread of their own, so uploads never wait for the
+ * broker; while it is down, the newest message per metric is kept and the
+ * connection is tried again with a growing delay of up to [MAX_BACKOFF].
+ */
+class MqttPublisher(
+    url: String,
+    user: String?,
+    password: String?,
+    private val metrics: MetricFilter,
+    private val prefix: String = "health",
+    private val qos: Int = 1,
+    private val retain: Boolean = true,
+    clientId: String = randomClientId(),
+    private val totals: Set<String> = emptySet(),
+    private val total: ((metric: String, day: LocalDate) -> Double?)? = null,
+    private val days: () -> DayBoundary = { DayBoundary() },
+) : AutoCloseable {
+    val log = LoggerFactory.getLogger(MqttPublisher::class.java)
+    private val client = MqttClient(url, clientId, MemoryPersistence())
+    private val options = MqttConnectOptions().apply {
+        isAutomaticReconnect = true
+        isCleanSession = true
+        user?.let { userName = it }
+        password?.let { this.password = it.toCharArray() }
+    }
+    private val published = ConcurrentHashMap<String, Instant>()
+    /** The newest sample per metric waiting to be sent. */
+    private val pending = ConcurrentHashMap<String, Newest>()
+    private val wake = LinkedBlockingQueue<Unit>(1)
+    @Volatile
+    private var closed = false
+    private val sender = Thread(::drain, "mqtt-publisher").apply { isDaemon = true }
+
+    private data class Newest(val units: String, val time: Instant, val sample: Sample)
+
+    init {
+        require(qos in 0..2) { "MQTT QoS must be 0, 1 or 2, got $qos" }
+        log.info("Publishing $metrics to $url below $prefix/ as $clientId")
+        sender.start()
+    }
+
+    /** Queues the newest sample per selected metric of [export] for sending; never blocks on the broker. */
+    fun publish(export: Export) {
+        for (metric in metrics.filter(export.metrics)) {
+            val (time, sample) = metric.data
+                .mapNotNull { s -> Timestamps.parseOrNull(s.date ?: s.startDate)?.let { it to s } }
+                .maxByOrNull { it.first } ?: continue
+            if (published[metric.name]?.isAfter(time) == true) continue
+            pending.merge(metric.name, Newest(metric.units, time, sample)) { old, new -> if (new.time.isBefore(old.time)) old else new }
+        }
+        if (pending.isNotEmpty()) wake.offer(Unit)
+    }
+
+    /** Sends what is pending until [close], connecting first with a delay growing from [MIN_BACKOFF]. */
+    private fun drain() {
+        var backoff = MIN_BACKOFF
+        while (!closed) {
+            try {
+                if (pending.isEmpty()) {
+                    wake.take()
+                    continue
+                }
+                if (!connect()) {
+                    Thread.sleep(backoff.toMillis())
+                    backoff = minOf(backoff.multipliedBy(2), MAX_BACKOFF)
+                    continue
+                }
+                backoff = MIN_BACKOFF
+                for (name in pending.keys.toList()) {
+                    val newest = pending.remove(name) ?: continue
+                    if (!send(name, newest)) {
+                        // Kept for the next attempt unless a newer sample arrived meanwhile.
+                        pending.putIfAbsent(name, newest)
+                        break
+                    }
+                }
+            } catch (e: InterruptedException) {
+                return
+            }
+        }
+    }
+
+    /**
+     * Connects unless connected; after that the client reconnects on its
+     * own. With retained messages, the times last published are read back
+     * from them first, so a backfill after a restart is not published.
+     */
+    private fun connect(): Boolean {
+        if (client.isConnected) return true
+        return try {
+            client.connect(options)
+            if (retain) {
+                client.subscribe("$prefix/+", 0) { topic, message -> restore(topic.removePrefix("$prefix/"), message.payload) }
+                // The broker sends the retained messages right after the subscription.
+                Thread.sleep(RETAINED_WAIT.toMillis())
+                client.unsubscribe("$prefix/+")
+            }
+            true
+        } catch (e: MqttException) {
+            log.warn("Could not connect to MQTT broker ${client.serverURI}: ${e.message}")
+            false
+        }
+    }
+
+    private fun restore(metric: String, payload: ByteArray) {
+        val time = runCatching {
+            Instant.parse(json.parseToJsonElement(payload.decodeToString()).jsonObject["timestamp"]!!.jsonPrimitive.content)
+        }.getOrNull() ?: return
+        published.merge(metric, time) { old, new -> maxOf(old, new) }
+    }
+
+    /** Publishes [newest] of metric [name] and returns false if the broker did not take it. */
+    private fun send(name: String, newest: Newest): Boolean {
+        if (published[name]?.isAfter(newest.time) == true) return true
+        val (units, time, sample) = newest
+        val fields = if (name in totals && total != null) {
+            val day = days().of(time)
+            val value = try {
+                total.invoke(name, day)
+            } catch (e: Exception) {
+                log.warn("Could not read the day's total of $name for MQTT", e)
+                return true
+            }
+            mapOf(
+                "value" to JsonPrimitive(value),
+                "units" to JsonPrimitive(units),
+                "timestamp" to JsonPrimitive(time.toString()),
+                "day" to JsonPrimitive(day.toString()),
+            )
+        } else {
+            mapOf(
+                "value" to JsonPrimitive(sample.qty ?: sample.avg ?: sample.asleep),
+                "units" to JsonPrimitive(units),
+                "timestamp" to JsonPrimitive(time.toString()),
+            ) + json.encodeToJsonElement(sample).jsonObject
+        }
+        return try {
+            client.publish("$prefix/$name", JsonObject(fields).toString().toByteArray(), qos, retain)
+            published[name] = time
+            true
+        } catch (e: MqttException) {
+            log.warn("Failed to publish $name to MQTT", e)
+            false
+        }
+    }
+
+    override fun close() {
+        closed = true
+        sender.interrupt()
+        if (client.isConnected) client.disconnect()
+        client.close()
+    }
+
+    companion object {
+        private val MIN_BACKOFF = Duration.ofSeconds(1)
+        private val MAX_BACKOFF = Duration.ofMinutes(5)
+        private val RETAINED_WAIT = Duration.ofSeconds(1)
+        private val json = Json { explicitNulls = false }
+        private val DEFAULT_METRICS = listOf("heart_rate", "resting_heart_rate", "weight_body_mass", "sleep_analysis", "step_count")
+        private val DEFAULT_TOTALS = listOf("step_count", "active_energy", "flights_climbed", "walking_running_distance", "apple_exercise_time")
+
+        /**
+         * Reads `MQTT_URL`, e.g. `tcp://mosquitto:1883`, `MQTT_USER`,
+         * `MQTT_PASSWORD`, `MQTT_CLIENT_ID` (default `health-import-server-`
+         * with a random suffix), `MQTT_TOPIC_PREFIX` (default `health`),
+         * `MQTT_QOS` (default 1), `MQTT_RETAIN` (default true), `MQTT_METRICS`
+         * and `MQTT_EXCLUDE_METRICS`, comma separated metrics like those of a
+         * [MetricFilter], and `MQTT_TOTAL_METRICS`, the metrics published as
+         * the day's total in [store].
+         */
+        fun fromEnv(store: ClickHouseMetricStore? = null): MqttPublisher? {
+            val url = Env.get("MQTT_URL") ?: return null
+            val boundary = DayBoundary.fromEnv()
+            return MqttPublisher(
+                url = url,
+                user = Env.get("MQTT_USER"),
+                password = Env.get("MQTT_PASSWORD"),
+                metrics = MetricFilter(
+                    MetricFilter.patterns("MQTT_METRICS").ifEmpty { DEFAULT_METRICS },
+                    MetricFilter.patterns("MQTT_EXCLUDE_METRICS"),
+                ),
+                prefix = Env.get("MQTT_TOPIC_PREFIX")?.trimEnd('/') ?: "health",
+                qos = Env.get("MQTT_QOS")?.toInt() ?: 1,
+                retain = Env.get("MQTT_RETAIN")?.toBoolean() ?: true,
+                clientId = Env.get("MQTT_CLIENT_ID") ?: randomClientId(),
+                totals = (Env.get("MQTT_TOTAL_METRICS")?.split(",")?.map { it.trim() }?.filter { it.isNotEmpty() } ?: DEFAULT_TOTALS).toSet(),
+                total = store?.let { s -> { metric: String, day: LocalDate -> s.dailyValues(metric, "qty", "sum", day, day)[day] } },
+                days = { store?.days ?: boundary },
+            )
+        }
+
+        /** Two instances with one client id would take turns kicking each other off the broker. */
+        private fun randomClientId() = "health-import-server-" + UUID.randomUUID().toString().take(8)
+    }
+}
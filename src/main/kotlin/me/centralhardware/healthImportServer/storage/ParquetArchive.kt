@@ -0,0 +1,216 @@
+package me.centralhardware.healthImportServer.storage
+
+import kotlinx.serialization.json.Json
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.Timestamps
+import me.centralhardware.healthImportServer.request.Workout
+import org.slf4j.LoggerFactory
+import java.net.URI
+import java.nio.file.Files
+import java.nio.file.Paths
+import java.security.MessageDigest
+import java.sql.Connection
+import java.sql.DriverManager
+
+/**
+ * Appends the metrics and workouts of every upload to Parquet files below
+ * [target], a directory or an `s3://bucket/prefix` URL, for long-term
+ * retention and analysis with DuckDB, Spark or pandas. The files are
+ * partitioned by the day of the samples, in directories such as
+ * `metrics/date=2024-03-02`, each upload adding new files. Files are named
+ * after their content, so a chunk archived again, e.g. after a failed
+ * attempt, replaces its own files; the same samples in different uploads
+ * are archived twice.
+ *
+ * DuckDB, running in memory, writes the files.
+ */
+class ParquetArchive(
+    private val target: String,
+    private val days: DayBoundary = DayBoundary(),
+    s3: S3Settings? = null,
+) : ExportStore, WorkoutStore, AutoCloseable {
+    val log = LoggerFactory.getLogger(ParquetArchive::class.java)
+    private val connection: Connection = DriverManager.getConnection("jdbc:duckdb:")
+
+    init {
+        connection.createStatement().use { stmt ->
+            stmt.execute("SET TimeZone = 'UTC'")
+            if (target.startsWith("s3://")) {
+                val settings = s3 ?: S3Settings()
+                stmt.execute("INSTALL httpfs")
+                stmt.execute("LOAD httpfs")
+                // The credential chain provider comes with the aws extension.
+                if (settings.accessKeyId == null) {
+                    stmt.execute("INSTALL aws")
+                    stmt.execute("LOAD aws")
+                }
+                stmt.execute(secret(settings))
+            } else {
+                Files.createDirectories(Paths.get(target))
+            }
+            SCHEMA.forEach { stmt.execute(it) }
+        }
+        log.info("Archiving uploads as Parquet to $target")
+    }
+
+    private fun secret(s3: S3Settings): String {
+        val options = mutableListOf("TYPE S3")
+        if (s3.accessKeyId == null) options += "PROVIDER CREDENTIAL_CHAIN"
+        s3.accessKeyId?.let { options += "KEY_ID ${literal(it)}" }
+        s3.secretAccessKey?.let { options += "SECRET ${literal(it)}" }
+        s3.region?.let { options += "REGION ${literal(it)}" }
+        s3.endpoint?.let { URI(it) }?.let { endpoint ->
+            options += "ENDPOINT ${literal(endpoint.authority)}"
+            options += "USE_SSL ${endpoint.scheme != "http"}"
+        }
+        s3.urlStyle?.let { options += "URL_STYLE ${literal(it)}" }
+        return "CREATE OR REPLACE SECRET archive (${options.joinToString()})"
+    }
+
+    private fun literal(value: String) = "'" + value.replace("'", "''") + "'"
+
+    @Synchronized
+    override fun ping() {
+        connection.createStatement().use { it.execute("SELECT 1") }
+    }
+
+    override fun writeMetrics(metrics: List<Metric>): Map<String, Int> = store(Export(metrics = metrics))
+
+    override fun writeWorkouts(workouts: List<Workout>): Map<String, Int> = store(Export(workouts = workouts))
+
+    /**
+     * Stages the metrics and workouts of [export] before copying either to
+     * Parquet, so a chunk that cannot be staged archives nothing, and
+     * returns the rows written.
+     */
+    @Synchronized
+    override fun store(export: Export): Map<String, Int> {
+        try {
+            val rows = linkedMapOf("metrics" to stageMetrics(export.metrics), "workouts" to stageWorkouts(export.workouts))
+            val name = "upload_" + digest(Export(metrics = export.metrics, workouts = export.workouts))
+            connection.createStatement().use { stmt ->
+                for (table in rows.filterValues { it > 0 }.keys) {
+                    stmt.execute(
+                        "COPY $table TO ${literal("${target.trimEnd('/')}/$table")} " +
+                                "(FORMAT PARQUET, COMPRESSION ZSTD, PARTITION_BY (date), OVERWRITE_OR_IGNORE, FILENAME_PATTERN '${name}_{i}')"
+                    )
+                }
+            }
+            return rows
+        } finally {
+            connection.createStatement().use { stmt -> TABLES.forEach { stmt.execute("DELETE FROM $it") } }
+        }
+    }
+
+    /** Names the files of [export] after its content, the first 64 bits of a SHA-256 in hex. */
+    private fun digest(export: Export): String =
+        MessageDigest.getInstance("SHA-256").digest(Json.encodeToString(Export.serializer(), export).toByteArray())
+            .take(8).joinToString("") { "%02x".format(it) }
+
+    private fun stageMetrics(metrics: List<Metric>): Int = connection.batch(
+        """
+            INSERT INTO metrics (date, timestamp, metric_name, metric_unit, source, category, qty, min, max, avg,
+                                 asleep, in_bed, core, deep, rem, awake, sleep_start, sleep_end)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        """.trimIndent(),
+        metrics.flatMap { m -> m.data.map { m to it } },
+    ) { stmt, (m, s) ->
+        val ts = Timestamps.parse(s.date ?: s.startDate ?: return@batch false)
+        stmt.setDate(1, java.sql.Date.valueOf(days.of(ts)))
+        stmt.setInstant(2, ts)
+        stmt.setString(3, m.name)
+        stmt.setString(4, m.units)
+        stmt.setString(5, s.sleepSource ?: s.source ?: "")
+        stmt.setString(6, s.value ?: "")
+        listOf(s.qty, s.min, s.max, s.avg, s.asleep, s.inBed, s.core, s.deep, s.rem, s.awake)
+            .forEachIndexed { i, value -> stmt.setNullableDouble(7 + i, value) }
+        stmt.setInstant(17, (s.sleepStart ?: s.inBedStart)?.let { Timestamps.parse(it) })
+        stmt.setInstant(18, (s.sleepEnd ?: s.inBedEnd ?: s.endDate)?.let { Timestamps.parse(it) })
+        true
+    }
+
+    private fun stageWorkouts(workouts: List<Workout>): Int = connection.batch(
+        """
+            INSERT INTO workouts (date, id, name, start, "end", active_energy_qty, active_energy_units, distance_qty,
+                                  distance_units, elevation_up_qty, elevation_up_units)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        """.trimIndent(),
+        workouts,
+    ) { stmt, w ->
+        val start = Timestamps.parse(w.start ?: return@batch false)
+        stmt.setDate(1, java.sql.Date.valueOf(days.of(start)))
+        stmt.setString(2, w.id ?: return@batch false)
+        stmt.setString(3, w.name ?: "")
+        stmt.setInstant(4, start)
+        stmt.setInstant(5, Timestamps.parse(w.end ?: return@batch false))
+        stmt.setNullableDouble(6, w.activeEnergyBurned?.total())
+        stmt.setString(7, w.activeEnergyBurned?.units ?: "")
+        stmt.setNullableDouble(8, w.distance?.total())
+        stmt.setString(9, w.distance?.units ?: "")
+        stmt.setNullableDouble(10, w.elevationUp?.total())
+        stmt.setString(11, w.elevationUp?.units ?: "")
+        true
+    }
+
+
+
+
+    override fun close() = connection.close()
+
+    companion object {
+        private val TABLES = listOf("metrics", "workouts")
+
+        /** Tables holding the rows of one upload until they are copied to Parquet. */
+        private val SCHEMA = listOf(
+            """
+                CREATE TABLE metrics (
+                    date DATE NOT NULL,
+                    timestamp TIMESTAMPTZ NOT NULL,
+                    metric_name VARCHAR NOT NULL,
+                    metric_unit VARCHAR NOT NULL,
+                    source VARCHAR NOT NULL,
+                    category VARCHAR NOT NULL,
+                    qty DOUBLE,
+                    min DOUBLE,
+                    max DOUBLE,
+                    avg DOUBLE,
+                    asleep DOUBLE,
+                    in_bed DOUBLE,
+                    core DOUBLE,
+                    deep DOUBLE,
+                    rem DOUBLE,
+                    awake DOUBLE,
+                    sleep_start TIMESTAMPTZ,
+                    sleep_end TIMESTAMPTZ
+                )
+            """,
+            """
+                CREATE TABLE workouts (
+                    date DATE NOT NULL,
+                    id VARCHAR NOT NULL,
+                    name VARCHAR NOT NULL,
+                    start TIMESTAMPTZ NOT NULL,
+                    "end" TIMESTAMPTZ NOT NULL,
+                    active_energy_qty DOUBLE,
+                    active_energy_units VARCHAR NOT NULL,
+                    distance_qty DOUBLE,
+                    distance_units VARCHAR NOT NULL,
+                    elevation_up_qty DOUBLE,
+                    elevation_up_units VARCHAR NOT NULL
+                )
+            """,
+        ).map { it.trimIndent() }
+
+        /**
+         * Reads `PARQUET_TARGET`, e.g. `/data/parquet` or `s3://health/archive`,
+         * and for S3 [S3Settings]. Days are split as configured with
+         * `DAY_TIMEZONE` and `DAY_START_HOUR`.
+         */
+        fun fromEnv(): ParquetArchive? {
+            val target = Env.get("PARQUET_TARGET") ?: return null
+            return ParquetArchive(target, DayBoundary.fromEnv(), S3Settings.fromEnv())
+        }
+    }
+}
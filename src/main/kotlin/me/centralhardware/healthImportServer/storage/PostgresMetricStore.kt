@@ -0,0 +1,244 @@
+package me.centralhardware.healthImportServer.storage
+
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.StateOfMind
+import me.centralhardware.healthImportServer.request.Timestamps
+import me.centralhardware.healthImportServer.request.Workout
+import org.flywaydb.core.Flyway
+import org.slf4j.LoggerFactory
+import java.sql.Connection
+import java.sql.DriverManager
+import java.sql.Timestamp
+import java.util.UUID
+
+/**
+ * Stores uploads in PostgreSQL, for small installations where running
+ * ClickHouse is not worth it, as a mode of its own or as a [StoreRouter]
+ * store. The tables are created by the Flyway migrations in
+ * `postgres-migration`, the time series as TimescaleDB hypertables if the
+ * extension is available. Every row is upserted, so sending the same data
+ * again updates it instead of adding duplicates.
+
+ */
+class PostgresMetricStore(
+    private val url: String,
+    private val user: String?,
+    private val password: String?,
+) : ExportStore, WorkoutStore, StateOfMindStore, AutoCloseable {
+    val log = LoggerFactory.getLogger(PostgresMetricStore::class.java)
+    private var connection: Connection
+
+    init {
+        Flyway.configure()
+            .dataSource(url, user, password)
+            .locations("classpath:postgres-migration")
+            // Tables created before the migrations existed are taken over by V1, which creates only missing ones.
+            .baselineOnMigrate(true)
+            .baselineVersion("0")
+            .load()
+            .migrate()
+        connection = DriverManager.getConnection(url, user, password)
+        createHypertables()
+    }
+
+    /** Opens the connection again if it was closed, e.g. because PostgreSQL restarted. */
+    private fun reconnect() {
+        if (connection.isValid(VALID_TIMEOUT_SECONDS)) return
+        log.warn("The connection to PostgreSQL was lost, reconnecting")
+        runCatching { connection.close() }
+        connection = DriverManager.getConnection(url, user, password)
+    }
+
+    private fun createHypertables() {
+        connection.createStatement().use { stmt ->
+            val timescale = stmt.executeQuery("SELECT 1 FROM pg_available_extensions WHERE name = 'timescaledb'").use { it.next() }
+            if (timescale) {
+                stmt.execute("CREATE EXTENSION IF NOT EXISTS timescaledb")
+                HYPERTABLES.forEach { (table, column) ->
+                    stmt.execute("SELECT create_hypertable('$table', '$column', if_not_exists => TRUE, migrate_data => TRUE)")
+                }
+                log.info("Using TimescaleDB hypertables for ${HYPERTABLES.keys.joinToString()}")
+            }
+        }
+    }
+
+    @Synchronized
+    override fun ping() {
+        reconnect()
+        connection.createStatement().use { it.execute("SELECT 1") }
+    }
+
+    /** Writes [export] in one transaction and returns the rows written per table. */
+    @Synchronized
+    override fun store(export: Export): Map<String, Int> {
+        reconnect()
+        connection.autoCommit = false
+        try {
+            val rows = super.store(export)
+            connection.commit()
+            return rows
+        } catch (e: Exception) {
+            connection.rollback()
+            throw e
+        } finally {
+            connection.autoCommit = true
+        }
+    }
+
+    @Synchronized
+    override fun writeMetrics(metrics: List<Metric>): Map<String, Int> = mapOf("metrics" to storeMetrics(metrics))
+
+    @Synchronized
+    override fun writeWorkouts(workouts: List<Workout>): Map<String, Int> = linkedMapOf(
+        "workouts" to storeWorkouts(workouts),
+        "workout_routes" to storeRoutes(workouts),
+        "workout_heart_rate_data" to storeHeartRate(workouts),
+    )
+
+    @Synchronized
+    override fun writeStateOfMind(entries: List<StateOfMind>): Map<String, Int> = mapOf("state_of_mind" to storeStateOfMind(entries))
+
+    private fun storeMetrics(metrics: List<Metric>): Int = connection.batch(
+        """
+            INSERT INTO metrics (timestamp, metric_name, metric_unit, source, category, qty, min, max, avg,
+                                 asleep, in_bed, core, deep, rem, awake, sleep_start, sleep_end)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+            ON CONFLICT (metric_name, timestamp, source, category) DO UPDATE SET
+                metric_unit = EXCLUDED.metric_unit, qty = EXCLUDED.qty, min = EXCLUDED.min, max = EXCLUDED.max,
+                avg = EXCLUDED.avg, asleep = EXCLUDED.asleep, in_bed = EXCLUDED.in_bed, core = EXCLUDED.core,
+                deep = EXCLUDED.deep, rem = EXCLUDED.rem, awake = EXCLUDED.awake,
+                sleep_start = EXCLUDED.sleep_start, sleep_end = EXCLUDED.sleep_end
+        """.trimIndent(),
+        metrics.flatMap { m -> m.data.map { m to it } },
+    ) { stmt, (m, s) ->
+        stmt.setTimestamp(1, timestamp(s.date ?: s.startDate) ?: return@batch false)
+        stmt.setString(2, m.name)
+        stmt.setString(3, m.units)
+        stmt.setString(4, s.sleepSource ?: s.source ?: "")
+        stmt.setString(5, s.value ?: "")
+        listOf(s.qty, s.min, s.max, s.avg, s.asleep, s.inBed, s.core, s.deep, s.rem, s.awake)
+            .forEachIndexed { i, value -> stmt.setNullableDouble(6 + i, value) }
+        stmt.setTimestamp(16, timestamp(s.sleepStart ?: s.inBedStart))
+        stmt.setTimestamp(17, timestamp(s.sleepEnd ?: s.inBedEnd ?: s.endDate))
+        true
+    }
+
+    private fun storeWorkouts(workouts: List<Workout>): Int = connection.batch(
+        """
+            INSERT INTO workouts (id, name, start, "end", active_energy_qty, active_energy_units, distance_qty,
+                                  distance_units, elevation_up_qty, elevation_up_units)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+            ON CONFLICT (id) DO UPDATE SET
+                name = EXCLUDED.name, start = EXCLUDED.start, "end" = EXCLUDED."end",
+                active_energy_qty = EXCLUDED.active_energy_qty, active_energy_units = EXCLUDED.active_energy_units,
+                distance_qty = EXCLUDED.distance_qty, distance_units = EXCLUDED.distance_units,
+                elevation_up_qty = EXCLUDED.elevation_up_qty, elevation_up_units = EXCLUDED.elevation_up_units
+        """.trimIndent(),
+        workouts,
+    ) { stmt, w ->
+        val id = w.id ?: return@batch false
+        stmt.setObject(1, uuid(id))
+        stmt.setString(2, w.name ?: "")
+        stmt.setTimestamp(3, timestamp(w.start) ?: return@batch false)
+        stmt.setTimestamp(4, timestamp(w.end) ?: return@batch false)
+        stmt.setNullableDouble(5, w.activeEnergyBurned?.total())
+        stmt.setString(6, w.activeEnergyBurned?.units ?: "")
+        stmt.setNullableDouble(7, w.distance?.total())
+        stmt.setString(8, w.distance?.units ?: "")
+        stmt.setNullableDouble(9, w.elevationUp?.total())
+        stmt.setString(10, w.elevationUp?.units ?: "")
+        true
+    }
+
+    private fun storeRoutes(workouts: List<Workout>): Int = connection.batch(
+        """
+            INSERT INTO workout_routes (workout_id, timestamp, latitude, longitude, altitude, speed, course)
+            VALUES (?, ?, ?, ?, ?, ?, ?)
+            ON CONFLICT (workout_id, timestamp) DO UPDATE SET
+                latitude = EXCLUDED.latitude, longitude = EXCLUDED.longitude, altitude = EXCLUDED.altitude,
+                speed = EXCLUDED.speed, course = EXCLUDED.course
+        """.trimIndent(),
+        workouts.filter { it.id != null }.flatMap { w -> w.route.map { w.id!! to it } },
+    ) { stmt, (id, r) ->
+        stmt.setObject(1, uuid(id))
+        stmt.setTimestamp(2, timestamp(r.timestamp) ?: return@batch false)
+        stmt.setNullableDouble(3, r.latitude)
+        stmt.setNullableDouble(4, r.longitude)
+        stmt.setNullableDouble(5, r.altitude)
+        stmt.setNullableDouble(6, r.speed)
+        stmt.setNullableDouble(7, r.course)
+        true
+    }
+
+    private fun storeHeartRate(workouts: List<Workout>): Int = connection.batch(
+        """
+            INSERT INTO workout_heart_rate_data (workout_id, timestamp, min, avg, max, units, source)
+            VALUES (?, ?, ?, ?, ?, ?, ?)
+            ON CONFLICT (workout_id, timestamp) DO UPDATE SET
+                min = EXCLUDED.min, avg = EXCLUDED.avg, max = EXCLUDED.max, units = EXCLUDED.units, source = EXCLUDED.source
+        """.trimIndent(),
+        workouts.filter { it.id != null }.flatMap { w -> w.heartRateData.map { w.id!! to it } },
+    ) { stmt, (id, h) ->
+        stmt.setObject(1, uuid(id))
+        stmt.setTimestamp(2, timestamp(h.date) ?: return@batch false)
+        stmt.setNullableDouble(3, h.min)
+        stmt.setNullableDouble(4, h.avg)
+        stmt.setNullableDouble(5, h.max)
+        stmt.setString(6, h.units ?: "")
+        stmt.setString(7, h.source ?: "")
+        true
+    }
+
+    private fun storeStateOfMind(entries: List<StateOfMind>): Int = connection.batch(
+        """
+            INSERT INTO state_of_mind (id, start, "end", kind, valence, valence_classification, labels, associations)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+            ON CONFLICT (id, start) DO UPDATE SET
+                "end" = EXCLUDED."end", kind = EXCLUDED.kind, valence = EXCLUDED.valence,
+                valence_classification = EXCLUDED.valence_classification,
+                labels = EXCLUDED.labels, associations = EXCLUDED.associations
+        """.trimIndent(),
+        entries,
+    ) { stmt, s ->
+        val id = s.id ?: return@batch false
+        stmt.setString(1, id)
+        stmt.setTimestamp(2, timestamp(s.start) ?: return@batch false)
+        stmt.setTimestamp(3, timestamp(s.end))
+        stmt.setString(4, s.kind ?: "")
+        stmt.setNullableDouble(5, s.valence)
+        stmt.setString(6, s.valenceClassification ?: "")
+        stmt.setArray(7, connection.createArrayOf("text", s.labels.toTypedArray()))
+        stmt.setArray(8, connection.createArrayOf("text", s.associations.toTypedArray()))
+        true
+    }
+
+
+    /** Auto Export sends UUIDs; ids of other sources are turned into one. */
+    private fun uuid(id: String): UUID =
+        runCatching { UUID.fromString(id) }.getOrElse { UUID.nameUUIDFromBytes(id.toByteArray()) }
+
+    /** Null for a missing timestamp or one that does not parse. */
+    private fun timestamp(value: String?): Timestamp? = Timestamps.parseOrNull(value)?.let { Timestamp.from(it) }
+
+
+    override fun close() = connection.close()
+
+    companion object {
+        private const val VALID_TIMEOUT_SECONDS = 5
+
+        /** Tables partitioned by time with TimescaleDB; their primary keys contain the time column as it requires. */
+        private val HYPERTABLES = mapOf(
+            "metrics" to "timestamp",
+            "workout_routes" to "timestamp",
+            "workout_heart_rate_data" to "timestamp",
+        )
+
+        /** Reads `POSTGRES_URL`, e.g. `jdbc:postgresql://localhost/health`, `POSTGRES_USER` and `POSTGRES_PASSWORD`. */
+        fun fromEnv(): PostgresMetricStore? {
+            val url = Env.get("POSTGRES_URL") ?: return null
+            return PostgresMetricStore(url, Env.get("POSTGRES_USER"), Env.get("POSTGRES_PASSWORD"))
+        }
+    }
+}
@@ -0,0 +1,28 @@
+package me.centralhardware.healthImportServer.storage
+
+import me.centralhardware.healthImportServer.Env
+
+/**
+ * Credentials and endpoint for `s3://` targets; without credentials the
+ * AWS defaults of the environment are used.
+ */
+data class S3Settings(
+    val accessKeyId: String? = null,
+    val secretAccessKey: String? = null,
+    val region: String? = null,
+    /** For S3-compatible storage such as MinIO, e.g. `http://minio:9000`. */
+    val endpoint: String? = null,
+    /** `path` for most S3-compatible storage, `vhost` for AWS. */
+    val urlStyle: String? = null,
+) {
+    companion object {
+        /** Reads `S3_ACCESS_KEY_ID`, `S3_SECRET_ACCESS_KEY`, `S3_REGION`, `S3_ENDPOINT` and `S3_URL_STYLE`. */
+        fun fromEnv() = S3Settings(
+            accessKeyId = Env.get("S3_ACCESS_KEY_ID"),
+            secretAccessKey = Env.get("S3_SECRET_ACCESS_KEY"),
+            region = Env.get("S3_REGION"),
+            endpoint = Env.get("S3_ENDPOINT"),
+            urlStyle = Env.get("S3_URL_STYLE"),
+        )
+    }
+}
@@ -0,0 +1,270 @@
+package me.centralhardware.healthImportServer.storage
+
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.request.ECG
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.Timestamps
+import me.centralhardware.healthImportServer.request.Workout
+import org.slf4j.LoggerFactory
+import java.sql.Connection
+import java.sql.DriverManager
+
+/**
+ * Stores uploads in an SQLite file, for a Raspberry Pi or similar machine
+ * without a database server. The schema is created on first start.
+ * Timestamps are stored as ISO 8601 text in UTC, which sorts in time order
+ * and works with SQLite's date functions. A metric sample with the
+ * timestamp and name of a stored one replaces it, as do workouts and ECG
+ * recordings with a stored id.
+
+ */
+class SqliteMetricStore(path: String) : ExportStore, WorkoutStore, EcgStore, AutoCloseable {
+    val log = LoggerFactory.getLogger(SqliteMetricStore::class.java)
+    private val connection: Connection = DriverManager.getConnection("jdbc:sqlite:$path")
+
+    init {
+        connection.createStatement().use { stmt ->
+            // WAL lets health checks read while an upload is written, and survives power loss on SD cards better.
+            stmt.execute("PRAGMA journal_mode = WAL")
+            SCHEMA.forEach { stmt.execute(it) }
+        }
+        log.info("Storing uploads in $path")
+    }
+
+    @Synchronized
+    override fun ping() {
+        connection.createStatement().use { it.execute("SELECT 1") }
+    }
+
+    /** Writes [export] in one transaction and returns the rows written per table. */
+    @Synchronized
+    override fun store(export: Export): Map<String, Int> {
+        connection.autoCommit = false
+        try {
+            val rows = super.store(export)
+            connection.commit()
+            return rows
+        } catch (e: Exception) {
+            connection.rollback()
+            throw e
+        } finally {
+            connection.autoCommit = true
+        }
+    }
+
+    @Synchronized
+    override fun writeMetrics(metrics: List<Metric>): Map<String, Int> = mapOf("metrics" to storeMetrics(metrics))
+
+    @Synchronized
+    override fun writeWorkouts(workouts: List<Workout>): Map<String, Int> = linkedMapOf(
+        "workouts" to storeWorkouts(workouts),
+        "workout_routes" to storeRoutes(workouts),
+        "workout_heart_rate_data" to storeHeartRate(workouts),
+    )
+
+    @Synchronized
+    override fun writeEcg(ecg: List<ECG>): Map<String, Int> = mapOf("ecg" to storeEcg(ecg))
+
+    private fun storeMetrics(metrics: List<Metric>): Int = connection.batch(
+        """
+            INSERT INTO metrics (timestamp, metric_name, metric_unit, source, category, qty, min, max, avg,
+                                 asleep, in_bed, core, deep, rem, awake, sleep_start, sleep_end)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+            ON CONFLICT (timestamp, metric_name) DO UPDATE SET
+                metric_unit = excluded.metric_unit, source = excluded.source, category = excluded.category,
+                qty = excluded.qty, min = excluded.min, max = excluded.max, avg = excluded.avg,
+                asleep = excluded.asleep, in_bed = excluded.in_bed, core = excluded.core, deep = excluded.deep,
+                rem = excluded.rem, awake = excluded.awake,
+                sleep_start = excluded.sleep_start, sleep_end = excluded.sleep_end
+        """.trimIndent(),
+        metrics.flatMap { m -> m.data.map { m to it } },
+    ) { stmt, (m, s) ->
+        val ts = s.date ?: s.startDate ?: return@batch false
+        stmt.setString(1, timestamp(ts))
+        stmt.setString(2, m.name)
+        stmt.setString(3, m.units)
+        stmt.setString(4, s.sleepSource ?: s.source ?: "")
+        stmt.setString(5, s.value ?: "")
+        listOf(s.qty, s.min, s.max, s.avg, s.asleep, s.inBed, s.core, s.deep, s.rem, s.awake)
+            .forEachIndexed { i, value -> stmt.setNullableDouble(6 + i, value) }
+        stmt.setString(16, (s.sleepStart ?: s.inBedStart)?.let { timestamp(it) })
+        stmt.setString(17, (s.sleepEnd ?: s.inBedEnd ?: s.endDate)?.let { timestamp(it) })
+        true
+    }
+
+    private fun storeWorkouts(workouts: List<Workout>): Int = connection.batch(
+        """
+            INSERT INTO workouts (id, name, start, "end", active_energy_qty, active_energy_units, distance_qty,
+                                  distance_units, elevation_up_qty, elevation_up_units)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+            ON CONFLICT (id) DO UPDATE SET
+                name = excluded.name, start = excluded.start, "end" = excluded."end",
+                active_energy_qty = excluded.active_energy_qty, active_energy_units = excluded.active_energy_units,
+                distance_qty = excluded.distance_qty, distance_units = excluded.distance_units,
+                elevation_up_qty = excluded.elevation_up_qty, elevation_up_units = excluded.elevation_up_units
+        """.trimIndent(),
+        workouts,
+    ) { stmt, w ->
+        stmt.setString(1, w.id ?: return@batch false)
+        stmt.setString(2, w.name ?: "")
+        stmt.setString(3, timestamp(w.start ?: return@batch false))
+        stmt.setString(4, timestamp(w.end ?: return@batch false))
+        stmt.setNullableDouble(5, w.activeEnergyBurned?.total())
+        stmt.setString(6, w.activeEnergyBurned?.units ?: "")
+        stmt.setNullableDouble(7, w.distance?.total())
+        stmt.setString(8, w.distance?.units ?: "")
+        stmt.setNullableDouble(9, w.elevationUp?.total())
+        stmt.setString(10, w.elevationUp?.units ?: "")
+        true
+    }
+
+    private fun storeRoutes(workouts: List<Workout>): Int = connection.batch(
+        """
+            INSERT OR REPLACE INTO workout_routes (workout_id, timestamp, latitude, longitude, altitude, speed, course)
+            VALUES (?, ?, ?, ?, ?, ?, ?)
+        """.trimIndent(),
+        workouts.filter { it.id != null }.flatMap { w -> w.route.map { w.id!! to it } },
+    ) { stmt, (id, r) ->
+        stmt.setString(1, id)
+        stmt.setString(2, timestamp(r.timestamp ?: return@batch false))
+        stmt.setNullableDouble(3, r.latitude)
+        stmt.setNullableDouble(4, r.longitude)
+        stmt.setNullableDouble(5, r.altitude)
+        stmt.setNullableDouble(6, r.speed)
+        stmt.setNullableDouble(7, r.course)
+        true
+    }
+
+    private fun storeHeartRate(workouts: List<Workout>): Int = connection.batch(
+        """
+            INSERT OR REPLACE INTO workout_heart_rate_data (workout_id, timestamp, min, avg, max, units, source)
+            VALUES (?, ?, ?, ?, ?, ?, ?)
+        """.trimIndent(),
+        workouts.filter { it.id != null }.flatMap { w -> w.heartRateData.map { w.id!! to it } },
+    ) { stmt, (id, h) ->
+        stmt.setString(1, id)
+        stmt.setString(2, timestamp(h.date ?: return@batch false))
+        stmt.setNullableDouble(3, h.min)
+        stmt.setNullableDouble(4, h.avg)
+        stmt.setNullableDouble(5, h.max)
+        stmt.setString(6, h.units ?: "")
+        stmt.setString(7, h.source ?: "")
+        true
+    }
+
+    /** Stores each recording as one row, its voltages as JSON arrays like `ecg_waveform` in ClickHouse. */
+    private fun storeEcg(ecg: List<ECG>): Int = connection.batch(
+        """
+            INSERT OR REPLACE INTO ecg (id, classification, source, average_heart_rate, start, "end",
+                                        sampling_frequency, units, offsets, voltages)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        """.trimIndent(),
+        ecg,
+    ) { stmt, e ->
+        val start = e.start ?: return@batch false
+        val end = e.end ?: return@batch false
+        val points = e.voltageMeasurements.filter { it.date != null && it.voltage != null }
+        val first = points.firstOrNull()?.date ?: 0.0
+        stmt.setString(1, ClickHouseMetricStore.ecgId(e))
+        stmt.setString(2, e.classification ?: "")
+        stmt.setString(3, e.source ?: "")
+        stmt.setNullableDouble(4, e.averageHeartRate)
+        stmt.setString(5, timestamp(start))
+        stmt.setString(6, timestamp(end))
+        stmt.setInt(7, e.samplingFrequency ?: 0)
+        stmt.setString(8, points.firstNotNullOfOrNull { it.units } ?: "")
+        stmt.setString(9, points.joinToString(",", "[", "]") { (it.date!! - first).toString() })
+        stmt.setString(10, points.joinToString(",", "[", "]") { it.voltage!!.toString() })
+        true
+    }
+
+
+    private fun timestamp(value: String): String = Timestamps.parse(value).toString()
+
+
+    override fun close() = connection.close()
+
+    companion object {
+        private val SCHEMA = listOf(
+            """
+                CREATE TABLE IF NOT EXISTS metrics (
+                    timestamp TEXT NOT NULL,
+                    metric_name TEXT NOT NULL,
+                    metric_unit TEXT NOT NULL,
+                    source TEXT NOT NULL DEFAULT '',
+                    category TEXT NOT NULL DEFAULT '',
+                    qty REAL,
+                    min REAL,
+                    max REAL,
+                    avg REAL,
+                    asleep REAL,
+                    in_bed REAL,
+                    core REAL,
+                    deep REAL,
+                    rem REAL,
+                    awake REAL,
+                    sleep_start TEXT,
+                    sleep_end TEXT,
+                    PRIMARY KEY (timestamp, metric_name)
+                ) WITHOUT ROWID
+            """,
+            "CREATE INDEX IF NOT EXISTS metrics_by_name ON metrics (metric_name, timestamp)",
+            """
+                CREATE TABLE IF NOT EXISTS workouts (
+                    id TEXT PRIMARY KEY,
+                    name TEXT NOT NULL,
+                    start TEXT NOT NULL,
+                    "end" TEXT NOT NULL,
+                    active_energy_qty REAL,
+                    active_energy_units TEXT NOT NULL DEFAULT '',
+                    distance_qty REAL,
+                    distance_units TEXT NOT NULL DEFAULT '',
+                    elevation_up_qty REAL,
+                    elevation_up_units TEXT NOT NULL DEFAULT ''
+                )
+            """,
+            """
+                CREATE TABLE IF NOT EXISTS workout_routes (
+                    workout_id TEXT NOT NULL,
+                    timestamp TEXT NOT NULL,
+                    latitude REAL,
+                    longitude REAL,
+                    altitude REAL,
+                    speed REAL,
+                    course REAL,
+                    PRIMARY KEY (workout_id, timestamp)
+                ) WITHOUT ROWID
+            """,
+            """
+                CREATE TABLE IF NOT EXISTS workout_heart_rate_data (
+                    workout_id TEXT NOT NULL,
+                    timestamp TEXT NOT NULL,
+                    min REAL,
+                    avg REAL,
+                    max REAL,
+                    units TEXT NOT NULL DEFAULT '',
+                    source TEXT NOT NULL DEFAULT '',
+                    PRIMARY KEY (workout_id, timestamp)
+                ) WITHOUT ROWID
+            """,
+            """
+                CREATE TABLE IF NOT EXISTS ecg (
+                    id TEXT PRIMARY KEY,
+                    classification TEXT NOT NULL DEFAULT '',
+                    source TEXT NOT NULL DEFAULT '',
+                    average_heart_rate REAL,
+                    start TEXT NOT NULL,
+                    "end" TEXT NOT NULL,
+                    sampling_frequency INTEGER NOT NULL DEFAULT 0,
+                    units TEXT NOT NULL DEFAULT '',
+                    offsets TEXT NOT NULL DEFAULT '[]',
+                    voltages TEXT NOT NULL DEFAULT '[]'
+                )
+            """,
+        ).map { it.trimIndent() }
+
+        /** Reads `SQLITE_PATH`, the database file, e.g. `/data/health.db`. */
+        fun fromEnv(): SqliteMetricStore? = Env.get("SQLITE_PATH")?.let { SqliteMetricStore(it) }
+    }
+}
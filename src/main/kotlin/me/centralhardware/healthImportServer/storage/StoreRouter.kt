@@ -0,0 +1,176 @@
+package me.centralhardware.healthImportServer.storage
+
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.request.ECG
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.StateOfMind
+import me.centralhardware.healthImportServer.request.Workout
+import org.slf4j.LoggerFactory
+
+/**
+ * Further named stores next to the main ClickHouse store, and which
+ * sections of a payload go to which of them. The main store is named
+ * [MAIN] and keeps serving the query API; sections without a route go to
+ * every store that can store them, the main one included. A store with a [MetricFilter] in
+ * [filters] only gets the metrics it accepts.
+ *
+ * The other stores get every chunk after it was written to the main store.
+ * A store that fails is logged and does not fail the upload, the data is in
+ * the main store already.
+ */
+class StoreRouter(
+    private val stores: Map<String, ExportStore>,
+    private val routes: Map<String, Set<String>> = emptyMap(),
+    private val filters: Map<String, MetricFilter> = emptyMap(),
+) {
+    val log = LoggerFactory.getLogger(StoreRouter::class.java)
+
+    init {
+        val unknownSections = routes.keys - SECTIONS
+        require(unknownSections.isEmpty()) { "Unknown sections ${unknownSections.joinToString()}, expected ${SECTIONS.joinToString()}" }
+        val unknownStores = routes.values.flatten().toSet() - stores.keys - MAIN
+        require(unknownStores.isEmpty()) { "Routes name unknown stores ${unknownStores.joinToString()}" }
+        require(MAIN !in stores) { "The store name $MAIN is taken by the main ClickHouse store" }
+        val unfiltered = filters.keys - stores.keys - MAIN
+        require(unfiltered.isEmpty()) { "Metric filters name unknown stores ${unfiltered.joinToString()}" }
+        for ((section, names) in routes) {
+            val unable = names.filter { name -> stores[name]?.let { section !in it.sections() } ?: false }
+            require(unable.isEmpty()) { "Section $section is routed to ${unable.joinToString()}, which cannot store it" }
+        }
+    }
+
+    /** The sections and metrics of [export] routed to [store] that it can store. */
+    fun select(store: String, export: Export): Export {
+        val metrics = filters[store]?.filter(export.metrics) ?: export.metrics
+        val sections = stores[store]?.sections() ?: SECTIONS
+        fun routed(section: String) = section in sections && (routes[section]?.contains(store) ?: true)
+        return Export(
+            metrics = if (routed("metrics")) metrics else emptyList(),
+            workouts = if (routed("workouts")) export.workouts else emptyList(),
+            stateOfMind = if (routed("state_of_mind")) export.stateOfMind else emptyList(),
+            ecg = if (routed("ecg")) export.ecg else emptyList(),
+        )
+    }
+
+    /** Writes the routed sections of [export] to each of the other stores and returns how long each took or that it failed. */
+    fun store(export: Export): Routed {
+        val millis = linkedMapOf<String, Long>()
+        val failed = mutableSetOf<String>()
+        for ((name, store) in stores) {
+            val selected = select(name, export)
+            if (selected.metrics.isEmpty() && selected.workouts.isEmpty() && selected.stateOfMind.isEmpty() && selected.ecg.isEmpty()) {
+                continue
+            }
+            val started = System.nanoTime()
+            try {
+                val written = store.store(selected)
+                log.info("Stored ${written.entries.joinToString { (table, count) -> "$count in $table" }} in store $name")
+                millis[name] = (System.nanoTime() - started) / 1_000_000
+            } catch (e: Exception) {
+                log.error("Failed to write a chunk to store $name", e)
+                failed += name
+            }
+        }
+        return Routed(millis, failed)
+    }
+
+    /** The milliseconds spent writing per store that took its part of a chunk, and the stores that failed to. */
+    data class Routed(val millis: Map<String, Long>, val failed: Set<String>)
+
+    /** Returns why a store is unhealthy per store name; empty if all are healthy. */
+    fun ping(): Map<String, String> = stores.mapNotNull { (name, store) ->
+        runCatching { store.ping() }.exceptionOrNull()?.let { name to (it.message ?: it.javaClass.simpleName) }
+    }.toMap()
+
+    companion object {
+        const val MAIN = "main"
+        val SECTIONS = setOf("metrics", "workouts", "state_of_mind", "ecg")
+
+        /**
+         * Reads `STORES`, `name=type` pairs such as
+         * `replica=clickhouse,archive=parquet`, and `STORE_ROUTES`,
+         * `section=store+store` pairs such as `metrics=main+replica,ecg=archive`.
+         * A store reads the settings of its type, each of them overridden by
+         * `STORE_<NAME>_<SETTING>`, e.g. `STORE_REPLICA_CLICKHOUSE_DATABASE`;
+         * the setting naming where it writes, e.g. `STORE_REPLICA_CLICKHOUSE_DSN`,
+         * must be set that way, so a store never writes to the main one. It
+         * takes the metrics of `STORE_<NAME>_METRICS` but not those of
+         * `STORE_<NAME>_EXCLUDE_METRICS`; `STORE_MAIN_METRICS` and
+         * `STORE_MAIN_EXCLUDE_METRICS` filter the main store. `STORES` and
+         * `STORE_ROUTES` of the config file and the environment are merged,
+         * the environment winning for a store or section named in both.
+         * Returns null if none of this is set.
+         */
+        fun fromEnv(clickHouse: () -> ClickHouseMetricStore): StoreRouter? {
+            val declared = pairs("STORES")
+            val filters = (declared.keys + MAIN).mapNotNull { name ->
+                val prefix = "STORE_${name.uppercase()}_"
+                MetricFilter.fromEnv("${prefix}METRICS", "${prefix}EXCLUDE_METRICS")?.let { name to it }
+            }.toMap()
+            if (declared.isEmpty() && filters.isEmpty()) return null
+            val stores = declared.mapValues { (name, type) ->
+                Env.scoped("STORE_${name.uppercase()}_") { create(name, type, clickHouse) }
+            }
+            val routes = pairs("STORE_ROUTES")
+                .mapValues { (_, names) -> names.split('+').map { it.trim() }.filter { it.isNotEmpty() }.toSet() }
+            return StoreRouter(stores, routes, filters)
+        }
+
+        private fun pairs(setting: String): Map<String, String> =
+            Env.layers(setting).fold(emptyMap()) { merged, value -> merged + ClickHouseConfig.parsePairs(value) }
+
+        /** The setting of each store type that names where it writes. */
+        private val TARGETS = linkedMapOf(
+            "clickhouse" to "CLICKHOUSE_DSN",
+            "postgres" to "POSTGRES_URL",
+            "sqlite" to "SQLITE_PATH",
+            "parquet" to "PARQUET_TARGET",
+            "kafka" to "KAFKA_BOOTSTRAP_SERVERS",
+            "victoriametrics" to "VICTORIAMETRICS_URL",
+            "jsonl" to "JSONL_DIR",
+        )
+
+        private fun create(name: String, type: String, clickHouse: () -> ClickHouseMetricStore): ExportStore {
+            val target = TARGETS[type] ?: error("Unknown type '$type' of store $name, expected ${TARGETS.keys.joinToString()}")
+            // Not falling back to the unprefixed setting, which configures the server itself.
+            val setting = "STORE_${name.uppercase()}_$target"
+            requireNotNull(Env.get(setting)) { "Store $name needs $setting" }
+            val store = when (type) {
+                "clickhouse" -> ClickHouseExportStore(clickHouse())
+                "postgres" -> PostgresMetricStore.fromEnv()
+                "sqlite" -> SqliteMetricStore.fromEnv()
+                "parquet" -> ParquetArchive.fromEnv()
+                "kafka" -> KafkaPublisher.fromEnv()
+                "victoriametrics" -> VictoriaMetricsStore.fromEnv()
+                else -> JsonlStore.fromEnv()
+            }
+            return store ?: error("Store $name is disabled by its settings")
+        }
+    }
+}
+
+/** Another ClickHouse database, written like the main store but never read from. */
+class ClickHouseExportStore(private val store: ClickHouseMetricStore) :
+    ExportStore, WorkoutStore, StateOfMindStore, EcgStore {
+    /** Writes all sections at once, so they are inserted in parallel like in the main store. */
+    override fun store(export: Export): Map<String, Int> {
+        store.storeAll(export)
+        return linkedMapOf(
+            "metrics" to export.totalSamples(),
+            "workouts" to export.workouts.size,
+            "state_of_mind" to export.stateOfMind.size,
+            "ecg" to export.ecg.size,
+        ).filterValues { it > 0 }
+    }
+
+    override fun writeMetrics(metrics: List<Metric>): Map<String, Int> = store(Export(metrics = metrics))
+
+    override fun writeWorkouts(workouts: List<Workout>): Map<String, Int> = store(Export(workouts = workouts))
+
+    override fun writeStateOfMind(entries: List<StateOfMind>): Map<String, Int> = store(Export(stateOfMind = entries))
+
+    override fun writeEcg(ecg: List<ECG>): Map<String, Int> = store(Export(ecg = ecg))
+
+    override fun ping() = store.ping()
+}
@@ -0,0 +1,122 @@
+package me.centralhardware.healthImportServer.storage
+
+import kotlinx.serialization.json.Json
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.api.UploadSignature
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.ExportWrapper
+import me.centralhardware.healthImportServer.transform.PayloadTransform
+import me.centralhardware.healthImportServer.transform.applyAll
+import org.slf4j.LoggerFactory
+import java.io.ByteArrayOutputStream
+import java.io.IOException
+import java.net.URI
+import java.net.http.HttpClient
+import java.net.http.HttpRequest
+import java.net.http.HttpResponse
+import java.time.Duration
+import java.time.Instant
+import java.util.zip.GZIPOutputStream
+
+/**
+ * Forwards uploads to another server, e.g. from a home instance to one in
+ * the cloud, keeping only the selected [sections] and the metrics [metrics]
+ * accepts, after [transforms]. The payload is sent in the Auto Export
+ * schema, so the receiving end can be another instance of this server or
+ * anything else that takes Auto Export uploads. An upload with nothing left
+ * to send is not forwarded.
+ */
+class UpstreamForwarder(
+    private val url: String,
+    private val sections: Set<String> = SECTIONS,
+    private val metrics: MetricFilter = MetricFilter(),
+    private val transforms: List<PayloadTransform> = emptyList(),
+    private val token: String? = null,
+    private val signature: UploadSignature? = null,
+    private val gzip: Boolean = false,
+) {
+    val log = LoggerFactory.getLogger(UpstreamForwarder::class.java)
+    private val client = HttpClient.newBuilder().connectTimeout(Duration.ofSeconds(10)).build()
+
+    init {
+        val unknown = sections - SECTIONS
+        require(unknown.isEmpty()) { "Unknown sections ${unknown.joinToString()}, expected ${SECTIONS.joinToString()}" }
+    }
+
+    /** The part of [export] that is forwarded. */
+    private fun select(export: Export): Export {
+        val transformed = transforms.applyAll(export)
+        return Export(
+            metrics = if ("metrics" in sections) metrics.filter(transformed.populatedMetrics()) else emptyList(),
+            workouts = if ("workouts" in sections) transformed.workouts else emptyList(),
+            stateOfMind = if ("state_of_mind" in sections) transformed.stateOfMind else emptyList(),
+            ecg = if ("ecg" in sections) transformed.ecg else emptyList(),
+        )
+    }
+
+    /** Forwards the selected part of [export] and returns it, failing unless the upstream accepted it. */
+    fun forward(export: Export): Export {
+        val selected = select(export)
+        if (selected.metrics.isEmpty() && selected.workouts.isEmpty() && selected.stateOfMind.isEmpty() && selected.ecg.isEmpty()) {
+            return selected
+        }
+        val payload = json.encodeToString(ExportWrapper.serializer(), ExportWrapper(selected)).toByteArray()
+        val body = if (!gzip) payload else ByteArrayOutputStream().also { out -> GZIPOutputStream(out).use { it.write(payload) } }.toByteArray()
+        val timestamp = Instant.now().epochSecond.toString()
+        val request = HttpRequest.newBuilder(URI(url))
+            .timeout(Duration.ofMinutes(5))
+            .header("Content-Type", "application/json")
+            .apply { if (gzip) header("Content-Encoding", "gzip") }
+            .apply { token?.let { header("Authorization", "Bearer $it") } }
+            .apply {
+                signature?.let {
+                    header(UploadSignature.TIMESTAMP_HEADER, timestamp)
+                    header(UploadSignature.SIGNATURE_HEADER, it.sign(timestamp, body))
+                }
+            }
+            .POST(HttpRequest.BodyPublishers.ofByteArray(body))
+            .build()
+        val response = client.send(request, HttpResponse.BodyHandlers.ofString())
+        if (response.statusCode() !in 200..299) {
+            throw IOException("$url answered HTTP ${response.statusCode()}: ${response.body().take(500)}")
+        }
+        log.info("Forwarded ${selected.totalSamples()} samples, ${selected.workouts.size} workouts to $url")
+        return selected
+    }
+
+    /** Fails unless the upstream can be reached; any HTTP answer counts. */
+    fun ping() {
+        val request = HttpRequest.newBuilder(URI(url))
+            .timeout(Duration.ofSeconds(10))
+            .method("HEAD", HttpRequest.BodyPublishers.noBody())
+            .build()
+        client.send(request, HttpResponse.BodyHandlers.discarding())
+    }
+
+    companion object {
+        val SECTIONS = setOf("metrics", "workouts", "state_of_mind", "ecg")
+        private val json = Json { explicitNulls = false }
+
+        /**
+         * Reads `PROXY_URL`, the upload endpoint to forward to, e.g.
+         * `https://health.example.com/upload`, `PROXY_SECTIONS` (default all
+         * of [SECTIONS]), `PROXY_METRICS` and `PROXY_EXCLUDE_METRICS` for a
+         * [MetricFilter], `PROXY_TOKEN`, a bearer token,
+         * `PROXY_SIGNING_KEY` to sign requests like `UPLOAD_SIGNING_KEY`
+         * expects, and `PROXY_GZIP` (default false).
+         */
+        fun fromEnv(transforms: List<PayloadTransform>): UpstreamForwarder? {
+            val url = Env.get("PROXY_URL") ?: return null
+            fun list(name: String) = Env.get(name)?.split(',')?.map { it.trim() }?.filter { it.isNotEmpty() } ?: emptyList()
+            return UpstreamForwarder(
+                url = url,
+                sections = list("PROXY_SECTIONS").toSet().ifEmpty { SECTIONS },
+                metrics = MetricFilter.fromEnv("PROXY_METRICS", "PROXY_EXCLUDE_METRICS") ?: MetricFilter(),
+                transforms = transforms,
+                token = Env.get("PROXY_TOKEN"),
+                signature = Env.get("PROXY_SIGNING_KEY")?.let { UploadSignature(it, Duration.ZERO) },
+                gzip = Env.get("PROXY_GZIP").toBoolean(),
+            )
+        }
+    }
+}
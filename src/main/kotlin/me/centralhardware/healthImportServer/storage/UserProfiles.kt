@@ -0,0 +1,108 @@
+package me.centralhardware.healthImportServer.storage
+
+import kotlinx.coroutines.delay
+import kotlinx.serialization.Serializable
+import me.centralhardware.healthImportServer.analytics.HeartRateZones
+import org.slf4j.LoggerFactory
+import java.time.Duration
+import java.time.ZoneId
+
+/**
+ * Settings of one person that override those of the environment: heart
+ * rate zones for workouts, the units of reports, the time zone of days, how
+ * long samples are kept and where notifications go.
+ */
+@Serializable
+data class UserProfile(
+    val user: String = UserProfiles.DEFAULT_USER,
+    /** Lower bounds of zones 2 to 5 in bpm; empty for those of `HR_ZONES`. */
+    val heartRateZones: List<Double> = emptyList(),
+    /** `metric` or `imperial`. */
+    val units: String = "metric",
+    /** Time zone of days, e.g. `Europe/Berlin`; null for `DAY_TIMEZONE`. */
+    val timezone: String? = null,
+    /** Days samples are kept; null keeps them forever. */
+    val retentionDays: Int? = null,
+    /** Webhook URLs notifications are posted to; empty for `NOTIFY_WEBHOOK_URL`. */
+    val notificationTargets: List<String> = emptyList(),
+) {
+    init {
+        require(user.isNotBlank()) { "A profile needs a user" }
+        if (heartRateZones.isNotEmpty()) HeartRateZones(heartRateZones)
+        require(units in UNITS) { "Units must be one of ${UNITS.joinToString()}, got '$units'" }
+        timezone?.let { ZoneId.of(it) }
+        require(retentionDays == null || retentionDays > 0) { "Retention must be at least one day" }
+        notificationTargets.forEach { target ->
+            require(target.startsWith("https://") || target.startsWith("http://")) { "Notification target $target is not an http(s) URL" }
+        }
+    }
+
+    fun zones(): HeartRateZones? = heartRateZones.takeIf { it.isNotEmpty() }?.let(::HeartRateZones)
+
+    fun zone(): ZoneId? = timezone?.let(ZoneId::of)
+
+    companion object {
+        val UNITS = setOf("metric", "imperial")
+    }
+}
+
+/**
+ * Profiles of the `user_profiles` table, read again every [refresh] like
+ * the stored API tokens. The server keeps the data of one person, whose
+ * settings are those of the [DEFAULT_USER] profile; profiles of other users
+ * are kept for when uploads carry a user.
+ */
+class UserProfiles(private val load: () -> List<UserProfile>, private val refresh: Duration = Duration.ofMinutes(1)) {
+    val log = LoggerFactory.getLogger(UserProfiles::class.java)
+
+    @Volatile private var byUser: Map<String, UserProfile> = emptyMap()
+    @Volatile private var loadedAt: Long? = null
+
+    fun get(user: String): UserProfile? {
+        val loaded = loadedAt
+        if (loaded == null || System.nanoTime() - loaded > refresh.toNanos()) reload()
+        return byUser[user]
+    }
+
+    /** The profile of the person whose data this is, if one was saved. */
+    fun current(): UserProfile? = get(DEFAULT_USER)
+
+    /** Reads the profiles again with the next [get], after one was changed. */
+    fun invalidate() {
+        loadedAt = null
+    }
+
+    private fun reload() {
+        try {
+            byUser = load().associateBy { it.user }
+        } catch (e: Exception) {
+            log.warn("Failed to read user profiles, keeping the ${byUser.size} read before", e)
+        }
+        loadedAt = System.nanoTime()
+    }
+
+    companion object {
+        const val DEFAULT_USER = "default"
+    }
+}
+
+/**
+ * Deletes samples older than the `retentionDays` of the current profile
+ * once a day. Nothing is deleted without a profile or retention.
+ */
+class Retention(private val store: ClickHouseMetricStore, private val interval: Duration = Duration.ofDays(1)) {
+    val log = LoggerFactory.getLogger(Retention::class.java)
+
+    suspend fun run() {
+        while (true) {
+            store.profiles.current()?.retentionDays?.let { days ->
+                try {
+                    store.purgeSamplesBefore(store.days.start(store.days.today().minusDays(days.toLong())))
+                } catch (e: Exception) {
+                    log.error("Failed to delete samples older than $days days", e)
+                }
+            }
+            delay(interval.toMillis())
+        }
+    }
+}
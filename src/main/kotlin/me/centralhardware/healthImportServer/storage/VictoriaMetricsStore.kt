@@ -0,0 +1,151 @@
+package me.centralhardware.healthImportServer.storage
+
+import kotlinx.serialization.Serializable
+import kotlinx.serialization.json.Json
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.Sample
+import me.centralhardware.healthImportServer.request.Timestamps
+import org.slf4j.LoggerFactory
+import java.io.ByteArrayOutputStream
+import java.io.IOException
+import java.net.URI
+import java.net.http.HttpClient
+import java.net.http.HttpRequest
+import java.net.http.HttpResponse
+import java.time.Duration
+import java.util.zip.GZIPOutputStream
+
+/**
+ * Pushes metric samples to VictoriaMetrics through `/api/v1/import`, one
+ * JSON line per series. A series is one value column of one metric, unit
+ * and source, named `<prefix><metric>` with the labels `unit`, `source`
+ * and `field` (`qty`, `avg`, `min`, `max`, or for sleep `asleep`, `deep`,
+ * ...). VictoriaMetrics drops samples of a series with equal timestamps, so
+ * data sent twice is stored once.
+ *
+ * Requests carry at most [batchPoints] points and are retried [retries]
+ * times with a growing delay when VictoriaMetrics cannot be reached or
+ * answers with a server error.
+ */
+class VictoriaMetricsStore(
+    url: String,
+    private val token: String? = null,
+    private val prefix: String = "health_",
+    private val batchPoints: Int = 50_000,
+    private val retries: Int = 3,
+) : ExportStore {
+    val log = LoggerFactory.getLogger(VictoriaMetricsStore::class.java)
+    private val base = url.trimEnd('/')
+    private val client = HttpClient.newBuilder().connectTimeout(Duration.ofSeconds(10)).build()
+
+    @Serializable
+    private data class Line(val metric: Map<String, String>, val values: List<Double>, val timestamps: List<Long>)
+
+    /** Fails unless VictoriaMetrics answers its health check. */
+    override fun ping() {
+        val response = client.send(request("/health").GET().build(), HttpResponse.BodyHandlers.discarding())
+        check(response.statusCode() == 200) { "HTTP ${response.statusCode()}" }
+    }
+
+    /** Pushes the samples of [metrics] and returns the points written per metric. */
+    override fun writeMetrics(metrics: List<Metric>): Map<String, Int> {
+        val points = linkedMapOf<String, Int>()
+        val batch = mutableListOf<Line>()
+        var batchSize = 0
+        for (metric in metrics) {
+            val series = linkedMapOf<Pair<String, String>, MutableList<Pair<Long, Double>>>()
+            for (sample in metric.data) {
+                val time = Timestamps.parseOrNull(sample.date ?: sample.startDate)?.toEpochMilli() ?: continue
+                val source = sample.sleepSource ?: sample.source ?: ""
+                for ((field, value) in fields(sample)) {
+                    series.getOrPut(field to source) { mutableListOf() } += time to value
+                }
+            }
+            for ((key, values) in series) {
+                val (field, source) = key
+                val labels = mapOf("__name__" to prefix + metric.name, "unit" to metric.units, "source" to source, "field" to field)
+                for (chunk in values.chunked(batchPoints)) {
+                    if (batchSize + chunk.size > batchPoints) {
+                        send(batch)
+                        batch.clear()
+                        batchSize = 0
+                    }
+                    batch += Line(labels, chunk.map { it.second }, chunk.map { it.first })
+                    batchSize += chunk.size
+                }
+                points.merge(metric.name, values.size, Int::plus)
+            }
+        }
+        if (batch.isNotEmpty()) send(batch)
+        return points
+    }
+
+    private fun fields(s: Sample): List<Pair<String, Double>> = listOfNotNull(
+        s.qty?.let { "qty" to it },
+        s.avg?.let { "avg" to it },
+        s.min?.let { "min" to it },
+        s.max?.let { "max" to it },
+        s.asleep?.let { "asleep" to it },
+        s.inBed?.let { "in_bed" to it },
+        s.core?.let { "core" to it },
+        s.deep?.let { "deep" to it },
+        s.rem?.let { "rem" to it },
+        s.awake?.let { "awake" to it },
+    )
+
+    private fun send(lines: List<Line>) {
+        val body = ByteArrayOutputStream().also { out ->
+            GZIPOutputStream(out).bufferedWriter().use { writer ->
+                lines.forEach { writer.write(Json.encodeToString(Line.serializer(), it)); writer.write("\n") }
+            }
+        }.toByteArray()
+        val request = request("/api/v1/import")
+            .header("Content-Encoding", "gzip")
+            .POST(HttpRequest.BodyPublishers.ofByteArray(body))
+            .build()
+        var attempt = 0
+        while (true) {
+            val error = try {
+                val response = client.send(request, HttpResponse.BodyHandlers.ofString())
+                when {
+                    response.statusCode() in 200..299 -> return
+                    response.statusCode() < 500 -> throw IllegalStateException("VictoriaMetrics rejected the import: HTTP ${response.statusCode()} ${response.body()}")
+                    else -> IOException("HTTP ${response.statusCode()} ${response.body()}")
+                }
+            } catch (e: IOException) {
+                e
+            }
+            if (attempt++ >= retries) throw IOException("Import to VictoriaMetrics failed after $attempt attempts", error)
+            val delay = RETRY_DELAY.multipliedBy(1L shl (attempt - 1))
+            log.warn("Import to VictoriaMetrics failed (${error.message}), retrying in ${delay.toSeconds()}s")
+            Thread.sleep(delay.toMillis())
+        }
+    }
+
+    private fun request(path: String): HttpRequest.Builder =
+        HttpRequest.newBuilder(URI("$base$path"))
+            .timeout(Duration.ofSeconds(60))
+            .apply { token?.let { header("Authorization", "Bearer $it") } }
+
+    companion object {
+        private val RETRY_DELAY = Duration.ofSeconds(2)
+
+        /**
+         * Reads `VICTORIAMETRICS_URL`, e.g. `http://victoriametrics:8428`,
+         * `VICTORIAMETRICS_TOKEN` for a bearer token, `VICTORIAMETRICS_PREFIX`
+         * (default `health_`), `VICTORIAMETRICS_BATCH_POINTS` (default 50000)
+         * and `VICTORIAMETRICS_RETRIES` (default 3).
+         */
+        fun fromEnv(): VictoriaMetricsStore? {
+            val url = Env.get("VICTORIAMETRICS_URL") ?: return null
+            return VictoriaMetricsStore(
+                url = url,
+                token = Env.get("VICTORIAMETRICS_TOKEN"),
+                prefix = Env.get("VICTORIAMETRICS_PREFIX") ?: "health_",
+                batchPoints = Env.get("VICTORIAMETRICS_BATCH_POINTS")?.toInt() ?: 50_000,
+                retries = Env.get("VICTORIAMETRICS_RETRIES")?.toInt() ?: 3,
+            )
+        }
+    }
+}
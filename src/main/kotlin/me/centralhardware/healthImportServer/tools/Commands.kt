@@ -0,0 +1,35 @@
+package me.centralhardware.healthImportServer.tools
+
+/**
+ * Command line entry point used when the server binary is started with
+ * arguments, e.g. `export --format autoexport --from 2024-01-01` or
+ * `import --format csv --input exports/`.
+ */
+fun runCommand(args: List<String>) {
+    // `token` takes a subcommand before its options.
+    if (args.first() == "token") return TokenCommand.run(args.getOrNull(1), parseOptions(args.drop(2)))
+    val options = parseOptions(args.drop(1))
+    when (args.first()) {
+        "export" -> ExportCommand.run(options)
+        "import" -> ImportCommand.run(options)
+        "ping" -> PingCommand.run(options)
+        "decrypt" -> DecryptCommand.run(options)
+        "tail" -> TailCommand.run(options)
+        "reprocess" -> ReprocessCommand.run(options)
+        else -> error("Unknown command '${args.first()}', expected export, import, ping, decrypt, tail, reprocess or token")
+    }
+}
+
+/** Parses `--name value` pairs; a flag without a value is read as `true`. */
+fun parseOptions(args: List<String>): Map<String, String> {
+    val options = linkedMapOf<String, String>()
+    var i = 0
+    while (i < args.size) {
+        val name = args[i].removePrefix("--")
+        require(name != args[i]) { "Unexpected argument '${args[i]}'" }
+        val value = args.getOrNull(i + 1)?.takeUnless { it.startsWith("--") }
+        options[name] = value ?: "true"
+        i += if (value == null) 1 else 2
+    }
+    return options
+}
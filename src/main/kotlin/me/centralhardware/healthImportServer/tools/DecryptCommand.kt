@@ -0,0 +1,41 @@
+package me.centralhardware.healthImportServer.tools
+
+import io.ktor.http.ContentType
+import me.centralhardware.healthImportServer.EncryptedArchive
+import me.centralhardware.healthImportServer.RequestEncoding
+import me.centralhardware.healthImportServer.UploadFormat
+import org.slf4j.LoggerFactory
+import java.nio.file.Files
+import java.nio.file.Paths
+import kotlin.io.path.extension
+import kotlin.io.path.isDirectory
+import kotlin.io.path.nameWithoutExtension
+
+/**
+ * `decrypt --key <private key> --input <file or directory> [--output <directory>]`
+ * restores payloads archived with `ARCHIVE_PUBLIC_KEY`. Each one is written
+ * with its `Content-Encoding` undone and the extension of its format, so it
+ * can be read with `import` or sent to `/upload` again.
+ */
+object DecryptCommand {
+    val log = LoggerFactory.getLogger(DecryptCommand::class.java)
+
+    fun run(options: Map<String, String>) {
+        val key = EncryptedArchive.privateKey(Files.readString(Paths.get(options["key"] ?: error("--key is required"))))
+        val input = Paths.get(options["input"] ?: error("--input is required"))
+        val output = Paths.get(options["output"] ?: ".")
+        Files.createDirectories(output)
+        val files = if (input.isDirectory()) {
+            Files.walk(input).use { paths -> paths.filter { it.extension == EncryptedArchive.EXTENSION }.sorted().toList() }
+        } else {
+            listOf(input)
+        }
+        for (file in files) {
+            val (envelope, body) = Files.newInputStream(file).use { EncryptedArchive.open(it, key) }
+            val extension = UploadFormat.of(ContentType.parse(envelope.contentType))?.fileExtension ?: "bin"
+            val target = output.resolve("${file.nameWithoutExtension}.$extension")
+            RequestEncoding.decode(body, envelope.contentEncoding).use { Files.copy(it, target) }
+            log.info("Decrypted ${file.fileName} (${envelope.contentType}, received ${envelope.receivedAt}) to $target")
+        }
+    }
+}
@@ -0,0 +1,243 @@
+package me.centralhardware.healthImportServer.tools
+
+import me.centralhardware.healthImportServer.ImportHandler
+import me.centralhardware.healthImportServer.request.ECG
+import me.centralhardware.healthImportServer.request.ECGVoltage
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.GPSLog
+import me.centralhardware.healthImportServer.request.HeartRateLog
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.QtyUnit
+import me.centralhardware.healthImportServer.request.Sample
+import me.centralhardware.healthImportServer.request.StateOfMind
+import me.centralhardware.healthImportServer.request.Timestamps
+import me.centralhardware.healthImportServer.request.Workout
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import org.slf4j.LoggerFactory
+import java.time.DayOfWeek
+import java.time.Instant
+import java.time.LocalDate
+import java.time.ZoneId
+import java.util.UUID
+import kotlin.math.PI
+import kotlin.math.cos
+import kotlin.math.exp
+import kotlin.math.pow
+import kotlin.math.sin
+import kotlin.random.Random
+
+/**
+ * Synthetic health data for `--demo`: heart rate, steps, energy, sleep with
+ * phases, weight, blood oxygen, workouts with routes, moods and ECGs of a
+ * person who does not exist. Every day is generated from a seed derived
+ * from its date, so generating a day again yields the same samples and
+ * seeding is repeatable; today only contains what happened until now.
+ */
+object DemoData {
+    val log = LoggerFactory.getLogger(DemoData::class.java)
+
+    /** Written with every seeding, so a database with demo data can be told apart from one with real data. */
+    const val MARKER_METRIC = "demo_data"
+    private const val WATCH = "Demo Watch"
+    private const val PHONE = "Demo iPhone"
+    private const val LATITUDE = 52.5163
+    private const val LONGITUDE = 13.3777
+
+    /**
+     * Stores the last [days] days up to now through [handler]. Refuses to
+     * write into a database that already holds data other than demo data.
+     */
+    fun seed(store: ClickHouseMetricStore, handler: ImportHandler, days: Int, zone: ZoneId = ZoneId.systemDefault()) {
+        val metrics = store.metricCatalog()
+        if (metrics.none { it.name == MARKER_METRIC }) {
+            val rows = store.sectionRowCounts().filterValues { it > 0 }
+            check(metrics.isEmpty() && rows.isEmpty()) {
+                val found = listOfNotNull(metrics.takeIf { it.isNotEmpty() }?.let { "${it.size} metrics" }) +
+                    rows.map { (table, count) -> "$count rows in $table" }
+                "--demo refuses to write into a database with real data (${found.joinToString()}), point CLICKHOUSE_DATABASE at an empty database"
+            }
+        }
+        val now = Instant.now()
+        val today = LocalDate.now(zone)
+        for (offset in days - 1 downTo 0) {
+            handler.import(day(today.minusDays(offset.toLong()), zone, now))
+        }
+        log.info("Seeded $days day(s) of demo data up to $today")
+    }
+
+    /** Everything recorded on [date] until [until]. */
+    fun day(date: LocalDate, zone: ZoneId, until: Instant): Export {
+        val random = Random(date.toEpochDay())
+        val start = date.atStartOfDay(zone).toInstant()
+        fun at(hours: Double): Instant = start.plusSeconds((hours * 3600).toLong())
+        fun ts(instant: Instant) = Timestamps.format(instant)
+        // Slow trends over weeks, so charts and correlations have something to show.
+        val fitness = sin(date.toEpochDay() * 2 * PI / 60)
+        val stress = cos(date.toEpochDay() * 2 * PI / 17)
+
+        val bedTime = at(-1.0 + random.nextDouble(-0.75, 0.75))
+        val asleep = 7.2 + 0.6 * fitness - 0.4 * stress + random.nextDouble(-0.8, 0.8)
+        val awake = random.nextDouble(0.2, 0.5)
+        val fellAsleep = bedTime.plusSeconds((random.nextDouble(0.1, 0.4) * 3600).toLong())
+        val wokeUp = fellAsleep.plusSeconds(((asleep + awake) * 3600).toLong())
+        val outOfBed = wokeUp.plusSeconds((random.nextDouble(0.05, 0.3) * 3600).toLong())
+        val deep = asleep * random.nextDouble(0.12, 0.18)
+        val rem = asleep * random.nextDouble(0.2, 0.25)
+        val sleep = Sample(
+            date = ts(start),
+            asleep = asleep,
+            inBed = (outOfBed.epochSecond - bedTime.epochSecond) / 3600.0,
+            sleepSource = WATCH,
+            inBedSource = PHONE,
+            sleepStart = ts(fellAsleep),
+            sleepEnd = ts(wokeUp),
+            inBedStart = ts(bedTime),
+            inBedEnd = ts(outOfBed),
+            core = asleep - deep - rem,
+            deep = deep,
+            rem = rem,
+            awake = awake,
+        )
+
+        val workout = if (random.nextDouble() < 0.5) workout(date, at(17.5 + random.nextDouble(0.0, 2.0)), fitness, random) else null
+        val workoutRange = workout?.let { Timestamps.parse(it.start!!)..Timestamps.parse(it.end!!) }
+
+        val resting = 56.0 - 3 * fitness + 2 * stress + random.nextDouble(-1.5, 1.5)
+        val heartRate = (0 until 144).map { i -> at(i / 6.0) }.map { t ->
+            val base = when {
+                t.isBefore(wokeUp) -> resting - 4
+                workoutRange != null && t in workoutRange -> 135.0 + 10 * random.nextDouble()
+                else -> resting + 18 + 10 * exp(-((hourOf(t, start) - 13) / 4).pow(2))
+            }
+            val avg = base + random.nextDouble(-3.0, 3.0)
+            Sample(date = ts(t), min = avg - random.nextDouble(2.0, 6.0), avg = avg, max = avg + random.nextDouble(2.0, 8.0))
+        }
+
+        val hourly = (7..22).map { hour -> at(hour.toDouble()) to hour }
+        val steps = hourly.map { (t, hour) ->
+            val commute = if (hour == 8 || hour == 18) 1800.0 else 0.0
+            val workoutSteps = if (workout?.name == "Running" && workoutRange != null && t in workoutRange) 4000.0 else 0.0
+            t to (random.nextDouble(150.0, 700.0) + commute + workoutSteps).toInt().toDouble()
+        }
+        val workoutEnergy = workout?.activeEnergyBurned?.qty ?: 0.0
+        val energy = hourly.map { (t, _) ->
+            t to random.nextDouble(15.0, 45.0) + if (workoutRange != null && t in workoutRange) workoutEnergy else 0.0
+        }
+
+        val mood = (0.25 + 0.35 * fitness - 0.3 * stress + random.nextDouble(-0.3, 0.3)).coerceIn(-1.0, 1.0)
+        val stateOfMind = StateOfMind(
+            id = UUID.nameUUIDFromBytes("demo|mood|$date".toByteArray()).toString(),
+            valence = mood,
+            valenceClassification = when {
+                mood < -0.5 -> "Very Unpleasant"
+                mood < -0.1 -> "Unpleasant"
+                mood < 0.1 -> "Neutral"
+                mood < 0.5 -> "Pleasant"
+                else -> "Very Pleasant"
+            },
+            labels = (if (mood >= 0) listOf("Calm", "Content", "Happy", "Grateful") else listOf("Stressed", "Tired", "Anxious"))
+                .shuffled(random).take(2),
+            associations = listOf("Work", "Family", "Fitness", "Health", "Friends").shuffled(random).take(2),
+            start = ts(at(21.0)),
+            end = ts(at(21.0)),
+            kind = "dailyMood",
+        )
+
+        val ecg = if (date.dayOfWeek == DayOfWeek.SUNDAY) listOf(ecg(at(9.5), resting + 6, random)) else emptyList()
+
+        fun metric(name: String, units: String, samples: List<Sample>) =
+            Metric(name, units, samples.filter { !Timestamps.parse(it.date!!).isAfter(until) })
+        return Export(
+            metrics = listOf(
+                metric("sleep_analysis", "hr", if (wokeUp.isAfter(until)) emptyList() else listOf(sleep)),
+                metric("heart_rate", "count/min", heartRate),
+                metric("resting_heart_rate", "count/min", listOf(Sample(date = ts(at(12.0)), qty = resting))),
+                metric(
+                    "heart_rate_variability", "ms",
+                    listOf(Sample(date = ts(at(3.0)), qty = 48 + 8 * fitness - 6 * stress + random.nextDouble(-5.0, 5.0))),
+                ),
+                metric("step_count", "count", steps.map { (t, qty) -> Sample(date = ts(t), qty = qty) }),
+                metric("walking_running_distance", "km", steps.map { (t, qty) -> Sample(date = ts(t), qty = qty * 0.00075) }),
+                metric("active_energy", "kcal", energy.map { (t, qty) -> Sample(date = ts(t), qty = qty) }),
+                metric(
+                    "weight_body_mass", "kg",
+                    listOf(Sample(date = ts(at(7.5)), qty = 74.5 - 1.2 * fitness + random.nextDouble(-0.4, 0.4))),
+                ),
+                metric(
+                    "blood_oxygen_saturation", "%",
+                    listOf(2.0, 4.0, 15.0).map { Sample(date = ts(at(it)), qty = random.nextDouble(94.5, 99.5)) },
+                ),
+                metric(MARKER_METRIC, "count", listOf(Sample(date = ts(start), qty = 1.0))),
+            ).filter { it.data.isNotEmpty() },
+            workouts = listOfNotNull(workout?.takeUnless { Timestamps.parse(it.end!!).isAfter(until) }),
+            stateOfMind = listOf(stateOfMind).filter { !Timestamps.parse(it.start!!).isAfter(until) },
+            ecg = ecg.filter { !Timestamps.parse(it.end!!).isAfter(until) },
+        )
+    }
+
+    private fun hourOf(t: Instant, dayStart: Instant) = (t.epochSecond - dayStart.epochSecond) / 3600.0
+
+    /** A loop through the Tiergarten, the longer the fitter the person is that week. */
+    private fun workout(date: LocalDate, start: Instant, fitness: Double, random: Random): Workout {
+        val (name, speedKmh, kcalPerMinute) = listOf(
+            Triple("Running", 10.5, 11.0),
+            Triple("Cycling", 22.0, 9.0),
+            Triple("Walking", 5.2, 4.5),
+        ).random(random)
+        val minutes = (40 + 10 * fitness + random.nextDouble(-10.0, 10.0)).toInt()
+        val end = start.plusSeconds(minutes * 60L)
+        val distance = speedKmh * minutes / 60
+        val radiusDegrees = distance / (2 * PI) / 111.0
+        val points = minutes * 12
+        return Workout(
+            id = UUID.nameUUIDFromBytes("demo|workout|$date".toByteArray()).toString(),
+            name = name,
+            start = Timestamps.format(start),
+            end = Timestamps.format(end),
+            activeEnergyBurned = QtyUnit(kcalPerMinute * minutes, "kcal"),
+            distance = QtyUnit(distance, "km"),
+            elevationUp = QtyUnit(random.nextDouble(5.0, 30.0), "m"),
+            route = (0 until points).map { i ->
+                val angle = 2 * PI * i / points
+                GPSLog(
+                    latitude = LATITUDE + radiusDegrees * sin(angle),
+                    longitude = LONGITUDE + radiusDegrees * cos(angle) / cos(LATITUDE * PI / 180),
+                    altitude = 34 + 4 * sin(3 * angle),
+                    timestamp = Timestamps.format(start.plusSeconds(i * 5L)),
+                    speed = speedKmh / 3.6,
+                )
+            },
+            heartRateData = (0 until minutes).map { minute ->
+                val avg = 100 + 45 * (1 - exp(-minute / 6.0)) + random.nextDouble(-4.0, 4.0)
+                HeartRateLog(
+                    min = avg - 5, max = avg + 5, avg = avg, units = "count/min", source = WATCH,
+                    date = Timestamps.format(start.plusSeconds(minute * 60L)),
+                )
+            },
+        )
+    }
+
+    /** 30 seconds at 512 Hz of a regular sinus rhythm. */
+    private fun ecg(start: Instant, bpm: Double, random: Random): ECG {
+        val frequency = 512
+        val beat = 60.0 / bpm
+        val voltages = (0 until 30 * frequency).map { i ->
+            val seconds = i.toDouble() / frequency
+            val phase = (seconds % beat) / beat
+            fun wave(center: Double, width: Double, height: Double) = height * exp(-((phase - center) / width).pow(2))
+            val microvolts = wave(0.2, 0.025, 120.0) - wave(0.28, 0.008, 90.0) + wave(0.3, 0.01, 1100.0) -
+                    wave(0.32, 0.01, 250.0) + wave(0.55, 0.05, 300.0) + random.nextDouble(-15.0, 15.0)
+            ECGVoltage(date = start.epochSecond + seconds, voltage = microvolts, units = "mcV")
+        }
+        return ECG(
+            classification = "Sinus Rhythm",
+            voltageMeasurements = voltages,
+            source = WATCH,
+            averageHeartRate = bpm,
+            start = Timestamps.format(start),
+            numberOfVoltageMeasurements = voltages.size,
+            samplingFrequency = frequency,
+            end = Timestamps.format(start.plusSeconds(30)),
+        )
+    }
+}
@@ -0,0 +1,35 @@
+package me.centralhardware.healthImportServer.tools
+
+import kotlinx.serialization.json.Json
+import me.centralhardware.healthImportServer.loadMetricStore
+import me.centralhardware.healthImportServer.request.ExportWrapper
+import org.slf4j.LoggerFactory
+import java.nio.file.Files
+import java.nio.file.Paths
+import java.time.LocalDate
+
+/**
+ * `export --format autoexport --from <date> [--to <date>] [--output <file>]`
+ * reads stored data back in the Auto Export JSON schema, so it can be posted
+ * to `/upload` of another instance. Writes to stdout without `--output`.
+ */
+object ExportCommand {
+    val log = LoggerFactory.getLogger(ExportCommand::class.java)
+    private val json = Json { explicitNulls = false }
+
+    fun run(options: Map<String, String>) {
+        val format = options["format"] ?: "autoexport"
+        require(format == "autoexport") { "Unsupported export format '$format', expected autoexport" }
+        val from = LocalDate.parse(options["from"] ?: error("--from is required"))
+        val to = options["to"]?.let { LocalDate.parse(it) }
+
+        val export = loadMetricStore().use { it.exportBetween(from, to ?: it.days.today()) }
+        log.info(
+            "Exported ${export.totalSamples()} samples, ${export.workouts.size} workouts, " +
+                    "${export.stateOfMind.size} state of mind entries and ${export.ecg.size} ECG recordings"
+        )
+        val payload = json.encodeToString(ExportWrapper.serializer(), ExportWrapper(export))
+        val output = options["output"]
+        if (output == null) println(payload) else Files.writeString(Paths.get(output), payload)
+    }
+}
@@ -0,0 +1,109 @@
+package me.centralhardware.healthImportServer.tools
+
+import me.centralhardware.healthImportServer.ImportHandler
+import me.centralhardware.healthImportServer.ImportTracker
+import me.centralhardware.healthImportServer.loadImportHandler
+import me.centralhardware.healthImportServer.loadMetricStore
+import me.centralhardware.healthImportServer.migrate.AppleHealthXml
+import me.centralhardware.healthImportServer.migrate.FitDecoder
+import me.centralhardware.healthImportServer.migrate.GpxDecoder
+import me.centralhardware.healthImportServer.migrate.LineProtocol
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.HealthAutoExportCsv
+import me.centralhardware.healthImportServer.request.ExportStream
+import org.slf4j.LoggerFactory
+import java.nio.file.Files
+import java.nio.file.Path
+import java.nio.file.Paths
+import kotlin.io.path.extension
+import kotlin.io.path.isDirectory
+import kotlin.io.path.name
+
+/**
+ * `import --format autoexport|csv|fit|gpx|applehealth|influx --input <file or directory>`
+ * brings history from other pipelines into the store. Directories are read
+ * file by file and each file is stored like a separate upload.
+ */
+object ImportCommand {
+    val log = LoggerFactory.getLogger(ImportCommand::class.java)
+    /** Rows read from an Auto Export file before they are stored, bounding the memory needed for it. */
+    private const val STREAM_ROWS = 200_000
+    private val extensions = mapOf(
+        "autoexport" to "json", "csv" to "csv", "fit" to "fit", "gpx" to "gpx", "applehealth" to "xml", "influx" to "lp",
+    )
+
+    fun run(options: Map<String, String>) {
+        val format = options["format"] ?: error("--format is required")
+        val extension = extensions[format]
+            ?: error("Unsupported import format '$format', expected ${extensions.keys.joinToString()}")
+        val input = Paths.get(options["input"] ?: error("--input is required"))
+        val files = if (input.isDirectory()) {
+            Files.walk(input).use { paths ->
+                paths.filter { it.extension.equals(extension, ignoreCase = true) }.sorted().toList()
+            }
+        } else {
+            listOf(input)
+        }
+
+        loadMetricStore().use { store ->
+            val handler = loadImportHandler(store, ImportTracker())
+            var failed = 0
+            for (file in files) {
+                if (format == "autoexport") {
+                    if (!importStreaming(handler, file)) failed++
+                    continue
+                }
+                val export = read(file, format, options)?.normalized()
+                if (export == null) {
+                    log.warn("Nothing to import in $file")
+                    continue
+                }
+                log.info(
+                    "Importing $file: ${export.totalSamples()} samples, ${export.workouts.size} workouts, " +
+                            "${export.stateOfMind.size} state of mind entries and ${export.ecg.size} ECG recordings"
+                )
+                if (handler.import(export).snapshot().chunksFailed > 0) failed++
+            }
+            log.info("Imported ${files.size - failed} of ${files.size} file(s)")
+            check(failed == 0) { "$failed file(s) were not fully imported" }
+        }
+    }
+
+    /**
+     * Stores an Auto Export file part by part as [ExportStream] reads it,
+     * so its size does not matter. The file is read through once before, so
+     * nothing of it is stored if it cannot be read to the end. Returns false
+     * if it was invalid or a part failed.
+     */
+    private fun importStreaming(handler: ImportHandler, file: Path): Boolean {
+        var parts = 0
+        var failed = 0
+        try {
+            Files.newBufferedReader(file).use { ExportStream(it, STREAM_ROWS).validate() }
+        } catch (e: Exception) {
+            log.error("Not importing $file: ${e.message}")
+            return false
+        }
+        log.info("Importing $file")
+        Files.newBufferedReader(file).use { reader ->
+            ExportStream(reader, STREAM_ROWS).forEach { export ->
+                parts++
+                log.info(
+                    "Importing part $parts of $file: ${export.totalSamples()} samples, ${export.workouts.size} workouts, " +
+                            "${export.stateOfMind.size} state of mind entries and ${export.ecg.size} ECG recordings"
+                )
+                if (handler.import(export).snapshot().chunksFailed > 0) failed++
+            }
+        }
+        if (parts == 0) log.warn("Nothing to import in $file")
+        return failed == 0
+    }
+
+    private fun read(file: Path, format: String, options: Map<String, String>): Export? = when (format) {
+        "csv" -> HealthAutoExportCsv.parse(Files.readString(file))
+        "fit" -> FitDecoder.decode(Files.readAllBytes(file), file.name)?.let { Export(workouts = listOf(it)) }
+        "gpx" -> GpxDecoder.decode(Files.readAllBytes(file), file.name)?.let { Export(workouts = listOf(it)) }
+        "applehealth" -> Files.newInputStream(file).use { AppleHealthXml.parse(it) }
+        else -> Files.newBufferedReader(file).useLines { LineProtocol.parse(it, options["precision"] ?: "ns") }
+    }
+}
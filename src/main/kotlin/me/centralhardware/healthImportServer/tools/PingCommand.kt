@@ -0,0 +1,35 @@
+package me.centralhardware.healthImportServer.tools
+
+import me.centralhardware.healthImportServer.EndpointPaths
+import me.centralhardware.healthImportServer.Env
+import java.net.URI
+import java.net.http.HttpClient
+import java.net.http.HttpRequest
+import java.net.http.HttpResponse
+import java.time.Duration
+import kotlin.system.exitProcess
+
+/**
+ * `ping [--addr host:port] [--path /health] [--timeout seconds]` calls the
+ * health endpoint of a running server and exits with status 1 unless it and its store are healthy. Meant
+ * for scripts and container health checks in images without curl.
+ */
+object PingCommand {
+
+    fun run(options: Map<String, String>) {
+        val addr = options["addr"] ?: Env.get("ADDR")?.replace("0.0.0.0", "127.0.0.1") ?: "127.0.0.1:8080"
+        val path = options["path"] ?: EndpointPaths.fromEnv().health
+        val timeout = Duration.ofSeconds(options["timeout"]?.toLong() ?: 5)
+        val url = if (addr.startsWith("http")) "${addr.trimEnd('/')}$path" else "http://$addr$path"
+        val client = HttpClient.newBuilder().connectTimeout(timeout).build()
+        val request = HttpRequest.newBuilder(URI(url)).timeout(timeout).GET().build()
+        val (status, body) = try {
+            client.send(request, HttpResponse.BodyHandlers.ofString()).let { it.statusCode() to it.body() }
+        } catch (e: Exception) {
+            System.err.println("$url: ${e.message ?: e.javaClass.simpleName}")
+            exitProcess(1)
+        }
+        println("$url: $status $body")
+        if (status != 200) exitProcess(1)
+    }
+}
@@ -0,0 +1,53 @@
+package me.centralhardware.healthImportServer.tools
+
+import me.centralhardware.healthImportServer.DeadLetters
+import me.centralhardware.healthImportServer.ImportTracker
+import me.centralhardware.healthImportServer.loadImportHandler
+import me.centralhardware.healthImportServer.loadMetricStore
+import me.centralhardware.healthImportServer.request.RequestParser
+import org.slf4j.LoggerFactory
+import java.nio.file.Files
+import java.nio.file.Paths
+
+/**
+ * `reprocess [--dir <dead letter directory>] [--file <name>]` stores the
+ * dead-lettered chunks again, oldest first, and deletes each one that was
+ * written along with its error report. Those that fail again are kept
+ * here rather than spooled for a retry.
+ */
+object ReprocessCommand {
+    val log = LoggerFactory.getLogger(ReprocessCommand::class.java)
+
+    fun run(options: Map<String, String>) {
+        val deadLetters = options["dir"]?.let { DeadLetters(Paths.get(it)) } ?: DeadLetters.fromEnv()
+        val files = options["file"]?.let { listOf(deadLetters.dir.resolve(it)) } ?: deadLetters.pending()
+        if (files.isEmpty()) {
+            log.info("Nothing to reprocess in ${deadLetters.dir}")
+            return
+        }
+
+        loadMetricStore().use { store ->
+            val handler = loadImportHandler(store, ImportTracker())
+            var failed = 0
+            for (file in files) {
+                val export = try {
+                    Files.newInputStream(file).use { RequestParser.parse(it).export }
+                } catch (e: Exception) {
+                    log.error("Could not read $file", e)
+                    failed++
+                    continue
+                }
+                log.info("Reprocessing $file: ${export.totalSamples()} samples, ${export.workouts.size} workouts")
+                val error = handler.replay(export, mapOf("reprocess" to file.fileName.toString()))
+                if (error != null) {
+                    log.warn("$file failed again (${error.message}), see ${deadLetters.reportOf(file)} for the earlier error")
+                    failed++
+                    continue
+                }
+                deadLetters.delete(file)
+            }
+            log.info("Reprocessed ${files.size - failed} of ${files.size} file(s)")
+            check(failed == 0) { "$failed file(s) are still dead-lettered" }
+        }
+    }
+}
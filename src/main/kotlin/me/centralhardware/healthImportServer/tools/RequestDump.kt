@@ -5,6 +5,7 @@ import io.ktor.server.netty.*
 import io.ktor.server.request.*
 import io.ktor.server.response.*
 import io.ktor.server.routing.*
+import me.centralhardware.healthImportServer.ListenAddress
 import java.nio.file.Files
 import java.nio.file.Paths
 
@@ -12,11 +13,9 @@ import java.nio.file.Paths
  * Utility server that dumps incoming requests to `request.json`.
  */
 fun main() {
-    val addr = System.getenv("ADDR") ?: "0.0.0.0:8080"
-    val host = addr.substringBefore(":")
-    val port = addr.substringAfter(":").toInt()
+    val addr = ListenAddress.fromEnv()
 
-    embeddedServer(Netty, host = host, port = port) {
+    embeddedServer(Netty, host = addr.host, port = addr.port) {
         routing {
             post("/") {
                 val body = call.receiveText()
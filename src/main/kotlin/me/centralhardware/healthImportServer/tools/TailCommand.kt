@@ -0,0 +1,79 @@
+package me.centralhardware.healthImportServer.tools
+
+import kotlinx.serialization.json.Json
+import me.centralhardware.healthImportServer.EndpointPaths
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.api.ApiTokens
+import me.centralhardware.healthImportServer.api.TokenRole
+import me.centralhardware.healthImportServer.monitoring.LiveEvent
+import java.net.URI
+import java.net.URLEncoder
+import java.net.http.HttpClient
+import java.net.http.HttpRequest
+import java.net.http.HttpResponse
+import java.time.Duration
+import java.time.Instant
+import java.time.ZoneId
+import java.time.format.DateTimeFormatter
+import java.util.Locale
+import kotlin.system.exitProcess
+
+/**
+ * `tail [--addr host:port] [--token <token>] [--metrics a,b] [--type metric|workout]`
+ * prints the samples and workouts a running server writes, as they arrive,
+ * e.g. to see whether the phone actually sends data while setting up Auto
+ * Export. Reads `/api/stream`; the token defaults to the first one in
+ * `API_TOKENS` that may read.
+ */
+object TailCommand {
+    private val json = Json { ignoreUnknownKeys = true }
+    private val time = DateTimeFormatter.ofPattern("yyyy-MM-dd HH:mm:ss").withZone(ZoneId.systemDefault())
+
+    fun run(options: Map<String, String>) {
+        val addr = options["addr"] ?: Env.get("ADDR")?.replace("0.0.0.0", "127.0.0.1") ?: "127.0.0.1:8080"
+        val base = if (addr.startsWith("http")) addr.trimEnd('/') else "http://$addr"
+        val query = listOfNotNull(
+            options["metrics"]?.let { "metrics=" + URLEncoder.encode(it, Charsets.UTF_8) },
+            options["type"]?.let { "type=" + URLEncoder.encode(it, Charsets.UTF_8) },
+        ).joinToString("&")
+        val url = "$base${EndpointPaths.fromEnv().api}/stream" + if (query.isEmpty()) "" else "?$query"
+        val client = HttpClient.newBuilder().connectTimeout(Duration.ofSeconds(10)).build()
+        val request = HttpRequest.newBuilder(URI(url))
+            .header("Accept", "text/event-stream")
+            .apply { (options["token"] ?: readToken())?.let { header("Authorization", "Bearer $it") } }
+            .GET()
+            .build()
+        val response = try {
+            client.send(request, HttpResponse.BodyHandlers.ofLines())
+        } catch (e: Exception) {
+            System.err.println("$url: ${e.message ?: e.javaClass.simpleName}")
+            exitProcess(1)
+        }
+        if (response.statusCode() != 200) {
+            System.err.println("$url: ${response.statusCode()} ${response.body().toList().joinToString("\n")}")
+            exitProcess(1)
+        }
+        System.err.println("Waiting for data from $url, Ctrl+C to stop")
+        response.body().forEach { line ->
+            if (!line.startsWith("data:")) return@forEach
+            println(format(json.decodeFromString(LiveEvent.serializer(), line.removePrefix("data:").trim())))
+        }
+        System.err.println("The server closed the stream")
+        exitProcess(1)
+    }
+
+    private fun readToken(): String? =
+        Env.get("API_TOKENS")?.let { ApiTokens.parse(it) }?.entries?.firstOrNull { it.value.grants(TokenRole.READ) }?.key
+
+    private fun format(event: LiveEvent): String {
+        val at = time.format(Instant.parse(event.timestamp))
+        val value = listOfNotNull(event.value?.let { "%.2f".format(Locale.ROOT, it).trimEnd('0').trimEnd('.') }, event.units, event.category)
+            .joinToString(" ")
+        val details = when (event.type) {
+            LiveEvent.WORKOUT -> listOfNotNull(event.end?.let { "until ${time.format(Instant.parse(it))}" }, value.ifEmpty { null })
+            else -> listOf(value)
+        }.joinToString(", ")
+        val source = event.source?.let { "  [$it]" } ?: ""
+        return "$at  ${event.type.padEnd(7)}  ${event.name.padEnd(28)}  $details$source"
+    }
+}
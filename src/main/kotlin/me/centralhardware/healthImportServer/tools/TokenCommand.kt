@@ -0,0 +1,65 @@
+package me.centralhardware.healthImportServer.tools
+
+import me.centralhardware.healthImportServer.api.StoredTokens
+import me.centralhardware.healthImportServer.api.TokenRole
+import me.centralhardware.healthImportServer.loadMetricStore
+import me.centralhardware.healthImportServer.storage.ApiToken
+import java.time.Instant
+import java.util.UUID
+
+/**
+ * `token create --name <name> --role upload|read|admin`, `token list` and
+ * `token revoke --id <id>` manage the API tokens stored in ClickHouse. Only
+ * a hash of each token is kept, so `create` prints the token once. A running
+ * server picks up changes within `API_TOKEN_REFRESH_SECONDS`.
+ */
+object TokenCommand {
+
+    fun run(subcommand: String?, options: Map<String, String>) {
+        when (subcommand) {
+            "create" -> create(options)
+            "list" -> list()
+            "revoke" -> revoke(options)
+            else -> error("Unknown token command '$subcommand', expected create, list or revoke")
+        }
+    }
+
+    private fun create(options: Map<String, String>) {
+        val name = options["name"] ?: error("--name is required")
+        val role = options["role"]?.let { TokenRole.of(it) ?: error("Unknown role '$it', expected one of ${TokenRole.names()}") }
+            ?: error("--role is required")
+        val token = StoredTokens.generate()
+        val stored = ApiToken(
+            id = UUID.randomUUID().toString().take(8),
+            name = name,
+            role = role.name.lowercase(),
+            hash = StoredTokens.hash(token),
+            createdAt = Instant.now(),
+        )
+        loadMetricStore().use { it.storeApiToken(stored) }
+        println("Created ${stored.role} token ${stored.id} ($name). It is not shown again:")
+        println(token)
+    }
+
+    private fun list() {
+        val tokens = loadMetricStore().use { it.apiTokens() }
+        println("%-8s  %-6s  %-24s  %-24s  %-24s  %s".format("ID", "ROLE", "CREATED", "LAST USED", "REVOKED", "NAME"))
+        tokens.forEach { t ->
+            println(
+                "%-8s  %-6s  %-24s  %-24s  %-24s  %s".format(
+                    t.id, t.role, t.createdAt, t.lastUsedAt ?: "never", t.revokedAt ?: "-", t.name,
+                )
+            )
+        }
+    }
+
+    private fun revoke(options: Map<String, String>) {
+        val id = options["id"] ?: error("--id is required")
+        loadMetricStore().use { store ->
+            val token = store.apiTokens().firstOrNull { it.id == id } ?: error("No token with id $id")
+            if (token.revokedAt != null) return println("Token $id was already revoked at ${token.revokedAt}")
+            store.storeApiToken(token.copy(revokedAt = Instant.now()))
+        }
+        println("Revoked token $id")
+    }
+}
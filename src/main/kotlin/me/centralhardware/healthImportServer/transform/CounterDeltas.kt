@@ -0,0 +1,69 @@
+package me.centralhardware.healthImportServer.transform
+
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.Sample
+import me.centralhardware.healthImportServer.request.Timestamps
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import java.time.Instant
+import java.util.concurrent.ConcurrentHashMap
+
+/**
+ * Turns metrics some apps report as running totals, such as a step counter
+ * that resets every day, into the amount added since the previous sample.
+ * A value below the previous one is taken as a reset, so counting starts
+ * over from zero. The totals are kept as `<name>_cumulative`, which also
+ * provides the previous value for the first sample of the next upload.
+ */
+class CounterDeltas(
+    private val metrics: Set<String>,
+    private val store: ClickHouseMetricStore,
+) : PayloadTransform {
+    /** Last total seen per metric, for uploads arriving before the previous one is stored. */
+    private val last = ConcurrentHashMap<String, Pair<Instant, Double>>()
+
+    override fun apply(export: Export): Export {
+        if (export.metrics.none { it.name in metrics }) return export
+        return export.copy(
+            metrics = export.metrics.flatMap { m -> if (m.name in metrics) deltas(m) else listOf(m) }
+        )
+    }
+
+    private fun deltas(metric: Metric): List<Metric> {
+        val totals = metric.data
+            .mapNotNull { s ->
+                val ts = Timestamps.parseOrNull(s.date) ?: return@mapNotNull null
+                val qty = s.qty ?: return@mapNotNull null
+                Triple(ts, s.date, qty)
+            }
+            .sortedBy { it.first }
+        if (totals.isEmpty()) return listOf(metric)
+
+        val totalName = metric.name + CUMULATIVE_SUFFIX
+        val first = totals.first().first
+        var previous = last[metric.name]?.takeIf { it.first.isBefore(first) }?.second
+            ?: store.latestValue(totalName, before = first)
+        val deltas = totals.map { (_, date, qty) ->
+            val delta = previous?.takeIf { qty >= it }?.let { qty - it } ?: qty
+            previous = qty
+            Sample(date = date, qty = delta)
+        }
+        last.merge(metric.name, totals.last().first to totals.last().third) { old, new ->
+            if (new.first.isAfter(old.first)) new else old
+        }
+        return listOf(
+            Metric(metric.name, metric.units, deltas),
+            Metric(totalName, metric.units, totals.map { (_, date, qty) -> Sample(date = date, qty = qty) }),
+        )
+    }
+
+    companion object {
+        const val CUMULATIVE_SUFFIX = "_cumulative"
+
+        fun fromEnv(store: ClickHouseMetricStore): CounterDeltas? {
+            val metrics = Env.get("CUMULATIVE_METRICS")?.split(",")?.map { it.trim() }?.filter { it.isNotEmpty() }
+            return if (!metrics.isNullOrEmpty()) CounterDeltas(metrics.toSet(), store) else null
+        }
+    }
+}
@@ -0,0 +1,52 @@
+package me.centralhardware.healthImportServer.transform
+
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.HeartRateLog
+import me.centralhardware.healthImportServer.request.Timestamps
+import java.time.Duration
+
+/**
+ * Reduces workout heart rate logs to at most one sample per [resolution].
+ * Samples in a bucket are merged into one keeping the lowest minimum, the
+ * highest maximum and the mean of the averages.
+ */
+class HeartRateDownsampler(private val resolution: Duration) : PayloadTransform {
+
+    override val reduces = true
+
+    override fun apply(export: Export): Export = export.copy(
+        workouts = export.workouts.map { w ->
+            w.copy(
+                heartRateData = downsample(w.heartRateData),
+                heartRateRecovery = downsample(w.heartRateRecovery),
+            )
+        }
+    )
+
+    private fun downsample(logs: List<HeartRateLog>): List<HeartRateLog> {
+        if (logs.size < 2) return logs
+        val bucketSeconds = resolution.seconds
+        val (dated, undated) = logs.partition { Timestamps.parseOrNull(it.date) != null }
+        val buckets = dated
+            .groupBy { Timestamps.parse(it.date!!).epochSecond / bucketSeconds }
+            .toSortedMap()
+            .values
+            .map { bucket ->
+                if (bucket.size == 1) return@map bucket.first()
+                bucket.first().copy(
+                    min = bucket.mapNotNull { it.min }.minOrNull(),
+                    max = bucket.mapNotNull { it.max }.maxOrNull(),
+                    avg = bucket.mapNotNull { it.avg }.takeIf { it.isNotEmpty() }?.average(),
+                )
+            }
+        return buckets + undated
+    }
+
+    companion object {
+        fun fromEnv(): HeartRateDownsampler? {
+            val seconds = Env.get("WORKOUT_HR_RESOLUTION_SECONDS")?.toLong() ?: 0
+            return if (seconds > 0) HeartRateDownsampler(Duration.ofSeconds(seconds)) else null
+        }
+    }
+}
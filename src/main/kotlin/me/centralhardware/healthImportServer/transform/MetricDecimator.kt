@@ -0,0 +1,63 @@
+package me.centralhardware.healthImportServer.transform
+
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.Timestamps
+import me.centralhardware.healthImportServer.storage.ClickHouseConfig
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import java.time.Duration
+import java.time.Instant
+import java.time.ZoneOffset
+
+/**
+ * Keeps at most one sample per interval of the metrics in [intervals],
+ * dropping samples that follow the last kept one too closely. Samples taken
+ * during a workout, either one in the payload or one already stored, are
+ * always kept at full resolution.
+ */
+class MetricDecimator(
+    private val intervals: Map<String, Duration>,
+    private val store: ClickHouseMetricStore? = null,
+) : PayloadTransform {
+
+    override val reduces = true
+
+    override fun apply(export: Export): Export {
+        val times = export.metrics.filter { it.name in intervals }
+            .flatMap { m -> m.data.mapNotNull { Timestamps.parseOrNull(it.date) } }
+        if (times.isEmpty()) return export
+        val workouts = export.workouts.mapNotNull { w ->
+            val start = Timestamps.parseOrNull(w.start) ?: return@mapNotNull null
+            val end = Timestamps.parseOrNull(w.end) ?: return@mapNotNull null
+            start..end
+        } + store?.workoutsBetween(
+            times.min().atZone(ZoneOffset.UTC).toLocalDate().minusDays(1),
+            times.max().atZone(ZoneOffset.UTC).toLocalDate(),
+        ).orEmpty().map { it.start..it.end }
+        return export.copy(
+            metrics = export.metrics.map { m -> intervals[m.name]?.let { decimate(m, it, workouts) } ?: m }
+        )
+    }
+
+    private fun decimate(metric: Metric, interval: Duration, workouts: List<ClosedRange<Instant>>): Metric {
+        val (dated, undated) = metric.data.partition { Timestamps.parseOrNull(it.date) != null }
+        var last: Instant? = null
+        val kept = dated.map { Timestamps.parse(it.date!!) to it }.sortedBy { it.first }.filter { (ts, _) ->
+            val keep = last.let { it == null || Duration.between(it, ts) >= interval } || workouts.any { ts in it }
+            if (keep) last = ts
+            keep
+        }
+        return metric.copy(data = kept.map { it.second } + undated)
+    }
+
+    companion object {
+        /** Reads `METRIC_SAMPLING_SECONDS` as `metric=seconds` pairs, e.g. `heart_rate=30`. */
+        fun fromEnv(store: ClickHouseMetricStore): MetricDecimator? {
+            val intervals = Env.get("METRIC_SAMPLING_SECONDS")?.let { ClickHouseConfig.parsePairs(it) }
+                ?.mapValues { (_, seconds) -> Duration.ofSeconds(seconds.toLong()) }
+                ?.filterValues { !it.isZero }
+            return if (!intervals.isNullOrEmpty()) MetricDecimator(intervals, store) else null
+        }
+    }
+}
@@ -0,0 +1,24 @@
+package me.centralhardware.healthImportServer.transform
+
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.storage.ClickHouseConfig
+
+/**
+ * Renames incoming metrics before they are stored, so samples sent under a
+ * name Auto Export used in an older version end up next to the current one.
+ */
+class MetricRenamer(private val names: Map<String, String>) : PayloadTransform {
+
+    override fun apply(export: Export): Export = export.copy(
+        metrics = export.metrics.map { m -> names[m.name]?.let { m.copy(name = it) } ?: m }
+    )
+
+    companion object {
+        /** Reads `METRIC_NAMES` as `old=new` pairs, e.g. `exercise_time=apple_exercise_time`. */
+        fun fromEnv(): MetricRenamer? {
+            val names = Env.get("METRIC_NAMES")?.let { ClickHouseConfig.parsePairs(it) } ?: return null
+            return if (names.isNotEmpty()) MetricRenamer(names) else null
+        }
+    }
+}
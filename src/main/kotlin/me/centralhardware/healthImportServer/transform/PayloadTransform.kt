@@ -0,0 +1,24 @@
+package me.centralhardware.healthImportServer.transform
+
+import me.centralhardware.healthImportServer.request.Export
+
+/**
+ * A step applied to every parsed payload before it is handed to the stores.
+ */
+fun interface PayloadTransform {
+    fun apply(export: Export): Export
+
+    /** Whether the samples this transform drops are dropped on purpose, e.g. to lower the resolution, rather than rejected. */
+    val reduces: Boolean get() = false
+}
+
+fun List<PayloadTransform>.applyAll(export: Export): Export = fold(export) { acc, t -> t.apply(acc) }
+
+/** Applies every transform to [export] and counts the samples dropped by those that [PayloadTransform.reduces]. */
+fun List<PayloadTransform>.applyCounting(export: Export): Pair<Export, Int> {
+    var reduced = 0
+    val result = fold(export) { acc, t ->
+        t.apply(acc).also { if (t.reduces) reduced += (acc.totalSamples() - it.totalSamples()).coerceAtLeast(0) }
+    }
+    return result to reduced
+}
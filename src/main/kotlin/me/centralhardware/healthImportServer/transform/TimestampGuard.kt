@@ -0,0 +1,83 @@
+package me.centralhardware.healthImportServer.transform
+
+import kotlinx.serialization.json.Json
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.ExportWrapper
+import me.centralhardware.healthImportServer.request.Timestamps
+import org.slf4j.LoggerFactory
+import java.nio.file.Files
+import java.nio.file.Path
+import java.nio.file.Paths
+import java.time.Duration
+import java.time.Instant
+import java.time.LocalDate
+import java.time.ZoneOffset
+import java.util.UUID
+
+/**
+ * Drops samples, workouts, state of mind entries and ECGs dated before
+ * [earliest] or more than [maxAhead] in the future, as found in corrupted
+ * exports. If [quarantine] is set, what was dropped is written there as an
+ * Auto Export payload that can be checked and imported with the `import`
+ * command.
+ */
+class TimestampGuard(
+    private val earliest: Instant,
+    private val maxAhead: Duration,
+    private val quarantine: Path? = null,
+) : PayloadTransform {
+    val log = LoggerFactory.getLogger(TimestampGuard::class.java)
+
+    init {
+        quarantine?.let { Files.createDirectories(it) }
+    }
+
+    override fun apply(export: Export): Export {
+        val latest = Instant.now().plus(maxAhead)
+        fun bogus(date: String?): Boolean {
+            val ts = Timestamps.parseOrNull(date) ?: return false
+            return ts.isBefore(earliest) || ts.isAfter(latest)
+        }
+
+        val metrics = export.metrics.map { m ->
+            val (kept, dropped) = m.data.partition { !bogus(it.date) }
+            m.copy(data = kept) to m.copy(data = dropped)
+        }
+        val (workouts, droppedWorkouts) = export.workouts.partition { !bogus(it.start) }
+        val (stateOfMind, droppedStateOfMind) = export.stateOfMind.partition { !bogus(it.start) }
+        val (ecg, droppedEcg) = export.ecg.partition { !bogus(it.start) }
+        val dropped = Export(
+            metrics = metrics.map { it.second }.filter { it.data.isNotEmpty() },
+            workouts = droppedWorkouts,
+            stateOfMind = droppedStateOfMind,
+            ecg = droppedEcg,
+        )
+        if (dropped.totalSamples() + dropped.workouts.size + dropped.stateOfMind.size + dropped.ecg.size == 0) return export
+
+        log.warn(
+            "Dropped ${dropped.totalSamples()} samples, ${dropped.workouts.size} workouts, " +
+                "${dropped.stateOfMind.size} state of mind entries and ${dropped.ecg.size} ECGs " +
+                "dated outside $earliest to $latest"
+        )
+        quarantine?.let { dir ->
+            val file = dir.resolve("${Instant.now().toEpochMilli()}-${UUID.randomUUID()}.json")
+            Files.writeString(file, Json.encodeToString(ExportWrapper.serializer(), ExportWrapper(dropped)))
+            log.warn("Quarantined dropped data in $file")
+        }
+        return Export(metrics.map { it.first }, workouts, stateOfMind, ecg)
+    }
+
+    companion object {
+        /**
+         * Reads `TIMESTAMP_EARLIEST` (default `1990-01-01`),
+         * `TIMESTAMP_MAX_FUTURE_HOURS` (default 24) and `TIMESTAMP_QUARANTINE_DIR`.
+         */
+        fun fromEnv(): TimestampGuard {
+            val earliest = LocalDate.parse(Env.get("TIMESTAMP_EARLIEST") ?: "1990-01-01")
+                .atStartOfDay(ZoneOffset.UTC).toInstant()
+            val maxAhead = Duration.ofHours(Env.get("TIMESTAMP_MAX_FUTURE_HOURS")?.toLong() ?: 24)
+            return TimestampGuard(earliest, maxAhead, Env.get("TIMESTAMP_QUARANTINE_DIR")?.let { Paths.get(it) })
+        }
+    }
+}
@@ -0,0 +1,63 @@
+package me.centralhardware.healthImportServer.transform
+
+import me.centralhardware.healthImportServer.Env
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.Timestamps
+import me.centralhardware.healthImportServer.storage.ClickHouseMetricStore
+import java.time.Instant
+import java.time.ZoneOffset
+
+/**
+ * Keeps `active_energy` samples recorded during a workout, of the same
+ * upload or a stored one, out of the daily totals, for sources that report
+ * a workout's energy both with the workout and as general samples. With
+ * [exclude] they are dropped, otherwise moved to `active_energy_workout`.
+ */
+class WorkoutEnergyOverlap(
+    private val store: ClickHouseMetricStore,
+    private val exclude: Boolean,
+) : PayloadTransform {
+
+    override fun apply(export: Export): Export {
+        val energy = export.metrics.filter { it.name == METRIC }
+        val times = energy.flatMap { m -> m.data.mapNotNull { Timestamps.parseOrNull(it.date ?: it.startDate) } }
+        if (times.isEmpty()) return export
+
+        val intervals = export.workouts.mapNotNull { w ->
+            val start = Timestamps.parseOrNull(w.start) ?: return@mapNotNull null
+            val end = Timestamps.parseOrNull(w.end) ?: return@mapNotNull null
+            start to end
+        } + store.workoutsBetween(
+            times.min().atZone(ZoneOffset.UTC).toLocalDate().minusDays(1),
+            times.max().atZone(ZoneOffset.UTC).toLocalDate().plusDays(1),
+        ).map { it.start to it.end }
+        if (intervals.isEmpty()) return export
+
+        fun duringWorkout(time: Instant?) = time != null && intervals.any { (start, end) -> !time.isBefore(start) && time.isBefore(end) }
+
+        val metrics = export.metrics.flatMap { m ->
+            if (m.name != METRIC) return@flatMap listOf(m)
+            val (during, outside) = m.data.partition { duringWorkout(Timestamps.parseOrNull(it.date ?: it.startDate)) }
+            when {
+                during.isEmpty() -> listOf(m)
+                exclude -> listOf(m.copy(data = outside))
+                else -> listOf(m.copy(data = outside), Metric(WORKOUT_METRIC, m.units, during))
+            }
+        }
+        return export.copy(metrics = metrics)
+    }
+
+    companion object {
+        const val METRIC = "active_energy"
+        const val WORKOUT_METRIC = "active_energy_workout"
+
+        /** Reads `WORKOUT_ENERGY_OVERLAP`, `tag` or `exclude`; returns null if it is not set. */
+        fun fromEnv(store: ClickHouseMetricStore): WorkoutEnergyOverlap? = when (val mode = Env.get("WORKOUT_ENERGY_OVERLAP")) {
+            null, "" -> null
+            "tag" -> WorkoutEnergyOverlap(store, exclude = false)
+            "exclude" -> WorkoutEnergyOverlap(store, exclude = true)
+            else -> throw IllegalArgumentException("Unknown WORKOUT_ENERGY_OVERLAP '$mode', expected tag or exclude")
+        }
+    }
+}
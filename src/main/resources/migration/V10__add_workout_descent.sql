@@ -0,0 +1,12 @@
+ALTER TABLE ${database}.workouts
+    ADD COLUMN IF NOT EXISTS elevation_down_qty Float64 DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS elevation_down_units LowCardinality(String) DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS ${database}.workout_flights_climbed (
+    workout_id UUID,
+    timestamp DateTime,
+    qty Float64,
+    units LowCardinality(String),
+    source LowCardinality(String),
+    PRIMARY KEY (workout_id, timestamp)
+) ENGINE = ReplacingMergeTree();
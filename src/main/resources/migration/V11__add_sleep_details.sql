@@ -0,0 +1,10 @@
+ALTER TABLE ${database}.metrics
+    ADD COLUMN IF NOT EXISTS sleep_start DateTime DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS sleep_end DateTime DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS in_bed_start DateTime DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS in_bed_end DateTime DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS core Float64 DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS deep Float64 DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS rem Float64 DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS awake Float64 DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS category LowCardinality(String) DEFAULT '';
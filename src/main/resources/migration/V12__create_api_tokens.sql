@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS ${database}.api_tokens (
+    id String,
+    name String,
+    role LowCardinality(String),
+    hash String,
+    created_at DateTime64(3),
+    revoked_at Nullable(DateTime64(3)),
+    updated_at DateTime64(3) DEFAULT now64(3)
+) ENGINE = ReplacingMergeTree(updated_at)
+ORDER BY id;
+
+CREATE TABLE IF NOT EXISTS ${database}.api_token_usage (
+    id String,
+    last_used_at DateTime64(3)
+) ENGINE = ReplacingMergeTree(last_used_at)
+ORDER BY id;
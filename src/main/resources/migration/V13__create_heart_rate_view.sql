@@ -0,0 +1,24 @@
+-- Heart rate samples of all metric tables and of workout logs in one place,
+-- so dashboards need no UNION. workout_id is NULL for samples of the
+-- heart_rate metric; the watch usually records workout time in both.
+CREATE VIEW IF NOT EXISTS ${database}.heart_rate_all AS
+SELECT
+    timestamp,
+    min,
+    avg,
+    max,
+    metric_unit AS units,
+    sleep_source AS source,
+    CAST(NULL AS Nullable(UUID)) AS workout_id
+FROM merge('${database}', '^metrics')
+WHERE metric_name = 'heart_rate'
+UNION ALL
+SELECT
+    timestamp,
+    min,
+    avg,
+    max,
+    units,
+    source,
+    toNullable(workout_id) AS workout_id
+FROM ${database}.workout_heart_rate_data;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS ${database}.annotations (
+    timestamp DateTime64(3),
+    text String,
+    tags Array(LowCardinality(String)),
+    source LowCardinality(String) DEFAULT '',
+    PRIMARY KEY (timestamp, text)
+) ENGINE = ReplacingMergeTree();
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS ${database}.workout_attachments (
+    workout_id UUID,
+    id UUID,
+    name String,
+    content_type LowCardinality(String),
+    size UInt64,
+    sha256 String,
+    location String,
+    created_at DateTime64(3),
+    PRIMARY KEY (workout_id, id)
+) ENGINE = ReplacingMergeTree();
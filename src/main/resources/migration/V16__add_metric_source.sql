@@ -0,0 +1,38 @@
+-- The device of every metric sample, such as the watch or a chest strap of
+-- heart rate samples, like the source of workout logs. sleep_source keeps
+-- the source of aggregated sleep only; rows written before this migration
+-- have the source of other samples there.
+ALTER TABLE ${database}.metrics
+    ADD COLUMN IF NOT EXISTS source LowCardinality(String) DEFAULT '';
+
+CREATE OR REPLACE VIEW ${database}.heart_rate_all AS
+SELECT
+    timestamp,
+    min,
+    avg,
+    max,
+    units,
+    device AS source,
+    workout_id
+FROM (
+    SELECT
+        timestamp,
+        min,
+        avg,
+        max,
+        metric_unit AS units,
+        if(source != '', source, sleep_source) AS device,
+        CAST(NULL AS Nullable(UUID)) AS workout_id
+    FROM merge('${database}', '^metrics')
+    WHERE metric_name = 'heart_rate'
+)
+UNION ALL
+SELECT
+    timestamp,
+    min,
+    avg,
+    max,
+    units,
+    source,
+    toNullable(workout_id) AS workout_id
+FROM ${database}.workout_heart_rate_data;
@@ -0,0 +1,6 @@
+-- The device an upload came from, as far as its headers or form fields tell.
+ALTER TABLE ${database}.imports
+    ADD COLUMN IF NOT EXISTS device_model LowCardinality(String) DEFAULT '',
+    ADD COLUMN IF NOT EXISTS os_version LowCardinality(String) DEFAULT '',
+    ADD COLUMN IF NOT EXISTS app_version LowCardinality(String) DEFAULT '',
+    ADD COLUMN IF NOT EXISTS battery_level Nullable(Float32);
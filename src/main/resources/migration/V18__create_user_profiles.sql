@@ -0,0 +1,11 @@
+-- Settings per person, edited with the admin API; see UserProfiles.
+CREATE TABLE IF NOT EXISTS ${database}.user_profiles (
+    user String,
+    heart_rate_zones Array(Float64),
+    units LowCardinality(String) DEFAULT 'metric',
+    timezone String DEFAULT '',
+    retention_days UInt32 DEFAULT 0,
+    notification_targets Array(String),
+    updated_at DateTime64(3) DEFAULT now64(3)
+) ENGINE = ReplacingMergeTree(updated_at)
+ORDER BY user;
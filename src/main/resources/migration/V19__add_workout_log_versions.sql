@@ -0,0 +1,10 @@
+-- The write that stored each row of a workout log, so the rows of a workout
+-- sent again can be replaced by deleting the older ones after the new ones
+-- were inserted. Rows written before this migration count as version 0.
+ALTER TABLE ${database}.workout_routes ADD COLUMN IF NOT EXISTS version UInt64 DEFAULT 0;
+ALTER TABLE ${database}.workout_heart_rate_data ADD COLUMN IF NOT EXISTS version UInt64 DEFAULT 0;
+ALTER TABLE ${database}.workout_heart_rate_recovery ADD COLUMN IF NOT EXISTS version UInt64 DEFAULT 0;
+ALTER TABLE ${database}.workout_step_count_log ADD COLUMN IF NOT EXISTS version UInt64 DEFAULT 0;
+ALTER TABLE ${database}.workout_walking_running_distance ADD COLUMN IF NOT EXISTS version UInt64 DEFAULT 0;
+ALTER TABLE ${database}.workout_active_energy ADD COLUMN IF NOT EXISTS version UInt64 DEFAULT 0;
+ALTER TABLE ${database}.workout_flights_climbed ADD COLUMN IF NOT EXISTS version UInt64 DEFAULT 0;
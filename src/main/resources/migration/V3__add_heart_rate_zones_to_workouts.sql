@@ -0,0 +1,6 @@
+ALTER TABLE ${database}.workouts
+    ADD COLUMN IF NOT EXISTS hr_zone_1_seconds UInt32 DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS hr_zone_2_seconds UInt32 DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS hr_zone_3_seconds UInt32 DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS hr_zone_4_seconds UInt32 DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS hr_zone_5_seconds UInt32 DEFAULT 0
@@ -0,0 +1,14 @@
+ALTER TABLE ${database}.workouts
+    ADD COLUMN IF NOT EXISTS elevation_up_qty Float64 DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS elevation_up_units LowCardinality(String) DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS ${database}.personal_records (
+    record LowCardinality(String),
+    value Float64,
+    units LowCardinality(String),
+    workout_id UUID,
+    workout_name LowCardinality(String),
+    achieved_at DateTime,
+    recorded_at DateTime DEFAULT now(),
+    PRIMARY KEY (record, achieved_at)
+) ENGINE = ReplacingMergeTree();
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS ${database}.ecg_waveform (
+    ecg_id UUID,
+    start DateTime64(9),
+    sampling_frequency UInt32,
+    units LowCardinality(String),
+    offsets Array(Float64) CODEC(ZSTD(3)),
+    voltages Array(Float64) CODEC(ZSTD(3)),
+    PRIMARY KEY (ecg_id)
+) ENGINE = ReplacingMergeTree();
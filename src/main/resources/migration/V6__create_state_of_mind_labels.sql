@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS ${database}.state_of_mind_labels (
+    id UUID,
+    kind LowCardinality(String),
+    name String,
+    display_name String,
+    PRIMARY KEY (kind, id)
+) ENGINE = ReplacingMergeTree();
+
+CREATE TABLE IF NOT EXISTS ${database}.state_of_mind_label_map (
+    state_of_mind_id UUID,
+    kind LowCardinality(String),
+    label_id UUID,
+    start DateTime,
+    PRIMARY KEY (kind, label_id, state_of_mind_id)
+) ENGINE = ReplacingMergeTree();
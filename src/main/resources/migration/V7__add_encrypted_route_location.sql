@@ -0,0 +1,2 @@
+ALTER TABLE ${database}.workout_routes
+    ADD COLUMN IF NOT EXISTS location_encrypted String DEFAULT '';
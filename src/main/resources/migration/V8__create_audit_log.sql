@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS ${database}.audit_log (
+    timestamp DateTime64(3),
+    actor LowCardinality(String),
+    action LowCardinality(String),
+    parameters String,
+    status UInt16
+) ENGINE = MergeTree()
+ORDER BY timestamp;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS ${database}.imports (
+    id UUID,
+    started_at DateTime64(3),
+    finished_at DateTime64(3),
+    state LowCardinality(String),
+    bytes_received UInt64,
+    chunks UInt32,
+    chunks_failed UInt32,
+    rows_expected UInt64,
+    rows_written UInt64,
+    PRIMARY KEY (id)
+) ENGINE = ReplacingMergeTree();
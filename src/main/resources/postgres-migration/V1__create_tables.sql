@@ -0,0 +1,69 @@
+-- The PostgreSQL store, see PostgresMetricStore. Tables are created only if
+-- missing, as the store created them itself before it had migrations.
+CREATE TABLE IF NOT EXISTS metrics (
+    timestamp timestamptz NOT NULL,
+    metric_name text NOT NULL,
+    metric_unit text NOT NULL,
+    source text NOT NULL DEFAULT '',
+    category text NOT NULL DEFAULT '',
+    qty double precision,
+    min double precision,
+    max double precision,
+    avg double precision,
+    asleep double precision,
+    in_bed double precision,
+    core double precision,
+    deep double precision,
+    rem double precision,
+    awake double precision,
+    sleep_start timestamptz,
+    sleep_end timestamptz,
+    PRIMARY KEY (metric_name, timestamp, source, category)
+);
+
+CREATE TABLE IF NOT EXISTS workouts (
+    id uuid PRIMARY KEY,
+    name text NOT NULL,
+    start timestamptz NOT NULL,
+    "end" timestamptz NOT NULL,
+    active_energy_qty double precision,
+    active_energy_units text NOT NULL DEFAULT '',
+    distance_qty double precision,
+    distance_units text NOT NULL DEFAULT '',
+    elevation_up_qty double precision,
+    elevation_up_units text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS workout_routes (
+    workout_id uuid NOT NULL,
+    timestamp timestamptz NOT NULL,
+    latitude double precision,
+    longitude double precision,
+    altitude double precision,
+    speed double precision,
+    course double precision,
+    PRIMARY KEY (workout_id, timestamp)
+);
+
+CREATE TABLE IF NOT EXISTS workout_heart_rate_data (
+    workout_id uuid NOT NULL,
+    timestamp timestamptz NOT NULL,
+    min double precision,
+    avg double precision,
+    max double precision,
+    units text NOT NULL DEFAULT '',
+    source text NOT NULL DEFAULT '',
+    PRIMARY KEY (workout_id, timestamp)
+);
+
+CREATE TABLE IF NOT EXISTS state_of_mind (
+    id text NOT NULL,
+    start timestamptz NOT NULL,
+    "end" timestamptz,
+    kind text NOT NULL DEFAULT '',
+    valence double precision,
+    valence_classification text NOT NULL DEFAULT '',
+    labels text[] NOT NULL DEFAULT '{}',
+    associations text[] NOT NULL DEFAULT '{}',
+    PRIMARY KEY (id, start)
+);
@@ -0,0 +1,77 @@
+package me.centralhardware.healthImportServer
+
+import io.ktor.http.ContentType
+import io.ktor.server.plugins.PayloadTooLargeException
+import me.centralhardware.healthImportServer.migrate.AppleHealthXml
+import java.io.ByteArrayOutputStream
+import java.util.zip.GZIPOutputStream
+import java.util.zip.ZipEntry
+import java.util.zip.ZipOutputStream
+import kotlin.test.Test
+import kotlin.test.assertEquals
+import kotlin.test.assertFails
+import kotlin.test.assertFailsWith
+import kotlin.test.assertNotNull
+import kotlin.test.assertNull
+
+class UploadFormatTest {
+
+    @Test
+    fun `formats are found by content type`() {
+        assertEquals(UploadFormat.JSON, UploadFormat.of(ContentType.Any))
+        assertEquals(UploadFormat.JSON, UploadFormat.of(ContentType.parse("application/json; charset=utf-8")))
+        assertEquals(UploadFormat.GZIP_JSON, UploadFormat.of(ContentType.parse("application/x-gzip")))
+        assertEquals(UploadFormat.APPLE_HEALTH_ARCHIVE, UploadFormat.of(ContentType.Application.Zip))
+        assertEquals(UploadFormat.GPX, UploadFormat.of(ContentType.parse("application/gpx+xml")))
+        assertNull(UploadFormat.of(ContentType.Image.PNG))
+    }
+
+    @Test
+    fun `formats are found by file name extension`() {
+        assertEquals(UploadFormat.GPX, UploadFormat.ofFileName("Morning Run.GPX"))
+        assertEquals(UploadFormat.GZIP_JSON, UploadFormat.ofFileName("export.json.gz"))
+        assertNull(UploadFormat.ofFileName("notes.txt"))
+    }
+
+    @Test
+    fun `gzipped payloads are inflated before parsing`() {
+        val body = gzip("""{"data": {"metrics": [{"name": "step_count", "units": "count", "data": [{"date": "2024-03-01 08:00:00 +0000", "qty": 12}]}]}}""".toByteArray())
+
+        val export = UploadFormat.GZIP_JSON.parse(body.inputStream()).export
+
+        assertEquals(12.0, export.metrics.single().data.single().qty)
+    }
+
+    @Test
+    fun `limited streams fail once they exceed the limit`() {
+        LimitedInputStream(ByteArray(10).inputStream(), 10).use { assertEquals(10, it.readBytes().size) }
+
+        assertFailsWith<PayloadTooLargeException> { LimitedInputStream(ByteArray(11).inputStream(), 10).readBytes() }
+    }
+
+    @Test
+    fun `archives are capped by their inflated size`() {
+        val xml = "<HealthData>" + "<Record type=\"HKQuantityTypeIdentifierStepCount\" unit=\"count\" value=\"1\" startDate=\"2024-03-01 08:00:00 +0000\"/>".repeat(100) + "</HealthData>"
+        val archive = zip("apple_health_export/export.xml", xml.toByteArray())
+
+        assertEquals(100, AppleHealthXml.parseArchive(archive.inputStream()).totalSamples())
+        assertNotNull(RequestEncoding.tooLarge(assertFails { AppleHealthXml.parseArchive(archive.inputStream(), 1024) }))
+    }
+
+    @Test
+    fun `archives without export xml are rejected`() {
+        assertFailsWith<IllegalArgumentException> { AppleHealthXml.parseArchive(zip("readme.txt", "hi".toByteArray()).inputStream()) }
+    }
+
+    private fun gzip(bytes: ByteArray): ByteArray =
+        ByteArrayOutputStream().also { out -> GZIPOutputStream(out).use { it.write(bytes) } }.toByteArray()
+
+    private fun zip(name: String, bytes: ByteArray): ByteArray =
+        ByteArrayOutputStream().also { out ->
+            ZipOutputStream(out).use {
+                it.putNextEntry(ZipEntry(name))
+                it.write(bytes)
+                it.closeEntry()
+            }
+        }.toByteArray()
+}
@@ -0,0 +1,50 @@
+package me.centralhardware.healthImportServer.api
+
+import kotlin.test.Test
+import kotlin.test.assertEquals
+import kotlin.test.assertFailsWith
+import kotlin.test.assertFalse
+import kotlin.test.assertNull
+import kotlin.test.assertTrue
+
+class ApiTokensTest {
+
+    @Test
+    fun `pairs are parsed into roles`() {
+        val roles = ApiTokens.parse("up=upload, rd=READ ,adm=admin,")
+
+        assertEquals(mapOf("up" to TokenRole.UPLOAD, "rd" to TokenRole.READ, "adm" to TokenRole.ADMIN), roles)
+    }
+
+    @Test
+    fun `tokens may end with base64 padding`() {
+        assertEquals(mapOf("dG9rZW4=" to TokenRole.READ), ApiTokens.parse("dG9rZW4==read"))
+    }
+
+    @Test
+    fun `unknown roles and missing separators are rejected`() {
+        assertFailsWith<IllegalArgumentException> { ApiTokens.parse("abc=owner") }
+        assertFailsWith<IllegalArgumentException> { ApiTokens.parse("abc") }
+        assertFailsWith<IllegalArgumentException> { ApiTokens.parse("=read") }
+    }
+
+    @Test
+    fun `tokens are looked up by their exact value`() {
+        val tokens = ApiTokens(mapOf("up" to TokenRole.UPLOAD, "rd" to TokenRole.READ))
+
+        assertEquals(TokenRole.UPLOAD, tokens.role("up"))
+        assertEquals(TokenRole.READ, tokens.role("rd"))
+        assertNull(tokens.role("u"))
+        assertNull(tokens.role("rd "))
+    }
+
+    @Test
+    fun `admin grants every role, others only their own`() {
+        assertTrue(TokenRole.ADMIN.grants(TokenRole.UPLOAD))
+        assertTrue(TokenRole.ADMIN.grants(TokenRole.READ))
+        assertTrue(TokenRole.READ.grants(TokenRole.READ))
+        assertFalse(TokenRole.READ.grants(TokenRole.UPLOAD))
+        assertFalse(TokenRole.UPLOAD.grants(TokenRole.READ))
+        assertFalse(TokenRole.UPLOAD.grants(TokenRole.ADMIN))
+    }
+}
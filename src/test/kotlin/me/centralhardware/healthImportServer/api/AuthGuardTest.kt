@@ -0,0 +1,78 @@
+package me.centralhardware.healthImportServer.api
+
+import io.ktor.http.HttpStatusCode
+import me.centralhardware.healthImportServer.notify.Notifier
+import java.time.Duration
+import java.time.Instant
+import kotlin.test.Test
+import kotlin.test.assertEquals
+import kotlin.test.assertNotNull
+import kotlin.test.assertNull
+
+class AuthGuardTest {
+    private val alerts = mutableListOf<String>()
+    private val guard = AuthGuard(3, Duration.ofMinutes(1), 2, object : Notifier {
+        override fun notify(title: String, message: String) {
+            alerts += message
+        }
+    })
+
+    @Test
+    fun `an address is locked out after too many failures`() {
+        repeat(2) { guard.failed(ADDRESS, "guess$it") }
+        assertNull(guard.lockedFor(ADDRESS))
+
+        guard.failed(ADDRESS, "guess2")
+
+        assertNotNull(guard.lockedFor(ADDRESS))
+        assertNull(guard.lockedFor("192.0.2.8"))
+    }
+
+    @Test
+    fun `every further lockout lasts twice as long`() {
+        val now = Instant.parse("2024-03-01T12:00:00Z")
+        repeat(3) { guard.failed(ADDRESS, null, now) }
+        assertEquals(Duration.ofMinutes(1), guard.lockedFor(ADDRESS, now))
+
+        val later = now.plus(Duration.ofMinutes(2))
+        repeat(3) { guard.failed(ADDRESS, null, later) }
+
+        assertEquals(Duration.ofMinutes(2), guard.lockedFor(ADDRESS, later))
+    }
+
+    @Test
+    fun `repeated lockouts are reported with the tried tokens`() {
+        val now = Instant.parse("2024-03-01T12:00:00Z")
+        repeat(6) { guard.failed(ADDRESS, "guess", now) }
+
+        assertEquals(1, alerts.size)
+        assertEquals(true, actor("guess") in alerts.single())
+    }
+
+    @Test
+    fun `an authenticated success clears the failures`() {
+        repeat(2) { guard.responded(ADDRESS, HttpStatusCode.Unauthorized, "guess$it", authenticated = false) }
+
+        guard.responded(ADDRESS, HttpStatusCode.OK, "valid", authenticated = true)
+        guard.responded(ADDRESS, HttpStatusCode.Unauthorized, "guess2", authenticated = false)
+
+        assertNull(guard.lockedFor(ADDRESS))
+    }
+
+    @Test
+    fun `an unauthenticated success with a token does not clear the failures`() {
+        // E.g. GET /health with a random bearer token between guesses.
+        repeat(2) {
+            guard.responded(ADDRESS, HttpStatusCode.Unauthorized, "guess$it", authenticated = false)
+            guard.responded(ADDRESS, HttpStatusCode.OK, "random$it", authenticated = false)
+        }
+
+        guard.responded(ADDRESS, HttpStatusCode.Unauthorized, "guess2", authenticated = false)
+
+        assertNotNull(guard.lockedFor(ADDRESS))
+    }
+
+    companion object {
+        private const val ADDRESS = "192.0.2.7"
+    }
+}
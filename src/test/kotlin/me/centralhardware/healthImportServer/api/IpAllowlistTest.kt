@@ -0,0 +1,79 @@
+package me.centralhardware.healthImportServer.api
+
+import java.net.InetAddress
+import kotlin.test.Test
+import kotlin.test.assertEquals
+import kotlin.test.assertFailsWith
+import kotlin.test.assertFalse
+import kotlin.test.assertNull
+import kotlin.test.assertTrue
+
+class IpAllowlistTest {
+
+    @Test
+    fun `networks contain the addresses of their prefix`() {
+        val network = Cidr("192.168.1.0/24")
+
+        assertTrue(network.contains(address("192.168.1.1")))
+        assertTrue(network.contains(address("192.168.1.255")))
+        assertFalse(network.contains(address("192.168.2.1")))
+    }
+
+    @Test
+    fun `a plain address is a single host`() {
+        val host = Cidr("10.0.0.5")
+
+        assertTrue(host.contains(address("10.0.0.5")))
+        assertFalse(host.contains(address("10.0.0.6")))
+    }
+
+    @Test
+    fun `IPv6 networks never contain IPv4 addresses`() {
+        val network = Cidr("fd00::/8")
+
+        assertTrue(network.contains(address("fd12:3456::1")))
+        assertFalse(network.contains(address("10.0.0.1")))
+        assertTrue(Cidr("0.0.0.0/0").contains(address("203.0.113.9")))
+        assertFalse(Cidr("0.0.0.0/0").contains(address("::1")))
+    }
+
+    @Test
+    fun `invalid prefixes are rejected`() {
+        assertFailsWith<IllegalArgumentException> { Cidr("10.0.0.0/33") }
+        assertFailsWith<NumberFormatException> { Cidr("10.0.0.0/x") }
+    }
+
+    @Test
+    fun `lists are split at commas`() {
+        val allowlist = IpAllowlist(Cidr.parseList("10.0.0.0/8, 192.168.0.0/16,"))
+
+        assertTrue(allowlist.allows(address("10.1.2.3")))
+        assertTrue(allowlist.allows(address("192.168.5.5")))
+        assertFalse(allowlist.allows(address("172.16.0.1")))
+    }
+
+    @Test
+    fun `forwarded addresses are only trusted from trusted proxies`() {
+        val addresses = ClientAddresses(listOf(Cidr("10.0.0.0/8")))
+
+        assertEquals(address("203.0.113.9"), addresses.clientAddress("10.0.0.2", listOf("203.0.113.9")))
+        assertEquals(address("198.51.100.1"), addresses.clientAddress("198.51.100.1", listOf("203.0.113.9")))
+    }
+
+    @Test
+    fun `the rightmost address that is not a proxy is the client`() {
+        val addresses = ClientAddresses(listOf(Cidr("10.0.0.0/8")))
+
+        // The client may put anything in front of what the proxies appended.
+        assertEquals(address("203.0.113.9"), addresses.clientAddress("10.0.0.2", listOf("192.0.2.66, 203.0.113.9", "10.0.0.3")))
+    }
+
+    @Test
+    fun `host names in headers are never resolved`() {
+        val addresses = ClientAddresses(listOf(Cidr("10.0.0.0/8")))
+
+        assertNull(addresses.clientAddress("10.0.0.2", listOf("example.com")))
+    }
+
+    private fun address(value: String): InetAddress = InetAddress.getByName(value)
+}
@@ -0,0 +1,62 @@
+package me.centralhardware.healthImportServer.api
+
+import java.time.Duration
+import java.time.Instant
+import kotlin.test.Test
+import kotlin.test.assertEquals
+import kotlin.test.assertNotNull
+import kotlin.test.assertNull
+
+class UploadSignatureTest {
+    private val signature = UploadSignature("secret", Duration.ofMinutes(5))
+    private val now = Instant.parse("2024-03-01T12:00:00Z")
+    private val body = """{"data": {}}""".toByteArray()
+
+    @Test
+    fun `a signed body is accepted`() {
+        val timestamp = now.epochSecond.toString()
+
+        assertNull(signature.verify(timestamp, signature.sign(timestamp, body), body, now))
+    }
+
+    @Test
+    fun `signatures in upper case are accepted`() {
+        val timestamp = now.epochSecond.toString()
+
+        assertNull(signature.verify(timestamp, signature.sign(timestamp, body).uppercase(), body, now))
+    }
+
+    @Test
+    fun `a request sent again within the window is rejected`() {
+        val timestamp = now.epochSecond.toString()
+        val signed = signature.sign(timestamp, body)
+        assertNull(signature.verify(timestamp, signed, body, now))
+
+        assertEquals("Request was already received", signature.verify(timestamp, signed, body, now.plusSeconds(30)))
+    }
+
+    @Test
+    fun `requests outside of the window are rejected`() {
+        val old = now.minus(Duration.ofMinutes(6)).epochSecond.toString()
+        val ahead = now.plus(Duration.ofMinutes(6)).epochSecond.toString()
+
+        assertEquals("Request timestamp outside of the allowed window", signature.verify(old, signature.sign(old, body), body, now))
+        assertEquals("Request timestamp outside of the allowed window", signature.verify(ahead, signature.sign(ahead, body), body, now))
+    }
+
+    @Test
+    fun `a changed body or another key is rejected`() {
+        val timestamp = now.epochSecond.toString()
+        val signed = signature.sign(timestamp, body)
+
+        assertEquals("Invalid signature", signature.verify(timestamp, signed, "{}".toByteArray(), now))
+        assertEquals("Invalid signature", UploadSignature("other", Duration.ofMinutes(5)).verify(timestamp, signed, body, now))
+    }
+
+    @Test
+    fun `missing or malformed headers are rejected`() {
+        assertNotNull(signature.verify(null, "abc", body, now))
+        assertNotNull(signature.verify(now.epochSecond.toString(), null, body, now))
+        assertEquals("Invalid X-Timestamp", signature.verify("yesterday", "abc", body, now))
+    }
+}
@@ -0,0 +1,82 @@
+package me.centralhardware.healthImportServer.dedup
+
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.Sample
+import kotlin.test.Test
+import kotlin.test.assertEquals
+
+class SampleDeduplicatorTest {
+    private val deduplicator = SampleDeduplicator(InMemoryDedupCache(100))
+
+    @Test
+    fun `samples are only skipped once they were remembered`() {
+        val metrics = listOf(steps(SAMPLE))
+
+        val first = deduplicator.filter(metrics)
+        assertEquals(0, first.skipped)
+        assertEquals(metrics, first.metrics)
+
+        deduplicator.remember(first.keys)
+        val second = deduplicator.filter(metrics)
+
+        assertEquals(1, second.skipped)
+        assertEquals(emptyList(), second.metrics)
+    }
+
+    @Test
+    fun `a corrected value for the same time is written`() {
+        deduplicator.remember(deduplicator.filter(listOf(steps(SAMPLE))).keys)
+
+        val corrected = deduplicator.filter(listOf(steps(SAMPLE.copy(qty = 1300.0))))
+
+        assertEquals(0, corrected.skipped)
+    }
+
+    @Test
+    fun `samples of other sources are not taken for duplicates`() {
+        deduplicator.remember(deduplicator.filter(listOf(steps(SAMPLE))).keys)
+
+        val other = deduplicator.filter(listOf(steps(SAMPLE.copy(source = "iPhone"))))
+
+        assertEquals(0, other.skipped)
+    }
+
+    @Test
+    fun `forgetting a metric writes its samples again`() {
+        val heartRate = Metric("heart_rate", "count/min", listOf(Sample(date = SAMPLE.date, qty = 62.0)))
+        deduplicator.remember(deduplicator.filter(listOf(steps(SAMPLE), heartRate)).keys)
+
+        deduplicator.forget("step_count")
+        val result = deduplicator.filter(listOf(steps(SAMPLE), heartRate))
+
+        assertEquals(1, result.skipped)
+        assertEquals(listOf("step_count"), result.metrics.map { it.name })
+    }
+
+    @Test
+    fun `the memory cache drops the least recently used keys`() {
+        val cache = InMemoryDedupCache(2)
+        cache.remember(listOf("a", "b"))
+        cache.seen(listOf("a"))
+
+        cache.remember(listOf("c"))
+
+        assertEquals(setOf("a", "c"), cache.seen(listOf("a", "b", "c")))
+    }
+
+    @Test
+    fun `forgetting a prefix leaves other keys`() {
+        val cache = InMemoryDedupCache(10)
+        cache.remember(listOf("step_count|1", "step_count_total|1", "heart_rate|1"))
+
+        cache.forget("step_count|")
+
+        assertEquals(setOf("step_count_total|1", "heart_rate|1"), cache.seen(listOf("step_count|1", "step_count_total|1", "heart_rate|1")))
+    }
+
+    private fun steps(vararg samples: Sample) = Metric("step_count", "count", samples.toList())
+
+    companion object {
+        private val SAMPLE = Sample(date = "2024-03-02 08:00:00 +0000", qty = 1200.0, source = "Apple Watch")
+    }
+}
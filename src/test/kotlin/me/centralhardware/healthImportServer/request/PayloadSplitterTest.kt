@@ -0,0 +1,65 @@
+package me.centralhardware.healthImportServer.request
+
+import kotlin.test.Test
+import kotlin.test.assertEquals
+
+class PayloadSplitterTest {
+
+    @Test
+    fun `without a limit the payload is one chunk`() {
+        val export = Export(metrics = listOf(steps("2024-03-01", 5), steps("2024-03-02", 5)))
+
+        assertEquals(listOf(export), PayloadSplitter.split(export, 0))
+    }
+
+    @Test
+    fun `consecutive days are packed until a chunk is full`() {
+        val export = Export(metrics = listOf(metric("step_count", "2024-03-01" to 4, "2024-03-02" to 4, "2024-03-03" to 4)))
+
+        val chunks = PayloadSplitter.split(export, 8)
+
+        assertEquals(listOf(8, 4), chunks.map { it.totalSamples() })
+        assertEquals(listOf("2024-03-03"), chunks.last().metrics.single().data.map { it.date!!.take(10) }.distinct())
+    }
+
+    @Test
+    fun `a day with more samples than fit is split`() {
+        val chunks = PayloadSplitter.split(Export(metrics = listOf(steps("2024-03-01", 25))), 10)
+
+        assertEquals(listOf(10, 10, 5), chunks.map { it.totalSamples() })
+        assertEquals(25, chunks.flatMap { it.metrics.single().data }.distinct().size)
+    }
+
+    @Test
+    fun `workouts count with their logs`() {
+        val workout = Workout(
+            id = "w1",
+            start = "2024-03-01 07:00:00 +0000",
+            heartRateData = List(5) { HeartRateLog(avg = 140.0, date = "2024-03-01 07:0$it:00 +0000") },
+        )
+        val export = Export(metrics = listOf(steps("2024-03-01", 5)), workouts = listOf(workout))
+
+        val chunks = PayloadSplitter.split(export, 6)
+
+        assertEquals(2, chunks.size)
+        assertEquals(listOf(workout), chunks.flatMap { it.workouts })
+    }
+
+    @Test
+    fun `metrics of one chunk are joined by name and units`() {
+        val export = Export(metrics = listOf(metric("step_count", "2024-03-01" to 2, "2024-03-02" to 2)))
+
+        val chunk = PayloadSplitter.split(export, 100).single()
+
+        assertEquals(1, chunk.metrics.size)
+        assertEquals(4, chunk.totalSamples())
+    }
+
+    private fun steps(day: String, count: Int) = metric("step_count", day to count)
+
+    private fun metric(name: String, vararg days: Pair<String, Int>) = Metric(
+        name,
+        "count",
+        days.flatMap { (day, count) -> List(count) { i -> Sample(date = "$day ${"%02d".format(i % 24)}:00:00 +0000", qty = i.toDouble()) } },
+    )
+}
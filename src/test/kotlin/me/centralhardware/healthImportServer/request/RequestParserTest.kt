@@ -0,0 +1,77 @@
+package me.centralhardware.healthImportServer.request
+
+import kotlinx.serialization.SerializationException
+import kotlinx.serialization.json.Json
+import kotlin.test.Test
+import kotlin.test.assertEquals
+import kotlin.test.assertFailsWith
+import kotlin.test.assertNull
+
+class RequestParserTest {
+
+    @Test
+    fun `a quantity object is read as one value`() {
+        val workout = parseWorkout("""{"qty": 420.5, "units": "kcal"}""")
+
+        assertEquals(QtyUnit(420.5, "kcal"), workout.activeEnergyBurned)
+        assertEquals(420.5, workout.activeEnergyBurned?.total())
+    }
+
+    @Test
+    fun `a quantity array keeps every value`() {
+        val energy = parseWorkout("""[{"qty": 100.0, "units": "kcal"}, {"qty": 50.0, "units": "kcal"}, {"units": "kcal"}]""")
+            .activeEnergyBurned!!
+
+        assertNull(energy.qty)
+        assertEquals("kcal", energy.units)
+        assertEquals(3, energy.values.size)
+        assertEquals(150.0, energy.total())
+        assertEquals(75.0, energy.mean())
+    }
+
+    @Test
+    fun `a quantity array is written back as an array`() {
+        val energy = QtyUnit(units = "kcal", values = listOf(QtyUnit(100.0, "kcal"), QtyUnit(50.0, "kcal")))
+
+        val text = Json.encodeToString(QtyUnitSerializer, energy)
+
+        assertEquals(energy, Json.decodeFromString(QtyUnitSerializer, text))
+    }
+
+    @Test
+    fun `quantities that are no objects are rejected`() {
+        assertFailsWith<SerializationException> { parseWorkout("420") }
+        assertFailsWith<SerializationException> { parseWorkout("[420]") }
+        assertFailsWith<SerializationException> { parseWorkout("""{"qty": "a lot", "units": "kcal"}""") }
+    }
+
+    @Test
+    fun `duplicate metric entries are joined and identical samples kept once`() {
+        val export = RequestParser.parse(
+            """
+            {"data": {"metrics": [
+                {"name": "step_count", "units": "count", "data": [{"date": "2024-03-02 08:00:00 +0000", "qty": 10}]},
+                {"name": "step_count", "units": "count", "data": [
+                    {"date": "2024-03-02 08:00:00 +0000", "qty": 10},
+                    {"date": "2024-03-02 07:00:00 +0000", "qty": 5}
+                ]}
+            ]}}
+            """.trimIndent()
+        ).export
+
+        val steps = export.metrics.single()
+        assertEquals(listOf(5.0, 10.0), steps.data.map { it.qty })
+    }
+
+    @Test
+    fun `a stream is parsed like a string`() {
+        val body = """{"data": {"metrics": [{"name": "weight_body_mass", "units": "kg", "data": [{"date": "2024-03-02 07:15:00 +0000", "qty": 72.4}]}]}}"""
+
+        assertEquals(RequestParser.parse(body).export, RequestParser.parse(body.byteInputStream()).export)
+    }
+
+    private fun parseWorkout(energy: String): Workout =
+        RequestParser.parse(
+            """{"data": {"workouts": [{"id": "w1", "name": "Run", "start": "2024-03-02 07:00:00 +0000", "activeEnergyBurned": $energy}]}}"""
+        ).export.workouts.single()
+}
@@ -0,0 +1,214 @@
+package me.centralhardware.healthImportServer.storage
+
+import me.centralhardware.healthImportServer.request.ECG
+import me.centralhardware.healthImportServer.request.ECGVoltage
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.HeartRateLog
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.QtyUnit
+import me.centralhardware.healthImportServer.request.Sample
+import me.centralhardware.healthImportServer.request.StateOfMind
+import me.centralhardware.healthImportServer.request.Timestamps
+import me.centralhardware.healthImportServer.request.Workout
+import org.testcontainers.clickhouse.ClickHouseContainer
+import java.sql.DriverManager
+import java.sql.ResultSet
+import java.time.Instant
+import java.time.LocalDate
+import java.time.ZoneOffset
+import java.time.format.DateTimeFormatter
+import java.util.UUID
+import kotlin.test.Test
+import kotlin.test.assertEquals
+import kotlin.test.assertTrue
+
+/**
+ * Runs the store against a real ClickHouse started with Testcontainers, so
+ * Docker is needed. All tests share one server and database; each writes
+ * its own metrics and days so they do not see each other's rows.
+ */
+class ClickHouseMetricStoreTest {
+
+    @Test
+    fun `migrations create every table with its latest columns`() {
+        val schemas = store.tableSchemas().associateBy { it.name }
+        for (table in listOf("metrics", "workouts", "state_of_mind", "ecg", "imports", "personal_records", "annotations")) {
+            assertTrue(table in schemas, "Table $table is missing, got ${schemas.keys}")
+        }
+        assertTrue(schemas.getValue("metrics").columns.any { it.name == "source" }, "metrics has no source column")
+        assertTrue(schemas.getValue("imports").columns.any { it.name == "device_model" }, "imports has no device columns")
+    }
+
+    @Test
+    fun `stored samples are read back`() {
+        val day = LocalDate.of(2024, 3, 2)
+        store.storeAll(Export(metrics = listOf(metric("test_weight", "kg", "2024-03-02 07:15:00 +0000" to 72.4, "2024-03-02 19:00:00 +0000" to 72.9))))
+
+        val samples = store.samplesBetween("test_weight", day, day)
+
+        assertEquals(listOf(72.4, 72.9), samples.map { it.qty })
+        assertEquals(Timestamps.parse("2024-03-02 07:15:00 +0000"), Timestamps.parse(samples.first().date!!))
+    }
+
+    @Test
+    fun `a sample sent again is stored once`() {
+        val day = LocalDate.of(2024, 3, 3)
+        val export = Export(metrics = listOf(metric("test_steps", "count", "2024-03-03 10:00:00 +0000" to 1200.0)))
+
+        store.storeAll(export)
+        store.storeAll(export)
+
+        assertEquals(listOf(1200.0), store.samplesBetween("test_steps", day, day).map { it.qty })
+    }
+
+    @Test
+    fun `a corrected sample replaces the stored one`() {
+        val day = LocalDate.of(2024, 3, 4)
+        store.storeAll(Export(metrics = listOf(metric("test_energy", "kcal", "2024-03-04 12:00:00 +0000" to 300.0))))
+        store.storeAll(Export(metrics = listOf(metric("test_energy", "kcal", "2024-03-04 12:00:00 +0000" to 340.0))))
+
+        assertEquals(listOf(340.0), store.samplesBetween("test_energy", day, day).map { it.qty })
+    }
+
+    @Test
+    fun `samples of two sources at the same time are both kept`() {
+        val day = LocalDate.of(2024, 3, 10)
+        val time = "2024-03-10 06:30:00 +0000"
+        store.storeAll(Export(metrics = listOf(Metric("test_heart_rate", "count/min", listOf(Sample(date = time, qty = 62.0, source = "Apple Watch"))))))
+        store.storeAll(Export(metrics = listOf(Metric("test_heart_rate", "count/min", listOf(Sample(date = time, qty = 64.0, source = "Polar H10"))))))
+
+        assertEquals(listOf(62.0, 64.0), store.samplesBetween("test_heart_rate", day, day).map { it.qty }.sortedBy { it })
+    }
+
+    @Test
+    fun `workouts are stored once with their heart rate`() {
+        val day = LocalDate.of(2024, 3, 5)
+        val id = UUID.randomUUID().toString()
+        val workout = Workout(
+            id = id,
+            name = "Outdoor Run",
+            start = "2024-03-05 07:00:00 +0000",
+            end = "2024-03-05 07:40:00 +0000",
+            activeEnergyBurned = QtyUnit(420.0, "kcal"),
+            distance = QtyUnit(6.2, "km"),
+            heartRateData = listOf(HeartRateLog(min = 120.0, max = 160.0, avg = 142.0, units = "bpm", date = "2024-03-05 07:10:00 +0000")),
+        )
+
+        store.storeAll(Export(workouts = listOf(workout)))
+        store.storeAll(Export(workouts = listOf(workout)))
+
+        val workouts = store.workoutsBetween(day, day)
+        assertEquals(listOf(id), workouts.map { it.id })
+        assertEquals("Outdoor Run", workouts.single().name)
+    }
+
+    @Test
+    fun `state of mind entries are stored with their labels`() {
+        val day = LocalDate.of(2024, 3, 6)
+        val entry = StateOfMind(
+            id = UUID.randomUUID().toString(),
+            valence = 0.4,
+            labels = listOf("Calm"),
+            associations = listOf("Family"),
+            start = "2024-03-06 20:00:00 +0000",
+            end = "2024-03-06 20:00:00 +0000",
+            kind = "dailyMood",
+        )
+
+        store.storeAll(Export(stateOfMind = listOf(entry)))
+
+        val stored = store.stateOfMind(day, day).single()
+        assertEquals(0.4, stored.valence)
+        assertEquals(listOf("Calm"), stored.labels)
+    }
+
+    @Test
+    fun `ECG recordings keep their waveform`() {
+        val day = LocalDate.of(2024, 3, 7)
+        val ecg = ECG(
+            classification = "Sinus Rhythm",
+            voltageMeasurements = (0 until 512).map { ECGVoltage(date = it / 512.0, voltage = it % 7 * 10.0, units = "µV") },
+            source = "Apple Watch",
+            averageHeartRate = 64.0,
+            start = "2024-03-07 08:00:00 +0000",
+            end = "2024-03-07 08:00:30 +0000",
+            numberOfVoltageMeasurements = 512,
+            samplingFrequency = 512,
+        )
+
+        store.storeAll(Export(ecg = listOf(ecg)))
+
+        val (id, stored) = store.ecgRecordings(day, day).single()
+        assertEquals("Sinus Rhythm", stored.classification)
+        assertEquals(512, store.ecgWaveform(id)?.offsets?.size)
+    }
+
+    @Test
+    fun `only exported days are exported`() {
+        store.storeAll(Export(metrics = listOf(metric("test_export", "count", "2024-03-08 09:00:00 +0000" to 1.0, "2024-03-09 09:00:00 +0000" to 2.0))))
+
+        val export = store.exportBetween(LocalDate.of(2024, 3, 9), LocalDate.of(2024, 3, 9))
+
+        assertEquals(listOf(2.0), export.metrics.single { it.name == "test_export" }.data.map { it.qty })
+    }
+
+    @Test
+    fun `a large payload is written in one insert per table`() {
+        val format = DateTimeFormatter.ofPattern("yyyy-MM-dd HH:mm:ss xx").withZone(ZoneOffset.UTC)
+        val start = Instant.parse("2024-03-11T00:00:00Z")
+        val samples = (0 until 5000).map { Sample(date = format.format(start.plusSeconds(it * 10L)), qty = it.toDouble()) }
+        val since = serverTime()
+
+        store.storeAll(Export(metrics = listOf(Metric("test_batched", "count/min", samples))))
+
+        val (inserts, rows) = insertsInto("metrics", since)
+        assertEquals(1L, inserts)
+        assertEquals(5000L, rows)
+    }
+
+    private fun metric(name: String, units: String, vararg samples: Pair<String, Double>) =
+        Metric(name, units, samples.map { (date, qty) -> Sample(date = date, qty = qty) })
+
+    /** The server's clock, so the query log is filtered by the time ClickHouse recorded. */
+    private fun serverTime(): String = query("SELECT toString(now64(6))") { it.getString(1) }
+
+    /** The finished inserts into [table] since [since] and the rows they wrote, from `system.query_log`. */
+    private fun insertsInto(table: String, since: String): Pair<Long, Long> {
+        execute("SYSTEM FLUSH LOGS")
+        return query(
+            """
+            SELECT count(), sum(written_rows) FROM system.query_log
+            WHERE type = 'QueryFinish' AND query_kind = 'Insert'
+              AND has(tables, 'health.$table') AND event_time_microseconds >= toDateTime64('$since', 6)
+            """.trimIndent()
+        ) { it.getLong(1) to it.getLong(2) }
+    }
+
+    private fun <T> query(sql: String, read: (ResultSet) -> T): T = connect().use { conn ->
+        conn.createStatement().use { stmt -> stmt.executeQuery(sql).use { rs -> rs.next(); read(rs) } }
+    }
+
+    private fun execute(sql: String) {
+        connect().use { conn -> conn.createStatement().use { it.execute(sql) } }
+    }
+
+    private fun connect() =
+        DriverManager.getConnection("jdbc:clickhouse://${clickHouse.host}:${clickHouse.getMappedPort(8123)}", clickHouse.username, clickHouse.password)
+
+    companion object {
+        private val clickHouse by lazy {
+            ClickHouseContainer("clickhouse/clickhouse-server:24.8").apply { start() }
+        }
+
+        /** Migrated once; the container is removed by Testcontainers when the tests end. */
+        private val store by lazy {
+            ClickHouseMetricStore(
+                ClickHouseConfig(
+                    dsn = "jdbc:clickhouse://${clickHouse.username}:${clickHouse.password}@${clickHouse.host}:${clickHouse.getMappedPort(8123)}",
+                    database = "health",
+                    optimize = false,
+                )
+            )
+        }
+    }
+}
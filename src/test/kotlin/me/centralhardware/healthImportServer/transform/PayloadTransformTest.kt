@@ -0,0 +1,104 @@
+package me.centralhardware.healthImportServer.transform
+
+import me.centralhardware.healthImportServer.request.Export
+import me.centralhardware.healthImportServer.request.HeartRateLog
+import me.centralhardware.healthImportServer.request.Metric
+import me.centralhardware.healthImportServer.request.Sample
+import me.centralhardware.healthImportServer.request.Workout
+import java.time.Duration
+import java.time.Instant
+import java.time.ZoneOffset
+import java.time.format.DateTimeFormatter
+import kotlin.test.Test
+import kotlin.test.assertEquals
+
+class PayloadTransformTest {
+
+    @Test
+    fun `samples dated too early or too far ahead are dropped`() {
+        val guard = TimestampGuard(Instant.parse("2000-01-01T00:00:00Z"), Duration.ofHours(24))
+        val export = Export(
+            metrics = listOf(Metric("step_count", "count", listOf(
+                Sample(date = "1970-01-01 00:00:00 +0000", qty = 1.0),
+                Sample(date = "2024-03-01 08:00:00 +0000", qty = 2.0),
+                Sample(date = format(Instant.now().plus(Duration.ofDays(3))), qty = 3.0),
+            ))),
+            workouts = listOf(Workout(id = "old", start = "1970-01-01 00:00:00 +0000"), Workout(id = "run", start = "2024-03-01 08:00:00 +0000")),
+        )
+
+        val guarded = guard.apply(export)
+
+        assertEquals(listOf(2.0), guarded.metrics.single().data.map { it.qty })
+        assertEquals(listOf("run"), guarded.workouts.map { it.id })
+    }
+
+    @Test
+    fun `valid payloads pass the guard unchanged`() {
+        val guard = TimestampGuard(Instant.parse("2000-01-01T00:00:00Z"), Duration.ofHours(24))
+        val export = Export(metrics = listOf(Metric("step_count", "count", listOf(Sample(date = "2024-03-01 08:00:00 +0000", qty = 2.0)))))
+
+        assertEquals(export, guard.apply(export))
+    }
+
+    @Test
+    fun `metrics listed under an old name are renamed`() {
+        val renamer = MetricRenamer(mapOf("exercise_time" to "apple_exercise_time"))
+        val export = Export(metrics = listOf(Metric("exercise_time", "min"), Metric("step_count", "count")))
+
+        assertEquals(listOf("apple_exercise_time", "step_count"), renamer.apply(export).metrics.map { it.name })
+    }
+
+    @Test
+    fun `heart rate logs are merged per bucket`() {
+        val downsampler = HeartRateDownsampler(Duration.ofMinutes(1))
+        val workout = Workout(heartRateData = listOf(
+            HeartRateLog(min = 120.0, max = 130.0, avg = 125.0, date = "2024-03-01 08:00:05 +0000"),
+            HeartRateLog(min = 118.0, max = 140.0, avg = 135.0, date = "2024-03-01 08:00:40 +0000"),
+            HeartRateLog(min = 140.0, max = 150.0, avg = 145.0, date = "2024-03-01 08:01:10 +0000"),
+        ))
+
+        val logs = downsampler.apply(Export(workouts = listOf(workout))).workouts.single().heartRateData
+
+        assertEquals(2, logs.size)
+        assertEquals(HeartRateLog(min = 118.0, max = 140.0, avg = 130.0, date = "2024-03-01 08:00:05 +0000"), logs[0])
+        assertEquals(workout.heartRateData[2], logs[1])
+    }
+
+    @Test
+    fun `samples closer than the interval are dropped outside of workouts`() {
+        val decimator = MetricDecimator(mapOf("heart_rate" to Duration.ofMinutes(1)))
+        val export = Export(
+            metrics = listOf(Metric("heart_rate", "count/min", listOf(
+                Sample(date = "2024-03-01 07:00:00 +0000", qty = 60.0),
+                Sample(date = "2024-03-01 07:00:20 +0000", qty = 61.0),
+                Sample(date = "2024-03-01 07:01:00 +0000", qty = 62.0),
+                Sample(date = "2024-03-01 08:00:00 +0000", qty = 120.0),
+                Sample(date = "2024-03-01 08:00:20 +0000", qty = 125.0),
+            ))),
+            workouts = listOf(Workout(start = "2024-03-01 08:00:00 +0000", end = "2024-03-01 08:30:00 +0000")),
+        )
+
+        val decimated = decimator.apply(export).metrics.single()
+
+        assertEquals(listOf(60.0, 62.0, 120.0, 125.0), decimated.data.map { it.qty })
+    }
+
+    @Test
+    fun `only reducing transforms are counted`() {
+        val export = Export(metrics = listOf(Metric("step_count", "count", listOf(Sample(date = "1970-01-01 00:00:00 +0000", qty = 1.0)))))
+        val rejecting = TimestampGuard(Instant.parse("2000-01-01T00:00:00Z"), Duration.ofHours(24))
+        val adding = PayloadTransform { it.copy(metrics = listOf(Metric("heart_rate", "count/min", List(3) { Sample(qty = 60.0) }))) }
+        val shrinking = object : PayloadTransform {
+            override val reduces = true
+            override fun apply(export: Export) = export.copy(metrics = export.metrics.map { it.copy(data = it.data.take(1)) })
+        }
+
+        val (result, reduced) = listOf(rejecting, adding, shrinking).applyCounting(export)
+
+        assertEquals(1, result.totalSamples())
+        assertEquals(2, reduced)
+    }
+
+    private fun format(instant: Instant): String =
+        DateTimeFormatter.ofPattern("yyyy-MM-dd HH:mm:ss Z").format(instant.atZone(ZoneOffset.UTC))
+}